@@ -0,0 +1,595 @@
+// Package client is a typed Go client for the master and slave HTTP APIs.
+//
+// Writes and schema changes always go to the master. Reads go to the master
+// by default and can be routed to a slave with ReadFromReplica, or by the
+// master with a staleness bound. Replica reads see the client's own writes.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MasterHeader is set by a node that refuses a write to point the caller at
+// the current master.
+const MasterHeader = "X-Ddb-Master"
+
+// LSNHeader carries the read-your-writes token of a write.
+const LSNHeader = "X-Ddb-Lsn"
+
+// Config describes the nodes a Client talks to.
+type Config struct {
+	// Masters lists candidate master base URLs, e.g. "http://localhost:8000".
+	// The first one that answers is used until it fails.
+	Masters []string
+	// Replicas lists slave base URLs used for replica reads.
+	Replicas []string
+	// Timeout bounds a single HTTP attempt. Defaults to 10s.
+	Timeout time.Duration
+	// MaxRetries is the number of extra attempts on transient errors.
+	// Reads are retried on network errors and overload statuses. Writes
+	// are only retried when the connection failed before the request was
+	// sent, so a write is never applied twice; other write failures are
+	// returned as is. Defaults to 3; use a negative value to disable
+	// retries.
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled each time.
+	// Defaults to 100ms.
+	RetryBackoff time.Duration
+	// HTTPClient overrides the underlying HTTP client.
+	HTTPClient *http.Client
+	// TLSConfig is used for https nodes when HTTPClient is nil, for
+	// example to trust a private CA or present a client certificate.
+	TLSConfig *tls.Config
+	// Header is added to every request.
+	Header http.Header
+	// Token is sent as "Authorization: Bearer <Token>". It can be an API
+	// key or a token issued by the master's /auth/token.
+	Token string
+}
+
+// Client is safe for concurrent use.
+type Client struct {
+	cfg Config
+	hc  *http.Client
+
+	mu      sync.Mutex
+	master  string
+	replica int
+	lsn     uint64 // highest write token seen
+}
+
+// Record is a single row keyed by column name.
+type Record map[string]string
+
+// Conditions match records whose columns equal every given value.
+type Conditions map[string]string
+
+// Query selects records from a table.
+type Query struct {
+	Database string
+	Table    string
+	// Where filters records; all conditions must match.
+	Where Conditions
+	// Limit caps the number of returned records when > 0.
+	Limit int
+	// ReadFromReplica routes the read to a slave instead of the master.
+	ReadFromReplica bool
+	// MaxStaleness and MaxLagLSN let the master serve the read from a
+	// slave that is at most this far behind, in time or in changes. The
+	// master serves it itself when no slave qualifies.
+	MaxStaleness time.Duration
+	MaxLagLSN    uint64
+	// MinLSN is a token from another Client's LSN that replica reads
+	// must reflect. The client's own token is always used.
+	MinLSN uint64
+}
+
+// Error is returned when a node answers with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ddb: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is a missing database or table.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// IsConflict reports whether err is an already existing database or table.
+func IsConflict(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusConflict
+}
+
+// ErrNoReplicas is returned for replica reads when Config.Replicas is empty.
+var ErrNoReplicas = errors.New("ddb: no replicas configured")
+
+// New returns a Client for cfg.
+func New(cfg Config) (*Client, error) {
+	if len(cfg.Masters) == 0 {
+		return nil, errors.New("ddb: at least one master address is required")
+	}
+	// The address lists are trimmed in place, so work on copies rather
+	// than the caller's slices.
+	cfg.Masters = slices.Clone(cfg.Masters)
+	cfg.Replicas = slices.Clone(cfg.Replicas)
+	for i, m := range cfg.Masters {
+		cfg.Masters[i] = strings.TrimRight(m, "/")
+	}
+	for i, r := range cfg.Replicas {
+		cfg.Replicas[i] = strings.TrimRight(r, "/")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	} else if cfg.MaxRetries < 0 {
+		cfg.MaxRetries = 0
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	hc := cfg.HTTPClient
+	if hc == nil {
+		hc = &http.Client{}
+		if cfg.TLSConfig != nil {
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.TLSClientConfig = cfg.TLSConfig
+			hc.Transport = transport
+		}
+	}
+	return &Client{cfg: cfg, hc: hc, master: cfg.Masters[0]}, nil
+}
+
+// ===================== DATABASES =====================
+
+// CreateDatabase creates an empty database.
+func (c *Client) CreateDatabase(ctx context.Context, name string) error {
+	_, err := c.post(ctx, "/create_database", request{Database: name})
+	return err
+}
+
+// DropDatabase removes a database and all of its tables.
+func (c *Client) DropDatabase(ctx context.Context, name string) error {
+	_, err := c.post(ctx, "/drop_database", request{Database: name})
+	return err
+}
+
+// ListDatabases returns the names of all databases.
+func (c *Client) ListDatabases(ctx context.Context) ([]string, error) {
+	var names []string
+	err := c.getJSON(ctx, c.currentMaster, "/list_databases", nil, &names)
+	return names, err
+}
+
+// ===================== TABLES =====================
+
+// CreateTable creates a table with the given columns.
+func (c *Client) CreateTable(ctx context.Context, database, table string, columns []string) error {
+	_, err := c.post(ctx, "/create_table", request{Database: database, Table: table, Columns: columns})
+	return err
+}
+
+// CreateTableWithTypes creates a table whose columns in types are CRDTs:
+// "gcounter", "pncounter", "lww" or "orset". They change through Apply.
+func (c *Client) CreateTableWithTypes(ctx context.Context, database, table string, columns []string, types map[string]string) error {
+	_, err := c.post(ctx, "/create_table", request{Database: database, Table: table, Columns: columns, Types: types})
+	return err
+}
+
+// DropTable removes a table.
+func (c *Client) DropTable(ctx context.Context, database, table string) error {
+	_, err := c.post(ctx, "/drop_table", request{Database: database, Table: table})
+	return err
+}
+
+// ListTables returns the table names of a database.
+func (c *Client) ListTables(ctx context.Context, database string) ([]string, error) {
+	var names []string
+	err := c.getJSON(ctx, c.currentMaster, "/list_tables", url.Values{"database": {database}}, &names)
+	return names, err
+}
+
+// DescribeTable returns the declared columns of a table.
+func (c *Client) DescribeTable(ctx context.Context, database, table string) ([]string, error) {
+	var resp struct {
+		Columns []string `json:"columns"`
+	}
+	err := c.getJSON(ctx, c.currentMaster, "/describe_table", url.Values{"database": {database}, "table": {table}}, &resp)
+	return resp.Columns, err
+}
+
+// ===================== RECORDS =====================
+
+// Insert appends a record to a table.
+func (c *Client) Insert(ctx context.Context, database, table string, record Record) error {
+	_, err := c.post(ctx, "/insert", request{Database: database, Table: table, Record: record})
+	return err
+}
+
+// Update sets data on every record matching where and returns how many
+// records changed.
+func (c *Client) Update(ctx context.Context, database, table string, where Conditions, data Record) (int, error) {
+	body, err := c.post(ctx, "/update", request{Database: database, Table: table, Conditions: where, UpdateData: data})
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(body, "Updated %d records.")
+}
+
+// ColumnOp changes a CRDT column: "increment" or "decrement" a counter by
+// Value (1 when empty), "add" or "remove" the element Value of a set, or
+// "set" a register.
+type ColumnOp struct {
+	Op    string `json:"op"`
+	Value string `json:"value,omitempty"`
+}
+
+// Apply runs ops, by column, on every record matching where and returns
+// how many records changed.
+func (c *Client) Apply(ctx context.Context, database, table string, where Conditions, ops map[string]ColumnOp) (int, error) {
+	body, err := c.post(ctx, "/update", request{Database: database, Table: table, Conditions: where, Ops: ops})
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(body, "Updated %d records.")
+}
+
+// Delete removes every record matching where and returns how many were
+// removed.
+func (c *Client) Delete(ctx context.Context, database, table string, where Conditions) (int, error) {
+	body, err := c.post(ctx, "/delete", request{Database: database, Table: table, Conditions: where})
+	if err != nil {
+		return 0, err
+	}
+	return parseCount(body, "Deleted %d records.")
+}
+
+// Op is one write of a transaction: "insert" with Record, "update" with
+// Where and Data, or "delete" with Where.
+type Op struct {
+	Op       string
+	Database string
+	Table    string
+	Record   Record
+	Where    Conditions
+	Data     Record
+}
+
+// Transaction applies ops atomically, also across shards, and returns how
+// many records each op touched.
+func (c *Client) Transaction(ctx context.Context, ops []Op) ([]int, error) {
+	type txnOp struct {
+		Op string `json:"op"`
+		request
+	}
+	var body struct {
+		Operations []txnOp `json:"operations"`
+	}
+	for _, op := range ops {
+		body.Operations = append(body.Operations, txnOp{Op: op.Op, request: request{
+			Database: op.Database, Table: op.Table, Record: op.Record, Conditions: op.Where, UpdateData: op.Data,
+		}})
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, http.MethodPost, c.currentMaster, "/transaction", nil, payload)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Rows []int `json:"rows"`
+	}
+	if err := json.Unmarshal(resp, &res); err != nil {
+		return nil, fmt.Errorf("ddb: unexpected response %q", resp)
+	}
+	return res.Rows, nil
+}
+
+// Select returns every record of a table.
+func (c *Client) Select(ctx context.Context, database, table string) ([]Record, error) {
+	return c.Query(ctx, Query{Database: database, Table: table})
+}
+
+// Query runs q. Conditions are evaluated client side because the select
+// endpoints only filter by table.
+func (c *Client) Query(ctx context.Context, q Query) ([]Record, error) {
+	params := url.Values{"database": {q.Database}, "table": {q.Table}}
+	if lsn := max(q.MinLSN, c.LSN()); lsn > 0 && (q.ReadFromReplica || q.MaxStaleness > 0 || q.MaxLagLSN > 0) {
+		params.Set("min_lsn", fmt.Sprint(lsn))
+	}
+	var records []Record
+	var err error
+	if q.ReadFromReplica {
+		if len(c.cfg.Replicas) == 0 {
+			return nil, ErrNoReplicas
+		}
+		err = c.getJSON(ctx, c.nextReplica, "/replicate_get", params, &records)
+		// A slave behind the token refuses; the master has every write.
+		var e *Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusPreconditionFailed {
+			params.Del("min_lsn")
+			err = c.getJSON(ctx, c.currentMaster, "/select", params, &records)
+		}
+	} else {
+		if q.Limit > 0 && len(q.Where) == 0 {
+			params.Set("limit", fmt.Sprint(q.Limit))
+		}
+		if q.MaxStaleness > 0 {
+			params.Set("max_staleness", q.MaxStaleness.String())
+		}
+		if q.MaxLagLSN > 0 {
+			params.Set("max_lag_lsn", fmt.Sprint(q.MaxLagLSN))
+		}
+		err = c.getJSON(ctx, c.currentMaster, "/select", params, &records)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := records[:0]
+	for _, rec := range records {
+		if !matches(rec, q.Where) {
+			continue
+		}
+		out = append(out, rec)
+		if q.Limit > 0 && len(out) == q.Limit {
+			break
+		}
+	}
+	return out, nil
+}
+
+func matches(rec Record, where Conditions) bool {
+	for k, v := range where {
+		if rec[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCount(body []byte, format string) (int, error) {
+	var n int
+	if _, err := fmt.Sscanf(string(body), format, &n); err != nil {
+		return 0, fmt.Errorf("ddb: unexpected response %q", body)
+	}
+	return n, nil
+}
+
+// ===================== TRANSPORT =====================
+
+// request mirrors RequestData on the server.
+type request struct {
+	Database   string              `json:"database"`
+	Table      string              `json:"table"`
+	Columns    []string            `json:"columns,omitempty"`
+	Types      map[string]string   `json:"types,omitempty"`
+	Record     map[string]string   `json:"record,omitempty"`
+	UpdateData map[string]string   `json:"update_data,omitempty"`
+	Ops        map[string]ColumnOp `json:"ops,omitempty"`
+	Conditions map[string]string   `json:"conditions,omitempty"`
+}
+
+func (c *Client) currentMaster() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.master
+}
+
+// failoverMaster moves to the candidate after failed, unless another
+// goroutine already did.
+func (c *Client) failoverMaster(failed string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.master != failed {
+		return
+	}
+	for i, m := range c.cfg.Masters {
+		if m == failed {
+			c.master = c.cfg.Masters[(i+1)%len(c.cfg.Masters)]
+			return
+		}
+	}
+	c.master = c.cfg.Masters[0]
+}
+
+func (c *Client) redirectMaster(addr string) {
+	c.mu.Lock()
+	c.master = strings.TrimRight(addr, "/")
+	c.mu.Unlock()
+}
+
+// LSN returns the client's read-your-writes token, the highest LSN the
+// master returned for its writes.
+func (c *Client) LSN() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lsn
+}
+
+func (c *Client) observeLSN(header http.Header) {
+	lsn, err := strconv.ParseUint(header.Get(LSNHeader), 10, 64)
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.lsn = max(c.lsn, lsn)
+	c.mu.Unlock()
+}
+
+func (c *Client) nextReplica() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.cfg.Replicas[c.replica%len(c.cfg.Replicas)]
+	c.replica++
+	return r
+}
+
+func (c *Client) post(ctx context.Context, path string, req request) ([]byte, error) {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, http.MethodPost, c.currentMaster, path, nil, payload)
+}
+
+func (c *Client) getJSON(ctx context.Context, node func() string, path string, params url.Values, out interface{}) error {
+	body, err := c.do(ctx, http.MethodGet, node, path, params, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("ddb: decoding %s: %w", path, err)
+	}
+	return nil
+}
+
+// do sends a request to the node returned by node, retrying transient
+// failures with exponential backoff. Each retry asks node again so master
+// failover and replica round-robin take effect between attempts.
+//
+// Only GETs are retried once the request reached the node: a write that
+// timed out or got a 5xx may still have been applied, so the caller
+// decides what to do with it.
+func (c *Client) do(ctx context.Context, method string, node func() string, path string, params url.Values, payload []byte) ([]byte, error) {
+	idempotent := method == http.MethodGet
+	backoff := c.cfg.RetryBackoff
+	var lastErr error
+	for attempt := 0; attempt <= c.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		base := node()
+		body, status, header, sent, err := c.once(ctx, method, base+path, params, payload)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			if !isTransient(err) || (sent && !idempotent) {
+				return nil, err
+			}
+			// failoverMaster ignores replicas, so any request that could
+			// not reach the current master moves on to the next one.
+			c.failoverMaster(base)
+			continue
+		case status == http.StatusMisdirectedRequest && header.Get(MasterHeader) != "":
+			c.redirectMaster(header.Get(MasterHeader))
+			lastErr = &Error{StatusCode: status, Message: strings.TrimSpace(string(body))}
+			continue
+		case status >= 200 && status < 300:
+			if method == http.MethodPost {
+				c.observeLSN(header)
+			}
+			return body, nil
+		}
+
+		lastErr = &Error{StatusCode: status, Message: strings.TrimSpace(string(body))}
+		if !idempotent || !retryableStatus(status) {
+			return nil, lastErr
+		}
+	}
+	return nil, lastErr
+}
+
+// once makes a single attempt. sent reports whether the request headers
+// were written, after which the node may have acted on the request even if
+// err is set.
+func (c *Client) once(ctx context.Context, method, target string, params url.Values, payload []byte) (data []byte, status int, header http.Header, sent bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	defer cancel()
+	var wrote atomic.Bool
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteHeaders: func() { wrote.Store(true) },
+	})
+
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, 0, nil, false, err
+	}
+	for k, vs := range c.cfg.Header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if c.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return nil, 0, nil, wrote.Load(), err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, nil, true, err
+	}
+	return data, resp.StatusCode, resp.Header, true, nil
+}
+
+// isTransient reports whether err is a network failure another attempt may
+// not hit, as opposed to a bad URL, a rejected certificate or a cancelled
+// context. Every error from http.Client is a *url.Error, so it's the
+// wrapped error that is classified.
+func isTransient(err error) bool {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,211 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// closedURL returns the address of a server that no longer listens.
+func closedURL() string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func newTestClient(t *testing.T, cfg Config) *Client {
+	t.Helper()
+	cfg.RetryBackoff = time.Millisecond
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestMasterFailover(t *testing.T) {
+	var writes atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Write([]byte(`["shop"]`))
+			return
+		}
+		writes.Add(1)
+		w.Write([]byte("Database created successfully."))
+	}))
+	defer up.Close()
+
+	down := closedURL()
+	c := newTestClient(t, Config{Masters: []string{down, up.URL}})
+	if err := c.CreateDatabase(context.Background(), "shop"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.currentMaster(); got != up.URL {
+		t.Fatalf("master %s, want %s", got, up.URL)
+	}
+	if writes.Load() != 1 {
+		t.Fatalf("%d writes reached the master, want 1", writes.Load())
+	}
+
+	// Reads that go to the master fail over the same way.
+	c = newTestClient(t, Config{Masters: []string{down, up.URL}})
+	if _, err := c.ListDatabases(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.currentMaster(); got != up.URL {
+		t.Fatalf("master %s after a read, want %s", got, up.URL)
+	}
+}
+
+func TestMasterRedirect(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Record inserted successfully."))
+	}))
+	defer master.Close()
+	slave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(MasterHeader, master.URL)
+		http.Error(w, "Replica is read-only", http.StatusMisdirectedRequest)
+	}))
+	defer slave.Close()
+
+	c := newTestClient(t, Config{Masters: []string{slave.URL}})
+	if err := c.Insert(context.Background(), "shop", "items", Record{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.currentMaster(); got != master.URL {
+		t.Fatalf("master %s, want %s", got, master.URL)
+	}
+}
+
+func TestReplicaReads(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/insert":
+			w.Header().Set(LSNHeader, "7")
+			w.Write([]byte("Record inserted successfully."))
+		case "/select":
+			if r.URL.Query().Has("min_lsn") {
+				http.Error(w, "min_lsn sent to the master", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`[{"id":"1","from":"master"}]`))
+		}
+	}))
+	defer master.Close()
+	var minLSN []string
+	behind := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minLSN = append(minLSN, r.URL.Query().Get("min_lsn"))
+		http.Error(w, "Replica has applied LSN 3 of the table, behind 7", http.StatusPreconditionFailed)
+	}))
+	defer behind.Close()
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		minLSN = append(minLSN, r.URL.Query().Get("min_lsn"))
+		w.Write([]byte(`[{"id":"1","from":"replica"}]`))
+	}))
+	defer current.Close()
+
+	ctx := context.Background()
+	c := newTestClient(t, Config{Masters: []string{master.URL}, Replicas: []string{behind.URL, current.URL}})
+	if err := c.Insert(ctx, "shop", "items", Record{"id": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if c.LSN() != 7 {
+		t.Fatalf("token %d, want 7", c.LSN())
+	}
+
+	// The replica that is behind refuses and the master answers; the next
+	// read goes to the other replica.
+	for _, want := range []string{"master", "replica"} {
+		rows, err := c.Query(ctx, Query{Database: "shop", Table: "items", ReadFromReplica: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 || rows[0]["from"] != want {
+			t.Fatalf("rows %v, want one from the %s", rows, want)
+		}
+	}
+	if len(minLSN) != 2 || minLSN[0] != "7" || minLSN[1] != "7" {
+		t.Fatalf("replicas got min_lsn %q, want the write's token", minLSN)
+	}
+
+	if _, err := newTestClient(t, Config{Masters: []string{master.URL}}).Query(ctx, Query{ReadFromReplica: true}); err != ErrNoReplicas {
+		t.Fatalf("err %v, want ErrNoReplicas", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+
+	// overloaded answers 503 until it has seen three requests.
+	overloaded := func(calls *atomic.Int32) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if calls.Add(1) < 3 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`["shop"]`))
+		}
+	}
+	var reads atomic.Int32
+	srv := httptest.NewServer(overloaded(&reads))
+	c := newTestClient(t, Config{Masters: []string{srv.URL}})
+	if _, err := c.ListDatabases(ctx); err != nil || reads.Load() != 3 {
+		t.Fatalf("read: err %v after %d attempts, want success after 3", err, reads.Load())
+	}
+	srv.Close()
+
+	var writes atomic.Int32
+	srv = httptest.NewServer(overloaded(&writes))
+	c = newTestClient(t, Config{Masters: []string{srv.URL}})
+	var e *Error
+	if err := c.CreateDatabase(ctx, "shop"); !errors.As(err, &e) || e.StatusCode != http.StatusServiceUnavailable || writes.Load() != 1 {
+		t.Fatalf("write: err %v after %d attempts, want the 503 after 1", err, writes.Load())
+	}
+	srv.Close()
+
+	// A connection dropped after the request was sent may have applied a
+	// write, so only reads try again.
+	var dropped atomic.Int32
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dropped.Add(1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	c = newTestClient(t, Config{Masters: []string{srv.URL}, MaxRetries: 2})
+	if err := c.CreateDatabase(ctx, "shop"); err == nil || dropped.Load() != 1 {
+		t.Fatalf("write: err %v after %d attempts, want an error after 1", err, dropped.Load())
+	}
+	dropped.Store(0)
+	if _, err := c.ListDatabases(ctx); err == nil || dropped.Load() != 3 {
+		t.Fatalf("read: err %v after %d attempts, want an error after 3", err, dropped.Load())
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "http://db:8000", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{refused, true},
+		{&url.Error{Op: "Get", URL: "http://db:8000", Err: io.EOF}, true},
+		{io.ErrUnexpectedEOF, true},
+		{&url.Error{Op: "Get", URL: "http://db:8000", Err: context.Canceled}, false},
+		{&url.Error{Op: "Get", URL: "db:8000", Err: errors.New("unsupported protocol scheme")}, false},
+		{errors.New("x509: certificate signed by unknown authority"), false},
+	} {
+		if got := isTransient(tc.err); got != tc.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
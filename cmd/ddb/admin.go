@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/client"
+)
+
+// dumpTable and dumpDatabase match the layout of data.json so a backup can
+// also be used as a master data file.
+type dumpTable struct {
+	Name    string              `json:"name"`
+	Columns []string            `json:"columns"`
+	Records []map[string]string `json:"records"`
+}
+
+type dumpDatabase struct {
+	Name   string                `json:"name"`
+	Tables map[string]*dumpTable `json:"tables"`
+}
+
+func runAdmin(ctx context.Context, cl *client.Client, opts options, args []string) error {
+	switch args[0] {
+	case "status":
+		return clusterStatus(ctx, opts)
+	case "backup":
+		fs := flag.NewFlagSet("backup", flag.ExitOnError)
+		out := fs.String("o", "", "write to `file` instead of stdout")
+		keyFile := fs.String("key-file", "", "encrypt with the newest key in this `file`, or set $DDB_ENCRYPTION_KEY")
+		fs.Parse(args[1:])
+		keys, err := loadBackupKeys(*keyFile)
+		if err != nil {
+			return err
+		}
+		return backup(ctx, cl, *out, keys)
+	case "restore":
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		keyFile := fs.String("key-file", "", "decrypt with the keys in this `file`, or set $DDB_ENCRYPTION_KEY")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			return errors.New("usage: ddb restore [-key-file file] file")
+		}
+		keys, err := loadBackupKeys(*keyFile)
+		if err != nil {
+			return err
+		}
+		return restore(ctx, cl, fs.Arg(0), keys)
+	case "resync":
+		if len(args) != 2 {
+			return errors.New("usage: ddb resync replica-url")
+		}
+		return resync(ctx, cl, strings.TrimRight(args[1], "/"), opts)
+	case "certs":
+		fs := flag.NewFlagSet("certs", flag.ExitOnError)
+		dir := fs.String("dir", "certs", "output directory")
+		hosts := fs.String("hosts", "localhost,127.0.0.1", "comma separated host names and IPs added to every node certificate")
+		days := fs.Int("days", 365, "validity in days")
+		fs.Parse(args[1:])
+		names := fs.Args()
+		if len(names) == 0 {
+			names = []string{"master", "slave"}
+		}
+		return generateCerts(*dir, splitList(*hosts), *days, names)
+	}
+	return fmt.Errorf("unknown command %q", args[0])
+}
+
+// clusterStatus probes every configured node.
+func clusterStatus(ctx context.Context, opts options) error {
+	hc := opts.httpClient()
+	var rows [][]string
+	probe := func(role, base, path string) {
+		start := time.Now()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+		if opts.token != "" {
+			req.Header.Set("Authorization", "Bearer "+opts.token)
+		}
+		resp, err := hc.Do(req)
+		state, detail := "up", ""
+		if err != nil {
+			state, detail = "down", err.Error()
+		} else {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if role == "master" {
+				var names []string
+				if json.Unmarshal(body, &names) == nil {
+					detail = fmt.Sprintf("%d databases", len(names))
+				}
+			}
+			if resp.StatusCode >= 500 {
+				state, detail = "error", resp.Status
+			}
+		}
+		rows = append(rows, []string{role, base, state, time.Since(start).Round(time.Millisecond).String(), detail})
+	}
+	for _, m := range opts.masters {
+		probe("master", strings.TrimRight(m, "/"), "/list_databases")
+	}
+	for _, r := range opts.replicas {
+		probe("replica", strings.TrimRight(r, "/"), "/")
+	}
+	printTable(os.Stdout, []string{"role", "address", "state", "latency", "detail"}, rows)
+	return nil
+}
+
+func snapshot(ctx context.Context, cl *client.Client) (map[string]*dumpDatabase, error) {
+	dbs, err := cl.ListDatabases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dump := make(map[string]*dumpDatabase, len(dbs))
+	for _, name := range dbs {
+		d := &dumpDatabase{Name: name, Tables: map[string]*dumpTable{}}
+		tables, err := cl.ListTables(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			cols, err := cl.DescribeTable(ctx, name, t)
+			if err != nil {
+				return nil, err
+			}
+			recs, err := cl.Select(ctx, name, t)
+			if err != nil {
+				return nil, err
+			}
+			dt := &dumpTable{Name: t, Columns: cols, Records: make([]map[string]string, len(recs))}
+			for i, r := range recs {
+				dt.Records[i] = r
+			}
+			d.Tables[t] = dt
+		}
+		dump[name] = d
+	}
+	return dump, nil
+}
+
+// backup writes a snapshot of every table, encrypted when keys is set.
+func backup(ctx context.Context, cl *client.Client, out string, keys *backupKeys) error {
+	dump, err := snapshot(ctx, cl)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if keys != nil {
+		data = keys.seal(data)
+	}
+	if out == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	if err := os.WriteFile(out, data, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %d databases to %s\n", len(dump), out)
+	return nil
+}
+
+// restore recreates databases and tables from a dump through the master,
+// so the data is replicated as usual. Existing databases and tables are
+// kept and the records are appended. Encrypted backups are decrypted
+// with keys.
+func restore(ctx context.Context, cl *client.Client, file string, keys *backupKeys) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if data, err = openBackup(keys, data); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	var dump map[string]*dumpDatabase
+	if err := json.Unmarshal(data, &dump); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	names := make([]string, 0, len(dump))
+	for n := range dump {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	records := 0
+	for _, name := range names {
+		if err := cl.CreateDatabase(ctx, name); err != nil && !client.IsConflict(err) {
+			return err
+		}
+		for tname, t := range dump[name].Tables {
+			if err := cl.CreateTable(ctx, name, tname, t.Columns); err != nil && !client.IsConflict(err) {
+				return err
+			}
+			for _, r := range t.Records {
+				if err := cl.Insert(ctx, name, tname, r); err != nil {
+					return err
+				}
+				records++
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d databases, %d records\n", len(names), records)
+	return nil
+}
+
+// resync replaces the contents of every master table on a replica with
+// the master's records using the replication endpoints. Requests are
+// signed like the master's when the replica requires a node secret.
+func resync(ctx context.Context, cl *client.Client, replica string, opts options) error {
+	hc := opts.httpClient()
+	dump, err := snapshot(ctx, cl)
+	if err != nil {
+		return err
+	}
+	send := func(endpoint string, payload interface{}) error {
+		body, _ := json.Marshal(payload)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, replica+"/"+endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if opts.nodeSecret != "" {
+			ts := strconv.FormatInt(time.Now().Unix(), 10)
+			mac := hmac.New(sha256.New, []byte(opts.nodeSecret))
+			fmt.Fprintf(mac, "%s\n%s\n", ts, req.URL.Path)
+			mac.Write(body)
+			req.Header.Set("X-Ddb-Node-Signature", "t="+ts+",sig="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		resp, err := hc.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s: %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return nil
+	}
+
+	records := 0
+	for dbName, d := range dump {
+		for tname, t := range d.Tables {
+			// Empty conditions match every record.
+			if err := send("replicate_delete", map[string]interface{}{"database": dbName, "table": tname, "columns": t.Columns}); err != nil {
+				return err
+			}
+			for _, r := range t.Records {
+				if err := send("replicate_insert", map[string]interface{}{"database": dbName, "table": tname, "columns": t.Columns, "record": r}); err != nil {
+					return err
+				}
+				records++
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Resynced %d records to %s\n", records, replica)
+	return nil
+}
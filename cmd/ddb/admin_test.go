@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/omar-karam1/distributed-db-go/client"
+)
+
+// fakeMaster serves the master endpoints that backup and restore use.
+type fakeMaster struct {
+	mu  sync.Mutex
+	dbs map[string]map[string]*dumpTable
+}
+
+func (m *fakeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var req struct {
+		Database string            `json:"database"`
+		Table    string            `json:"table"`
+		Columns  []string          `json:"columns"`
+		Record   map[string]string `json:"record"`
+	}
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&req)
+	} else {
+		req.Database, req.Table = r.URL.Query().Get("database"), r.URL.Query().Get("table")
+	}
+	tables := m.dbs[req.Database]
+	switch r.URL.Path {
+	case "/list_databases":
+		json.NewEncoder(w).Encode(slices.Sorted(maps.Keys(m.dbs)))
+	case "/list_tables":
+		json.NewEncoder(w).Encode(slices.Sorted(maps.Keys(tables)))
+	case "/describe_table":
+		json.NewEncoder(w).Encode(map[string][]string{"columns": tables[req.Table].Columns})
+	case "/select":
+		json.NewEncoder(w).Encode(tables[req.Table].Records)
+	case "/create_database":
+		if tables != nil {
+			http.Error(w, "Database already exists", http.StatusConflict)
+			return
+		}
+		m.dbs[req.Database] = map[string]*dumpTable{}
+	case "/create_table":
+		if tables[req.Table] != nil {
+			http.Error(w, "Table already exists", http.StatusConflict)
+			return
+		}
+		tables[req.Table] = &dumpTable{Name: req.Table, Columns: req.Columns, Records: []map[string]string{}}
+	case "/insert":
+		tables[req.Table].Records = append(tables[req.Table].Records, req.Record)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeMaster(t *testing.T, dbs map[string]map[string]*dumpTable) (*fakeMaster, *client.Client) {
+	m := &fakeMaster{dbs: dbs}
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	cl, err := client.New(client.Config{Masters: []string{srv.URL}, MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, cl
+}
+
+// quiet sends what fn writes to stderr away and returns what it writes
+// to stdout.
+func quiet(t *testing.T, fn func()) string {
+	t.Helper()
+	stdout, stderr := os.Stdout, os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	devnull, _ := os.Open(os.DevNull)
+	os.Stdout, os.Stderr = w, devnull
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	defer func() {
+		os.Stdout, os.Stderr = stdout, stderr
+		devnull.Close()
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	_, src := newFakeMaster(t, map[string]map[string]*dumpTable{
+		"shop": {
+			"items":  {Name: "items", Columns: []string{"id", "name"}, Records: []map[string]string{{"id": "1", "name": "apple"}, {"id": "2", "name": "pear"}}},
+			"orders": {Name: "orders", Columns: []string{"id"}, Records: []map[string]string{}},
+		},
+		"hr": {"staff": {Name: "staff", Columns: []string{"id"}, Records: []map[string]string{{"id": "7"}}}},
+	})
+	keyFile := filepath.Join(t.TempDir(), "backup.key")
+	if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(make([]byte, 32))+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadBackupKeys(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		keys *backupKeys
+	}{{"plain", nil}, {"encrypted", keys}} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "backup.json")
+			quiet(t, func() { err = backup(ctx, src, file, tc.keys) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := os.ReadFile(file)
+			if encrypted := strings.HasPrefix(string(data), sealedFileHeader); encrypted != (tc.keys != nil) {
+				t.Fatalf("backup encrypted: %v", encrypted)
+			}
+
+			// Restoring keeps what the target has and adds the rest.
+			_, dstClient := newFakeMaster(t, map[string]map[string]*dumpTable{
+				"shop": {"items": {Name: "items", Columns: []string{"id", "name"}, Records: []map[string]string{}}},
+			})
+			quiet(t, func() { err = restore(ctx, dstClient, file, tc.keys) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := snapshot(ctx, src)
+			got, _ := snapshot(ctx, dstClient)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("restored %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	t.Run("missing key", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "backup.json")
+		quiet(t, func() { err = backup(ctx, src, file, keys) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, dstClient := newFakeMaster(t, map[string]map[string]*dumpTable{})
+		if err := restore(ctx, dstClient, file, nil); err == nil || !strings.Contains(err.Error(), "-key-file") {
+			t.Fatalf("err %v, want a hint to pass -key-file", err)
+		}
+	})
+}
+
+func TestClusterStatus(t *testing.T) {
+	up := httptest.NewServer(&fakeMaster{dbs: map[string]map[string]*dumpTable{"shop": {}, "hr": {}}})
+	defer up.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "storage unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	var token string
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("Authorization")
+	}))
+	defer replica.Close()
+
+	opts := options{masters: []string{up.URL, failing.URL, down.URL}, replicas: []string{replica.URL}, token: "ddb_key"}
+	var err error
+	out := quiet(t, func() { err = clusterStatus(context.Background(), opts) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		for _, addr := range []string{up.URL, failing.URL, down.URL, replica.URL} {
+			if strings.Contains(line, addr+" ") {
+				rows[addr] = line
+			}
+		}
+	}
+	for addr, want := range map[string][]string{
+		up.URL:      {"master", "up", "2 databases"},
+		failing.URL: {"master", "error", "503"},
+		down.URL:    {"master", "down"},
+		replica.URL: {"replica", "up"},
+	} {
+		for _, w := range want {
+			if !strings.Contains(rows[addr], w) {
+				t.Errorf("%s: row %q, want %q in it", addr, rows[addr], w)
+			}
+		}
+	}
+	if token != "Bearer ddb_key" {
+		t.Errorf("replica got Authorization %q, want the token", token)
+	}
+}
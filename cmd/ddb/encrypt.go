@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Backups use the same format as encrypted node data files, so an
+// encrypted backup can also be used as the master's data.json with the
+// same key file.
+
+const sealedFileHeader = "DDBENC1 "
+
+// backupKeys holds AES-GCM keys by id, newest first in ids.
+type backupKeys struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// loadBackupKeys reads keys from file, or from $DDB_ENCRYPTION_KEY when
+// file is empty. It returns nil when neither is set.
+func loadBackupKeys(file string) (*backupKeys, error) {
+	text := os.Getenv("DDB_ENCRYPTION_KEY")
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+	k := &backupKeys{aeads: map[string]cipher.AEAD{}}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != 32 {
+			key, err = base64.StdEncoding.DecodeString(line)
+		}
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("encryption keys must be 32 bytes, hex or base64 encoded")
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if k.aeads[id] == nil {
+			k.ids = append(k.ids, id)
+		}
+		k.aeads[id] = aead
+	}
+	if len(k.ids) == 0 {
+		if file != "" {
+			return nil, fmt.Errorf("%s: no keys found", file)
+		}
+		return nil, nil
+	}
+	return k, nil
+}
+
+// seal encrypts data with the newest key.
+func (k *backupKeys) seal(data []byte) []byte {
+	id := k.ids[0]
+	aead := k.aeads[id]
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return append([]byte(sealedFileHeader+id+"\n"), aead.Seal(nonce, nonce, data, []byte(id))...)
+}
+
+// openBackup decrypts data when it is encrypted and returns it unchanged
+// otherwise. k may be nil.
+func openBackup(k *backupKeys, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sealedFileHeader)) {
+		return data, nil
+	}
+	id, sealed, ok := bytes.Cut(data[len(sealedFileHeader):], []byte("\n"))
+	if !ok {
+		return nil, errors.New("invalid encrypted file header")
+	}
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.aeads[string(id)]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("backup is encrypted with key %s, pass -key-file or set $DDB_ENCRYPTION_KEY", id)
+	}
+	n := aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("encrypted backup is truncated")
+	}
+	return aead.Open(nil, sealed[:n], sealed[n:], id)
+}
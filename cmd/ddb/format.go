@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// printRows renders rows as an ASCII table.
+func printRows(w io.Writer, rows *sql.Rows) error {
+	cols, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	var data [][]string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		row := make([]string, len(cols))
+		for i, v := range vals {
+			if v.Valid {
+				row[i] = v.String
+			} else {
+				row[i] = "NULL"
+			}
+		}
+		data = append(data, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	printTable(w, cols, data)
+	return nil
+}
+
+func printList(w io.Writer, header string, items []string) {
+	data := make([][]string, len(items))
+	for i, it := range items {
+		data[i] = []string{it}
+	}
+	printTable(w, []string{header}, data)
+}
+
+func printTable(w io.Writer, header []string, data [][]string) {
+	widths := make([]int, len(header))
+	for i, h := range header {
+		widths[i] = utf8.RuneCountInString(h)
+	}
+	for _, row := range data {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	var sep strings.Builder
+	sep.WriteString("+")
+	for _, wd := range widths {
+		sep.WriteString(strings.Repeat("-", wd+2))
+		sep.WriteString("+")
+	}
+	line := func(cells []string) {
+		var b strings.Builder
+		b.WriteString("|")
+		for i, c := range cells {
+			b.WriteString(" ")
+			b.WriteString(c)
+			b.WriteString(strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c)+1))
+			b.WriteString("|")
+		}
+		fmt.Fprintln(w, b.String())
+	}
+
+	fmt.Fprintln(w, sep.String())
+	line(header)
+	fmt.Fprintln(w, sep.String())
+	for _, row := range data {
+		line(row)
+	}
+	fmt.Fprintln(w, sep.String())
+	if len(data) == 1 {
+		fmt.Fprintln(w, "(1 row)")
+	} else {
+		fmt.Fprintf(w, "(%d rows)\n", len(data))
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// lineEditor is a small readline replacement: cursor movement, history
+// and tab completion. It switches the terminal to raw mode with stty only
+// while a line is being read so normal output keeps working in between.
+
+var errInterrupted = errors.New("interrupted")
+
+const maxHistory = 1000
+
+type lineEditor struct {
+	in          *bufio.Reader
+	out         io.Writer
+	history     []string
+	historyFile string
+	complete    func(prefix string) []string
+}
+
+func newLineEditor(historyFile string, complete func(string) []string) *lineEditor {
+	ed := &lineEditor{in: bufio.NewReader(os.Stdin), out: os.Stdout, historyFile: historyFile, complete: complete}
+	if historyFile != "" {
+		if data, err := os.ReadFile(historyFile); err == nil {
+			for _, l := range strings.Split(string(data), "\n") {
+				if l != "" {
+					ed.history = append(ed.history, l)
+				}
+			}
+		}
+	}
+	return ed
+}
+
+func (ed *lineEditor) addHistory(line string) {
+	if line == "" || (len(ed.history) > 0 && ed.history[len(ed.history)-1] == line) {
+		return
+	}
+	ed.history = append(ed.history, line)
+	if len(ed.history) > maxHistory {
+		ed.history = ed.history[len(ed.history)-maxHistory:]
+	}
+}
+
+func (ed *lineEditor) saveHistory() {
+	if ed.historyFile == "" {
+		return
+	}
+	os.WriteFile(ed.historyFile, []byte(strings.Join(ed.history, "\n")+"\n"), 0600)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// readLine reads one line. It falls back to plain buffered reading when
+// the terminal cannot be put into raw mode.
+func (ed *lineEditor) readLine(prompt string) (string, error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return ed.readPlain(prompt)
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return ed.readPlain(prompt)
+	}
+	defer stty(saved)
+	return ed.readRaw(prompt)
+}
+
+func (ed *lineEditor) readPlain(prompt string) (string, error) {
+	fmt.Fprint(ed.out, prompt)
+	line, err := ed.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (ed *lineEditor) readRaw(prompt string) (string, error) {
+	var buf []rune
+	pos := 0
+	hist := len(ed.history)
+	draft := ""
+
+	redraw := func() {
+		fmt.Fprintf(ed.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(ed.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(s string) {
+		buf = []rune(s)
+		pos = len(buf)
+		redraw()
+	}
+
+	fmt.Fprint(ed.out, prompt)
+	for {
+		r, _, err := ed.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(ed.out, "\r\n")
+			return string(buf), nil
+		case 3: // Ctrl-C
+			fmt.Fprint(ed.out, "^C\r\n")
+			return "", errInterrupted
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				return "", io.EOF
+			}
+		case 1: // Ctrl-A
+			pos = 0
+			redraw()
+		case 5: // Ctrl-E
+			pos = len(buf)
+			redraw()
+		case 21: // Ctrl-U
+			buf = buf[pos:]
+			pos = 0
+			redraw()
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+				redraw()
+			}
+		case '\t':
+			ed.completeWord(&buf, &pos, prompt)
+			redraw()
+		case 27: // escape sequence
+			b1, _, _ := ed.in.ReadRune()
+			if b1 != '[' {
+				continue
+			}
+			b2, _, _ := ed.in.ReadRune()
+			switch b2 {
+			case 'A': // up
+				if hist > 0 {
+					if hist == len(ed.history) {
+						draft = string(buf)
+					}
+					hist--
+					setLine(ed.history[hist])
+				}
+			case 'B': // down
+				if hist < len(ed.history) {
+					hist++
+					if hist == len(ed.history) {
+						setLine(draft)
+					} else {
+						setLine(ed.history[hist])
+					}
+				}
+			case 'C': // right
+				if pos < len(buf) {
+					pos++
+					redraw()
+				}
+			case 'D': // left
+				if pos > 0 {
+					pos--
+					redraw()
+				}
+			case '3': // delete, ESC [ 3 ~
+				ed.in.ReadRune()
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+					redraw()
+				}
+			}
+		default:
+			if r >= 32 {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+				redraw()
+			}
+		}
+	}
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 127
+}
+
+// completeWord extends the word left of the cursor to the longest common
+// prefix of the candidates, listing them when there is more than one.
+func (ed *lineEditor) completeWord(buf *[]rune, pos *int, prompt string) {
+	start := *pos
+	for start > 0 && isWordRune((*buf)[start-1]) {
+		start--
+	}
+	prefix := string((*buf)[start:*pos])
+	cands := ed.complete(prefix)
+	if len(cands) == 0 {
+		return
+	}
+	common := cands[0]
+	for _, c := range cands[1:] {
+		for !strings.HasPrefix(strings.ToUpper(c), strings.ToUpper(common)) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(cands) == 1 {
+		common += " "
+	} else {
+		fmt.Fprintf(ed.out, "\r\n%s\r\n", strings.Join(cands, "  "))
+	}
+	if len([]rune(common)) < len([]rune(prefix)) {
+		return
+	}
+	rest := append([]rune(common), (*buf)[*pos:]...)
+	*buf = append((*buf)[:start], rest...)
+	*pos = start + len([]rune(common))
+}
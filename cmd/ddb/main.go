@@ -0,0 +1,148 @@
+// Command ddb is an interactive shell and admin tool for the database.
+//
+//	ddb [flags]                      start the REPL (or run stdin when piped)
+//	ddb [flags] -f script.sql        run a script
+//	ddb [flags] status               show master and replica health
+//	ddb [flags] backup [-o file]     dump every database as JSON
+//	ddb [flags] restore file         load a dump through the master
+//	ddb [flags] resync replica-url   rebuild a replica from the master
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/client"
+)
+
+type options struct {
+	masters    []string
+	replicas   []string
+	database   string
+	timeout    time.Duration
+	token      string
+	nodeSecret string
+	tls        *tls.Config // nil for the default verification
+}
+
+func main() {
+	var opts options
+	master := flag.String("master", "http://localhost:8000", "comma separated master URLs")
+	replica := flag.String("replica", "http://localhost:8001", "comma separated replica URLs")
+	flag.StringVar(&opts.database, "d", "", "database to use")
+	flag.DurationVar(&opts.timeout, "timeout", 10*time.Second, "per request timeout")
+	script := flag.String("f", "", "run statements from `file` and exit")
+	flag.StringVar(&opts.token, "token", "", "API key or token for the master, or set $DDB_TOKEN")
+	flag.StringVar(&opts.nodeSecret, "node-secret", "", "secret for signing resync requests, or set $DDB_NODE_SECRET")
+	caFile := flag.String("ca", "", "trust this CA `file` for https nodes")
+	certFile := flag.String("cert", "", "client certificate `file`, e.g. for resync against mutual TLS replicas")
+	keyFile := flag.String("key", "", "private key `file` for -cert")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: ddb [flags] [status | backup [-o file] [-key-file file] | restore [-key-file file] file | resync replica-url | certs [-dir dir] name...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if opts.token == "" {
+		opts.token = os.Getenv("DDB_TOKEN")
+	}
+	if opts.nodeSecret == "" {
+		opts.nodeSecret = os.Getenv("DDB_NODE_SECRET")
+	}
+	opts.masters = splitList(*master)
+	opts.replicas = splitList(*replica)
+	if *caFile != "" || *certFile != "" {
+		cfg, err := clientTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			fatal(err)
+		}
+		opts.tls = cfg
+	}
+
+	cl, err := client.New(client.Config{Masters: opts.masters, Replicas: opts.replicas, Timeout: opts.timeout, Token: opts.token, TLSConfig: opts.tls})
+	if err != nil {
+		fatal(err)
+	}
+	ctx := context.Background()
+
+	if flag.NArg() > 0 {
+		if err := runAdmin(ctx, cl, opts, flag.Args()); err != nil {
+			fatal(err)
+		}
+		return
+	}
+
+	sh := newShell(cl, opts)
+	defer sh.close()
+	switch {
+	case *script != "":
+		f, err := os.Open(*script)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		if err := sh.runScript(ctx, f); err != nil {
+			fatal(err)
+		}
+	case !isTerminal(os.Stdin):
+		if err := sh.runScript(ctx, os.Stdin); err != nil {
+			fatal(err)
+		}
+	default:
+		sh.repl(ctx)
+	}
+}
+
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", caFile)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// httpClient returns a client for direct node requests honoring -ca and -cert.
+func (o options) httpClient() *http.Client {
+	hc := &http.Client{Timeout: o.timeout}
+	if o.tls != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = o.tls
+		hc.Transport = transport
+	}
+	return hc
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "ddb:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/omar-karam1/distributed-db-go/client"
+	_ "github.com/omar-karam1/distributed-db-go/sqldriver"
+)
+
+const helpText = `Statements end with ';' and may span several lines.
+  USE db;  CREATE DATABASE db;  DROP DATABASE db;
+  SHOW DATABASES;  SHOW TABLES;  DESCRIBE table;
+  SELECT / INSERT / UPDATE / DELETE / CREATE TABLE / DROP TABLE (see sqldriver)
+Meta commands:
+  \l        list databases       \dt       list tables
+  \d table  describe a table     \c db     switch database
+  \h        this help            \q        quit`
+
+var keywords = []string{
+	"SELECT", "FROM", "WHERE", "AND", "LIMIT", "INSERT", "INTO", "VALUES",
+	"UPDATE", "SET", "DELETE", "CREATE", "DROP", "TABLE", "DATABASE",
+	"USE", "SHOW", "DATABASES", "TABLES", "DESCRIBE", "NULL",
+}
+
+type shell struct {
+	client   *client.Client
+	opts     options
+	database string
+	db       *sql.DB
+	out      io.Writer
+
+	// completion cache, refreshed after DDL and database switches
+	names []string
+}
+
+func newShell(cl *client.Client, opts options) *shell {
+	return &shell{client: cl, opts: opts, database: opts.database, out: os.Stdout}
+}
+
+func (s *shell) close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+func (s *shell) prompt() string {
+	if s.database == "" {
+		return "ddb> "
+	}
+	return s.database + "> "
+}
+
+// repl reads statements from the terminal until \q or Ctrl-D.
+func (s *shell) repl(ctx context.Context) {
+	historyFile := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyFile = filepath.Join(home, ".ddb_history")
+	}
+	ed := newLineEditor(historyFile, s.complete)
+	defer ed.saveHistory()
+
+	fmt.Fprintln(s.out, `ddb shell. Type \h for help.`)
+	s.refreshNames(ctx)
+	var buf strings.Builder
+	for {
+		prompt := s.prompt()
+		if buf.Len() > 0 {
+			prompt = strings.Repeat(" ", len(prompt)-3) + "-> "
+		}
+		line, err := ed.readLine(prompt)
+		if errors.Is(err, errInterrupted) {
+			buf.Reset()
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(s.out)
+			return
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if buf.Len() == 0 && strings.HasPrefix(trimmed, `\`) {
+			ed.addHistory(trimmed)
+			if trimmed == `\q` {
+				return
+			}
+			if err := s.meta(ctx, trimmed); err != nil {
+				fmt.Fprintln(s.out, "ERROR:", err)
+			}
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteString("\n")
+		for {
+			stmt, rest, ok := cutStatement(buf.String())
+			if !ok {
+				break
+			}
+			ed.addHistory(strings.Join(strings.Fields(stmt), " ") + ";")
+			if err := s.exec(ctx, stmt); err != nil {
+				fmt.Fprintln(s.out, "ERROR:", err)
+			}
+			buf.Reset()
+			buf.WriteString(strings.TrimLeft(rest, " \t\n"))
+		}
+	}
+}
+
+// runScript executes every statement in r and stops at the first error.
+func (s *shell) runScript(ctx context.Context, r io.Reader) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var buf strings.Builder
+	line := 0
+	for sc.Scan() {
+		line++
+		text := sc.Text()
+		trimmed := strings.TrimSpace(text)
+		if buf.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		if buf.Len() == 0 && strings.HasPrefix(trimmed, `\`) {
+			if trimmed == `\q` {
+				return nil
+			}
+			if err := s.meta(ctx, trimmed); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			continue
+		}
+		buf.WriteString(text)
+		buf.WriteString("\n")
+		for {
+			stmt, rest, ok := cutStatement(buf.String())
+			if !ok {
+				break
+			}
+			if err := s.exec(ctx, stmt); err != nil {
+				return fmt.Errorf("line %d: %w", line, err)
+			}
+			buf.Reset()
+			buf.WriteString(strings.TrimLeft(rest, " \t\n"))
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(buf.String()) != "" {
+		return s.exec(ctx, buf.String())
+	}
+	return nil
+}
+
+// cutStatement splits off the first ';'-terminated statement, ignoring
+// semicolons inside quotes.
+func cutStatement(text string) (stmt, rest string, ok bool) {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == ';':
+			return text[:i], text[i+1:], true
+		}
+	}
+	return "", text, false
+}
+
+func (s *shell) meta(ctx context.Context, cmd string) error {
+	fields := strings.Fields(cmd)
+	switch fields[0] {
+	case `\h`, `\?`:
+		fmt.Fprintln(s.out, helpText)
+		return nil
+	case `\l`:
+		return s.exec(ctx, "SHOW DATABASES")
+	case `\dt`:
+		return s.exec(ctx, "SHOW TABLES")
+	case `\d`:
+		if len(fields) != 2 {
+			return errors.New(`usage: \d table`)
+		}
+		return s.exec(ctx, "DESCRIBE "+fields[1])
+	case `\c`:
+		if len(fields) != 2 {
+			return errors.New(`usage: \c database`)
+		}
+		return s.exec(ctx, "USE "+fields[1])
+	}
+	return fmt.Errorf("unknown command %s, try \\h", fields[0])
+}
+
+// exec runs one statement. Database level statements go straight through
+// the client; everything else goes through the SQL driver.
+func (s *shell) exec(ctx context.Context, stmt string) error {
+	stmt = strings.TrimSpace(stmt)
+	if stmt == "" {
+		return nil
+	}
+	fields := strings.Fields(stmt)
+	word := func(i int) string {
+		if i < len(fields) {
+			return strings.ToUpper(fields[i])
+		}
+		return ""
+	}
+	arg := func(i int) string {
+		if i < len(fields) {
+			return strings.Trim(fields[i], "`\"")
+		}
+		return ""
+	}
+
+	switch {
+	case word(0) == "USE" && len(fields) == 2:
+		return s.use(ctx, arg(1))
+	case word(0) == "CREATE" && word(1) == "DATABASE" && len(fields) == 3:
+		if err := s.client.CreateDatabase(ctx, arg(2)); err != nil {
+			return err
+		}
+		fmt.Fprintln(s.out, "OK")
+		s.refreshNames(ctx)
+		return nil
+	case word(0) == "DROP" && word(1) == "DATABASE" && len(fields) == 3:
+		if err := s.client.DropDatabase(ctx, arg(2)); err != nil {
+			return err
+		}
+		if arg(2) == s.database {
+			s.database = ""
+		}
+		fmt.Fprintln(s.out, "OK")
+		s.refreshNames(ctx)
+		return nil
+	case word(0) == "SHOW" && word(1) == "DATABASES" && len(fields) == 2:
+		names, err := s.client.ListDatabases(ctx)
+		if err != nil {
+			return err
+		}
+		printList(s.out, "database", names)
+		return nil
+	case word(0) == "SHOW" && word(1) == "TABLES" && len(fields) == 2:
+		if s.database == "" {
+			return errNoDatabase
+		}
+		names, err := s.client.ListTables(ctx, s.database)
+		if err != nil {
+			return err
+		}
+		printList(s.out, "table", names)
+		return nil
+	case (word(0) == "DESCRIBE" || word(0) == "DESC") && len(fields) == 2:
+		if s.database == "" {
+			return errNoDatabase
+		}
+		cols, err := s.client.DescribeTable(ctx, s.database, arg(1))
+		if err != nil {
+			return err
+		}
+		printList(s.out, "column", cols)
+		return nil
+	}
+
+	if s.database == "" {
+		return errNoDatabase
+	}
+	if s.db == nil {
+		if err := s.openDB(); err != nil {
+			return err
+		}
+	}
+	if word(0) == "SELECT" {
+		rows, err := s.db.QueryContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return printRows(s.out, rows)
+	}
+	res, err := s.db.ExecContext(ctx, stmt)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	fmt.Fprintf(s.out, "%d row(s) affected\n", n)
+	if word(0) == "CREATE" || word(0) == "DROP" {
+		s.refreshNames(ctx)
+	}
+	return nil
+}
+
+var errNoDatabase = errors.New(`no database selected, run USE db; or \c db`)
+
+func (s *shell) use(ctx context.Context, name string) error {
+	if _, err := s.client.ListTables(ctx, name); err != nil {
+		return err
+	}
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+	s.database = name
+	fmt.Fprintf(s.out, "Using database %s\n", name)
+	s.refreshNames(ctx)
+	return nil
+}
+
+func (s *shell) openDB() error {
+	dsn := s.opts.masters[0] + "/" + s.database + "?timeout=" + s.opts.timeout.String()
+	for _, m := range s.opts.masters[1:] {
+		dsn += "&master=" + m
+	}
+	db, err := sql.Open("ddb", dsn)
+	if err != nil {
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// refreshNames reloads database, table and column names for completion.
+// Failures are ignored; completion simply offers fewer names.
+func (s *shell) refreshNames(ctx context.Context) {
+	seen := map[string]bool{}
+	var names []string
+	add := func(n string) {
+		if n != "" && !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	dbs, _ := s.client.ListDatabases(ctx)
+	for _, d := range dbs {
+		add(d)
+	}
+	if s.database != "" {
+		tables, _ := s.client.ListTables(ctx, s.database)
+		for _, t := range tables {
+			add(t)
+			cols, _ := s.client.DescribeTable(ctx, s.database, t)
+			for _, c := range cols {
+				add(c)
+			}
+		}
+	}
+	sort.Strings(names)
+	s.names = names
+}
+
+// complete returns the candidates for the word being typed.
+func (s *shell) complete(prefix string) []string {
+	if prefix == "" {
+		return nil
+	}
+	var out []string
+	upper := strings.ToUpper(prefix)
+	for _, kw := range keywords {
+		if strings.HasPrefix(kw, upper) {
+			out = append(out, kw)
+		}
+	}
+	for _, n := range s.names {
+		if strings.HasPrefix(n, prefix) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
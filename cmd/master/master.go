@@ -0,0 +1,8175 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"runtime"
+	"runtime/debug"
+	"unicode"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+	"github.com/omar-karam1/distributed-db-go/internal/changefeed"
+	"github.com/omar-karam1/distributed-db-go/internal/crdt"
+	"github.com/omar-karam1/distributed-db-go/internal/crypto"
+	"github.com/omar-karam1/distributed-db-go/internal/lifecycle"
+	"github.com/omar-karam1/distributed-db-go/internal/merkle"
+	"github.com/omar-karam1/distributed-db-go/internal/sqlparse"
+	"github.com/omar-karam1/distributed-db-go/internal/telemetry"
+	"github.com/omar-karam1/distributed-db-go/internal/tlsutil"
+	"github.com/omar-karam1/distributed-db-go/internal/wire"
+)
+
+// ===================== DATA STRUCTURES =====================
+
+type Table struct {
+	Name    string              `json:"name"`
+	Columns []string            `json:"columns"`
+	Types   map[string]string   `json:"types,omitempty"` // CRDT type per column, see CRDT COLUMNS
+	Records []map[string]string `json:"records"`
+	Txns    []string            `json:"txns,omitempty"` // recent transactions applied, see applyTxn
+	// Versions holds the HLC state of each row by key with -peers.
+	Versions map[string]*rowVersion `json:"versions,omitempty"`
+	// ReplLSN is the LSN of the last change sent to the slaves, see
+	// REPLICA READS.
+	ReplLSN uint64     `json:"repl_lsn,omitempty"`
+	mu      sync.Mutex `json:"-"`
+}
+
+type Database struct {
+	Name   string            `json:"name"`
+	Tables map[string]*Table `json:"tables"`
+}
+
+type RequestData struct {
+	Database   string             `json:"database"`
+	Table      string             `json:"table"`
+	Columns    []string           `json:"columns"`
+	Types      map[string]string  `json:"types,omitempty"`
+	Record     map[string]string  `json:"record"`
+	UpdateData map[string]string  `json:"update_data"`
+	Ops        map[string]crdt.Op `json:"ops,omitempty"`
+	Conditions map[string]string  `json:"conditions"`
+	LSN        uint64             `json:"lsn,omitempty"`
+	PrevLSN    uint64             `json:"prev_lsn,omitempty"`
+	RequestID  string             `json:"-"` // sent in X-Request-Id
+	Span       *telemetry.Span    `json:"-"` // parent of the spans traced while applying the request
+	Routed     bool               `json:"-"` // already routed to this master's shard
+}
+
+var (
+	databases     = make(map[string]*Database)
+	dbMu          sync.Mutex
+	dataFile      = "data.json"
+	changesFile   = "changes.log"
+	pgAddr        = "" // PostgreSQL front-end address, disabled when empty
+	pgMaxMessage  = 16 << 20 // largest PostgreSQL message accepted after authentication
+	respAddr      = "" // Redis protocol address, disabled when empty
+	grpcAddr      = "" // gRPC address, disabled when empty
+	kvDatabase    = "kv"
+	kvTable       = "kv"
+	cdcConfigFile = "" // CDC sink config, disabled when empty
+	authEnabled   = false
+	authFile      = "auth.json"
+	auditFile     = "audit.log" // disabled when empty
+	nodeSecret    = ""                 // signs replication requests
+	insecureNodes = false              // accept unauthenticated requests from other masters
+	serverTLS     *tls.Config          // client listeners, plain text when nil
+	nodeClient    = http.DefaultClient // replication requests to slaves
+	nodeTLS       = false              // slaves are reached over https
+	slaveNodes    = []string{
+		"http://localhost:8001/replicate_insert",
+		"http://localhost:8002/replicate_insert",
+	}
+)
+
+// ===================== INIT =====================
+
+func initDatabaseStorage() {
+	if _, err := os.Stat(dataFile); err == nil {
+		content, err := keyRing.ReadFile(dataFile)
+		if err != nil {
+			telemetry.Fatal("Loading data file", "file", dataFile, "err", err)
+		}
+		json.Unmarshal(content, &databases)
+		slog.Info("Loaded data", "file", dataFile)
+		return
+	}
+	slog.Info("No existing data file found", "file", dataFile)
+	databases = make(map[string]*Database)
+}
+
+// saveDataToFile saves the data file. It takes dbMu, so the caller must
+// hold neither dbMu nor a table lock.
+func saveDataToFile() {
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	dataHealth.Report(err)
+	if err != nil {
+		slog.Error("Saving data file", "file", dataFile, "err", err)
+	}
+}
+
+// saveData writes the data file. The caller holds dbMu.
+func saveData() error {
+	defer metrics.Since("ddb_snapshot_write_duration_seconds", "", time.Now())
+	content, _ := json.MarshalIndent(databases, "", "  ")
+	return keyRing.WriteFile(dataFile, content, 0644)
+}
+
+// ===================== MAIN =====================
+
+func main() {
+	flag.StringVar(&pgAddr, "pg-addr", pgAddr, "serve the PostgreSQL protocol on this address, e.g. :5432")
+	flag.IntVar(&pgMaxMessage, "pg-max-message", pgMaxMessage, "largest PostgreSQL protocol message in bytes accepted from an authenticated client")
+	flag.StringVar(&respAddr, "resp-addr", respAddr, "serve the Redis protocol on this address, e.g. :6379")
+	flag.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "serve the gRPC API on this address, e.g. :9000")
+	flag.StringVar(&kvDatabase, "kv-database", kvDatabase, "database holding the Redis key-value table")
+	flag.StringVar(&kvTable, "kv-table", kvTable, "table holding Redis keys")
+	flag.StringVar(&cdcConfigFile, "cdc-config", cdcConfigFile, "export changes to the sinks in this JSON `file`")
+	flag.BoolVar(&authEnabled, "auth", authEnabled, "require API keys or tokens on every endpoint")
+	flag.StringVar(&authFile, "auth-file", authFile, "credential store used with -auth")
+	jwtSecret := flag.String("jwt-secret", "", "token signing secret, or set $DDB_JWT_SECRET; generated and kept in the auth file when empty")
+	flag.StringVar(&nodeSecret, "node-secret", "", "shared secret used to sign replication requests to slaves, or set $DDB_NODE_SECRET")
+	flag.BoolVar(&insecureNodes, "insecure-replication", false, "accept requests from other masters without -node-secret or -node-ca, for local testing only")
+	tlsCert := flag.String("tls-cert", "", "serve HTTP, PostgreSQL, Redis and gRPC over TLS with this certificate")
+	tlsKey := flag.String("tls-key", "", "private key for -tls-cert")
+	nodeCA := flag.String("node-ca", "", "CA that signs slave certificates; replicate to slaves over mutual TLS")
+	nodeCert := flag.String("node-cert", "", "client certificate presented to slaves (defaults to -tls-cert)")
+	nodeKey := flag.String("node-key", "", "private key for -node-cert (defaults to -tls-key)")
+	flag.StringVar(&auditFile, "audit-file", auditFile, "append-only audit log of every change, disabled when empty")
+	keyFile := flag.String("encryption-key-file", "", "encrypt data and change log files with the keys in this `file`, or set $DDB_ENCRYPTION_KEY")
+	logFormat := flag.String("log-format", "text", "log as logfmt text or json")
+	logLevel := flag.String("log-level", "info", "minimum log `level`: debug, info, warn or error")
+	logOutput := flag.String("log-output", "stderr", "comma separated log destinations: stderr, stdout or file paths")
+	traceOutput := flag.String("trace-output", "", "export trace spans to this file, or to an OTLP/HTTP collector URL such as http://localhost:4318/v1/traces")
+	traceSample := flag.Float64("trace-sample", 1, "fraction of new traces to record")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGTERM, how long to wait for requests and replication in progress")
+	addr := flag.String("addr", ":8000", "serve HTTP on this address")
+	slaves := flag.String("slaves", strings.Join(slaveNodes, ","), "comma separated slave URLs, e.g. http://localhost:8001")
+	shardMapFile := flag.String("shard-map", "", "shard tables across master groups with the map in this `file`, kept up to date by the masters")
+	shardID := flag.String("shard-id", "", "this master's shard in -shard-map")
+	txnLogFile := flag.String("txn-log", "transactions.log", "log of transactions in progress, for recovery after a crash")
+	txnTimeout := flag.Duration("txn-timeout", 10*time.Second, "abort a transaction when its shards have not all prepared within this time")
+	antiEntropyInterval := flag.Duration("anti-entropy-interval", 10*time.Minute, "compare the slaves' tables with the master's this often, 0 to only check on demand")
+	antiEntropyRepair := flag.Bool("anti-entropy-repair", false, "repair the rows that differ in background checks")
+	peers := flag.String("peers", "", "comma separated URLs of the other masters; every master accepts writes and replicates them to the others")
+	nodeID := flag.String("node-id", "", "this master's name in HLC timestamps, required with -peers")
+	conflictResolution := flag.String("conflict-resolution", "lww", "with -peers, resolve concurrent writes by lww (last writer wins), merge (per column) or custom")
+	conflictResolver := flag.String("conflict-resolver", "", "command run for each conflict with -conflict-resolution custom")
+	conflictLog := flag.String("conflict-log", "conflicts.log", "log of resolved conflicts with -peers, disabled when empty")
+	flag.Parse()
+	if err := telemetry.SetupLogging(*logFormat, *logLevel, *logOutput); err != nil {
+		telemetry.Fatal("Configuring logging", "err", err)
+	}
+	slaveNodes = nil
+	for _, slave := range strings.Split(*slaves, ",") {
+		if slave = strings.TrimSpace(slave); slave != "" {
+			slaveNodes = append(slaveNodes, slave)
+		}
+	}
+	if err := telemetry.StartTracing(*traceOutput, "ddb-master", *traceSample); err != nil {
+		telemetry.Fatal("Starting tracing", "err", err)
+	}
+	if *jwtSecret == "" {
+		*jwtSecret = os.Getenv("DDB_JWT_SECRET")
+	}
+	if nodeSecret == "" {
+		nodeSecret = os.Getenv("DDB_NODE_SECRET")
+	}
+
+	if *tlsCert != "" {
+		cfg, err := tlsutil.NewServerConfig(*tlsCert, *tlsKey, *nodeCA)
+		if err != nil {
+			telemetry.Fatal("Loading TLS certificate", "err", err)
+		}
+		serverTLS = cfg
+	}
+	if *nodeCA != "" {
+		if *nodeCert == "" {
+			*nodeCert, *nodeKey = *tlsCert, *tlsKey
+		}
+		client, err := newNodeClient(*nodeCA, *nodeCert, *nodeKey)
+		if err != nil {
+			telemetry.Fatal("Loading node TLS certificate", "err", err)
+		}
+		nodeClient, nodeTLS = client, true
+	}
+	// Without a way to authenticate other masters, the node endpoints would
+	// let anyone write around -auth, access control and the audit log.
+	if !nodeAuthConfigured() && (authEnabled || *shardMapFile != "" || *peers != "") {
+		if !insecureNodes {
+			telemetry.Fatal("-auth, -shard-map and -peers need -node-secret, or -node-ca with -tls-cert, to authenticate other masters; -insecure-replication skips this for local testing")
+		}
+		slog.Warn("Accepting unauthenticated requests from other masters")
+	}
+
+	if err := keyRing.Load(*keyFile); err != nil {
+		telemetry.Fatal("Loading encryption keys", "err", err)
+	}
+	keyRing.Watch(reencrypt)
+
+	if *shardMapFile != "" {
+		if *shardID == "" {
+			telemetry.Fatal("-shard-map needs -shard-id")
+		}
+		if err := loadShards(*shardMapFile, *shardID); err != nil {
+			telemetry.Fatal("Loading shard map", "err", err)
+		}
+		// Masters that missed a new map catch up here.
+		go func() {
+			for range time.Tick(30 * time.Second) {
+				pushShardMaps(nil)
+			}
+		}()
+	}
+
+	slog.Info("Master node starting", "addr", *addr)
+	initDatabaseStorage()
+	feed.Open(changesFile)
+	if err := txns.open(*txnLogFile, *txnTimeout); err != nil {
+		telemetry.Fatal("Opening transaction log", "file", *txnLogFile, "err", err)
+	}
+	if *peers != "" {
+		if shards.enabled() {
+			telemetry.Fatal("-peers cannot be used with -shard-map")
+		}
+		var list []string
+		for _, peer := range strings.Split(*peers, ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				list = append(list, peer)
+			}
+		}
+		if err := leaders.start(*nodeID, list, *conflictResolution, *conflictResolver, *conflictLog); err != nil {
+			telemetry.Fatal("Starting multi-master replication", "err", err)
+		}
+	}
+	go func() {
+		for range time.Tick(2 * time.Second) {
+			resolveTxns()
+		}
+	}()
+	if *antiEntropyInterval > 0 {
+		go runAntiEntropy(*antiEntropyInterval, *antiEntropyRepair)
+	}
+	if auditFile != "" {
+		audit.open(auditFile)
+	}
+	if keyRing.Stale() {
+		go keyRing.Reencrypt(reencrypt)
+	}
+	if authEnabled {
+		apiKeys.open(authFile, *jwtSecret)
+		// Slaves that were down when the access list changed catch up here.
+		go func() {
+			for range time.Tick(30 * time.Second) {
+				replicateACL(auth.CurrentACL())
+			}
+		}()
+	}
+	if cdcConfigFile != "" {
+		startCDC(cdcConfigFile)
+	}
+
+	if pgAddr != "" {
+		go startPostgresListener(pgAddr)
+	}
+	if respAddr != "" {
+		go startRespListener(respAddr)
+	}
+	if grpcAddr != "" {
+		go startGRPCListener(grpcAddr)
+	}
+
+	// Serve HTML static files
+	fs := http.FileServer(http.Dir("master"))
+	http.Handle("/", fs)
+
+	// API endpoints
+	http.HandleFunc("/create_database", requireAuth(handleCreateDatabase))
+	http.HandleFunc("/create_table", requireAuth(handleCreateTable))
+	http.HandleFunc("/insert", requireAuth(handleInsert))
+	http.HandleFunc("/select", requireAuth(handleSelect))
+	http.HandleFunc("/update", requireAuth(handleUpdate))
+	http.HandleFunc("/delete", requireAuth(handleDelete))
+	http.HandleFunc("/drop_table", requireAuth(handleDropTable))
+	http.HandleFunc("/drop_database", requireAuth(handleDropDatabase))
+	http.HandleFunc("/list_databases", requireAuth(handleListDatabases))
+	http.HandleFunc("/list_tables", requireAuth(handleListTables))
+	http.HandleFunc("/describe_table", requireAuth(handleDescribeTable))
+	http.HandleFunc("/changes", requireAuth(feed.HandleChanges))
+	http.HandleFunc("/cdc", requireAdmin(handleCDCStatus))
+	http.HandleFunc("/encryption", requireAdmin(handleEncryption))
+	http.HandleFunc("/audit", requireAdmin(handleAudit))
+	http.HandleFunc("/audit/verify", requireAdmin(handleAuditVerify))
+	http.HandleFunc("/metrics", requireAdmin(handleMetrics))
+	http.HandleFunc("/healthz", node.HandleHealthz)
+	http.HandleFunc("/readyz", node.HandleReadyz)
+	http.HandleFunc("/auth/token", requireAuth(handleAuthToken))
+	http.HandleFunc("/auth/keys", requireAdmin(handleAuthKeys))
+	http.HandleFunc("/auth/grant", requireAuth(handleAuthGrant))
+	http.HandleFunc("/auth/revoke", requireAuth(handleAuthGrant))
+	http.HandleFunc("/auth/grants", requireAdmin(handleAuthGrants))
+	http.HandleFunc("/auth/whoami", requireAuth(handleWhoAmI))
+	http.HandleFunc("/shards", requireAdmin(handleShards))
+	http.HandleFunc("/shards/rebalance", requireAdmin(handleRebalance))
+	http.HandleFunc("/shard/migrate", requireNode(handleShardMigrate))
+	http.HandleFunc("/shard/stage", requireNode(handleShardStage))
+	http.HandleFunc("/shard/commit", requireNode(handleShardCommit))
+	http.HandleFunc("/transaction", requireAuth(handleTransaction))
+	http.HandleFunc("/transactions", requireAdmin(handleTransactions))
+	http.HandleFunc("/consistency", requireAdmin(handleConsistency))
+	http.HandleFunc("/peers", requireAdmin(handlePeers))
+	http.HandleFunc("/conflicts", requireAdmin(handleConflicts))
+	http.HandleFunc("/peer/apply", requireNode(handlePeerApply))
+	http.HandleFunc("/txn/prepare", requireNode(handleTxnPrepare))
+	http.HandleFunc("/txn/commit", requireNode(handleTxnCommit))
+	http.HandleFunc("/txn/abort", requireNode(handleTxnAbort))
+	http.HandleFunc("/txn/status", requireNode(handleTxnStatus))
+	http.HandleFunc("/shard/exec", requireNode(handleShardExec))
+	http.HandleFunc("/shard/map", requireNode(handleShardMap))
+
+	// Open browser automatically
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		host := *addr
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		if serverTLS != nil {
+			openBrowser("https://" + host)
+		} else {
+			openBrowser("http://" + host)
+		}
+	}()
+
+	srv := &http.Server{Addr: *addr, Handler: telemetry.TraceRequests(telemetry.LogRequests(metrics.Instrument(http.DefaultServeMux))), TLSConfig: serverTLS}
+	go node.Serve(srv)
+	node.Ready()
+	waitForShutdown(*shutdownTimeout)
+}
+
+func openBrowser(url string) {
+	var cmd string
+	var args []string
+
+	switch os := runtime.GOOS; os {
+	case "windows":
+		cmd = "rundll32"
+		args = []string{"url.dll,FileProtocolHandler", url}
+	case "darwin":
+		cmd = "open"
+		args = []string{url}
+	default: // linux and others
+		cmd = "xdg-open"
+		args = []string{url}
+	}
+	exec.Command(cmd, args...).Start()
+}
+
+// ===================== OPERATIONS =====================
+
+var (
+	errDatabaseNotFound = errors.New("Database not found")
+	errTableNotFound    = errors.New("Table not found")
+	errDatabaseExists   = errors.New("Database already exists")
+	errTableExists      = errors.New("Table already exists")
+)
+
+// httpStatus maps an operation error to the status the handlers return.
+func httpStatus(err error) int {
+	if errors.Is(err, errShardUnavailable) || errors.Is(err, errStaleShardMap) {
+		return http.StatusServiceUnavailable
+	}
+	switch err {
+	case errTableInTransaction, errDuplicateKey:
+		return http.StatusConflict
+	case errDatabaseNotFound, errTableNotFound:
+		return http.StatusNotFound
+	case errDatabaseExists, errTableExists:
+		return http.StatusConflict
+	case auth.ErrUnauthenticated, auth.ErrBadCredentials, auth.ErrTokenExpired:
+		return http.StatusUnauthorized
+	case auth.ErrForbidden:
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+func lookupTable(dbName, tableName string) (*Table, error) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	db, ok := databases[dbName]
+	if !ok {
+		return nil, errDatabaseNotFound
+	}
+	table, ok := db.Tables[tableName]
+	if !ok {
+		return nil, errTableNotFound
+	}
+	return table, nil
+}
+
+func createDatabase(name string) error {
+	if shards.enabled() {
+		_, err := routeShards(shardExec{Op: "create_database", Request: RequestData{Database: name}})
+		return err
+	}
+	return createLocalDatabase(name)
+}
+
+// createLocalDatabase creates the database on this master only.
+func createLocalDatabase(name string) error {
+	dbMu.Lock()
+	if _, exists := databases[name]; exists {
+		dbMu.Unlock()
+		return errDatabaseExists
+	}
+
+	databases[name] = &Database{
+		Name:   name,
+		Tables: make(map[string]*Table),
+	}
+	leaders.schema("create_database", name, "", nil, nil)
+	dbMu.Unlock()
+	saveDataToFile()
+	return nil
+}
+
+func createTable(req RequestData) error {
+	if shards.enabled() && !req.Routed {
+		_, err := routeShards(shardExec{Op: "create_table", Request: req})
+		return err
+	}
+	if leaders.enabled() && len(req.Columns) == 0 {
+		return errMissingKey
+	}
+	if err := checkColumnTypes(req.Columns, req.Types); err != nil {
+		return err
+	}
+
+	dbMu.Lock()
+	db, ok := databases[req.Database]
+	if !ok {
+		dbMu.Unlock()
+		return errDatabaseNotFound
+	}
+	if _, exists := db.Tables[req.Table]; exists {
+		dbMu.Unlock()
+		return errTableExists
+	}
+	db.Tables[req.Table] = &Table{
+		Name:    req.Table,
+		Columns: req.Columns,
+		Types:   req.Types,
+		Records: []map[string]string{},
+	}
+	leaders.schema("create_table", req.Database, req.Table, req.Columns, req.Types)
+	dbMu.Unlock()
+	saveDataToFile()
+	return nil
+}
+
+func insertRecord(req RequestData) error {
+	if shards.enabled() && !req.Routed {
+		_, err := routeShards(shardExec{Op: "insert", Request: req})
+		return err
+	}
+	table, err := lookupTable(req.Database, req.Table)
+	if err != nil {
+		return err
+	}
+
+	wait := req.Span.Child("lock_wait")
+	table.mu.Lock()
+	wait.End()
+	records, err := leaders.prepareInserts(table, []map[string]string{req.Record})
+	if err == nil {
+		err = checkInsertColumns(table, records)
+	}
+	if err != nil {
+		table.mu.Unlock()
+		return err
+	}
+	req.Record = records[0]
+	apply := req.Span.Child("apply")
+	delta := insertColumns(table, req.Record)
+	table.Records = append(table.Records, req.Record)
+	events := []changefeed.Event{{Op: "insert", Database: req.Database, Table: req.Table, After: maps.Clone(req.Record), CRDT: delta}}
+	req.LSN = feed.Publish(events)
+	req.PrevLSN = table.chainLSN(req.LSN)
+	leaders.local(table, events)
+	apply.Set("lsn", req.LSN)
+	apply.End()
+	table.mu.Unlock()
+
+	persist := req.Span.Child("persist")
+	saveDataToFile()
+	persist.End()
+	replicateToSlaves(req, "replicate_insert")
+	return nil
+}
+
+// insertRecords appends several records with a single save and returns how
+// many were inserted.
+func insertRecords(req RequestData, records []map[string]string) (int, error) {
+	if shards.enabled() && !req.Routed {
+		res, err := routeShards(shardExec{Op: "insert_batch", Request: req, Records: records})
+		return res.Count, err
+	}
+	table, err := lookupTable(req.Database, req.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := req.Span.Child("lock_wait")
+	table.mu.Lock()
+	wait.End()
+	if records, err = leaders.prepareInserts(table, records); err == nil {
+		err = checkInsertColumns(table, records)
+	}
+	if err != nil {
+		table.mu.Unlock()
+		return 0, err
+	}
+	apply := req.Span.Child("apply")
+	reqs := make([]RequestData, len(records))
+	for i, record := range records {
+		delta := insertColumns(table, record)
+		table.Records = append(table.Records, record)
+		reqs[i] = req
+		reqs[i].Record = record
+		events := []changefeed.Event{{Op: "insert", Database: req.Database, Table: req.Table, After: maps.Clone(record), CRDT: delta}}
+		reqs[i].LSN = feed.Publish(events)
+		reqs[i].PrevLSN = table.chainLSN(reqs[i].LSN)
+		leaders.local(table, events)
+	}
+	apply.Set("rows", len(records))
+	apply.End()
+	table.mu.Unlock()
+
+	persist := req.Span.Child("persist")
+	saveDataToFile()
+	persist.End()
+	for _, r := range reqs {
+		replicateToSlaves(r, "replicate_insert")
+	}
+	return len(records), nil
+}
+
+// selectRecords returns up to limit records (all when limit <= 0) matching
+// conditions, along with the table's declared columns.
+func selectRecords(dbName, tableName string, conditions map[string]string, limit int) ([]map[string]string, []string, error) {
+	if shards.enabled() {
+		res, err := routeShards(shardExec{Op: "select", Request: RequestData{Database: dbName, Table: tableName, Conditions: conditions}, Limit: limit})
+		if limit > 0 && len(res.Records) > limit {
+			res.Records = res.Records[:limit]
+		}
+		return res.Records, res.Columns, err
+	}
+	return selectLocalRecords(dbName, tableName, conditions, limit)
+}
+
+// selectLocalRecords reads the records stored on this master.
+func selectLocalRecords(dbName, tableName string, conditions map[string]string, limit int) ([]map[string]string, []string, error) {
+	table, err := lookupTable(dbName, tableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	records := []map[string]string{}
+	for _, record := range table.Records {
+		if !changefeed.MatchesConditions(record, conditions) {
+			continue
+		}
+		records = append(records, maps.Clone(record))
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records, table.Columns, nil
+}
+
+func updateRecords(req RequestData) (int, error) {
+	if shards.enabled() && !req.Routed {
+		res, err := routeShards(shardExec{Op: "update", Request: req})
+		return res.Count, err
+	}
+	table, err := lookupTable(req.Database, req.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := req.Span.Child("lock_wait")
+	table.mu.Lock()
+	wait.End()
+	err = leaders.checkUpdate(table, req.UpdateData)
+	if err == nil {
+		err = checkColumnWrites(table, req.UpdateData, req.Ops)
+	}
+	if err != nil {
+		table.mu.Unlock()
+		return 0, err
+	}
+	apply := req.Span.Child("apply")
+	updated := 0
+	var events []changefeed.Event
+	ops := updateOps(table, req.UpdateData, req.Ops)
+	for _, record := range table.Records {
+		if changefeed.MatchesConditions(record, req.Conditions) {
+			before := maps.Clone(record)
+			for k, v := range req.UpdateData {
+				record[k] = v
+			}
+			delta := applyColumnOps(table, record, ops)
+			events = append(events, changefeed.Event{Op: "update", Database: req.Database, Table: req.Table, Before: before, After: maps.Clone(record), CRDT: delta})
+			updated++
+		}
+	}
+	req.LSN = feed.Publish(events)
+	req.PrevLSN = table.chainLSN(req.LSN)
+	leaders.local(table, events)
+	apply.Set("rows", updated)
+	apply.End()
+	table.mu.Unlock()
+
+	persist := req.Span.Child("persist")
+	saveDataToFile()
+	persist.End()
+	replicateUpdate(req)
+	return updated, nil
+}
+
+func deleteRecords(req RequestData) (int, error) {
+	if shards.enabled() && !req.Routed {
+		res, err := routeShards(shardExec{Op: "delete", Request: req})
+		return res.Count, err
+	}
+	table, err := lookupTable(req.Database, req.Table)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := req.Span.Child("lock_wait")
+	table.mu.Lock()
+	wait.End()
+	apply := req.Span.Child("apply")
+	filtered := []map[string]string{}
+	deleted := 0
+	var events []changefeed.Event
+	for _, record := range table.Records {
+		if !changefeed.MatchesConditions(record, req.Conditions) {
+			filtered = append(filtered, record)
+		} else {
+			events = append(events, changefeed.Event{Op: "delete", Database: req.Database, Table: req.Table, Before: maps.Clone(record)})
+			deleted++
+		}
+	}
+	table.Records = filtered
+	req.LSN = feed.Publish(events)
+	req.PrevLSN = table.chainLSN(req.LSN)
+	leaders.local(table, events)
+	apply.Set("rows", deleted)
+	apply.End()
+	table.mu.Unlock()
+
+	persist := req.Span.Child("persist")
+	saveDataToFile()
+	persist.End()
+	replicateDelete(req)
+	return deleted, nil
+}
+
+func dropTable(req RequestData) error {
+	if shards.enabled() && !req.Routed {
+		_, err := routeShards(shardExec{Op: "drop_table", Request: req})
+		return err
+	}
+	dbMu.Lock()
+	db, ok := databases[req.Database]
+	if !ok {
+		dbMu.Unlock()
+		return errDatabaseNotFound
+	}
+	if txns.pinned(req.Database, req.Table) {
+		dbMu.Unlock()
+		return errTableInTransaction
+	}
+	delete(db.Tables, req.Table)
+	leaders.schema("drop_table", req.Database, req.Table, nil, nil)
+	dbMu.Unlock()
+	saveDataToFile()
+	return nil
+}
+
+func dropDatabase(name string) error {
+	if shards.enabled() {
+		_, err := routeShards(shardExec{Op: "drop_database", Request: RequestData{Database: name}})
+		return err
+	}
+	return dropLocalDatabase(name)
+}
+
+// dropLocalDatabase drops the database on this master only. A database
+// with a table in a prepared transaction is kept.
+func dropLocalDatabase(name string) error {
+	dbMu.Lock()
+	if txns.pinned(name, "") {
+		dbMu.Unlock()
+		return errTableInTransaction
+	}
+	delete(databases, name)
+	leaders.schema("drop_database", name, "", nil, nil)
+	dbMu.Unlock()
+	saveDataToFile()
+	return nil
+}
+
+// ===================== HANDLERS =====================
+
+func handleCreateDatabase(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	if !checkAccess(w, r, auth.PrivDDL, req.Database, "") {
+		return
+	}
+
+	err := createDatabase(req.Database)
+	audit.record(httpActor(r), auditEntry{Op: "create_database", Database: req.Database}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte("Database created successfully."))
+}
+
+func handleCreateTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	if !checkAccess(w, r, auth.PrivDDL, req.Database, req.Table) {
+		return
+	}
+
+	err := createTable(req)
+	audit.record(httpActor(r), auditEntry{Op: "create_table", Database: req.Database, Table: req.Table}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte("Table created successfully."))
+}
+
+func handleInsert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decode := telemetry.RequestSpan(r).Child("decode")
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	decode.End()
+	req.RequestID, req.Span = telemetry.RequestID(r), telemetry.RequestSpan(r)
+	if !checkAccess(w, r, auth.PrivWrite, req.Database, req.Table) {
+		return
+	}
+
+	err := insertRecord(req)
+	audit.record(httpActor(r), auditEntry{Op: "insert", Database: req.Database, Table: req.Table, Rows: 1}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	setLSNToken(w)
+	w.Write([]byte("Record inserted successfully."))
+}
+
+func handleSelect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dbName := r.URL.Query().Get("database")
+	tableName := r.URL.Query().Get("table")
+	limit := r.URL.Query().Get("limit")
+	if !checkAccess(w, r, auth.PrivRead, dbName, tableName) {
+		return
+	}
+
+	// Convert limit to integer
+	limitNum := 0
+	if limit != "" {
+		fmt.Sscanf(limit, "%d", &limitNum)
+	}
+
+	bound, ok, err := parseReadBound(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if ok {
+		records, replica, found := readFromReplica(r, bound, dbName, tableName)
+		if !found {
+			replica = "master"
+		}
+		w.Header().Set(servedByHeader, replica)
+		metrics.Add("ddb_replica_reads_total", telemetry.Labels("served_by", replica), 1)
+		if found {
+			if limitNum > 0 && len(records) > limitNum {
+				records = records[:limitNum]
+			}
+			json.NewEncoder(w).Encode(records)
+			return
+		}
+	}
+
+	records, _, err := selectRecords(dbName, tableName, nil, limitNum)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(records)
+}
+
+func handleDescribeTable(w http.ResponseWriter, r *http.Request) {
+	dbName := r.URL.Query().Get("database")
+	tableName := r.URL.Query().Get("table")
+	if !checkAccess(w, r, auth.PrivRead, dbName, tableName) {
+		return
+	}
+	
+	table, err := lookupTable(dbName, tableName)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	
+	response := struct {
+		Columns []string          `json:"columns"`
+		Types   map[string]string `json:"types,omitempty"`
+	}{
+		Columns: table.Columns,
+		Types:   table.Types,
+	}
+	
+	json.NewEncoder(w).Encode(response)
+}
+
+func handleUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decode := telemetry.RequestSpan(r).Child("decode")
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	decode.End()
+	req.RequestID, req.Span = telemetry.RequestID(r), telemetry.RequestSpan(r)
+	if !checkAccess(w, r, auth.PrivWrite, req.Database, req.Table) {
+		return
+	}
+
+	updated, err := updateRecords(req)
+	audit.record(httpActor(r), auditEntry{Op: "update", Database: req.Database, Table: req.Table, Rows: updated}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	setLSNToken(w)
+	w.Write([]byte(fmt.Sprintf("Updated %d records.", updated)))
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	decode := telemetry.RequestSpan(r).Child("decode")
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	decode.End()
+	req.RequestID, req.Span = telemetry.RequestID(r), telemetry.RequestSpan(r)
+	if !checkAccess(w, r, auth.PrivWrite, req.Database, req.Table) {
+		return
+	}
+
+	deleted, err := deleteRecords(req)
+	audit.record(httpActor(r), auditEntry{Op: "delete", Database: req.Database, Table: req.Table, Rows: deleted}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	setLSNToken(w)
+	w.Write([]byte(fmt.Sprintf("Deleted %d records.", deleted)))
+}
+
+func handleDropTable(w http.ResponseWriter, r *http.Request) {
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	if !checkAccess(w, r, auth.PrivDDL, req.Database, req.Table) {
+		return
+	}
+
+	err := dropTable(req)
+	audit.record(httpActor(r), auditEntry{Op: "drop_table", Database: req.Database, Table: req.Table}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("Table %s dropped from %s", req.Table, req.Database)))
+}
+
+func handleDropDatabase(w http.ResponseWriter, r *http.Request) {
+	var req RequestData
+	json.NewDecoder(r.Body).Decode(&req)
+	if !checkAccess(w, r, auth.PrivDDL, req.Database, "") {
+		return
+	}
+
+	err := dropDatabase(req.Database)
+	audit.record(httpActor(r), auditEntry{Op: "drop_database", Database: req.Database}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Write([]byte(fmt.Sprintf("Database %s dropped", req.Database)))
+}
+
+func handleListDatabases(w http.ResponseWriter, r *http.Request) {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+
+	p := auth.RequestPrincipal(r)
+	dbNames := []string{}
+	for name := range databases {
+		if auth.CanSee(p, name, "") {
+			dbNames = append(dbNames, name)
+		}
+	}
+	json.NewEncoder(w).Encode(dbNames)
+}
+
+func handleListTables(w http.ResponseWriter, r *http.Request) {
+	dbName := r.URL.Query().Get("database")
+	p := auth.RequestPrincipal(r)
+	if !auth.CanSee(p, dbName, "") {
+		http.Error(w, auth.ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	
+	db, ok := databases[dbName]
+	if !ok {
+		http.Error(w, "Database not found", http.StatusNotFound)
+		return
+	}
+	
+	tableNames := []string{}
+	for name := range db.Tables {
+		if auth.CanSee(p, dbName, name) {
+			tableNames = append(tableNames, name)
+		}
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tableNames)
+}
+
+// ===================== REPLICATION =====================
+
+func replicateToSlaves(req RequestData, endpoint string) {
+	if req.RequestID == "" {
+		req.RequestID = telemetry.NewRequestID() // from SQL, Redis or an internal write
+	}
+	for _, slave := range slaveNodes {
+		replica := strings.TrimSuffix(slaveURL(slave, ""), "/")
+		replicationSent(replica, req.LSN)
+		replicationWG.Add(1)
+		go func(url string) {
+			defer replicationWG.Done()
+			jsonData, _ := json.Marshal(req)
+			hreq, err := http.NewRequest(http.MethodPost, slaveURL(url, endpoint), bytes.NewReader(jsonData))
+			if err != nil {
+				return
+			}
+			hreq.Header.Set("Content-Type", "application/json")
+			hreq.Header.Set(telemetry.RequestIDHeader, req.RequestID)
+			signNodeRequest(hreq, jsonData)
+			trace := req.Span.ClientChild("replicate " + replica)
+			trace.Set("replica", replica)
+			trace.Set("endpoint", endpoint)
+			trace.Set("lsn", req.LSN)
+			if tp := trace.Traceparent(); tp != "" {
+				hreq.Header.Set(telemetry.TraceparentHeader, tp)
+			}
+			start := time.Now()
+			resp, err := nodeClient.Do(hreq)
+			result := "ok"
+			if err != nil {
+				result = "error"
+				slog.Warn("Replication failed", "request_id", req.RequestID, "replica", replica, "endpoint", endpoint, "lsn", req.LSN, "err", err)
+			} else {
+				if resp.StatusCode != http.StatusOK {
+					result = "rejected"
+					err = errors.New(resp.Status)
+					slog.Warn("Replication rejected", "request_id", req.RequestID, "replica", replica, "endpoint", endpoint, "lsn", req.LSN, "status", resp.Status)
+				}
+				resp.Body.Close()
+			}
+			slog.Debug("Replicated", "request_id", req.RequestID, "replica", replica, "endpoint", endpoint, "lsn", req.LSN, "result", result)
+			replicationDone(replica, req.LSN, err)
+			trace.Fail(err)
+			trace.Set("result", result)
+			trace.End()
+			metrics.Add("ddb_replication_requests_total", telemetry.Labels("replica", replica, "result", result), 1)
+			metrics.Since("ddb_replication_duration_seconds", telemetry.Labels("replica", replica), start)
+		}(slave)
+	}
+}
+
+// replicaState is what /metrics reports about one slave.
+type replicaState struct {
+	inflight int
+	sentLSN  uint64 // highest LSN sent
+	ackedLSN uint64 // highest LSN the slave accepted
+	lastAck  time.Time
+	lastErr  string // of the last request, empty when it succeeded
+
+	// pending counts the requests in flight per LSN and when the first
+	// was sent, for replica reads with bounded staleness.
+	pending  map[uint64]pendingLSN
+	diverged bool // a request failed, so the slave may lack a change
+	failedAt time.Time
+}
+
+type pendingLSN struct {
+	n    int
+	sent time.Time
+}
+
+var (
+	replicaMu     sync.Mutex
+	replicaStates = map[string]*replicaState{}
+	replicationWG sync.WaitGroup // requests in flight, waited for at shutdown
+)
+
+func replicationSent(replica string, lsn uint64) {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	st := replicaStates[replica]
+	if st == nil {
+		st = &replicaState{pending: map[uint64]pendingLSN{}}
+		replicaStates[replica] = st
+	}
+	st.inflight++
+	if lsn != 0 {
+		p := st.pending[lsn]
+		if p.n == 0 {
+			p.sent = time.Now()
+		}
+		p.n++
+		st.pending[lsn] = p
+	}
+	if lsn > st.sentLSN {
+		st.sentLSN = lsn
+	}
+}
+
+func replicationDone(replica string, lsn uint64, err error) {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	st := replicaStates[replica]
+	st.inflight--
+	if p, ok := st.pending[lsn]; ok {
+		if p.n--; p.n == 0 {
+			delete(st.pending, lsn)
+		} else {
+			st.pending[lsn] = p
+		}
+	}
+	if err != nil {
+		st.lastErr = err.Error()
+		st.diverged, st.failedAt = true, time.Now()
+		return
+	}
+	st.lastErr = ""
+	st.lastAck = time.Now()
+	if lsn > st.ackedLSN {
+		st.ackedLSN = lsn
+	}
+}
+
+// collectReplicationMetrics reports queue depth and lag per slave. Lag
+// counts changes sent since the last one the slave accepted, so it only
+// covers changes made since the master started.
+func collectReplicationMetrics() {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	for replica, st := range replicaStates {
+		labels := telemetry.Labels("replica", replica)
+		metrics.Set("ddb_replication_queue_depth", labels, float64(st.inflight))
+		lag := uint64(0)
+		if st.sentLSN > st.ackedLSN {
+			lag = st.sentLSN - st.ackedLSN
+		}
+		metrics.Set("ddb_replication_lag_lsn", labels, float64(lag))
+		if !st.lastAck.IsZero() {
+			metrics.Set("ddb_replication_last_ack_timestamp_seconds", labels, float64(st.lastAck.Unix()))
+		}
+	}
+}
+
+// slaveURL returns the URL of endpoint on a slave listed in slaveNodes,
+// using https when replication runs over mutual TLS.
+func slaveURL(slave, endpoint string) string {
+	base := strings.TrimSuffix(slave, "/replicate_insert")
+	if nodeTLS {
+		base = "https://" + strings.TrimPrefix(base, "http://")
+	}
+	return base + "/" + endpoint
+}
+
+func replicateUpdate(req RequestData) {
+	replicateToSlaves(req, "replicate_update")
+}
+
+func replicateDelete(req RequestData) {
+	replicateToSlaves(req, "replicate_delete")
+}
+
+
+// ===================== SQL =====================
+
+// The PostgreSQL front-end runs the dialect of internal/sqlparse, shared
+// with the database/sql driver, through the same operations as the HTTP
+// handlers.
+
+// sqlResult is the outcome of one statement: rows for SELECT, and the
+// PostgreSQL command tag for everything.
+type sqlResult struct {
+	columns  []string
+	rows     [][]*string
+	tag      string
+	affected int // rows changed by INSERT, UPDATE and DELETE
+}
+
+func bindSQLValue(v sqlparse.Value, args []*string) (string, bool, error) {
+	if v.Param == 0 {
+		return v.Lit, v.Null, nil
+	}
+	if v.Param > len(args) {
+		return "", false, fmt.Errorf("missing value for parameter $%d", v.Param)
+	}
+	if args[v.Param-1] == nil {
+		return "", true, nil
+	}
+	return *args[v.Param-1], false, nil
+}
+
+func bindSQLAssigns(as []sqlparse.Assignment, args []*string) (map[string]string, error) {
+	if len(as) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(as))
+	for _, a := range as {
+		v, _, err := bindSQLValue(a.Value, args)
+		if err != nil {
+			return nil, err
+		}
+		out[a.Column] = v
+	}
+	return out, nil
+}
+
+// selectColumns is the column list a SELECT returns: the explicit list, the
+// table's declared columns, or the sorted union of record keys.
+func selectColumns(st *sqlparse.Statement, declared []string, records []map[string]string) []string {
+	if st.Columns != nil {
+		return st.Columns
+	}
+	if len(declared) > 0 {
+		return declared
+	}
+	seen := map[string]bool{}
+	var cols []string
+	for _, r := range records {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				cols = append(cols, k)
+			}
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+// recordRows lays records out in column order; missing values are nil.
+func recordRows(columns []string, records []map[string]string) [][]*string {
+	rows := make([][]*string, 0, len(records))
+	for _, rec := range records {
+		row := make([]*string, len(columns))
+		for i, col := range columns {
+			if v, ok := rec[col]; ok {
+				row[i] = &v
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// sqlPrivilege returns the privilege st needs and the database and table it
+// applies to.
+func sqlPrivilege(st *sqlparse.Statement, dbName string) (string, string, string) {
+	switch st.Kind {
+	case sqlparse.Select:
+		return auth.PrivRead, dbName, st.Target
+	case sqlparse.Insert, sqlparse.Update, sqlparse.Delete:
+		return auth.PrivWrite, dbName, st.Target
+	case sqlparse.CreateDatabase, sqlparse.DropDatabase:
+		return auth.PrivDDL, st.Target, ""
+	}
+	return auth.PrivDDL, dbName, st.Target
+}
+
+// executeSQL runs st against dbName through the same operations as the
+// HTTP handlers, so writes are persisted and replicated identically.
+func executeSQL(dbName string, st *sqlparse.Statement, args []*string) (*sqlResult, error) {
+	req := RequestData{Database: dbName, Table: st.Target}
+	var err error
+	switch st.Kind {
+	case sqlparse.Select:
+		conditions, err := bindSQLAssigns(st.Where, args)
+		if err != nil {
+			return nil, err
+		}
+		records, declared, err := selectRecords(dbName, st.Target, conditions, st.Limit)
+		if err != nil {
+			return nil, err
+		}
+		res := &sqlResult{columns: selectColumns(st, declared, records)}
+		res.rows = recordRows(res.columns, records)
+		res.tag = fmt.Sprintf("SELECT %d", len(res.rows))
+		return res, nil
+	case sqlparse.Insert:
+		req.Record = map[string]string{}
+		for i, col := range st.Columns {
+			v, null, err := bindSQLValue(st.Values[i], args)
+			if err != nil {
+				return nil, err
+			}
+			if !null {
+				req.Record[col] = v
+			}
+		}
+		if err = insertRecord(req); err != nil {
+			return nil, err
+		}
+		return &sqlResult{tag: "INSERT 0 1", affected: 1}, nil
+	case sqlparse.Update:
+		if req.UpdateData, err = bindSQLAssigns(st.Set, args); err != nil {
+			return nil, err
+		}
+		if req.Conditions, err = bindSQLAssigns(st.Where, args); err != nil {
+			return nil, err
+		}
+		n, err := updateRecords(req)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlResult{tag: fmt.Sprintf("UPDATE %d", n), affected: n}, nil
+	case sqlparse.Delete:
+		if req.Conditions, err = bindSQLAssigns(st.Where, args); err != nil {
+			return nil, err
+		}
+		n, err := deleteRecords(req)
+		if err != nil {
+			return nil, err
+		}
+		return &sqlResult{tag: fmt.Sprintf("DELETE %d", n), affected: n}, nil
+	case sqlparse.CreateTable:
+		req.Columns = st.Columns
+		err = createTable(req)
+	case sqlparse.DropTable:
+		err = dropTable(req)
+	case sqlparse.CreateDatabase:
+		err = createDatabase(st.Target)
+	case sqlparse.DropDatabase:
+		err = dropDatabase(st.Target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sqlResult{tag: st.Kind.String()}, nil
+}
+
+// ===================== POSTGRES PROTOCOL =====================
+
+// The PostgreSQL front-end speaks protocol 3.0 so psql, pgx and BI tools
+// can connect directly. The startup "database" parameter selects the
+// database. With -auth the password must be an API key or token; it is
+// sent in cleartext, so use -tls-cert or trusted networks only.
+//
+// Values are stored as strings, so column types are inferred from the
+// data: a column is int8, float8 or bool when every value parses as one,
+// and text otherwise.
+
+const (
+	pgMaxStartupMessage = 1 << 20 // before authentication, whatever -pg-max-message says
+	pgProtocolVersion   = 196608
+	pgSSLRequest      = 80877103
+	pgCancelRequest   = 80877102
+	pgTypeBool        = 16
+	pgTypeInt8        = 20
+	pgTypeText        = 25
+	pgTypeFloat8      = 701
+	pgTypeUnknown     = 0
+)
+
+func startPostgresListener(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		telemetry.Fatal("PostgreSQL listener", "err", err)
+	}
+	slog.Info("PostgreSQL front-end listening", "addr", addr)
+	sessions.listen(ln)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("PostgreSQL accept", "err", err)
+			continue
+		}
+		sessions.serve(conn, servePostgres)
+	}
+}
+
+type pgPrepared struct {
+	stmt   *sqlparse.Statement
+	params []uint32
+	fields []uint32 // column types sent by the last Describe
+}
+
+type pgPortal struct {
+	prepared *pgPrepared
+	args     []*string
+	formats  []int16    // result format codes from Bind
+	fields   []uint32   // column types sent by Describe
+	result   *sqlResult // set when Describe had to run the statement early
+}
+
+type pgSession struct {
+	conn     net.Conn
+	rw       *bufio.ReadWriter
+	database string
+	stmts    map[string]*pgPrepared
+	portals  map[string]*pgPortal
+	failed   bool // error in extended query, skip until Sync
+	user     *auth.Principal
+}
+
+func servePostgres(conn net.Conn) {
+	defer conn.Close()
+	s := &pgSession{
+		conn:    conn,
+		rw:      bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)),
+		stmts:   map[string]*pgPrepared{},
+		portals: map[string]*pgPortal{},
+	}
+	if err := s.startup(); err != nil {
+		if err != io.EOF {
+			slog.Warn("PostgreSQL startup", "remote", conn.RemoteAddr().String(), "err", err)
+		}
+		return
+	}
+	for {
+		typ, body, err := s.readMessage(pgMaxMessage)
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("PostgreSQL session", "remote", conn.RemoteAddr().String(), "err", err)
+			}
+			return
+		}
+		if typ == 'X' {
+			return
+		}
+		if s.failed && typ != 'S' {
+			continue
+		}
+		if err := s.handle(typ, body); err != nil {
+			s.sendError(err)
+			if typ != 'Q' {
+				s.failed = true
+			} else {
+				s.ready()
+			}
+		}
+		if typ == 'S' || typ == 'Q' || typ == 'H' {
+			if err := s.rw.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *pgSession) startup() error {
+	for {
+		var n int32
+		if err := binary.Read(s.rw, binary.BigEndian, &n); err != nil {
+			return err
+		}
+		if n < 8 || n > 10000 {
+			return fmt.Errorf("bad startup length %d", n)
+		}
+		body := make([]byte, n-4)
+		if _, err := io.ReadFull(s.rw, body); err != nil {
+			return err
+		}
+		switch code := binary.BigEndian.Uint32(body); code {
+		case pgSSLRequest:
+			if serverTLS == nil {
+				s.rw.WriteByte('N')
+				s.rw.Flush()
+				continue
+			}
+			s.rw.WriteByte('S')
+			s.rw.Flush()
+			tlsConn := tls.Server(s.conn, serverTLS)
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+			s.conn = tlsConn
+			s.rw = bufio.NewReadWriter(bufio.NewReader(tlsConn), bufio.NewWriter(tlsConn))
+			continue
+		case pgCancelRequest:
+			return io.EOF
+		case pgProtocolVersion:
+			params := strings.Split(string(body[4:]), "\x00")
+			for i := 0; i+1 < len(params); i += 2 {
+				if params[i] == "database" {
+					s.database = params[i+1]
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported protocol version %d", code)
+		}
+		break
+	}
+
+	if authEnabled {
+		s.send('R', pgInt32(3)) // AuthenticationCleartextPassword
+		if err := s.rw.Flush(); err != nil {
+			return err
+		}
+		typ, body, err := s.readMessage(pgMaxStartupMessage)
+		if err != nil {
+			return err
+		}
+		if typ != 'p' {
+			return fmt.Errorf("expected password message, got %q", typ)
+		}
+		if s.user, err = apiKeys.authenticate(strings.TrimRight(string(body), "\x00")); err != nil {
+			s.sendError(err)
+			s.rw.Flush()
+			return err
+		}
+	}
+
+	s.send('R', pgInt32(0))
+	for _, kv := range [][2]string{
+		{"server_version", "14.0 (distributed-db)"},
+		{"server_encoding", "UTF8"},
+		{"client_encoding", "UTF8"},
+		{"DateStyle", "ISO, MDY"},
+		{"integer_datetimes", "on"},
+		{"standard_conforming_strings", "on"},
+	} {
+		s.send('S', pgCString(kv[0]), pgCString(kv[1]))
+	}
+	s.send('K', pgInt32(int32(os.Getpid())), pgInt32(0))
+	s.ready()
+	return s.rw.Flush()
+}
+
+// readMessage reads a typed message whose body is at most limit bytes. The
+// length is checked before allocating, so a client can't make the server
+// reserve memory it never sends.
+func (s *pgSession) readMessage(limit int) (byte, []byte, error) {
+	typ, err := s.rw.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n int32
+	if err := binary.Read(s.rw, binary.BigEndian, &n); err != nil {
+		return 0, nil, err
+	}
+	if n < 4 {
+		return 0, nil, fmt.Errorf("bad message length %d", n)
+	}
+	if int64(n)-4 > int64(limit) {
+		return 0, nil, fmt.Errorf("message of %d bytes exceeds the %d byte limit", n-4, limit)
+	}
+	body := make([]byte, n-4)
+	_, err = io.ReadFull(s.rw, body)
+	return typ, body, err
+}
+
+func (s *pgSession) send(typ byte, parts ...[]byte) {
+	n := 4
+	for _, p := range parts {
+		n += len(p)
+	}
+	s.rw.WriteByte(typ)
+	binary.Write(s.rw, binary.BigEndian, int32(n))
+	for _, p := range parts {
+		s.rw.Write(p)
+	}
+}
+
+func (s *pgSession) ready() { s.send('Z', []byte{'I'}) }
+
+func (s *pgSession) sendError(err error) {
+	code := "XX000"
+	switch err {
+	case errDatabaseNotFound:
+		code = "3D000"
+	case errTableNotFound:
+		code = "42P01"
+	case errDatabaseExists:
+		code = "42P04"
+	case errTableExists:
+		code = "42P07"
+	case auth.ErrUnauthenticated, auth.ErrBadCredentials, auth.ErrTokenExpired:
+		code = "28P01"
+	case auth.ErrForbidden:
+		code = "42501"
+	default:
+		if strings.HasPrefix(err.Error(), "syntax error") {
+			code = "42601"
+		} else if strings.HasPrefix(err.Error(), "unsupported") {
+			code = "0A000"
+		}
+	}
+	s.send('E',
+		[]byte("SERROR\x00"), []byte("VERROR\x00"),
+		append([]byte("C"), pgCString(code)...),
+		append([]byte("M"), pgCString(err.Error())...),
+		[]byte{0})
+}
+
+func (s *pgSession) handle(typ byte, body []byte) error {
+	r := &pgReader{buf: body}
+	switch typ {
+	case 'Q':
+		return s.simpleQuery(r.cstring())
+	case 'P':
+		name, query := r.cstring(), r.cstring()
+		params := make([]uint32, r.count())
+		for i := range params {
+			params[i] = uint32(r.int32())
+		}
+		var st *sqlparse.Statement
+		if strings.TrimSpace(query) != "" {
+			var err error
+			if st, err = sqlparse.Parse(query); err != nil {
+				return err
+			}
+		}
+		if st != nil && len(params) < st.Params {
+			params = append(params, make([]uint32, st.Params-len(params))...)
+		}
+		// Unspecified parameter types are described as "unknown" so clients
+		// send any Go value in text form.
+		for i, oid := range params {
+			if oid == 0 {
+				params[i] = pgTypeUnknown
+			}
+		}
+		s.stmts[name] = &pgPrepared{stmt: st, params: params}
+		s.send('1')
+	case 'B':
+		portal, name := r.cstring(), r.cstring()
+		prep, ok := s.stmts[name]
+		if !ok {
+			return fmt.Errorf("prepared statement %q does not exist", name)
+		}
+		formats := make([]int16, r.count())
+		for i := range formats {
+			formats[i] = r.int16()
+		}
+		args := make([]*string, r.count())
+		for i := range args {
+			n := r.int32()
+			if r.err != nil || int64(n) > int64(len(r.buf)) {
+				return errors.New("malformed message")
+			}
+			if n < 0 {
+				continue
+			}
+			raw := r.bytes(int(n))
+			format := int16(0)
+			if len(formats) == 1 {
+				format = formats[0]
+			} else if i < len(formats) {
+				format = formats[i]
+			}
+			v, err := pgDecodeParam(raw, format, prep.params, i)
+			if err != nil {
+				return err
+			}
+			args[i] = &v
+		}
+		results := make([]int16, r.count())
+		for i := range results {
+			results[i] = r.int16()
+		}
+		s.portals[portal] = &pgPortal{prepared: prep, args: args, formats: results}
+		s.send('2')
+	case 'D':
+		kind, name := r.byte(), r.cstring()
+		if kind == 'S' {
+			prep, ok := s.stmts[name]
+			if !ok {
+				return fmt.Errorf("prepared statement %q does not exist", name)
+			}
+			oids := make([][]byte, 0, len(prep.params)+1)
+			oids = append(oids, pgInt16(int16(len(prep.params))))
+			for _, oid := range prep.params {
+				oids = append(oids, pgInt32(int32(oid)))
+			}
+			s.send('t', oids...)
+			return s.describeStatement(prep)
+		}
+		portal, ok := s.portals[name]
+		if !ok {
+			return fmt.Errorf("portal %q does not exist", name)
+		}
+		if portal.prepared.stmt == nil || portal.prepared.stmt.Kind != sqlparse.Select {
+			s.send('n')
+			return nil
+		}
+		res, err := s.execute(portal.prepared.stmt, portal.args)
+		if err != nil {
+			return err
+		}
+		portal.result = res
+		portal.fields = portal.prepared.fields
+		if len(portal.fields) != len(res.columns) {
+			portal.fields = pgColumnTypes(res.rows, len(res.columns))
+		}
+		s.sendRowDescription(res.columns, portal.fields, portal.formats)
+	case 'E':
+		name := r.cstring()
+		portal, ok := s.portals[name]
+		if !ok {
+			return fmt.Errorf("portal %q does not exist", name)
+		}
+		if portal.prepared.stmt == nil {
+			s.send('I')
+			return nil
+		}
+		res := portal.result
+		if res == nil {
+			var err error
+			if res, err = s.execute(portal.prepared.stmt, portal.args); err != nil {
+				return err
+			}
+		}
+		portal.result = nil
+		fields := portal.fields
+		if fields == nil {
+			fields = portal.prepared.fields
+		}
+		if len(fields) != len(res.columns) {
+			fields = pgColumnTypes(res.rows, len(res.columns))
+		}
+		if err := s.sendRows(res, fields, portal.formats); err != nil {
+			return err
+		}
+		s.send('C', pgCString(res.tag))
+	case 'C':
+		kind, name := r.byte(), r.cstring()
+		if kind == 'S' {
+			delete(s.stmts, name)
+		} else {
+			delete(s.portals, name)
+		}
+		s.send('3')
+	case 'S':
+		s.failed = false
+		s.ready()
+	case 'H':
+	default:
+		return fmt.Errorf("unsupported message type %q", typ)
+	}
+	return r.err
+}
+
+func (s *pgSession) simpleQuery(query string) error {
+	empty := true
+	for _, q := range sqlparse.Split(query) {
+		if strings.TrimSpace(q) == "" {
+			continue
+		}
+		empty = false
+		st, err := sqlparse.Parse(q)
+		if err != nil {
+			return err
+		}
+		res, err := s.execute(st, nil)
+		if err != nil {
+			return err
+		}
+		if st.Kind == sqlparse.Select {
+			fields := pgColumnTypes(res.rows, len(res.columns))
+			s.sendRowDescription(res.columns, fields, nil)
+			if err := s.sendRows(res, fields, nil); err != nil {
+				return err
+			}
+		}
+		s.send('C', pgCString(res.tag))
+	}
+	if empty {
+		s.send('I')
+	}
+	s.ready()
+	return nil
+}
+
+// describeStatement answers a statement Describe. Types are inferred from
+// the table's current records and remembered for Execute, since clients
+// pick binary or text result formats based on them.
+func (s *pgSession) describeStatement(prep *pgPrepared) error {
+	st := prep.stmt
+	if st == nil || st.Kind != sqlparse.Select {
+		s.send('n')
+		return nil
+	}
+	if err := auth.Authorize(s.user, auth.PrivRead, s.database, st.Target); err != nil {
+		return err
+	}
+	records, declared, err := selectRecords(s.database, st.Target, nil, 0)
+	if err != nil {
+		return err
+	}
+	cols := selectColumns(st, declared, records)
+	prep.fields = pgColumnTypes(recordRows(cols, records), len(cols))
+	s.sendRowDescription(cols, prep.fields, nil)
+	return nil
+}
+
+// execute runs st for the session user after checking its privileges.
+func (s *pgSession) execute(st *sqlparse.Statement, args []*string) (*sqlResult, error) {
+	priv, db, table := sqlPrivilege(st, s.database)
+	err := auth.Authorize(s.user, priv, db, table)
+	var res *sqlResult
+	if err == nil {
+		res, err = executeSQL(s.database, st, args)
+	}
+	if st.Kind != sqlparse.Select {
+		e := auditEntry{Op: strings.ToLower(strings.ReplaceAll(st.Kind.String(), " ", "_")), Database: db, Table: table}
+		if res != nil {
+			e.Rows = res.affected
+		}
+		audit.record(auditActor{User: s.user, Source: s.conn.RemoteAddr().String(), Protocol: "postgres"}, e, err)
+	}
+	return res, err
+}
+
+func pgColumnTypes(rows [][]*string, n int) []uint32 {
+	types := make([]uint32, n)
+	for i := range types {
+		isInt, isFloat, isBool, seen := true, true, true, false
+		for _, row := range rows {
+			v := row[i]
+			if v == nil {
+				continue
+			}
+			seen = true
+			if _, err := strconv.ParseInt(*v, 10, 64); err != nil {
+				isInt = false
+			}
+			if _, err := strconv.ParseFloat(*v, 64); err != nil {
+				isFloat = false
+			}
+			if *v != "true" && *v != "false" {
+				isBool = false
+			}
+		}
+		switch {
+		case !seen:
+			types[i] = pgTypeText
+		case isInt:
+			types[i] = pgTypeInt8
+		case isFloat:
+			types[i] = pgTypeFloat8
+		case isBool:
+			types[i] = pgTypeBool
+		default:
+			types[i] = pgTypeText
+		}
+	}
+	return types
+}
+
+// pgFormat returns the format code for column i: one code applies to all
+// columns, none means text.
+func pgFormat(formats []int16, i int) int16 {
+	if len(formats) == 1 {
+		return formats[0]
+	}
+	if i < len(formats) {
+		return formats[i]
+	}
+	return 0
+}
+
+func (s *pgSession) sendRowDescription(columns []string, types []uint32, formats []int16) {
+	parts := [][]byte{pgInt16(int16(len(columns)))}
+	for i, col := range columns {
+		size := int16(-1)
+		switch types[i] {
+		case pgTypeInt8, pgTypeFloat8:
+			size = 8
+		case pgTypeBool:
+			size = 1
+		}
+		parts = append(parts, pgCString(col),
+			pgInt32(0), pgInt16(0), // table oid, attribute number
+			pgInt32(int32(types[i])), pgInt16(size), pgInt32(-1), // type oid, size, modifier
+			pgInt16(pgFormat(formats, i)))
+	}
+	s.send('T', parts...)
+}
+
+func (s *pgSession) sendRows(res *sqlResult, types []uint32, formats []int16) error {
+	for _, row := range res.rows {
+		parts := [][]byte{pgInt16(int16(len(row)))}
+		for i, v := range row {
+			if v == nil {
+				parts = append(parts, pgInt32(-1))
+				continue
+			}
+			data, err := pgEncodeValue(*v, types[i], pgFormat(formats, i))
+			if err != nil {
+				return fmt.Errorf("column %s: %v", res.columns[i], err)
+			}
+			parts = append(parts, pgInt32(int32(len(data))), data)
+		}
+		s.send('D', parts...)
+	}
+	return nil
+}
+
+// pgEncodeValue renders a stored value in the requested format. A value
+// that no longer fits the type announced by Describe cannot be sent in
+// binary and is reported as an error.
+func pgEncodeValue(v string, oid uint32, format int16) ([]byte, error) {
+	if format == 0 {
+		return []byte(v), nil
+	}
+	switch oid {
+	case pgTypeInt8:
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an integer", v)
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(n))
+		return b, nil
+	case pgTypeFloat8:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, math.Float64bits(f))
+		return b, nil
+	case pgTypeBool:
+		if v != "true" && v != "false" {
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		}
+		if v == "true" {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	}
+	return []byte(v), nil
+}
+
+// pgDecodeParam converts a bound parameter to the string stored in records.
+// Binary parameters are decoded for the common integer, float and bool
+// types; text parameters are used as is.
+func pgDecodeParam(raw []byte, format int16, oids []uint32, i int) (string, error) {
+	if format == 0 {
+		return string(raw), nil
+	}
+	oid := uint32(pgTypeUnknown)
+	if i < len(oids) {
+		oid = oids[i]
+	}
+	switch {
+	case oid == 16 && len(raw) == 1: // bool
+		return strconv.FormatBool(raw[0] != 0), nil
+	case oid == 21 && len(raw) == 2: // int2
+		return strconv.Itoa(int(int16(binary.BigEndian.Uint16(raw)))), nil
+	case oid == 23 && len(raw) == 4: // int4
+		return strconv.Itoa(int(int32(binary.BigEndian.Uint32(raw)))), nil
+	case oid == 20 && len(raw) == 8: // int8
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(raw)), 10), nil
+	case oid == 700 && len(raw) == 4: // float4
+		return strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), 'g', -1, 32), nil
+	case oid == 701 && len(raw) == 8: // float8
+		return strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(raw)), 'g', -1, 64), nil
+	case oid == 25 || oid == 1043 || oid == 19 || oid == 705: // text, varchar, name, unknown
+		return string(raw), nil
+	}
+	return "", fmt.Errorf("unsupported binary parameter type %d", oid)
+}
+
+type pgReader struct {
+	buf []byte
+	err error
+}
+
+// take returns the next n bytes of the message, or nil once it is
+// malformed. n comes from the client, so nothing is allocated for it.
+func (r *pgReader) take(n int) []byte {
+	if r.err == nil && (n < 0 || n > len(r.buf)) {
+		r.err = errors.New("malformed message")
+	}
+	if r.err != nil {
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// fixed reads a field of at most four bytes, zero once the message is
+// malformed.
+func (r *pgReader) fixed(n int) []byte {
+	if b := r.take(n); b != nil {
+		return b
+	}
+	return make([]byte, 4)[:n]
+}
+
+func (r *pgReader) byte() byte         { return r.fixed(1)[0] }
+func (r *pgReader) int16() int16       { return int16(binary.BigEndian.Uint16(r.fixed(2))) }
+func (r *pgReader) int32() int32       { return int32(binary.BigEndian.Uint32(r.fixed(4))) }
+func (r *pgReader) count() int         { return int(binary.BigEndian.Uint16(r.fixed(2))) }
+func (r *pgReader) bytes(n int) []byte { return r.take(n) }
+
+func (r *pgReader) cstring() string {
+	i := bytes.IndexByte(r.buf, 0)
+	if i < 0 {
+		r.err = errors.New("malformed message")
+		return ""
+	}
+	s := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return s
+}
+
+func pgInt16(v int16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+func pgInt32(v int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(v))
+	return b
+}
+
+func pgCString(s string) []byte { return append([]byte(s), 0) }
+
+// ===================== REDIS PROTOCOL =====================
+
+// The RESP listener serves plain key lookups from a designated table with
+// the columns key, type ("string" or "hash"), value and expires_at (unix
+// milliseconds, empty for no expiry). Hash values are stored as a JSON
+// object. Every write goes through insertRecord/updateRecords/
+// deleteRecords so it is persisted and replicated like any table write.
+// Reads treat an expired key as missing but leave its row alone; the next
+// write to the key replaces the row and DEL removes it. With -auth,
+// clients must send AUTH with an API key or token before any other
+// command.
+
+// kvMu serializes RESP commands. HTTP and SQL writes to the kv table do
+// not take it, so a command that rewrites a row it read only updates the
+// row if it is unchanged and fails with errRespChanged otherwise.
+var kvMu sync.Mutex
+
+// kvChanged counts the keys written or deleted by the command in progress,
+// for the audit log. Guarded by kvMu.
+var kvChanged int
+
+// respPrivileges is the privilege each data command needs on the kv table.
+var respPrivileges = map[string]string{
+	"GET": auth.PrivRead, "EXISTS": auth.PrivRead, "TTL": auth.PrivRead, "HGET": auth.PrivRead, "SCAN": auth.PrivRead,
+	"SET": auth.PrivWrite, "DEL": auth.PrivWrite, "EXPIRE": auth.PrivWrite, "INCR": auth.PrivWrite, "HSET": auth.PrivWrite,
+}
+
+var errRespWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+var errRespChanged = errors.New("ERR key was changed by another client, try again")
+
+type kvEntry struct {
+	Type      string
+	Value     string
+	ExpiresAt int64
+}
+
+// A kvRow is a key's row as it was read, nil when the key has none.
+type kvRow map[string]string
+
+func startRespListener(addr string) {
+	if err := createDatabase(kvDatabase); err != nil && err != errDatabaseExists {
+		if !errors.Is(err, errShardUnavailable) {
+			telemetry.Fatal("RESP listener", "err", err)
+		}
+		slog.Warn("Creating the key-value database on every shard", "err", err)
+	}
+	err := createTable(RequestData{Database: kvDatabase, Table: kvTable, Columns: []string{"key", "type", "value", "expires_at"}})
+	if err != nil && err != errTableExists {
+		if !errors.Is(err, errShardUnavailable) {
+			telemetry.Fatal("RESP listener", "err", err)
+		}
+		slog.Warn("Creating the key-value table on every shard", "err", err)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		telemetry.Fatal("RESP listener", "err", err)
+	}
+	if serverTLS != nil {
+		ln = tls.NewListener(ln, serverTLS)
+	}
+	slog.Info("RESP listening", "addr", addr, "database", kvDatabase, "table", kvTable)
+	sessions.listen(ln)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Error("RESP accept", "err", err)
+			continue
+		}
+		sessions.serve(conn, serveResp)
+	}
+}
+
+func serveResp(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	wr := bufio.NewWriter(conn)
+	var user *auth.Principal
+	for {
+		args, err := readRespCommand(rd)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+				writeRespError(wr, "ERR Protocol error: "+err.Error())
+				wr.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := strings.EqualFold(args[0], "QUIT")
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			// AUTH password or AUTH username password; the username is ignored.
+			if len(args) < 2 || len(args) > 3 {
+				writeRespError(wr, "ERR wrong number of arguments for 'auth' command")
+			} else if !authEnabled {
+				writeRespError(wr, "ERR AUTH called without any password configured")
+			} else if p, err := apiKeys.authenticate(args[len(args)-1]); err != nil {
+				writeRespError(wr, "WRONGPASS invalid username-password pair or user is disabled.")
+			} else {
+				user = p
+				writeRespSimple(wr, "OK")
+			}
+		case authEnabled && user == nil && cmd != "PING" && cmd != "QUIT":
+			writeRespError(wr, "NOAUTH Authentication required.")
+		case respPrivileges[cmd] != "" && auth.Authorize(user, respPrivileges[cmd], kvDatabase, kvTable) != nil:
+			if respPrivileges[cmd] == auth.PrivWrite {
+				auditResp(conn, user, args, 0, auth.ErrForbidden)
+			}
+			writeRespError(wr, fmt.Sprintf("NOPERM this user has no permissions to run the '%s' command", strings.ToLower(cmd)))
+		default:
+			rows, err := execRespCommand(wr, args)
+			if respPrivileges[cmd] == auth.PrivWrite {
+				auditResp(conn, user, args, rows, err)
+			}
+		}
+		if rd.Buffered() == 0 || quit {
+			if wr.Flush() != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// auditResp records a write command with its outcome: the keys it names
+// are the detail, rows the keys it actually wrote or deleted and err the
+// error it replied with.
+func auditResp(conn net.Conn, user *auth.Principal, args []string, rows int, err error) {
+	var keys []string
+	switch {
+	case len(args) < 2:
+	case strings.EqualFold(args[0], "DEL"):
+		keys = args[1:]
+	default:
+		keys = args[1:2]
+	}
+	audit.record(auditActor{User: user, Source: conn.RemoteAddr().String(), Protocol: "resp"},
+		auditEntry{Op: strings.ToLower(args[0]), Database: kvDatabase, Table: kvTable, Detail: strings.Join(keys, " "), Rows: rows}, err)
+}
+
+// readRespCommand reads a RESP array of bulk strings or an inline command.
+// A null array (*-1) reads as an empty command and a null bulk string ($-1)
+// is left out; any other negative length is a protocol error.
+func readRespCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readRespLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < -1 || n > 1024*1024 {
+		return nil, errors.New("invalid multibulk length")
+	}
+	// The buffers grow as data arrives rather than trusting the lengths.
+	args := make([]string, 0, min(max(n, 0), 64))
+	for i := 0; i < n; i++ {
+		line, err := readRespLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("expected '$', got %q", line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < -1 || size > 512*1024*1024 {
+			return nil, errors.New("invalid bulk length")
+		}
+		if size == -1 {
+			continue
+		}
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, rd, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		args = append(args, string(buf.Bytes()[:size]))
+	}
+	return args, nil
+}
+
+func readRespLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRespError(w *bufio.Writer, msg string) { fmt.Fprintf(w, "-%s\r\n", msg) }
+func writeRespSimple(w *bufio.Writer, s string)  { fmt.Fprintf(w, "+%s\r\n", s) }
+func writeRespInt(w *bufio.Writer, n int64)      { fmt.Fprintf(w, ":%d\r\n", n) }
+func writeRespNull(w *bufio.Writer)              { w.WriteString("$-1\r\n") }
+
+func writeRespBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeRespArray(w *bufio.Writer, items []string) {
+	fmt.Fprintf(w, "*%d\r\n", len(items))
+	for _, it := range items {
+		writeRespBulk(w, it)
+	}
+}
+
+// execRespCommand runs a command and writes its reply. It returns the
+// number of keys the command wrote or deleted and the error it replied with.
+func execRespCommand(w *bufio.Writer, args []string) (int, error) {
+	cmd := strings.ToUpper(args[0])
+	arity := map[string]int{
+		"PING": -1, "ECHO": 2, "QUIT": 1, "COMMAND": -1, "SELECT": 2,
+		"GET": 2, "SET": -3, "DEL": -2, "EXISTS": -2, "EXPIRE": 3, "TTL": 2,
+		"INCR": 2, "HGET": 3, "HSET": -4, "SCAN": -2,
+	}
+	want, ok := arity[cmd]
+	if !ok {
+		err := fmt.Errorf("ERR unknown command '%s'", args[0])
+		writeRespError(w, err.Error())
+		return 0, err
+	}
+	if want > 0 && len(args) != want || want < 0 && len(args) < -want {
+		err := fmt.Errorf("ERR wrong number of arguments for '%s' command", strings.ToLower(cmd))
+		writeRespError(w, err.Error())
+		return 0, err
+	}
+
+	kvMu.Lock()
+	defer kvMu.Unlock()
+	kvChanged = 0
+	err := runRespCommand(w, cmd, args[1:])
+	if err != nil {
+		msg := err.Error()
+		if !strings.HasPrefix(msg, "ERR") && !strings.HasPrefix(msg, "WRONGTYPE") {
+			msg = "ERR " + msg
+		}
+		writeRespError(w, msg)
+	}
+	return kvChanged, err
+}
+
+func runRespCommand(w *bufio.Writer, cmd string, args []string) error {
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			writeRespBulk(w, args[0])
+		} else {
+			writeRespSimple(w, "PONG")
+		}
+	case "ECHO":
+		writeRespBulk(w, args[0])
+	case "QUIT":
+		writeRespSimple(w, "OK")
+	case "COMMAND":
+		writeRespArray(w, nil)
+	case "SELECT":
+		if args[0] != "0" {
+			return errors.New("ERR DB index is out of range")
+		}
+		writeRespSimple(w, "OK")
+	case "GET":
+		e, err := kvGet(args[0])
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			writeRespNull(w)
+			return nil
+		}
+		if e.Type != "string" {
+			return errRespWrongType
+		}
+		writeRespBulk(w, e.Value)
+	case "SET":
+		return respSet(w, args)
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			e, row, err := kvLookup(key)
+			if err != nil {
+				return err
+			}
+			if row != nil {
+				if err := kvDelete(key); err != nil {
+					return err
+				}
+			}
+			if e != nil {
+				n++
+			}
+		}
+		writeRespInt(w, n)
+	case "EXISTS":
+		var n int64
+		for _, key := range args {
+			e, err := kvGet(key)
+			if err != nil {
+				return err
+			}
+			if e != nil {
+				n++
+			}
+		}
+		writeRespInt(w, n)
+	case "EXPIRE":
+		secs, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		e, row, err := kvLookup(args[0])
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			writeRespInt(w, 0)
+			return nil
+		}
+		if secs <= 0 {
+			if err := kvDelete(args[0]); err != nil {
+				return err
+			}
+		} else {
+			e.ExpiresAt = time.Now().Add(time.Duration(secs) * time.Second).UnixMilli()
+			if err := kvPut(args[0], e, row); err != nil {
+				return err
+			}
+		}
+		writeRespInt(w, 1)
+	case "TTL":
+		e, err := kvGet(args[0])
+		if err != nil {
+			return err
+		}
+		switch {
+		case e == nil:
+			writeRespInt(w, -2)
+		case e.ExpiresAt == 0:
+			writeRespInt(w, -1)
+		default:
+			writeRespInt(w, (e.ExpiresAt-time.Now().UnixMilli()+999)/1000)
+		}
+	case "INCR":
+		e, row, err := kvLookup(args[0])
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			e = &kvEntry{Type: "string", Value: "0"}
+		}
+		if e.Type != "string" {
+			return errRespWrongType
+		}
+		n, err := strconv.ParseInt(e.Value, 10, 64)
+		if err != nil || n == math.MaxInt64 {
+			return errors.New("ERR value is not an integer or out of range")
+		}
+		n++
+		e.Value = strconv.FormatInt(n, 10)
+		if err := kvPut(args[0], e, row); err != nil {
+			return err
+		}
+		writeRespInt(w, n)
+	case "HGET":
+		e, err := kvGet(args[0])
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			writeRespNull(w)
+			return nil
+		}
+		if e.Type != "hash" {
+			return errRespWrongType
+		}
+		fields := map[string]string{}
+		json.Unmarshal([]byte(e.Value), &fields)
+		v, ok := fields[args[1]]
+		if !ok {
+			writeRespNull(w)
+			return nil
+		}
+		writeRespBulk(w, v)
+	case "HSET":
+		if len(args)%2 != 1 {
+			return errors.New("ERR wrong number of arguments for 'hset' command")
+		}
+		e, row, err := kvLookup(args[0])
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			e = &kvEntry{Type: "hash", Value: "{}"}
+		}
+		if e.Type != "hash" {
+			return errRespWrongType
+		}
+		fields := map[string]string{}
+		json.Unmarshal([]byte(e.Value), &fields)
+		var added int64
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := fields[args[i]]; !ok {
+				added++
+			}
+			fields[args[i]] = args[i+1]
+		}
+		encoded, _ := json.Marshal(fields)
+		e.Value = string(encoded)
+		if err := kvPut(args[0], e, row); err != nil {
+			return err
+		}
+		writeRespInt(w, added)
+	case "SCAN":
+		return respScan(w, args)
+	}
+	return nil
+}
+
+// respSet implements SET key value [EX seconds | PX milliseconds] [NX | XX].
+func respSet(w *bufio.Writer, args []string) error {
+	e := &kvEntry{Type: "string", Value: args[1]}
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return errors.New("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return errors.New("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			e.ExpiresAt = time.Now().Add(time.Duration(n) * unit).UnixMilli()
+			i++
+		default:
+			return errors.New("ERR syntax error")
+		}
+	}
+	if nx && xx {
+		return errors.New("ERR syntax error")
+	}
+
+	old, row, err := kvLookup(args[0])
+	if err != nil {
+		return err
+	}
+	if nx && old != nil || xx && old == nil {
+		writeRespNull(w)
+		return nil
+	}
+	if err := kvPut(args[0], e, row); err != nil {
+		return err
+	}
+	writeRespSimple(w, "OK")
+	return nil
+}
+
+// respScan implements SCAN cursor [MATCH pattern] [COUNT n]. The cursor is
+// an offset into the sorted key list.
+func respScan(w *bufio.Writer, args []string) error {
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil || cursor < 0 {
+		return errors.New("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errors.New("ERR syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				return errors.New("ERR syntax error")
+			}
+		default:
+			return errors.New("ERR syntax error")
+		}
+	}
+
+	records, _, err := selectRecords(kvDatabase, kvTable, nil, 0)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	var keys []string
+	for _, rec := range records {
+		if exp, _ := strconv.ParseInt(rec["expires_at"], 10, 64); exp != 0 && exp <= now {
+			continue
+		}
+		keys = append(keys, rec["key"])
+	}
+	sort.Strings(keys)
+
+	var out []string
+	next := cursor
+	for ; next < len(keys) && next < cursor+count; next++ {
+		if ok, _ := path.Match(pattern, keys[next]); ok {
+			out = append(out, keys[next])
+		}
+	}
+	if next >= len(keys) {
+		next = 0
+	}
+	fmt.Fprintf(w, "*2\r\n")
+	writeRespBulk(w, strconv.Itoa(next))
+	writeRespArray(w, out)
+	return nil
+}
+
+// kvGet returns the live entry for key, nil if it is missing or expired.
+func kvGet(key string) (*kvEntry, error) {
+	e, _, err := kvLookup(key)
+	return e, err
+}
+
+// kvLookup returns the live entry for key along with the row it was read
+// from, which is still returned once the entry has expired.
+func kvLookup(key string) (*kvEntry, kvRow, error) {
+	records, _, err := selectRecords(kvDatabase, kvTable, map[string]string{"key": key}, 1)
+	if err != nil || len(records) == 0 {
+		return nil, nil, err
+	}
+	rec := records[0]
+	e := &kvEntry{Type: rec["type"], Value: rec["value"]}
+	if e.Type == "" {
+		e.Type = "string"
+	}
+	e.ExpiresAt, _ = strconv.ParseInt(rec["expires_at"], 10, 64)
+	if e.ExpiresAt != 0 && e.ExpiresAt <= time.Now().UnixMilli() {
+		return nil, rec, nil
+	}
+	return e, rec, nil
+}
+
+// kvPut writes e for key. It replaces row, the key's row as read, and
+// fails with errRespChanged if another client changed it since.
+func kvPut(key string, e *kvEntry, row kvRow) error {
+	expires := ""
+	if e.ExpiresAt != 0 {
+		expires = strconv.FormatInt(e.ExpiresAt, 10)
+	}
+	data := map[string]string{"type": e.Type, "value": e.Value, "expires_at": expires}
+	req := RequestData{Database: kvDatabase, Table: kvTable}
+	if row != nil {
+		req.Conditions = row
+		req.UpdateData = data
+		n, err := updateRecords(req)
+		kvChanged += n
+		if err == nil && n == 0 {
+			err = errRespChanged
+		}
+		return err
+	}
+	data["key"] = key
+	req.Record = data
+	if err := insertRecord(req); err != nil {
+		return err
+	}
+	kvChanged++
+	return nil
+}
+
+func kvDelete(key string) error {
+	n, err := deleteRecords(RequestData{Database: kvDatabase, Table: kvTable, Conditions: map[string]string{"key": key}})
+	kvChanged += n
+	return err
+}
+
+// ===================== GRPC =====================
+
+// The gRPC API (proto/ddb.proto) is served over cleartext HTTP/2 with the
+// standard library; internal/wire frames and encodes the messages.
+
+// grpcStatus maps an operation error to the code matching httpStatus.
+func grpcStatus(err error) (int, string) {
+	if ge, ok := err.(*wire.Error); ok {
+		return ge.Code, ge.Msg
+	}
+	switch httpStatus(err) {
+	case http.StatusNotFound:
+		return wire.NotFound, err.Error()
+	case http.StatusConflict:
+		return wire.AlreadyExists, err.Error()
+	case http.StatusBadRequest:
+		return wire.InvalidArgument, err.Error()
+	case http.StatusUnauthorized:
+		return wire.Unauthenticated, err.Error()
+	case http.StatusForbidden:
+		return wire.PermissionDenied, err.Error()
+	}
+	return wire.Internal, err.Error()
+}
+
+type grpcRequest struct {
+	RequestData
+	Limit   int
+	Records []map[string]string
+}
+
+func startGRPCListener(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(wire.Service, handleGRPC)
+	srv := &http.Server{Addr: addr, Handler: telemetry.TraceRequests(telemetry.LogRequests(metrics.Instrument(mux))), Protocols: new(http.Protocols), TLSConfig: serverTLS}
+	slog.Info("gRPC listening", "addr", addr)
+	if serverTLS != nil {
+		srv.Protocols.SetHTTP2(true)
+	} else {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	node.Serve(srv)
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, wire.Service)
+
+	send := wire.Respond(w)
+
+	code, msg := wire.OK, ""
+	var err error
+	var user *auth.Principal
+	if authEnabled {
+		user, err = apiKeys.authenticate(auth.BearerCredential(r))
+	}
+	var req *grpcRequest
+	if err == nil {
+		decode := telemetry.RequestSpan(r).Child("decode")
+		req, err = readGRPCRequest(r.Body)
+		decode.Fail(err)
+		decode.End()
+	}
+	if err == nil {
+		req.RequestID, req.Span = telemetry.RequestID(r), telemetry.RequestSpan(r)
+	}
+	if err == nil {
+		err = dispatchGRPC(auditActor{User: user, Source: r.RemoteAddr, Protocol: "grpc", RequestID: telemetry.RequestID(r)}, method, req, send)
+	}
+	if err != nil {
+		code, msg = grpcStatus(err)
+	}
+	wire.WriteStatus(w, code, msg)
+}
+
+// grpcAuditOp turns an RPC name such as InsertBatch into the audit
+// operation insert_batch.
+func grpcAuditOp(method string) string {
+	var b strings.Builder
+	for i, c := range method {
+		if unicode.IsUpper(c) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			c = unicode.ToLower(c)
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func readGRPCRequest(body io.Reader) (*grpcRequest, error) {
+	data, err := wire.ReadMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := pbDecodeRequest(data)
+	if err != nil {
+		return nil, wire.NewError(wire.InvalidArgument, err.Error())
+	}
+	return req, nil
+}
+
+// grpcPrivileges is the privilege each RPC needs; the List RPCs filter
+// their results instead.
+var grpcPrivileges = map[string]string{
+	"CreateDatabase": auth.PrivDDL, "DropDatabase": auth.PrivDDL, "CreateTable": auth.PrivDDL, "DropTable": auth.PrivDDL,
+	"Insert": auth.PrivWrite, "InsertBatch": auth.PrivWrite, "Update": auth.PrivWrite, "Delete": auth.PrivWrite,
+	"Select": auth.PrivRead, "StreamSelect": auth.PrivRead, "DescribeTable": auth.PrivRead,
+}
+
+func dispatchGRPC(actor auditActor, method string, req *grpcRequest, send func([]byte)) error {
+	p := actor.User
+	table := req.Table
+	if method == "CreateDatabase" || method == "DropDatabase" {
+		table = ""
+	}
+	if priv := grpcPrivileges[method]; priv != "" {
+		if err := auth.Authorize(p, priv, req.Database, table); err != nil {
+			if priv != auth.PrivRead {
+				audit.record(actor, auditEntry{Op: grpcAuditOp(method), Database: req.Database, Table: table}, err)
+			}
+			return err
+		}
+	}
+	// ack answers the write RPCs, which all end up here.
+	ack := func(err error, message string, count int64) error {
+		e := auditEntry{Op: grpcAuditOp(method), Database: req.Database, Table: table, Rows: int(count)}
+		if err != nil && method == "InsertBatch" {
+			e.Detail = fmt.Sprintf("%d records inserted before the error", count)
+		}
+		audit.record(actor, e, err)
+		if err != nil {
+			return err
+		}
+		send(wire.EncodeAck(message, count))
+		return nil
+	}
+
+	switch method {
+	case "CreateDatabase":
+		return ack(createDatabase(req.Database), "Database created successfully.", 0)
+	case "DropDatabase":
+		return ack(dropDatabase(req.Database), fmt.Sprintf("Database %s dropped", req.Database), 0)
+	case "ListDatabases":
+		dbMu.Lock()
+		names := []string{}
+		for name := range databases {
+			if auth.CanSee(p, name, "") {
+				names = append(names, name)
+			}
+		}
+		dbMu.Unlock()
+		sort.Strings(names)
+		send(wire.EncodeNames(names))
+	case "CreateTable":
+		return ack(createTable(req.RequestData), "Table created successfully.", 0)
+	case "DropTable":
+		return ack(dropTable(req.RequestData), fmt.Sprintf("Table %s dropped from %s", req.Table, req.Database), 0)
+	case "ListTables":
+		dbMu.Lock()
+		db, ok := databases[req.Database]
+		names := []string{}
+		if ok {
+			for name := range db.Tables {
+				if auth.CanSee(p, req.Database, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		dbMu.Unlock()
+		if !ok {
+			return errDatabaseNotFound
+		}
+		sort.Strings(names)
+		send(wire.EncodeNames(names))
+	case "DescribeTable":
+		table, err := lookupTable(req.Database, req.Table)
+		if err != nil {
+			return err
+		}
+		send(wire.EncodeNames(table.Columns))
+	case "Insert":
+		return ack(insertRecord(req.RequestData), "Record inserted successfully.", 1)
+	case "InsertBatch":
+		n, err := insertRecords(req.RequestData, req.Records)
+		return ack(err, fmt.Sprintf("Inserted %d records.", n), int64(n))
+	case "Update":
+		n, err := updateRecords(req.RequestData)
+		return ack(err, fmt.Sprintf("Updated %d records.", n), int64(n))
+	case "Delete":
+		n, err := deleteRecords(req.RequestData)
+		return ack(err, fmt.Sprintf("Deleted %d records.", n), int64(n))
+	case "Select", "StreamSelect":
+		records, _, err := selectRecords(req.Database, req.Table, req.Conditions, req.Limit)
+		if err != nil {
+			return err
+		}
+		if method == "Select" {
+			send(wire.EncodeRecords(records))
+			return nil
+		}
+		for _, rec := range records {
+			send(wire.EncodeRecord(rec))
+		}
+	default:
+		return wire.NewError(wire.Unimplemented, "unknown method "+method)
+	}
+	return nil
+}
+
+// ===================== PROTOBUF =====================
+
+func pbDecodeRequest(data []byte) (*grpcRequest, error) {
+	req := &grpcRequest{}
+	err := wire.Fields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			req.Database = string(b)
+		case 2:
+			req.Table = string(b)
+		case 3:
+			req.Columns = append(req.Columns, string(b))
+		case 4, 5, 6:
+			if b == nil {
+				return errors.New("malformed map field")
+			}
+			target := &req.Record
+			if field == 5 {
+				target = &req.UpdateData
+			} else if field == 6 {
+				target = &req.Conditions
+			}
+			if *target == nil {
+				*target = map[string]string{}
+			}
+			return wire.DecodeMapEntry(b, *target)
+		case 7:
+			req.Limit = int(int32(v))
+		case 8:
+			rec, err := wire.DecodeRecord(b)
+			if err != nil {
+				return err
+			}
+			req.Records = append(req.Records, rec)
+		}
+		return nil
+	})
+	return req, err
+}
+
+// ===================== CHANGE FEED =====================
+
+// Changes are logged and streamed by internal/changefeed.
+
+var feed = changefeed.New(keyRing, metrics)
+
+// ===================== CDC =====================
+
+// The CDC exporter follows the change log and delivers every event to the
+// sinks listed in the -cdc-config file, wrapped in a Debezium-style
+// envelope. Each sink runs independently and commits its own offset after
+// every delivered event, so a restart resumes where that sink stopped.
+//
+// Example config:
+//
+//	{
+//	  "offset_dir": "cdc",
+//	  "sinks": [
+//	    {"name": "lake", "type": "file", "path": "cdc/lake.ndjson", "max_bytes": 10485760, "max_files": 5},
+//	    {"name": "hook", "type": "webhook", "url": "http://localhost:9999/events", "database": "shop",
+//	     "max_retries": 5, "dead_letter": "cdc/hook.dead.ndjson"}
+//	  ]
+//	}
+
+type cdcConfig struct {
+	OffsetDir string          `json:"offset_dir"`
+	Sinks     []cdcSinkConfig `json:"sinks"`
+}
+
+type cdcSinkConfig struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"` // "file" or "webhook"
+	Database string `json:"database"`
+	Table    string `json:"table"`
+
+	// file sink
+	Path     string `json:"path"`
+	MaxBytes int64  `json:"max_bytes"`
+	MaxFiles int    `json:"max_files"`
+
+	// webhook sink
+	URL        string            `json:"url"`
+	Headers    map[string]string `json:"headers"`
+	TimeoutMS  int               `json:"timeout_ms"`
+	MaxRetries int               `json:"max_retries"`
+	BackoffMS  int               `json:"backoff_ms"`
+	DeadLetter string            `json:"dead_letter"`
+}
+
+// cdcEnvelope follows Debezium's payload layout: op is "c", "u" or "d".
+type cdcEnvelope struct {
+	Before map[string]string `json:"before"`
+	After  map[string]string `json:"after"`
+	Source cdcSource         `json:"source"`
+	Op     string            `json:"op"`
+	TsMs   int64             `json:"ts_ms"`
+}
+
+type cdcSource struct {
+	Connector string `json:"connector"`
+	Name      string `json:"name"`
+	Db        string `json:"db"`
+	Table     string `json:"table"`
+	LSN       uint64 `json:"lsn"`
+	Seq       int    `json:"seq"`
+	TsMs      int64  `json:"ts_ms"`
+}
+
+// cdcOffset is the last delivered event: the Seq-th event (1-based) of the
+// operation with the given LSN.
+type cdcOffset struct {
+	LSN uint64 `json:"lsn"`
+	Seq int    `json:"seq"`
+}
+
+type cdcSink interface {
+	deliver(env cdcEnvelope) error
+}
+
+type cdcSinkStatus struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Offset    cdcOffset `json:"offset"`
+	Committed int64     `json:"committed"`
+	Dead      int64     `json:"dead_lettered"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type cdcRunner struct {
+	cfg        cdcSinkConfig
+	sink       cdcSink
+	offsetFile string
+
+	mu     sync.Mutex
+	status cdcSinkStatus
+}
+
+var (
+	cdcMu      sync.Mutex
+	cdcRunners []*cdcRunner
+)
+
+func loadCDCConfig(file string) (*cdcConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg cdcConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if cfg.OffsetDir == "" {
+		cfg.OffsetDir = "cdc"
+	}
+	seen := map[string]bool{}
+	for i, s := range cfg.Sinks {
+		if s.Name == "" || seen[s.Name] {
+			return nil, fmt.Errorf("%s: sink %d needs a unique name", file, i)
+		}
+		seen[s.Name] = true
+		switch s.Type {
+		case "file":
+			if s.Path == "" {
+				return nil, fmt.Errorf("%s: file sink %q needs a path", file, s.Name)
+			}
+		case "webhook":
+			if s.URL == "" {
+				return nil, fmt.Errorf("%s: webhook sink %q needs a url", file, s.Name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: sink %q has unknown type %q", file, s.Name, s.Type)
+		}
+	}
+	return &cfg, nil
+}
+
+// startCDC starts one exporter goroutine per configured sink.
+func startCDC(file string) {
+	cfg, err := loadCDCConfig(file)
+	if err != nil {
+		telemetry.Fatal("Loading CDC config", "err", err)
+	}
+	if err := os.MkdirAll(cfg.OffsetDir, 0755); err != nil {
+		telemetry.Fatal("Creating CDC offset directory", "err", err)
+	}
+	for _, sc := range cfg.Sinks {
+		r := newCDCRunner(cfg.OffsetDir, sc)
+		cdcMu.Lock()
+		cdcRunners = append(cdcRunners, r)
+		cdcMu.Unlock()
+		slog.Info("CDC sink starting", "sink", sc.Name, "type", sc.Type, "after_lsn", r.status.Offset.LSN)
+		go r.run(context.Background())
+	}
+}
+
+// newCDCRunner returns the runner of a sink, resuming from the offset it
+// committed in offsetDir.
+func newCDCRunner(offsetDir string, sc cdcSinkConfig) *cdcRunner {
+	r := &cdcRunner{
+		cfg:        sc,
+		offsetFile: filepath.Join(offsetDir, sc.Name+".offset"),
+		status:     cdcSinkStatus{Name: sc.Name, Type: sc.Type},
+	}
+	switch sc.Type {
+	case "file":
+		r.sink = &cdcFileSink{path: sc.Path, maxBytes: sc.MaxBytes, maxFiles: sc.MaxFiles}
+	case "webhook":
+		hook := newCDCWebhookSink(sc)
+		hook.onDead = func(error) {
+			r.mu.Lock()
+			r.status.Dead++
+			r.mu.Unlock()
+		}
+		r.sink = hook
+	}
+	if data, err := os.ReadFile(r.offsetFile); err == nil {
+		json.Unmarshal(data, &r.status.Offset)
+	}
+	return r
+}
+
+// run streams changes after the committed offset until ctx is done.
+// Falling behind the live feed or a failing sink restarts the stream from
+// the offset.
+func (r *cdcRunner) run(ctx context.Context) {
+	filter := changefeed.Filter{Database: r.cfg.Database, Table: r.cfg.Table}
+	for ctx.Err() == nil {
+		r.mu.Lock()
+		off := r.status.Offset
+		r.mu.Unlock()
+
+		// Replay the committed LSN itself when it was only partly delivered;
+		// events up to off.Seq are skipped below.
+		from := off.LSN
+		if off.Seq > 0 && from > 0 {
+			from--
+		}
+		cur := cdcOffset{}
+		err := feed.Stream(ctx, filter, from, func(e changefeed.Event) error {
+			if e.LSN != cur.LSN {
+				cur = cdcOffset{LSN: e.LSN}
+			}
+			cur.Seq++
+			if cur.LSN == off.LSN && cur.Seq <= off.Seq {
+				return nil
+			}
+			if err := r.sink.deliver(newCDCEnvelope(e, cur.Seq)); err != nil {
+				return err
+			}
+			return r.commit(cur)
+		})
+		if err != nil && err != changefeed.ErrLagged && ctx.Err() == nil {
+			slog.Error("CDC sink failed", "sink", r.cfg.Name, "err", err)
+			r.mu.Lock()
+			r.status.LastError = err.Error()
+			r.mu.Unlock()
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// commit records off as delivered and persists it atomically.
+func (r *cdcRunner) commit(off cdcOffset) error {
+	data, _ := json.Marshal(off)
+	tmp := r.offsetFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.offsetFile); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.status.Offset = off
+	r.status.Committed++
+	r.mu.Unlock()
+	return nil
+}
+
+func newCDCEnvelope(e changefeed.Event, seq int) cdcEnvelope {
+	op := map[string]string{"insert": "c", "update": "u", "delete": "d"}[e.Op]
+	ts := e.Time.UnixMilli()
+	return cdcEnvelope{
+		Before: e.Before,
+		After:  e.After,
+		Source: cdcSource{Connector: "ddb", Name: "master", Db: e.Database, Table: e.Table, LSN: e.LSN, Seq: seq, TsMs: ts},
+		Op:     op,
+		TsMs:   time.Now().UnixMilli(),
+	}
+}
+
+// cdcFileSink appends envelopes as NDJSON and rotates the file once it
+// would grow past maxBytes, keeping path.1 ... path.<maxFiles>.
+type cdcFileSink struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func (s *cdcFileSink) deliver(env cdcEnvelope) error {
+	line, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line))+1 > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	return s.writeLine(line)
+}
+
+func (s *cdcFileSink) openFile() error {
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *cdcFileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	keep := s.maxFiles
+	if keep <= 0 {
+		keep = 1
+	}
+	os.Remove(fmt.Sprintf("%s.%d", s.path, keep))
+	for i := keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+	return s.openFile()
+}
+
+// cdcWebhookSink POSTs each envelope as JSON. Network errors, 429 and 5xx
+// responses are retried with exponential backoff; other failures and
+// exhausted retries go to the dead-letter file so the sink keeps moving.
+type cdcWebhookSink struct {
+	cfg    cdcSinkConfig
+	client *http.Client
+	dead   *cdcFileSink
+	onDead func(error)
+}
+
+func newCDCWebhookSink(cfg cdcSinkConfig) *cdcWebhookSink {
+	if cfg.TimeoutMS <= 0 {
+		cfg.TimeoutMS = 5000
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.BackoffMS <= 0 {
+		cfg.BackoffMS = 500
+	}
+	if cfg.DeadLetter == "" {
+		cfg.DeadLetter = cfg.Name + ".dead.ndjson"
+	}
+	return &cdcWebhookSink{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		dead:   &cdcFileSink{path: cfg.DeadLetter},
+	}
+}
+
+type cdcDeadLetter struct {
+	Sink     string      `json:"sink"`
+	Error    string      `json:"error"`
+	Attempts int         `json:"attempts"`
+	Event    cdcEnvelope `json:"event"`
+}
+
+func (s *cdcWebhookSink) deliver(env cdcEnvelope) error {
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	backoff := time.Duration(s.cfg.BackoffMS) * time.Millisecond
+	attempts := 0
+	for {
+		attempts++
+		retry, err := s.post(body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempts > s.cfg.MaxRetries {
+			slog.Warn("CDC sink dead-lettering event", "sink", s.cfg.Name, "lsn", env.Source.LSN, "attempts", attempts, "err", err)
+			if s.onDead != nil {
+				s.onDead(err)
+			}
+			line, _ := json.Marshal(cdcDeadLetter{Sink: s.cfg.Name, Error: err.Error(), Attempts: attempts, Event: env})
+			return s.dead.writeLine(line)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends one request and reports whether a failure is worth retrying.
+func (s *cdcWebhookSink) post(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("webhook returned %s", resp.Status)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
+
+func (s *cdcFileSink) writeLine(line []byte) error {
+	if s.file == nil {
+		if err := s.openFile(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(append(line, '\n'))
+	s.size += int64(n)
+	return err
+}
+
+// handleCDCStatus serves GET /cdc with the offset and counters of every sink.
+func handleCDCStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cdcMu.Lock()
+	statuses := make([]cdcSinkStatus, 0, len(cdcRunners))
+	for _, runner := range cdcRunners {
+		runner.mu.Lock()
+		statuses = append(statuses, runner.status)
+		runner.mu.Unlock()
+	}
+	cdcMu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"lsn": feed.LSN(), "sinks": statuses})
+}
+
+// ===================== AUTH =====================
+
+// internal/auth reads credentials and checks tokens and node signatures.
+// The master keeps the API keys, in -auth-file, and issues the tokens.
+
+// apiKey is a stored credential. Only a salted SHA-256 hash of the secret
+// is kept; the key itself is shown once when it is created.
+type apiKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Salt      string    `json:"salt"`
+	Hash      string    `json:"hash"`
+	Admin     bool      `json:"admin"`
+	Roles     []string  `json:"roles,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type authStore struct {
+	mu        sync.Mutex
+	path      string
+	JWTSecret string       `json:"jwt_secret"`
+	Keys      []*apiKey    `json:"keys"`
+	Grants    []auth.Grant `json:"grants"`
+}
+
+var apiKeys = &authStore{}
+
+// open loads the credential store, creating a JWT secret and an initial
+// admin key when the store is empty.
+func (s *authStore) open(path, jwtSecret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.path = path
+	if content, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(content, s); err != nil {
+			telemetry.Fatal("Reading credentials", "file", path, "err", err)
+		}
+	}
+	if jwtSecret != "" {
+		s.JWTSecret = jwtSecret
+	} else if s.JWTSecret == "" {
+		s.JWTSecret = randomToken(32)
+	}
+	if len(s.Keys) == 0 {
+		key, _ := s.createKey("admin", true)
+		// Printed rather than logged so the key stays out of log files.
+		fmt.Println("Created admin API key (shown once):", key)
+	}
+	if err := s.save(); err != nil {
+		telemetry.Fatal("Writing credentials", "file", path, "err", err)
+	}
+}
+
+// save writes the store and publishes the new access list; the caller
+// holds s.mu.
+func (s *authStore) save() error {
+	a := &auth.AccessList{Keys: map[string]auth.ACLKey{}, Grants: append([]auth.Grant(nil), s.Grants...)}
+	for _, k := range s.Keys {
+		a.Keys[k.ID] = auth.ACLKey{Name: k.Name, Admin: k.Admin, Roles: append([]string(nil), k.Roles...)}
+	}
+	auth.SetACL(a)
+	go replicateACL(a)
+	content, _ := json.MarshalIndent(s, "", "  ")
+	return os.WriteFile(s.path, content, 0600)
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		telemetry.Fatal("Generating random token", "err", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashSecret(salt, secret string) string {
+	sum := sha256.Sum256([]byte(salt + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createKey adds a key and returns it in full; the caller holds s.mu.
+func (s *authStore) createKey(name string, admin bool, roles ...string) (string, *apiKey) {
+	b := make([]byte, 4)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	for s.findKey(id) != nil {
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	secret := randomToken(24)
+	k := &apiKey{ID: id, Name: name, Salt: randomToken(16), Admin: admin, Roles: roles, CreatedAt: time.Now().UTC()}
+	k.Hash = hashSecret(k.Salt, secret)
+	s.Keys = append(s.Keys, k)
+	return "ddb_" + id + "." + secret, k
+}
+
+// findKey returns the key with the given id; the caller holds s.mu.
+func (s *authStore) findKey(id string) *apiKey {
+	for _, k := range s.Keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+// authenticate resolves an API key or token to its principal. Tokens stop
+// working as soon as the key they were issued for is revoked.
+func (s *authStore) authenticate(cred string) (*auth.Principal, error) {
+	if cred == "" {
+		return nil, auth.ErrUnauthenticated
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var id string
+	if rest, ok := strings.CutPrefix(cred, "ddb_"); ok {
+		keyID, secret, ok := strings.Cut(rest, ".")
+		k := s.findKey(keyID)
+		if !ok || k == nil || !hmac.Equal([]byte(hashSecret(k.Salt, secret)), []byte(k.Hash)) {
+			return nil, auth.ErrBadCredentials
+		}
+		id = k.ID
+	} else {
+		claims, err := auth.VerifyToken([]byte(s.JWTSecret), cred)
+		if err != nil {
+			return nil, err
+		}
+		id = claims.Subject
+	}
+	k := s.findKey(id)
+	if k == nil {
+		return nil, auth.ErrBadCredentials
+	}
+	return &auth.Principal{ID: k.ID, Name: k.Name, Admin: k.Admin}, nil
+}
+
+// requireAuth rejects requests without valid credentials when -auth is set
+// and makes the caller available through requestPrincipal.
+func requireAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authEnabled {
+			h(w, r)
+			return
+		}
+		p, err := apiKeys.authenticate(auth.BearerCredential(r))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ddb"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, auth.WithPrincipal(r, p))
+	}
+}
+
+// requireAdmin is requireAuth for endpoints that need cluster-wide admin.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return requireAuth(func(w http.ResponseWriter, r *http.Request) {
+		if auth.Authorize(auth.RequestPrincipal(r), auth.PrivAdmin, "", "") != nil {
+			http.Error(w, "Admin credentials required", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// handleAuthToken exchanges the caller's credentials for a signed token.
+// The optional body {"ttl_seconds": n} sets the lifetime, up to 24 hours.
+func handleAuthToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := auth.RequestPrincipal(r)
+	if p == nil {
+		http.Error(w, "Authentication is disabled", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		TTLSeconds int64 `json:"ttl_seconds"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	}
+	ttl := time.Duration(body.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	if ttl > 24*time.Hour {
+		ttl = 24 * time.Hour
+	}
+	now := time.Now()
+	claims := auth.TokenClaims{Subject: p.ID, Name: p.Name, Admin: p.Admin, Issuer: "ddb", IssuedAt: now.Unix(), ExpiresAt: now.Add(ttl).Unix()}
+	apiKeys.mu.Lock()
+	secret := []byte(apiKeys.JWTSecret)
+	apiKeys.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"token":      auth.SignToken(secret, claims),
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
+
+// handleAuthKeys lists (GET), creates (POST {"name", "admin"}) and revokes
+// (DELETE ?id=) API keys.
+func handleAuthKeys(w http.ResponseWriter, r *http.Request) {
+	if !authEnabled {
+		http.Error(w, "Authentication is disabled", http.StatusBadRequest)
+		return
+	}
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		type keyInfo struct {
+			ID        string    `json:"id"`
+			Name      string    `json:"name"`
+			Admin     bool      `json:"admin"`
+			Roles     []string  `json:"roles"`
+			CreatedAt time.Time `json:"created_at"`
+		}
+		keys := []keyInfo{}
+		for _, k := range apiKeys.Keys {
+			keys = append(keys, keyInfo{k.ID, k.Name, k.Admin, k.Roles, k.CreatedAt})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	case http.MethodPost:
+		var req struct {
+			Name  string   `json:"name"`
+			Admin bool     `json:"admin"`
+			Roles []string `json:"roles"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		key, k := apiKeys.createKey(req.Name, req.Admin, req.Roles...)
+		err := apiKeys.save()
+		audit.record(httpActor(r), auditEntry{Op: "create_key", Detail: fmt.Sprintf("%s %s admin=%t roles=%s", k.ID, k.Name, k.Admin, strings.Join(k.Roles, ","))}, err)
+		if err != nil {
+			http.Error(w, "Failed to save credentials", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": k.ID, "name": k.Name, "admin": k.Admin, "roles": k.Roles, "key": key})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		for i, k := range apiKeys.Keys {
+			if k.ID == id {
+				apiKeys.Keys = append(apiKeys.Keys[:i], apiKeys.Keys[i+1:]...)
+				err := apiKeys.save()
+				audit.record(httpActor(r), auditEntry{Op: "revoke_key", Detail: k.ID + " " + k.Name}, err)
+				if err != nil {
+					http.Error(w, "Failed to save credentials", http.StatusInternalServerError)
+					return
+				}
+				fmt.Fprintf(w, "Key %s revoked", id)
+				return
+			}
+		}
+		http.Error(w, "Key not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Only GET, POST or DELETE allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// grantRequest is the body of /auth/grant and /auth/revoke: either a
+// privilege for a role ({"role", "privilege", "database", "table"}) or a
+// role for a key ({"key", "role"}).
+type grantRequest struct {
+	auth.Grant
+	Key string `json:"key"`
+}
+
+// handleAuthGrant serves POST /auth/grant and POST /auth/revoke. Granting
+// privileges needs admin on the grant's scope, so a database admin can
+// manage its own database; assigning roles needs cluster admin.
+func handleAuthGrant(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authEnabled {
+		http.Error(w, "Authentication is disabled", http.StatusBadRequest)
+		return
+	}
+	revoke := strings.HasSuffix(r.URL.Path, "/revoke")
+	var req grantRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" {
+		if !auth.ValidPrivilege(req.Privilege) {
+			http.Error(w, "privilege must be read, write, ddl or admin", http.StatusBadRequest)
+			return
+		}
+		if req.Database == "" && req.Table != "" {
+			http.Error(w, "A table grant needs a database", http.StatusBadRequest)
+			return
+		}
+		if !checkAccess(w, r, auth.PrivAdmin, req.Database, req.Table) {
+			return
+		}
+	} else if !checkAccess(w, r, auth.PrivAdmin, "", "") {
+		return
+	}
+
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	found := false
+	if req.Key != "" {
+		k := apiKeys.findKey(req.Key)
+		if k == nil {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		roles := []string{}
+		for _, role := range k.Roles {
+			if role != req.Role {
+				roles = append(roles, role)
+			}
+		}
+		found = len(roles) < len(k.Roles)
+		if !revoke {
+			roles = append(roles, req.Role)
+		}
+		k.Roles = roles
+	} else {
+		grants := []auth.Grant{}
+		for _, g := range apiKeys.Grants {
+			if g != req.Grant {
+				grants = append(grants, g)
+			}
+		}
+		found = len(grants) < len(apiKeys.Grants)
+		if !revoke {
+			grants = append(grants, req.Grant)
+		}
+		apiKeys.Grants = grants
+	}
+	if found != revoke {
+		if revoke {
+			http.Error(w, "Grant not found", http.StatusNotFound)
+		} else {
+			w.Write([]byte("Already granted"))
+		}
+		return
+	}
+	err := apiKeys.save()
+	e := auditEntry{Op: "grant", Database: req.Database, Table: req.Table, Detail: "role " + req.Role + " " + req.Privilege}
+	if req.Key != "" {
+		e.Detail = "key " + req.Key + " role " + req.Role
+	}
+	if revoke {
+		e.Op = "revoke"
+	}
+	audit.record(httpActor(r), e, err)
+	if err != nil {
+		http.Error(w, "Failed to save credentials", http.StatusInternalServerError)
+		return
+	}
+	if revoke {
+		w.Write([]byte("Revoked"))
+	} else {
+		w.Write([]byte("Granted"))
+	}
+}
+
+// handleAuthGrants lists every grant (GET /auth/grants).
+func handleAuthGrants(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auth.CurrentACL().Grants)
+}
+
+// handleWhoAmI describes the caller and the grants it holds, so the UI can
+// show what it may do.
+func handleWhoAmI(w http.ResponseWriter, r *http.Request) {
+	p := auth.RequestPrincipal(r)
+	resp := map[string]interface{}{"auth": authEnabled}
+	if p != nil {
+		a := auth.CurrentACL()
+		resp["id"] = p.ID
+		resp["name"] = p.Name
+		resp["admin"] = p.Admin
+		resp["roles"] = a.Keys[p.ID].Roles
+		resp["grants"] = a.GrantsFor(p.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// replicateACL pushes the access list to every slave.
+func replicateACL(a *auth.AccessList) {
+	jsonData, _ := json.Marshal(a)
+	for _, slave := range slaveNodes {
+		hreq, err := http.NewRequest(http.MethodPost, slaveURL(slave, "replicate_acl"), bytes.NewReader(jsonData))
+		if err != nil {
+			continue
+		}
+		hreq.Header.Set("Content-Type", "application/json")
+		signNodeRequest(hreq, jsonData)
+		if resp, err := nodeClient.Do(hreq); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// signNodeRequest adds the node signature when -node-secret is set.
+func signNodeRequest(req *http.Request, body []byte) {
+	if nodeSecret == "" {
+		return
+	}
+	auth.SignNodeRequest(req, []byte(nodeSecret), body)
+}
+
+// ===================== ACCESS CONTROL =====================
+
+// Grants and the access list they form live in internal/auth.
+
+// checkAccess writes 403 and returns false when the caller of r lacks priv.
+func checkAccess(w http.ResponseWriter, r *http.Request, priv, db, table string) bool {
+	if err := auth.Authorize(auth.RequestPrincipal(r), priv, db, table); err != nil {
+		if priv != auth.PrivRead {
+			audit.record(httpActor(r), auditEntry{Op: path.Base(r.URL.Path), Database: db, Table: table}, err)
+		}
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// ===================== TLS =====================
+
+// newNodeClient returns the HTTP client used for replication: it trusts
+// only caFile and presents certFile as this node's identity.
+func newNodeClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	if certFile == "" {
+		return nil, errors.New("-node-ca needs -node-cert or -tls-cert")
+	}
+	cfg, err := tlsutil.NewClientConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// ===================== ENCRYPTION =====================
+
+// Data files and the change log are encrypted with AES-256-GCM when a key
+// is configured; internal/crypto holds the keys and seals the files.
+
+var keyRing = &crypto.Keyring{}
+
+// reencrypt writes the data file, the change log and the audit log again
+// under the newest key.
+func reencrypt() error {
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	if err == nil {
+		err = feed.Rewrite()
+	}
+	if err == nil {
+		err = audit.rewrite()
+	}
+	if err == nil {
+		err = txns.rewrite()
+	}
+	if err == nil {
+		err = leaders.rewrite()
+	}
+	return err
+}
+
+// handleEncryption serves GET /encryption with the key and re-encryption
+// state. POST reloads the key file, like SIGHUP, and starts re-encrypting
+// when the newest key changed.
+func handleEncryption(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !keyRing.Configured() {
+			http.Error(w, "Encryption is not configured", http.StatusConflict)
+			return
+		}
+		err := keyRing.Rotate(reencrypt)
+		audit.record(httpActor(r), auditEntry{Op: "rotate_key", Detail: "key " + keyRing.Status().KeyID}, err)
+		if err != nil {
+			http.Error(w, "Reloading keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Only GET or POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keyRing.Status())
+}
+
+// ===================== AUDIT =====================
+
+// The audit log records every change to data, schema, keys, grants and
+// encryption keys with who made it and from where. Entries are appended
+// to -audit-file and hash-chained: each entry holds the hash of the one
+// before, so editing or removing an entry breaks the chain from that
+// point on. Denied changes are recorded too, with their error.
+
+type auditEntry struct {
+	Seq         uint64    `json:"seq"`
+	Time        time.Time `json:"ts"`
+	PrincipalID string    `json:"principal_id,omitempty"`
+	Principal   string    `json:"principal,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Protocol    string    `json:"protocol"`
+	RequestID   string    `json:"request_id,omitempty"`
+	Op          string    `json:"op"`
+	Database    string    `json:"database,omitempty"`
+	Table       string    `json:"table,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+	Rows        int       `json:"rows"`
+	Error       string    `json:"error,omitempty"`
+	PrevHash    string    `json:"prev_hash"`
+	Hash        string    `json:"hash"`
+}
+
+// auditActor is who made a change and over which protocol.
+type auditActor struct {
+	User      *auth.Principal
+	Source    string
+	Protocol  string
+	RequestID string
+}
+
+func httpActor(r *http.Request) auditActor {
+	return auditActor{User: auth.RequestPrincipal(r), Source: r.RemoteAddr, Protocol: "http", RequestID: telemetry.RequestID(r)}
+}
+
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	seq      uint64
+	lastHash string
+}
+
+var audit = &auditLog{}
+
+// hash returns the chain hash of e, which covers every field but Hash.
+func (e auditEntry) hash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// open verifies the existing log, continues its chain and opens it for
+// appending. A broken chain is reported but does not stop the master.
+func (l *auditLog) open(path string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path = path
+	res, err := verifyAuditLog(path)
+	if errors.Is(err, crypto.ErrNoKey) {
+		telemetry.Fatal("Reading audit log", "file", path, "err", err)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Reading audit log", "file", path, "err", err)
+	}
+	if !res.OK {
+		slog.Warn("Audit log chain is broken", "file", path, "entry", res.BrokenAt, "reason", res.Error)
+	}
+	l.seq, l.lastHash = res.lastSeq, res.lastHash
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		slog.Error("Opening audit log", "file", path, "err", err)
+		return
+	}
+	l.file = file
+}
+
+// record appends e for actor. err is the reason the change failed, if
+// it did; failed changes are recorded with zero rows.
+func (l *auditLog) record(actor auditActor, e auditEntry, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	l.seq++
+	e.Seq = l.seq
+	e.Time = time.Now().UTC()
+	if actor.User != nil {
+		e.PrincipalID, e.Principal = actor.User.ID, actor.User.Name
+	}
+	e.Source, e.Protocol, e.RequestID = actor.Source, actor.Protocol, actor.RequestID
+	if err != nil {
+		e.Rows, e.Error = 0, err.Error()
+	}
+	e.PrevHash = l.lastHash
+	e.Hash = e.hash()
+	line, _ := json.Marshal(e)
+	_, werr := l.file.Write(append(keyRing.SealLine(line), '\n'))
+	auditHealth.Report(werr)
+	if werr != nil {
+		slog.Error("Writing audit log", "err", werr)
+		return
+	}
+	l.lastHash = e.Hash
+}
+
+// rewrite re-encrypts the log under the newest key. The chain covers the
+// plain entries, so it stays valid.
+func (l *auditLog) rewrite() error {
+	if l.path == "" {
+		return nil
+	}
+	return keyRing.RewriteLog(l.path, &l.mu, func(file *os.File) {
+		if l.file != nil {
+			l.file.Close()
+		}
+		l.file = file
+	})
+}
+
+// readAuditLog calls fn for every entry in order until fn returns false.
+func readAuditLog(path string, fn func(auditEntry) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		line, err := keyRing.OpenLine(sc.Bytes())
+		if errors.Is(err, crypto.ErrNoKey) {
+			return err
+		}
+		var e auditEntry
+		if err != nil || json.Unmarshal(line, &e) != nil {
+			e = auditEntry{Error: "unreadable entry"}
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+type auditVerifyResult struct {
+	OK       bool   `json:"ok"`
+	Entries  int    `json:"entries"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	lastSeq  uint64
+	lastHash string
+}
+
+// verifyAuditLog checks that sequence numbers are contiguous and every
+// entry links to and hashes like the one before.
+func verifyAuditLog(path string) (auditVerifyResult, error) {
+	res := auditVerifyResult{OK: true}
+	err := readAuditLog(path, func(e auditEntry) bool {
+		res.Entries++
+		switch {
+		case e.Seq != res.lastSeq+1:
+			res.Error = fmt.Sprintf("expected entry %d, found %d", res.lastSeq+1, e.Seq)
+		case e.PrevHash != res.lastHash:
+			res.Error = "previous hash does not match"
+		case e.Hash != e.hash():
+			res.Error = "entry hash does not match its contents"
+		}
+		if res.Error != "" && res.OK {
+			res.OK, res.BrokenAt = false, res.lastSeq+1
+		}
+		if e.Seq > res.lastSeq {
+			res.lastSeq = e.Seq
+		}
+		res.lastHash = e.Hash
+		return true
+	})
+	return res, err
+}
+
+// handleAudit serves GET /audit?since=&until=&principal=&op=&database=&table=&limit=.
+// since and until are RFC 3339 times, principal matches a key name or
+// id, and the newest limit (default 1000) matching entries are returned
+// oldest first.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if audit.path == "" {
+		http.Error(w, "Audit log is disabled", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	var since, until time.Time
+	for name, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(name); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	limit := 1000
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	who, op, db, table := q.Get("principal"), q.Get("op"), q.Get("database"), q.Get("table")
+
+	entries := []auditEntry{}
+	err := readAuditLog(audit.path, func(e auditEntry) bool {
+		switch {
+		case !since.IsZero() && e.Time.Before(since), !until.IsZero() && e.Time.After(until):
+		case who != "" && e.Principal != who && e.PrincipalID != who:
+		case op != "" && e.Op != op, db != "" && e.Database != db, table != "" && e.Table != table:
+		default:
+			entries = append(entries, e)
+			if len(entries) > limit {
+				entries = entries[1:]
+			}
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Reading audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// handleAuditVerify serves GET /audit/verify.
+func handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	if audit.path == "" {
+		http.Error(w, "Audit log is disabled", http.StatusBadRequest)
+		return
+	}
+	res, err := verifyAuditLog(audit.path)
+	if err != nil && !os.IsNotExist(err) {
+		http.Error(w, "Reading audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// ===================== METRICS =====================
+
+// /metrics serves the Prometheus text format. Counters and histograms are
+// updated as requests run; gauges such as table sizes are collected when
+// the endpoint is scraped.
+
+// metricInfo is the TYPE and HELP line of each metric family.
+var metricInfo = map[string][2]string{
+	"ddb_table_records":                              {"gauge", "Records per table."},
+	"ddb_snapshot_write_duration_seconds":            {"histogram", "Time to write the data file."},
+	"ddb_changelog_write_duration_seconds":           {"histogram", "Time to append a batch to the change log."},
+	"ddb_changelog_lsn":                              {"gauge", "Last LSN written to the change log."},
+	"ddb_replication_queue_depth":                    {"gauge", "Replication requests in flight per replica."},
+	"ddb_replication_requests_total":                 {"counter", "Replication requests per replica by result."},
+	"ddb_replication_duration_seconds":               {"histogram", "Replication request latency per replica."},
+	"ddb_replication_lag_lsn":                        {"gauge", "Changes written on the master but not yet acknowledged by the replica."},
+	"ddb_replication_last_ack_timestamp_seconds":     {"gauge", "Unix time of the replica's last successful replication request."},
+	"ddb_replica_reads_total":                        {"counter", "Selects with a staleness bound by the node that served them."},
+	"ddb_anti_entropy_divergent_rows":                {"gauge", "Rows that differ from the master per replica in the last consistency check."},
+	"ddb_anti_entropy_repaired_rows_total":           {"counter", "Rows repaired on the replica by consistency checks."},
+	"ddb_replication_applied_lsn":                    {"gauge", "Last LSN applied from the master."},
+	"ddb_replication_last_applied_timestamp_seconds": {"gauge", "Unix time a change from the master was last applied."},
+}
+
+var metrics = telemetry.NewRegistry(metricInfo)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// handleMetrics serves GET /metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	collectTableMetrics()
+	collectReplicationMetrics()
+	metrics.Serve(w)
+}
+
+// collectTableMetrics sets the table size and change log gauges.
+func collectTableMetrics() {
+	metrics.Reset("ddb_table_records")
+	dbMu.Lock()
+	for dbName, db := range databases {
+		for tableName, table := range db.Tables {
+			table.mu.Lock()
+			n := len(table.Records)
+			table.mu.Unlock()
+			metrics.Set("ddb_table_records", telemetry.Labels("database", dbName, "table", tableName), float64(n))
+		}
+	}
+	dbMu.Unlock()
+	metrics.Set("ddb_changelog_lsn", "", float64(feed.LSN()))
+}
+
+// ===================== LIFECYCLE =====================
+
+// /healthz and /readyz are served by internal/lifecycle from nodeChecks
+// and replicationHealth.
+//
+// On SIGTERM or SIGINT the node stops accepting connections, lets requests
+// in progress finish, saves its data file and syncs its logs to disk
+// before it exits. A second signal exits immediately.
+
+var node = lifecycle.NewNode(nodeChecks, replicationHealth)
+
+var dataHealth lifecycle.Check
+
+// storageChecks reports the data file and change log.
+func storageChecks() map[string]string {
+	return map[string]string{"data_file": dataHealth.Status(), "change_log": feed.Status()}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT and then shuts the node
+// down, giving requests in progress up to timeout to finish.
+func waitForShutdown(timeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+	signal.Stop(sig)
+	slog.Info("Shutting down", "signal", s.String(), "timeout", timeout)
+	node.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdown(ctx)
+
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	dataHealth.Report(err)
+	if err != nil {
+		slog.Error("Saving data file", "err", err)
+	}
+	if err := feed.Sync(); err != nil {
+		slog.Error("Syncing change log", "err", err)
+	}
+	if err := leaders.sync(); err != nil {
+		slog.Error("Syncing peer journal", "err", err)
+	}
+	slog.Info("Shutdown complete")
+	telemetry.FlushTraces()
+}
+
+var auditHealth lifecycle.Check
+
+// nodeChecks adds the audit log to the storage checks.
+func nodeChecks() map[string]string {
+	checks := storageChecks()
+	if auditFile != "" {
+		checks["audit_log"] = auditHealth.Status()
+		audit.mu.Lock()
+		if audit.file == nil {
+			checks["audit_log"] = "not open"
+		}
+		audit.mu.Unlock()
+	}
+	return checks
+}
+
+type replicaHealth struct {
+	Replica   string     `json:"replica"`
+	InFlight  int        `json:"in_flight"`
+	LagLSN    uint64     `json:"lag_lsn"`
+	LastAck   *time.Time `json:"last_ack,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// replicationHealth describes each slave. An unreachable slave does not
+// fail the checks since the master keeps accepting writes without it.
+func replicationHealth() any {
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	list := []replicaHealth{}
+	for _, slave := range slaveNodes {
+		h := replicaHealth{Replica: strings.TrimSuffix(slaveURL(slave, ""), "/")}
+		if st := replicaStates[h.Replica]; st != nil {
+			h.InFlight, h.LastError = st.inflight, st.lastErr
+			if st.sentLSN > st.ackedLSN {
+				h.LagLSN = st.sentLSN - st.ackedLSN
+			}
+			if !st.lastAck.IsZero() {
+				t := st.lastAck.UTC()
+				h.LastAck = &t
+			}
+		}
+		list = append(list, h)
+	}
+	return list
+}
+
+// shutdown drains the HTTP servers and the PostgreSQL and Redis sessions,
+// then waits for replication requests still on their way to the slaves.
+func shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := sessions.drain(ctx); err != nil {
+			slog.Warn("PostgreSQL and Redis sessions still running at shutdown", "err", err)
+		}
+	}()
+	node.ShutdownServers(ctx)
+	<-done
+	if err := lifecycle.Wait(ctx, &replicationWG); err != nil {
+		slog.Warn("Replication to slaves unfinished at shutdown", "err", err)
+	}
+	if err := audit.sync(); err != nil {
+		slog.Error("Syncing audit log", "err", err)
+	}
+}
+
+func (l *auditLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+// sessionTracker follows PostgreSQL and Redis connections so shutdown can
+// let each finish the command it is running.
+type sessionTracker struct {
+	mu        sync.Mutex
+	draining  bool
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+var sessions = &sessionTracker{conns: map[net.Conn]bool{}}
+
+func (t *sessionTracker) listen(ln net.Listener) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, ln)
+	if t.draining {
+		ln.Close()
+	}
+}
+
+// serve runs handle for conn in a new goroutine.
+func (t *sessionTracker) serve(conn net.Conn, handle func(net.Conn)) {
+	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		conn.Close()
+		return
+	}
+	t.conns[conn] = true
+	t.wg.Add(1)
+	t.mu.Unlock()
+	go func() {
+		defer t.wg.Done()
+		defer func() {
+			// A bug in one session must not take the server down with it.
+			if r := recover(); r != nil {
+				slog.Error("Session panicked", "remote", conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+				conn.Close()
+			}
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+		handle(conn)
+	}()
+}
+
+// drain closes the listeners and waits for the sessions. A read deadline
+// in the past ends each session when it next waits for a command, so a
+// command in progress still completes.
+func (t *sessionTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	for _, ln := range t.listeners {
+		ln.Close()
+	}
+	for conn := range t.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+	return lifecycle.Wait(ctx, &t.wg)
+}
+
+// ===================== SHARDING =====================
+
+// With -shard-map, tables are partitioned across several master groups,
+// each a master with its own slaves. The shard map lists the groups and
+// the shard key column of each partitioned table; a row belongs to the
+// shard that owns the hash of its key on a consistent hash ring. Tables
+// not in the map live on the first shard.
+//
+// Every master routes: writes go to the shard that owns the row, and
+// selects without the shard key are sent to every shard and merged.
+// Masters call each other on /shard/exec, signed like replication
+// requests. Each call carries the caller's map version; a master with a
+// different version answers 409 with its map, and the two keep the newer
+// one before the call is retried. POST /shards sets a new map with the
+// next version and pushes it to every master.
+
+var (
+	errShardKeyMissing  = errors.New("Record is missing the shard key column")
+	errShardKeyUpdate   = errors.New("The shard key column cannot be updated")
+	errShardUnavailable = errors.New("Shard unavailable")
+	errStaleShardMap    = errors.New("Shard map changed, retry the request")
+)
+
+const defaultVNodes = 64
+
+type shardInfo struct {
+	ID       string   `json:"id"`
+	Master   string   `json:"master"`             // base URL, e.g. http://db2:8000
+	Replicas []string `json:"replicas,omitempty"` // the group's slaves, for clients
+	Points   []string `json:"points,omitempty"`   // ring points owned, id#0 to id#vnodes-1 when empty
+}
+
+// pointNames returns the names of the ring points s owns.
+func (s shardInfo) pointNames(vnodes int) []string {
+	if len(s.Points) > 0 {
+		return s.Points
+	}
+	if vnodes <= 0 {
+		vnodes = defaultVNodes
+	}
+	names := make([]string, vnodes)
+	for v := range names {
+		names[v] = s.ID + "#" + strconv.Itoa(v)
+	}
+	return names
+}
+
+type shardMap struct {
+	Version int               `json:"version"`
+	Shards  []shardInfo       `json:"shards"`
+	Tables  map[string]string `json:"tables,omitempty"` // "database.table" to shard key column
+	VNodes  int               `json:"vnodes,omitempty"` // ring points per shard, 64 when 0
+}
+
+func (m *shardMap) validate() error {
+	if len(m.Shards) == 0 {
+		return errors.New("shard map has no shards")
+	}
+	seen, points := map[string]bool{}, map[string]bool{}
+	for _, s := range m.Shards {
+		if s.ID == "" || s.Master == "" {
+			return errors.New("every shard needs an id and a master URL")
+		}
+		if seen[s.ID] {
+			return fmt.Errorf("duplicate shard %q", s.ID)
+		}
+		seen[s.ID] = true
+		for _, p := range s.pointNames(m.VNodes) {
+			if points[p] {
+				return fmt.Errorf("ring point %q belongs to two shards", p)
+			}
+			points[p] = true
+		}
+	}
+	for t, key := range m.Tables {
+		if db, table, ok := strings.Cut(t, "."); !ok || db == "" || table == "" || key == "" {
+			return fmt.Errorf("table %q must be database.table with a shard key column", t)
+		}
+	}
+	return nil
+}
+
+// shardRing is a consistent hash ring. Each shard has VNodes points,
+// placed by hashing their names, and owns the keys that hash up to each
+// of them, so adding a shard only moves the keys the new shard takes
+// over. Rebalancing hands named points from one shard to another.
+type shardRing struct {
+	points []uint64
+	owners []int // index in shardMap.Shards of each point
+}
+
+func hashShardKey(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+func newShardRing(m *shardMap) *shardRing {
+	type point struct {
+		hash  uint64
+		shard int
+	}
+	var points []point
+	for i, s := range m.Shards {
+		for _, name := range s.pointNames(m.VNodes) {
+			points = append(points, point{hashShardKey(name), i})
+		}
+	}
+	sort.Slice(points, func(a, b int) bool { return points[a].hash < points[b].hash })
+	r := &shardRing{}
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.shard)
+	}
+	return r
+}
+
+// owner returns the index of the shard that owns key.
+func (r *shardRing) owner(key string) int {
+	h := hashShardKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[i]
+}
+
+type shardState struct {
+	mu   sync.RWMutex
+	file string
+	self string // this master's shard ID
+	m    *shardMap
+	ring *shardRing
+
+	// owning is held for reading while an operation runs on this shard's
+	// rows, and for writing while a migration cuts over to a new map.
+	owning    sync.RWMutex
+	migrating sync.Mutex // one migration out of this shard at a time
+}
+
+var shards = &shardState{}
+
+// loadShards reads the shard map file. A missing file leaves sharding off
+// until a map is set with POST /shards or pushed by another master.
+func loadShards(file, self string) error {
+	shards.file, shards.self = file, self
+	data, err := keyRing.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var m shardMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	if err := m.validate(); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	shards.m, shards.ring = &m, newShardRing(&m)
+	return nil
+}
+
+func (s *shardState) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m != nil
+}
+
+func (s *shardState) current() (*shardMap, *shardRing) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m, s.ring
+}
+
+// install saves m and starts routing with it, unless the map in use is
+// as new.
+func (s *shardState) install(m *shardMap) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m != nil && m.Version <= s.m.Version {
+		return false, nil
+	}
+	data, _ := json.MarshalIndent(m, "", "  ")
+	if err := keyRing.WriteFile(s.file, data, 0644); err != nil {
+		return false, err
+	}
+	s.m, s.ring = m, newShardRing(m)
+	slog.Info("Installed shard map", "version", m.Version, "shards", len(m.Shards))
+	return true, nil
+}
+
+// shardExec is one operation sent to a shard.
+type shardExec struct {
+	Version int                 `json:"version"`
+	Op      string              `json:"op"`
+	Request RequestData         `json:"request"`
+	Records []map[string]string `json:"records,omitempty"` // insert_batch
+	Limit   int                 `json:"limit,omitempty"`   // select
+}
+
+type shardResult struct {
+	Count   int                 `json:"count"`
+	Records []map[string]string `json:"records,omitempty"`
+	Columns []string            `json:"columns,omitempty"`
+	Error   string              `json:"error,omitempty"`
+	Map     *shardMap           `json:"shard_map,omitempty"` // the shard's map, with 409
+}
+
+// plan returns the operation each shard has to run for x, by index in
+// m.Shards, and whether x goes to every shard.
+func (m *shardMap) plan(ring *shardRing, x shardExec) (map[int]shardExec, bool, error) {
+	all := func() (map[int]shardExec, bool, error) {
+		p := map[int]shardExec{}
+		for i := range m.Shards {
+			p[i] = x
+		}
+		return p, true, nil
+	}
+	switch x.Op {
+	case "create_database", "drop_database", "create_table", "drop_table":
+		return all()
+	}
+	req := x.Request
+	key := m.Tables[req.Database+"."+req.Table]
+	if key == "" {
+		return map[int]shardExec{0: x}, false, nil
+	}
+	switch x.Op {
+	case "insert":
+		v, ok := req.Record[key]
+		if !ok {
+			return nil, false, fmt.Errorf("%w %s", errShardKeyMissing, key)
+		}
+		return map[int]shardExec{ring.owner(v): x}, false, nil
+	case "insert_batch":
+		p := map[int]shardExec{}
+		for _, record := range x.Records {
+			v, ok := record[key]
+			if !ok {
+				return nil, false, fmt.Errorf("%w %s", errShardKeyMissing, key)
+			}
+			i := ring.owner(v)
+			sx, ok := p[i]
+			if !ok {
+				sx, sx.Records = x, nil
+			}
+			sx.Records = append(sx.Records, record)
+			p[i] = sx
+		}
+		return p, false, nil
+	}
+	if _, ok := req.UpdateData[key]; ok {
+		return nil, false, errShardKeyUpdate
+	}
+	if v, ok := req.Conditions[key]; ok {
+		return map[int]shardExec{ring.owner(v): x}, false, nil
+	}
+	return all()
+}
+
+// shardOutcome is what one shard did with its part of an operation.
+type shardOutcome struct {
+	shard int
+	x     shardExec
+	res   shardResult
+	err   error
+}
+
+// run sends each shard its part of plan in parallel and returns the
+// outcomes in shard order.
+func (m *shardMap) run(plan map[int]shardExec) []shardOutcome {
+	outcomes := make([]shardOutcome, 0, len(plan))
+	for i, x := range plan {
+		x.Version = m.Version
+		outcomes = append(outcomes, shardOutcome{shard: i, x: x})
+	}
+	sort.Slice(outcomes, func(a, b int) bool { return outcomes[a].shard < outcomes[b].shard })
+	var wg sync.WaitGroup
+	for n := range outcomes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o := &outcomes[n]
+			o.res, o.err = m.exec(o.shard, o.x)
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// routeShards runs x on the shards that hold its rows and merges their
+// results in shard order. Counts are added up. When a shard fails the
+// first error is returned, preferring errShardUnavailable so the client
+// knows to retry.
+func routeShards(x shardExec) (shardResult, error) {
+	m, ring := shards.current()
+	plan, _, err := m.plan(ring, x)
+	if err != nil {
+		return shardResult{}, err
+	}
+	// A shard with another map version has not run its part. Once the two
+	// masters agree on a map the part is planned again, except that parts
+	// meant for every shard go back to the same shard.
+	var outcomes []shardOutcome
+	done := m.run(plan)
+	cur, curRing := shards.current()
+	for _, o := range done {
+		if !errors.Is(o.err, errStaleShardMap) {
+			outcomes = append(outcomes, o)
+			continue
+		}
+		sub, broadcast, err := cur.plan(curRing, o.x)
+		if err != nil {
+			o.err = err
+			outcomes = append(outcomes, o)
+			continue
+		}
+		if broadcast {
+			sub = map[int]shardExec{}
+			for i, s := range cur.Shards {
+				if s.ID == m.Shards[o.shard].ID {
+					sub[i] = o.x
+				}
+			}
+		}
+		outcomes = append(outcomes, cur.run(sub)...)
+	}
+
+	res := shardResult{Records: []map[string]string{}}
+	var firstErr error
+	for _, o := range outcomes {
+		if o.err != nil {
+			if firstErr == nil || errors.Is(o.err, errShardUnavailable) && !errors.Is(firstErr, errShardUnavailable) {
+				firstErr = o.err
+			}
+			continue
+		}
+		res.Count += o.res.Count
+		res.Records = append(res.Records, o.res.Records...)
+		if res.Columns == nil {
+			res.Columns = o.res.Columns
+		}
+	}
+	return res, firstErr
+}
+
+// exec runs x on shard i of m, directly when it is this master's shard.
+func (m *shardMap) exec(i int, x shardExec) (shardResult, error) {
+	shard := m.Shards[i]
+	if shard.ID == shards.self {
+		res, _, err := execOwned(x)
+		return res, err
+	}
+	trace := x.Request.Span.ClientChild("shard " + shard.ID)
+	defer trace.End()
+	trace.Set("shard.id", shard.ID)
+	trace.Set("shard.op", x.Op)
+
+	body, _ := json.Marshal(x)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(shard.Master, "/")+"/shard/exec", bytes.NewReader(body))
+	if err != nil {
+		return shardResult{}, fmt.Errorf("%w: %s: %v", errShardUnavailable, shard.ID, err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set(telemetry.RequestIDHeader, x.Request.RequestID)
+	if tp := trace.Traceparent(); tp != "" {
+		hreq.Header.Set(telemetry.TraceparentHeader, tp)
+	}
+	signNodeRequest(hreq, body)
+	resp, err := nodeClient.Do(hreq)
+	if err != nil {
+		trace.Fail(err)
+		return shardResult{}, fmt.Errorf("%w: %s: %v", errShardUnavailable, shard.ID, err)
+	}
+	defer resp.Body.Close()
+	var res shardResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		err = fmt.Errorf("%w: %s returned %s", errShardUnavailable, shard.ID, resp.Status)
+		trace.Fail(err)
+		return shardResult{}, err
+	}
+	if resp.StatusCode == http.StatusConflict {
+		shards.reconcile(shard, m, res.Map)
+		return shardResult{}, errStaleShardMap
+	}
+	if res.Error != "" {
+		err := shardError(res.Error)
+		trace.Fail(err)
+		return shardResult{}, err
+	}
+	return res, nil
+}
+
+// execOwned runs x on this master's rows if x was planned with the map in
+// use, and returns that map otherwise.
+func execOwned(x shardExec) (shardResult, *shardMap, error) {
+	shards.owning.RLock()
+	defer shards.owning.RUnlock()
+	if m, _ := shards.current(); m == nil || m.Version != x.Version {
+		return shardResult{}, m, errStaleShardMap
+	}
+	res, err := execLocal(x)
+	return res, nil, err
+}
+
+// execLocal runs x on this master's own tables.
+func execLocal(x shardExec) (shardResult, error) {
+	req := x.Request
+	req.Routed = true
+	var res shardResult
+	var err error
+	switch x.Op {
+	case "create_database":
+		err = createLocalDatabase(req.Database)
+	case "drop_database":
+		err = dropLocalDatabase(req.Database)
+	case "create_table":
+		err = createTable(req)
+	case "drop_table":
+		err = dropTable(req)
+	case "insert":
+		if err = insertRecord(req); err == nil {
+			res.Count = 1
+		}
+	case "insert_batch":
+		res.Count, err = insertRecords(req, x.Records)
+	case "update":
+		res.Count, err = updateRecords(req)
+	case "delete":
+		res.Count, err = deleteRecords(req)
+	case "select":
+		res.Records, res.Columns, err = selectLocalRecords(req.Database, req.Table, req.Conditions, x.Limit)
+	default:
+		err = fmt.Errorf("unknown shard operation %q", x.Op)
+	}
+	return res, err
+}
+
+// shardError turns an error message from another shard back into the
+// error it stands for, so it maps to the same status code.
+func shardError(msg string) error {
+	for _, err := range []error{errDatabaseNotFound, errTableNotFound, errDatabaseExists, errTableExists} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	if strings.HasPrefix(msg, errShardUnavailable.Error()) {
+		return fmt.Errorf("%w%s", errShardUnavailable, strings.TrimPrefix(msg, errShardUnavailable.Error()))
+	}
+	return errors.New(msg)
+}
+
+// reconcile settles a version mismatch with peer: a newer map from the
+// peer is installed, an older one is replaced by pushing ours.
+func (s *shardState) reconcile(peer shardInfo, ours, theirs *shardMap) {
+	if theirs != nil && theirs.Version > ours.Version {
+		if err := theirs.validate(); err != nil {
+			slog.Warn("Invalid shard map from peer", "shard", peer.ID, "err", err)
+			return
+		}
+		if _, err := s.install(theirs); err != nil {
+			slog.Error("Saving shard map", "file", s.file, "err", err)
+		}
+		return
+	}
+	if err := pushShardMap(peer, ours); err != nil {
+		slog.Warn("Pushing shard map", "shard", peer.ID, "err", err)
+	}
+}
+
+// pushShardMap sends m to the master of peer. A peer with a newer map
+// answers with it, and that map is installed instead.
+func pushShardMap(peer shardInfo, m *shardMap) error {
+	var newer shardMap
+	err := postNode(peer, "/shard/map", m, &newer)
+	var conflict *nodeConflict
+	if errors.As(err, &conflict) && newer.Version > m.Version && newer.validate() == nil {
+		_, err = shards.install(&newer)
+	}
+	return err
+}
+
+// nodeConflict is a 409 answer from another master.
+type nodeConflict struct{ peer string }
+
+func (e *nodeConflict) Error() string { return e.peer + " has a different shard map" }
+
+// postNode posts in as JSON to path on the master of peer and decodes the
+// answer into out, which a 409 answer is decoded into as well.
+func postNode(peer shardInfo, path string, in, out any) error {
+	return postNodeContext(context.Background(), peer, path, in, out)
+}
+
+func postNodeContext(ctx context.Context, peer shardInfo, path string, in, out any) error {
+	body, _ := json.Marshal(in)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer.Master, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	signNodeRequest(hreq, body)
+	resp, err := nodeClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+		if out != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+				return fmt.Errorf("%s: %v", peer.ID, err)
+			}
+		}
+		if resp.StatusCode == http.StatusConflict {
+			return &nodeConflict{peer.ID}
+		}
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s returned %s: %s", peer.ID, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// pushShardMaps sends the current map to every other master and returns
+// the shards that could not be reached. extra are masters that should
+// hear about the map although it no longer lists them.
+func pushShardMaps(extra []shardInfo) []string {
+	m, _ := shards.current()
+	if m == nil {
+		return nil
+	}
+	peers := map[string]shardInfo{}
+	for _, s := range append(append([]shardInfo{}, m.Shards...), extra...) {
+		if s.ID != shards.self {
+			peers[s.ID] = s
+		}
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	unreachable := []string{}
+	for _, id := range sortedKeys(peers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pushShardMap(peers[id], m); err != nil {
+				slog.Warn("Pushing shard map", "shard", id, "err", err)
+				mu.Lock()
+				unreachable = append(unreachable, id)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(unreachable)
+	return unreachable
+}
+
+// handleShardExec serves POST /shard/exec for other masters.
+func handleShardExec(w http.ResponseWriter, r *http.Request) {
+	var x shardExec
+	if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	x.Request.RequestID = telemetry.RequestID(r)
+	x.Request.Span = telemetry.RequestSpan(r)
+	res, m, err := execOwned(x)
+	w.Header().Set("Content-Type", "application/json")
+	if err == errStaleShardMap {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(shardResult{Error: err.Error(), Map: m})
+		return
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleShardMap serves POST /shard/map, where other masters push a newer
+// map.
+func handleShardMap(w http.ResponseWriter, r *http.Request) {
+	var m shardMap
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := m.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if shards.file == "" {
+		http.Error(w, "Sharding is not enabled on this master", http.StatusNotFound)
+		return
+	}
+	if cur, _ := shards.current(); cur != nil && cur.Version > m.Version {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(cur)
+		return
+	}
+	if _, err := shards.install(&m); err != nil {
+		http.Error(w, "Saving shard map failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleShards serves GET /shards, the shard map in use, and POST
+// /shards, which sets a new map and pushes it to every master.
+func handleShards(w http.ResponseWriter, r *http.Request) {
+	if shards.file == "" {
+		http.Error(w, "Sharding is not enabled, start the master with -shard-map", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		m, _ := shards.current()
+		if m == nil {
+			http.Error(w, "No shard map has been set", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m)
+	case http.MethodPost:
+		var m shardMap
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if err := m.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		old, _ := shards.current()
+		m.Version = 1
+		if old != nil {
+			m.Version = old.Version + 1
+		}
+		installed, err := shards.install(&m)
+		if err == nil && !installed {
+			err = errStaleShardMap
+		}
+		audit.record(httpActor(r), auditEntry{Op: "set_shard_map", Detail: fmt.Sprintf("version %d, %d shards", m.Version, len(m.Shards))}, err)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+		var extra []shardInfo
+		if old != nil {
+			extra = old.Shards
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"version": m.Version, "unreachable": pushShardMaps(extra)})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// requireNode accepts only requests from other masters: with a client
+// certificate signed by -node-ca when the listener asks for one, and
+// signed with -node-secret when it is set. With neither, only
+// -insecure-replication lets them through.
+func requireNode(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mtls := serverTLS != nil && serverTLS.ClientCAs != nil
+		if mtls && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "A node client certificate is required", http.StatusForbidden)
+			return
+		}
+		if nodeSecret == "" {
+			if !mtls && !insecureNodes {
+				http.Error(w, "Node requests need -node-secret or -node-ca", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if !auth.VerifyNodeSignature([]byte(nodeSecret), r, body) {
+			http.Error(w, "Invalid node signature", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+// nodeAuthConfigured reports whether requireNode can tell other masters
+// from clients.
+func nodeAuthConfigured() bool {
+	return nodeSecret != "" || serverTLS != nil && serverTLS.ClientCAs != nil
+}
+
+// Rebalancing moves ring points, and the rows they own, from one shard to
+// another while both keep serving: POST /shards/rebalance splits a shard,
+// moves it to a new master group or merges it into another shard. The
+// master that gives up rows runs the migration. It stages a snapshot of
+// the rows on the receiving master, then sends the changes written since
+// from its change log until it has nearly caught up. For the cutover it
+// stops running operations on its rows, sends the last changes, and has
+// the receiver add the staged rows and install the new map before it
+// installs the map itself and drops the rows it handed over. Requests
+// planned with the old map get 409 from either master and are planned
+// again with the new one.
+
+type rebalanceRequest struct {
+	Op    string    `json:"op"`    // split, move or merge
+	Shard string    `json:"shard"` // the shard giving up rows
+	New   shardInfo `json:"new"`   // split and move: the shard receiving them
+	Into  string    `json:"into"`  // merge: the shard receiving them
+}
+
+// rebalance returns the map after r and the shards giving and receiving
+// rows.
+func (m *shardMap) rebalance(r rebalanceRequest) (*shardMap, shardInfo, shardInfo, error) {
+	next := &shardMap{Version: m.Version + 1, Tables: m.Tables, VNodes: m.VNodes}
+	next.Shards = append(next.Shards, m.Shards...)
+	from := -1
+	for i, s := range next.Shards {
+		if s.ID == r.Shard {
+			from = i
+		}
+	}
+	if from < 0 {
+		return nil, shardInfo{}, shardInfo{}, fmt.Errorf("no shard %q", r.Shard)
+	}
+	src := next.Shards[from]
+	points := src.pointNames(m.VNodes)
+	var dst shardInfo
+	switch r.Op {
+	case "split":
+		// The new shard takes every other point of the shard, half of its
+		// ranges on the ring.
+		sorted := append([]string{}, points...)
+		sort.Slice(sorted, func(a, b int) bool { return hashShardKey(sorted[a]) < hashShardKey(sorted[b]) })
+		dst, src.Points = r.New, nil
+		dst.Points = nil
+		for i, p := range sorted {
+			if i%2 == 0 {
+				src.Points = append(src.Points, p)
+			} else {
+				dst.Points = append(dst.Points, p)
+			}
+		}
+		next.Shards[from] = src
+		next.Shards = append(next.Shards, dst)
+	case "move":
+		dst = r.New
+		dst.Points = points
+		next.Shards[from] = dst
+	case "merge":
+		to := -1
+		for i, s := range next.Shards {
+			if s.ID == r.Into && i != from {
+				to = i
+			}
+		}
+		if to < 0 {
+			return nil, shardInfo{}, shardInfo{}, fmt.Errorf("no shard %q to merge into", r.Into)
+		}
+		dst = next.Shards[to]
+		dst.Points = append(append([]string{}, dst.pointNames(m.VNodes)...), points...)
+		// Merging the first shard puts the receiver first, so it also takes
+		// over the tables that are not partitioned.
+		if from == 0 {
+			from, to = to, from
+		}
+		next.Shards[to] = dst
+		next.Shards = append(next.Shards[:from], next.Shards[from+1:]...)
+	default:
+		return nil, shardInfo{}, shardInfo{}, errors.New("op must be split, move or merge")
+	}
+	if err := next.validate(); err != nil {
+		return nil, shardInfo{}, shardInfo{}, err
+	}
+	return next, src, dst, nil
+}
+
+// rowOwner returns the ID of the shard that owns row of dbName.table
+// under m.
+func (m *shardMap) rowOwner(ring *shardRing, dbName, table string, row map[string]string) string {
+	key := m.Tables[dbName+"."+table]
+	if key == "" {
+		return m.Shards[0].ID
+	}
+	return m.Shards[ring.owner(row[key])].ID
+}
+
+type stagedTable struct {
+	Database string              `json:"database"`
+	Table    string              `json:"table"`
+	Columns  []string            `json:"columns,omitempty"`
+	Types    map[string]string   `json:"types,omitempty"`
+	Records  []map[string]string `json:"records"`
+}
+
+// shardStage is a batch of a migration for the receiving master: the
+// snapshot of the moving rows, or changes made to them since.
+type shardStage struct {
+	ID     string             `json:"id"`
+	Tables []stagedTable      `json:"tables,omitempty"`
+	Events []changefeed.Event `json:"events,omitempty"`
+}
+
+type shardCommit struct {
+	ID  string    `json:"id"`
+	Map *shardMap `json:"shard_map"`
+}
+
+type shardMigrate struct {
+	Map  *shardMap `json:"shard_map"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+}
+
+// staging holds the rows of migrations into this master until cutover.
+var staging = struct {
+	sync.Mutex
+	migrations map[string]map[string]*stagedTable // by migration ID, then database.table
+	committed  map[string]int                     // rows added by finished migrations
+}{migrations: map[string]map[string]*stagedTable{}, committed: map[string]int{}}
+
+// stage adds a batch to migration b.ID.
+func stage(b shardStage) {
+	staging.Lock()
+	defer staging.Unlock()
+	tables := staging.migrations[b.ID]
+	if tables == nil {
+		tables = map[string]*stagedTable{}
+		staging.migrations[b.ID] = tables
+	}
+	get := func(dbName, table string) *stagedTable {
+		t := tables[dbName+"."+table]
+		if t == nil {
+			t = &stagedTable{Database: dbName, Table: table}
+			tables[dbName+"."+table] = t
+		}
+		return t
+	}
+	for _, st := range b.Tables {
+		t := get(st.Database, st.Table)
+		t.Columns, t.Types = st.Columns, st.Types
+		t.Records = append(t.Records, st.Records...)
+	}
+	for _, e := range b.Events {
+		t := get(e.Database, e.Table)
+		switch e.Op {
+		case "insert":
+			t.Records = append(t.Records, e.After)
+		case "update", "delete":
+			for i, record := range t.Records {
+				if !maps.Equal(record, e.Before) {
+					continue
+				}
+				if e.Op == "update" {
+					t.Records[i] = e.After
+				} else {
+					t.Records = append(t.Records[:i], t.Records[i+1:]...)
+				}
+				break
+			}
+		}
+	}
+}
+
+// commitStaged adds the rows of migration id to the tables and installs
+// next, without running any operation on this master in between.
+func commitStaged(id string, next *shardMap) (int, error) {
+	shards.owning.Lock()
+	defer shards.owning.Unlock()
+	staging.Lock()
+	tables, ok := staging.migrations[id]
+	n, done := staging.committed[id]
+	delete(staging.migrations, id)
+	staging.Unlock()
+	if !ok {
+		if done {
+			return n, nil
+		}
+		return 0, fmt.Errorf("unknown migration %s", id)
+	}
+	n = 0
+	for _, key := range sortedKeys(tables) {
+		t := tables[key]
+		if err := createLocalDatabase(t.Database); err != nil && err != errDatabaseExists {
+			return n, err
+		}
+		columns := t.Columns
+		if len(columns) == 0 && len(t.Records) > 0 {
+			columns = sortedKeys(t.Records[0])
+		}
+		req := RequestData{Database: t.Database, Table: t.Table, Columns: columns, Types: t.Types, Routed: true}
+		if err := createTable(req); err != nil && err != errTableExists {
+			return n, err
+		}
+		if len(t.Records) == 0 {
+			continue
+		}
+		added, err := insertRecords(req, t.Records)
+		n += added
+		if err != nil {
+			return n, err
+		}
+	}
+	if _, err := shards.install(next); err != nil {
+		return n, err
+	}
+	staging.Lock()
+	staging.committed[id] = n
+	staging.Unlock()
+	return n, nil
+}
+
+// migrateShard hands the rows this master loses under next to shard to
+// and cuts over to next. It returns the number of rows moved.
+func migrateShard(next *shardMap, to string) (int, error) {
+	if !shards.migrating.TryLock() {
+		return 0, errors.New("A migration out of this shard is already running")
+	}
+	defer shards.migrating.Unlock()
+	cur, curRing := shards.current()
+	if cur == nil || next.Version != cur.Version+1 {
+		return 0, errStaleShardMap
+	}
+	if err := next.validate(); err != nil {
+		return 0, err
+	}
+	var dst shardInfo
+	for _, s := range next.Shards {
+		if s.ID == to {
+			dst = s
+		}
+	}
+	if dst.ID == "" || dst.ID == shards.self {
+		return 0, fmt.Errorf("no shard %q to migrate to", to)
+	}
+	nextRing := newShardRing(next)
+	moves := func(dbName, table string, row map[string]string) bool {
+		return cur.rowOwner(curRing, dbName, table, row) == shards.self && next.rowOwner(nextRing, dbName, table, row) == to
+	}
+	id := telemetry.NewRequestID()
+	log := slog.With("migration", id, "to", to, "version", next.Version)
+
+	// Snapshot each table under its lock, with the LSN it is consistent
+	// with, so that only later changes are sent again.
+	snapshot := shardStage{ID: id}
+	snapshotLSN := map[string]uint64{}
+	dbMu.Lock()
+	names := map[string]*Table{}
+	for dbName, db := range databases {
+		for tableName, table := range db.Tables {
+			names[dbName+"."+tableName] = table
+		}
+	}
+	dbMu.Unlock()
+	from := feed.LSN()
+	rows := 0
+	for _, key := range sortedKeys(names) {
+		dbName, tableName, _ := strings.Cut(key, ".")
+		table := names[key]
+		st := stagedTable{Database: dbName, Table: tableName, Records: []map[string]string{}}
+		table.mu.Lock()
+		snapshotLSN[key] = feed.LSN()
+		st.Columns = append(st.Columns, table.Columns...)
+		st.Types = table.Types
+		for _, record := range table.Records {
+			if moves(dbName, tableName, record) {
+				st.Records = append(st.Records, maps.Clone(record))
+			}
+		}
+		table.mu.Unlock()
+		from = min(from, snapshotLSN[key])
+		rows += len(st.Records)
+		snapshot.Tables = append(snapshot.Tables, st)
+	}
+	if err := postNode(dst, "/shard/stage", snapshot, nil); err != nil {
+		return 0, fmt.Errorf("%w: staging snapshot: %v", errShardUnavailable, err)
+	}
+	log.Info("Staged shard snapshot", "rows", rows, "lsn", from)
+
+	// catchUp sends the changes to moving rows logged after from. Every
+	// event up to feed.LSN() is already on disk.
+	catchUp := func() (int, error) {
+		upto := feed.LSN()
+		batch := shardStage{ID: id}
+		err := feed.ReadLog(from, func(e changefeed.Event) bool {
+			if e.LSN > upto {
+				return false
+			}
+			row := e.After
+			if e.Op == "delete" {
+				row = e.Before
+			}
+			if e.LSN > snapshotLSN[e.Database+"."+e.Table] && moves(e.Database, e.Table, row) {
+				batch.Events = append(batch.Events, e)
+			}
+			return true
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		from = upto
+		if len(batch.Events) == 0 {
+			return 0, nil
+		}
+		if err := postNode(dst, "/shard/stage", batch, nil); err != nil {
+			return 0, fmt.Errorf("%w: staging changes: %v", errShardUnavailable, err)
+		}
+		return len(batch.Events), nil
+	}
+	for round := 0; round < 10; round++ {
+		n, err := catchUp()
+		if err != nil {
+			return 0, err
+		}
+		if n < 100 {
+			break
+		}
+	}
+
+	shards.owning.Lock()
+	defer shards.owning.Unlock()
+	if txns.prepared() > 0 {
+		return 0, errors.New("Transactions are prepared on this shard, retry the rebalance")
+	}
+	if _, err := catchUp(); err != nil {
+		return 0, err
+	}
+	var moved int
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = postNode(dst, "/shard/commit", shardCommit{ID: id, Map: next}, &moved); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w: committing migration: %v", errShardUnavailable, err)
+	}
+	if _, err := shards.install(next); err != nil {
+		return moved, err
+	}
+	pruneMovedRows(names, moves)
+	log.Info("Migrated shard rows", "rows", moved)
+	return moved, nil
+}
+
+// pruneMovedRows drops the rows handed over in a migration and deletes
+// them on the slaves, one request and LSN per shard key or the whole
+// table when it is not partitioned.
+func pruneMovedRows(tables map[string]*Table, moves func(dbName, table string, row map[string]string) bool) {
+	m, _ := shards.current()
+	for _, name := range sortedKeys(tables) {
+		dbName, tableName, _ := strings.Cut(name, ".")
+		table := tables[name]
+		key := m.Tables[name]
+		table.mu.Lock()
+		kept := []map[string]string{}
+		events := map[string][]changefeed.Event{}
+		for _, record := range table.Records {
+			if !moves(dbName, tableName, record) {
+				kept = append(kept, record)
+				continue
+			}
+			// Without a shard key the whole table moves under "".
+			events[record[key]] = append(events[record[key]], changefeed.Event{Op: "delete", Database: dbName, Table: tableName, Before: maps.Clone(record)})
+		}
+		if len(events) == 0 {
+			table.mu.Unlock()
+			continue
+		}
+		table.Records = kept
+		var reqs []RequestData
+		for _, v := range sortedKeys(events) {
+			req := RequestData{Database: dbName, Table: tableName, LSN: feed.Publish(events[v])}
+			if key != "" {
+				req.Conditions = map[string]string{key: v}
+			}
+			req.PrevLSN = table.chainLSN(req.LSN)
+			reqs = append(reqs, req)
+		}
+		table.mu.Unlock()
+		for _, req := range reqs {
+			replicateDelete(req)
+		}
+	}
+	saveDataToFile()
+}
+
+// handleRebalance serves POST /shards/rebalance.
+func handleRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req rebalanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	cur, _ := shards.current()
+	if cur == nil {
+		http.Error(w, "Sharding is not enabled, start the master with -shard-map", http.StatusNotFound)
+		return
+	}
+	next, src, dst, err := cur.rebalance(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var moved int
+	if src.ID == shards.self {
+		moved, err = migrateShard(next, dst.ID)
+	} else if err = postNode(src, "/shard/migrate", shardMigrate{Map: next, From: src.ID, To: dst.ID}, &moved); err != nil {
+		if _, ok := err.(*nodeConflict); ok {
+			err = errStaleShardMap
+		}
+	}
+	if err == nil {
+		_, err = shards.install(next)
+	}
+	detail := fmt.Sprintf("%s %s to %s, version %d, %d rows", req.Op, src.ID, dst.ID, next.Version, moved)
+	audit.record(httpActor(r), auditEntry{Op: "rebalance_shard", Detail: detail, Rows: moved}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"version": next.Version, "rows": moved, "unreachable": pushShardMaps(cur.Shards)})
+}
+
+// handleShardMigrate serves POST /shard/migrate, where the master that
+// received a rebalance request asks this one to hand over rows.
+func handleShardMigrate(w http.ResponseWriter, r *http.Request) {
+	var req shardMigrate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Map == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.From != shards.self {
+		http.Error(w, fmt.Sprintf("This master is not shard %s", req.From), http.StatusBadRequest)
+		return
+	}
+	moved, err := migrateShard(req.Map, req.To)
+	if err == errStaleShardMap {
+		m, _ := shards.current()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(m)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(moved)
+}
+
+// handleShardStage serves POST /shard/stage on the receiving master.
+func handleShardStage(w http.ResponseWriter, r *http.Request) {
+	var b shardStage
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil || b.ID == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if shards.file == "" {
+		http.Error(w, "Sharding is not enabled on this master", http.StatusNotFound)
+		return
+	}
+	stage(b)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleShardCommit serves POST /shard/commit on the receiving master.
+func handleShardCommit(w http.ResponseWriter, r *http.Request) {
+	var c shardCommit
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil || c.Map == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := c.Map.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := commitStaged(c.ID, c.Map)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(n)
+}
+
+// ===================== TRANSACTIONS =====================
+
+// POST /transaction applies a list of inserts, updates and deletes
+// atomically, also when their rows live on different shards. The master
+// that receives it coordinates a two-phase commit:
+//
+//  1. It logs the transaction and asks every shard involved to prepare
+//     its part. A shard checks that the part can be applied, logs it as
+//     prepared and keeps its tables from being dropped or migrated.
+//  2. If every shard prepared within -txn-timeout it logs the decision to
+//     commit and tells the shards to commit; otherwise it logs an abort
+//     and tells them to abort.
+//
+// A logged decision is final. A shard applies its part in one step,
+// together with a marker in the data file that makes a second commit
+// harmless. Both roles are recovered from the log: the coordinator
+// delivers decisions until every shard has them and aborts transactions
+// that were not decided by their deadline, and a shard with a prepared
+// part asks the coordinator for the outcome until it learns it. Parts are
+// applied when they commit, so a transaction is atomic but reads on other
+// shards may see one part before the others.
+
+var (
+	errTxnAborted         = errors.New("Transaction aborted")
+	errTableInTransaction = errors.New("Table has a prepared transaction")
+)
+
+const maxTxnMarkers = 1000 // transactions remembered per table
+
+type txnOp struct {
+	Op string `json:"op"` // insert, update or delete
+	RequestData
+}
+
+// txnRecord is a line of the transaction log. Later records of a
+// transaction only carry what changed.
+type txnRecord struct {
+	Txn          string      `json:"txn"`
+	Role         string      `json:"role"`  // coordinator or participant
+	State        string      `json:"state"` // begin, prepared, commit, abort or done
+	Coordinator  *shardInfo  `json:"coordinator,omitempty"`
+	Participants []shardInfo `json:"participants,omitempty"`
+	Ops          []txnOp     `json:"ops,omitempty"`
+	Version      int         `json:"version,omitempty"` // shard map the ops were planned with
+	Deadline     time.Time   `json:"deadline"`
+	Time         time.Time   `json:"ts"`
+}
+
+type txnLog struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	timeout time.Duration
+	live    map[string]txnRecord // unfinished transactions by role and ID
+	pins    map[string]int       // prepared parts per database and per database.table
+}
+
+var txns = &txnLog{live: map[string]txnRecord{}, pins: map[string]int{}}
+
+// open replays the log and compacts it to the unfinished transactions.
+func (l *txnLog) open(path string, timeout time.Duration) error {
+	l.path, l.timeout = path, timeout
+	file, err := os.Open(path)
+	if err == nil {
+		sc := bufio.NewScanner(file)
+		sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for sc.Scan() {
+			line, err := keyRing.OpenLine(sc.Bytes())
+			if errors.Is(err, crypto.ErrNoKey) {
+				file.Close()
+				return err
+			}
+			var rec txnRecord
+			if err != nil || json.Unmarshal(line, &rec) != nil {
+				continue // torn line from a crash
+			}
+			l.track(rec)
+		}
+		file.Close()
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if n := len(l.live); n > 0 {
+		slog.Info("Recovering transactions", "unfinished", n)
+	}
+	return l.rewrite()
+}
+
+// rewrite replaces the log with the records of unfinished transactions,
+// sealed with the newest key.
+func (l *txnLog) rewrite() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, key := range sortedKeys(l.live) {
+		line, _ := json.Marshal(l.live[key])
+		buf.Write(keyRing.SealLine(line))
+		buf.WriteByte('\n')
+	}
+	tmp := l.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	out.Close()
+	if err := os.Rename(tmp, l.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// record appends rec to the log and syncs it to disk before it counts.
+func (l *txnLog) record(rec txnRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.recordLocked(rec)
+}
+
+func (l *txnLog) recordLocked(rec txnRecord) error {
+	rec.Time = time.Now().UTC()
+	line, _ := json.Marshal(rec)
+	if _, err := l.file.Write(append(keyRing.SealLine(line), '\n')); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.track(rec)
+	return nil
+}
+
+// track updates the unfinished transactions with rec.
+func (l *txnLog) track(rec txnRecord) {
+	key := rec.Role + "/" + rec.Txn
+	old, ok := l.live[key]
+	if ok && old.Role == "participant" && old.State == "prepared" {
+		l.pin(old.Ops, -1)
+	}
+	if rec.State == "done" || rec.Role == "participant" && rec.State != "prepared" {
+		delete(l.live, key)
+		return
+	}
+	if ok && rec.Ops == nil {
+		old.State, old.Time = rec.State, rec.Time
+		rec = old
+	}
+	if rec.Role == "participant" {
+		l.pin(rec.Ops, 1)
+	}
+	l.live[key] = rec
+}
+
+func (l *txnLog) pin(ops []txnOp, delta int) {
+	for _, op := range ops {
+		for _, key := range []string{op.Database, op.Database + "." + op.Table} {
+			if l.pins[key] += delta; l.pins[key] <= 0 {
+				delete(l.pins, key)
+			}
+		}
+	}
+}
+
+// pinned reports whether a prepared transaction uses the table, or any
+// table of the database when table is empty.
+func (l *txnLog) pinned(dbName, table string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if table == "" {
+		return l.pins[dbName] > 0
+	}
+	return l.pins[dbName+"."+table] > 0
+}
+
+// prepared returns the number of parts prepared on this master.
+func (l *txnLog) prepared() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, rec := range l.live {
+		if rec.Role == "participant" {
+			n++
+		}
+	}
+	return n
+}
+
+func (l *txnLog) get(role, id string) (txnRecord, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.live[role+"/"+id]
+	return rec, ok
+}
+
+func (l *txnLog) unfinished() []txnRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	list := make([]txnRecord, 0, len(l.live))
+	for _, key := range sortedKeys(l.live) {
+		list = append(list, l.live[key])
+	}
+	return list
+}
+
+// decide logs state as the outcome of coordinator transaction id unless
+// it already has one, and returns the outcome.
+func (l *txnLog) decide(id, state string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rec, ok := l.live["coordinator/"+id]
+	if !ok {
+		return "abort", nil
+	}
+	if rec.State != "begin" {
+		return rec.State, nil
+	}
+	if err := l.recordLocked(txnRecord{Txn: id, Role: "coordinator", State: state}); err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// outcome is what the coordinator tells a participant about transaction
+// id. Without a record the transaction was finished, which cannot be the
+// case while a participant is still prepared, or never began: either way
+// it is presumed aborted.
+func (l *txnLog) outcome(id string) string {
+	rec, ok := l.get("coordinator", id)
+	switch {
+	case !ok:
+		return "abort"
+	case rec.State == "begin":
+		return "pending"
+	}
+	return rec.State
+}
+
+// ----- participant -----
+
+// prepareTxn checks this master's part of a transaction and logs it as
+// prepared.
+func prepareTxn(rec txnRecord) error {
+	shards.owning.RLock()
+	defer shards.owning.RUnlock()
+	if m, _ := shards.current(); m != nil && m.Version != rec.Version {
+		return errStaleShardMap
+	}
+	for _, op := range rec.Ops {
+		table, err := lookupTable(op.Database, op.Table)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "insert":
+			err = checkInsertColumns(table, []map[string]string{op.Record})
+		case "update":
+			err = checkColumnWrites(table, op.UpdateData, op.Ops)
+		case "delete":
+		default:
+			return fmt.Errorf("unknown operation %q", op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	rec.Role, rec.State = "participant", "prepared"
+	return txns.record(rec)
+}
+
+// commitTxn applies the prepared part of transaction id. Committing a
+// part that is no longer prepared does nothing.
+func commitTxn(id string) ([]int, error) {
+	rec, ok := txns.get("participant", id)
+	if !ok {
+		return nil, nil
+	}
+	counts, err := applyTxn(id, rec.Ops)
+	if err != nil {
+		return nil, err
+	}
+	return counts, txns.record(txnRecord{Txn: id, Role: "participant", State: "commit"})
+}
+
+func abortTxn(id string) error {
+	if _, ok := txns.get("participant", id); !ok {
+		return nil
+	}
+	return txns.record(txnRecord{Txn: id, Role: "participant", State: "abort"})
+}
+
+// applyTxn applies ops in one step: their tables stay locked until the
+// changes are saved together with id in each table's Txns, which tells a
+// commit repeated after a crash that the changes are already there.
+func applyTxn(id string, ops []txnOp) ([]int, error) {
+	tables := map[string]*Table{}
+	for _, op := range ops {
+		table, err := lookupTable(op.Database, op.Table)
+		if err != nil {
+			return nil, err
+		}
+		tables[op.Database+"."+op.Table] = table
+	}
+	// dbMu, taken before the table locks as everywhere else, keeps the
+	// data file consistent while it is saved.
+	names := sortedKeys(tables)
+	dbMu.Lock()
+	for _, name := range names {
+		tables[name].mu.Lock()
+	}
+	unlock := func() {
+		for _, name := range names {
+			tables[name].mu.Unlock()
+		}
+		dbMu.Unlock()
+	}
+	for _, name := range names {
+		for _, done := range tables[name].Txns {
+			if done == id {
+				unlock()
+				return nil, nil
+			}
+		}
+	}
+
+	counts := make([]int, len(ops))
+	reqs := make([]RequestData, len(ops))
+	for i, op := range ops {
+		table := tables[op.Database+"."+op.Table]
+		req := op.RequestData
+		var events []changefeed.Event
+		switch op.Op {
+		case "insert":
+			insertColumns(table, req.Record)
+			table.Records = append(table.Records, req.Record)
+			events = append(events, changefeed.Event{Op: "insert", Database: req.Database, Table: req.Table, After: maps.Clone(req.Record)})
+		case "update":
+			ops := updateOps(table, req.UpdateData, req.Ops)
+			for _, record := range table.Records {
+				if changefeed.MatchesConditions(record, req.Conditions) {
+					before := maps.Clone(record)
+					for k, v := range req.UpdateData {
+						record[k] = v
+					}
+					applyColumnOps(table, record, ops)
+					events = append(events, changefeed.Event{Op: "update", Database: req.Database, Table: req.Table, Before: before, After: maps.Clone(record)})
+				}
+			}
+		case "delete":
+			kept := []map[string]string{}
+			for _, record := range table.Records {
+				if changefeed.MatchesConditions(record, req.Conditions) {
+					events = append(events, changefeed.Event{Op: "delete", Database: req.Database, Table: req.Table, Before: maps.Clone(record)})
+				} else {
+					kept = append(kept, record)
+				}
+			}
+			table.Records = kept
+		}
+		counts[i] = len(events)
+		req.LSN = feed.Publish(events)
+		req.PrevLSN = table.chainLSN(req.LSN)
+		reqs[i] = req
+	}
+	for _, name := range names {
+		table := tables[name]
+		if table.Txns = append(table.Txns, id); len(table.Txns) > maxTxnMarkers {
+			table.Txns = table.Txns[len(table.Txns)-maxTxnMarkers:]
+		}
+	}
+	err := saveData()
+	dataHealth.Report(err)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "insert":
+			replicateToSlaves(reqs[i], "replicate_insert")
+		case "update":
+			replicateUpdate(reqs[i])
+		case "delete":
+			replicateDelete(reqs[i])
+		}
+	}
+	return counts, nil
+}
+
+// ----- coordinator -----
+
+// txnPart is the share of a transaction one shard runs.
+type txnPart struct {
+	shard shardInfo
+	ops   []txnOp
+	index []int // position of each op in the transaction
+}
+
+// planTxn splits ops by shard. Without sharding this master runs them all.
+func planTxn(ops []txnOp) ([]*txnPart, int, error) {
+	m, ring := shards.current()
+	if m == nil {
+		index := make([]int, len(ops))
+		for i := range index {
+			index[i] = i
+		}
+		return []*txnPart{{shard: shardInfo{ID: shards.self}, ops: ops, index: index}}, 0, nil
+	}
+	parts := map[int]*txnPart{}
+	for i, op := range ops {
+		switch op.Op {
+		case "insert", "update", "delete":
+		default:
+			return nil, 0, fmt.Errorf("unknown operation %q", op.Op)
+		}
+		plan, _, err := m.plan(ring, shardExec{Op: op.Op, Request: op.RequestData})
+		if err != nil {
+			return nil, 0, err
+		}
+		for s := range plan {
+			if parts[s] == nil {
+				parts[s] = &txnPart{shard: shardInfo{ID: m.Shards[s].ID, Master: m.Shards[s].Master}}
+			}
+			parts[s].ops = append(parts[s].ops, op)
+			parts[s].index = append(parts[s].index, i)
+		}
+	}
+	list := make([]*txnPart, 0, len(parts))
+	for i := range m.Shards {
+		if p := parts[i]; p != nil {
+			list = append(list, p)
+		}
+	}
+	return list, m.Version, nil
+}
+
+// coordinatorInfo is how participants reach this master.
+func coordinatorInfo() (*shardInfo, error) {
+	m, _ := shards.current()
+	if m == nil {
+		return &shardInfo{ID: shards.self}, nil
+	}
+	for _, s := range m.Shards {
+		if s.ID == shards.self {
+			return &shardInfo{ID: s.ID, Master: s.Master}, nil
+		}
+	}
+	return nil, errors.New("This master is not in the shard map and cannot coordinate transactions")
+}
+
+// runTxn commits ops atomically and returns the transaction ID, the rows
+// each op touched and the shards that have yet to learn the decision.
+func runTxn(ops []txnOp, requestID string, parent *telemetry.Span) (string, []int, []string, error) {
+	if leaders.enabled() {
+		return "", nil, nil, errMultiMasterTxn
+	}
+	parts, version, err := planTxn(ops)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	coordinator, err := coordinatorInfo()
+	if err != nil {
+		return "", nil, nil, err
+	}
+	id := telemetry.NewRequestID()
+	deadline := time.Now().Add(txns.timeout)
+	begin := txnRecord{Txn: id, Role: "coordinator", State: "begin", Version: version, Deadline: deadline}
+	for _, p := range parts {
+		begin.Participants = append(begin.Participants, p.shard)
+	}
+	if err := txns.record(begin); err != nil {
+		return id, nil, nil, err
+	}
+	log := slog.With("txn", id, "request_id", requestID)
+
+	prepare := parent.Child("txn prepare")
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i, p := range parts {
+		rec := txnRecord{Txn: id, Coordinator: coordinator, Ops: p.ops, Version: version, Deadline: deadline}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if p.shard.ID == shards.self {
+				errs[i] = prepareTxn(rec)
+				return
+			}
+			var res shardResult
+			err := postNodeContext(ctx, p.shard, "/txn/prepare", rec, &res)
+			var conflict *nodeConflict
+			switch {
+			case errors.As(err, &conflict):
+				m, _ := shards.current()
+				shards.reconcile(p.shard, m, res.Map)
+				errs[i] = errStaleShardMap
+			case err != nil:
+				errs[i] = fmt.Errorf("%w: %s: %v", errShardUnavailable, p.shard.ID, err)
+			case res.Error != "":
+				errs[i] = shardError(res.Error)
+			}
+		}()
+	}
+	wg.Wait()
+	cancel()
+	cause := errors.Join(errs...)
+	prepare.Fail(cause)
+	prepare.End()
+
+	state := "commit"
+	if cause != nil {
+		state = "abort"
+	}
+	if state, err = txns.decide(id, state); err != nil {
+		return id, nil, nil, err
+	}
+	log.Info("Transaction decided", "outcome", state, "shards", len(parts))
+	if state == "abort" && cause == nil {
+		cause = errors.New("not prepared before -txn-timeout")
+	}
+
+	finish := parent.Child("txn " + state)
+	counts := make([]int, len(ops))
+	pending := finishTxn(id, state, parts, counts)
+	finish.End()
+	if len(pending) == 0 {
+		if err := txns.record(txnRecord{Txn: id, Role: "coordinator", State: "done"}); err != nil {
+			log.Error("Logging transaction", "err", err)
+		}
+	}
+	if state == "abort" {
+		return id, nil, pending, fmt.Errorf("%w: %w", errTxnAborted, cause)
+	}
+	return id, counts, pending, nil
+}
+
+// finishTxn delivers the decision on transaction id to its shards, adding
+// the rows touched to counts, and returns the shards it did not reach.
+// resolveTxns tries those again later.
+func finishTxn(id, state string, parts []*txnPart, counts []int) []string {
+	var mu sync.Mutex
+	pending := []string{}
+	var wg sync.WaitGroup
+	for _, p := range parts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var rows []int
+			var err error
+			switch {
+			case p.shard.ID == shards.self && state == "commit":
+				rows, err = commitTxn(id)
+			case p.shard.ID == shards.self:
+				err = abortTxn(id)
+			default:
+				ctx, cancel := context.WithTimeout(context.Background(), txns.timeout)
+				err = postNodeContext(ctx, p.shard, "/txn/"+state, txnRecord{Txn: id}, &rows)
+				cancel()
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				slog.Warn("Delivering transaction decision", "txn", id, "outcome", state, "shard", p.shard.ID, "err", err)
+				pending = append(pending, p.shard.ID)
+				return
+			}
+			for i, n := range rows {
+				if counts != nil && i < len(p.index) {
+					counts[p.index[i]] += n
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Strings(pending)
+	return pending
+}
+
+// resolveTxns finishes what the log says is unfinished. The coordinator
+// aborts transactions not decided by their deadline and delivers its
+// decisions; a participant prepared past its deadline asks the
+// coordinator for the outcome.
+func resolveTxns() {
+	for _, rec := range txns.unfinished() {
+		if time.Now().Before(rec.Deadline) {
+			continue
+		}
+		switch rec.Role {
+		case "coordinator":
+			state, err := txns.decide(rec.Txn, "abort")
+			if err != nil {
+				slog.Error("Logging transaction", "txn", rec.Txn, "err", err)
+				continue
+			}
+			var parts []*txnPart
+			for _, s := range rec.Participants {
+				parts = append(parts, &txnPart{shard: s})
+			}
+			if len(finishTxn(rec.Txn, state, parts, nil)) == 0 {
+				txns.record(txnRecord{Txn: rec.Txn, Role: "coordinator", State: "done"})
+				slog.Info("Finished transaction", "txn", rec.Txn, "outcome", state)
+			}
+		case "participant":
+			state := "pending"
+			if rec.Coordinator == nil || rec.Coordinator.ID == shards.self {
+				state = txns.outcome(rec.Txn)
+			} else if err := postNode(*rec.Coordinator, "/txn/status", txnRecord{Txn: rec.Txn}, &state); err != nil {
+				slog.Warn("Transaction in doubt, coordinator unreachable", "txn", rec.Txn, "coordinator", rec.Coordinator.ID, "err", err)
+				continue
+			}
+			var err error
+			switch state {
+			case "commit":
+				_, err = commitTxn(rec.Txn)
+			case "abort":
+				err = abortTxn(rec.Txn)
+			}
+			if err != nil {
+				slog.Error("Resolving transaction", "txn", rec.Txn, "outcome", state, "err", err)
+			}
+		}
+	}
+}
+
+type txnRequest struct {
+	Operations []txnOp `json:"operations"`
+}
+
+// handleTransaction serves POST /transaction.
+func handleTransaction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req txnRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Operations) == 0 {
+		http.Error(w, "Invalid request, expected a list of operations", http.StatusBadRequest)
+		return
+	}
+	for i := range req.Operations {
+		op := &req.Operations[i]
+		if !checkAccess(w, r, auth.PrivWrite, op.Database, op.Table) {
+			return
+		}
+		op.Routed, op.Span = false, nil
+	}
+	id, counts, pending, err := runTxn(req.Operations, telemetry.RequestID(r), telemetry.RequestSpan(r))
+	rows := 0
+	for _, n := range counts {
+		rows += n
+	}
+	audit.record(httpActor(r), auditEntry{Op: "transaction", Detail: fmt.Sprintf("%s, %d operations", id, len(req.Operations)), Rows: rows}, err)
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	setLSNToken(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"id": id, "status": "committed", "rows": counts, "pending": pending})
+}
+
+// handleTransactions serves GET /transactions, the unfinished ones.
+func handleTransactions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txns.unfinished())
+}
+
+// handleTxnPrepare serves POST /txn/prepare for coordinators.
+func handleTxnPrepare(w http.ResponseWriter, r *http.Request) {
+	var rec txnRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || rec.Txn == "" || rec.Coordinator == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	err := prepareTxn(rec)
+	w.Header().Set("Content-Type", "application/json")
+	if err == errStaleShardMap {
+		m, _ := shards.current()
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(shardResult{Error: err.Error(), Map: m})
+		return
+	}
+	var res shardResult
+	if err != nil {
+		res.Error = err.Error()
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleTxnCommit serves POST /txn/commit and returns the rows each op of
+// the part touched.
+func handleTxnCommit(w http.ResponseWriter, r *http.Request) {
+	var rec txnRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || rec.Txn == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	rows, err := commitTxn(rec.Txn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// handleTxnAbort serves POST /txn/abort.
+func handleTxnAbort(w http.ResponseWriter, r *http.Request) {
+	var rec txnRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || rec.Txn == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if err := abortTxn(rec.Txn); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode([]int{})
+}
+
+// handleTxnStatus serves POST /txn/status, where participants in doubt ask
+// for the outcome of a transaction.
+func handleTxnStatus(w http.ResponseWriter, r *http.Request) {
+	var rec txnRecord
+	if err := json.NewDecoder(r.Body).Decode(&rec); err != nil || rec.Txn == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(txns.outcome(rec.Txn))
+}
+
+// ===================== REPLICA READS =====================
+
+// A select opts into replica reads with max_staleness (a duration such as
+// 5s, or seconds), max_lag_lsn (changes the replica may be behind) or
+// min_lsn (a read-your-writes token). The master proxies it to a slave
+// that satisfies every bound given and serves it itself when none does.
+// Writes return their token in X-Ddb-Lsn: the master's LSN after the
+// write.
+//
+// LSNs are global but slaves apply the requests of different tables in
+// any order, so every request also carries the LSN of the table's change
+// before it (PrevLSN). A slave counts a table as applied up to the last
+// LSN of its unbroken chain and checks min_lsn against that, so the bound
+// also holds for slaves the master has sent nothing to since it started.
+// The master lowers the bound of a proxied read to the table's last
+// change, which lets a slave serve tables that were not written since.
+// A client sending its token straight to a slave has no such hint and
+// falls back to the master when the table is quiet. Anti-entropy restarts
+// a chain broken by a lost request once the table is consistent again.
+//
+// Slaves only verify tokens, so with -node-secret or -node-ca the master
+// forwards a read for the caller it already authorized: X-Ddb-Caller
+// names the API key and the request is signed like replication, over
+// "<query>\n<caller>" instead of a body.
+//
+// Replica reads are off with sharding, where the shard masters serve
+// every select.
+
+const (
+	lsnHeader      = "X-Ddb-Lsn"
+	servedByHeader = "X-Ddb-Served-By"
+
+	replicaReadTimeout = 2 * time.Second
+)
+
+type readBound struct {
+	maxStaleness time.Duration
+	maxLag       uint64
+	minLSN       uint64
+	stale, lag   bool // which of the maximums were given
+}
+
+// parseReadBound reads the bound of a select and reports whether it asks
+// for a replica read.
+func parseReadBound(q url.Values) (readBound, bool, error) {
+	var b readBound
+	if v := q.Get("max_staleness"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			secs, ferr := strconv.ParseFloat(v, 64)
+			if ferr != nil {
+				return b, false, fmt.Errorf("Invalid max_staleness %q, expected a duration such as 5s", v)
+			}
+			d = time.Duration(secs * float64(time.Second))
+		}
+		if d < 0 {
+			return b, false, fmt.Errorf("Invalid max_staleness %q", v)
+		}
+		b.maxStaleness, b.stale = d, true
+	}
+	if v := q.Get("max_lag_lsn"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return b, false, fmt.Errorf("Invalid max_lag_lsn %q", v)
+		}
+		b.maxLag, b.lag = n, true
+	}
+	if v := q.Get("min_lsn"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return b, false, fmt.Errorf("Invalid min_lsn %q", v)
+		}
+		b.minLSN = n
+	}
+	return b, b.stale || b.lag || q.Has("min_lsn"), nil
+}
+
+// setLSNToken returns the read-your-writes token of a write.
+func setLSNToken(w http.ResponseWriter) {
+	if !shards.enabled() {
+		w.Header().Set(lsnHeader, strconv.FormatUint(feed.LSN(), 10))
+	}
+}
+
+// applied returns the LSN up to which the slave accepted every change sent
+// since the master started.
+func (st *replicaState) applied() uint64 {
+	lsn := st.sentLSN
+	for l := range st.pending {
+		lsn = min(lsn, l-1)
+	}
+	return lsn
+}
+
+// staleness returns how long the oldest change the slave has not accepted
+// has been waiting.
+func (st *replicaState) staleness(now time.Time) time.Duration {
+	var d time.Duration
+	for _, p := range st.pending {
+		d = max(d, now.Sub(p.sent))
+	}
+	return d
+}
+
+type replicaRead struct {
+	slave   string // entry of slaveNodes
+	replica string
+	need    uint64 // LSN the slave must have applied
+}
+
+// replicaTurn spreads replica reads over the slaves.
+var replicaTurn atomic.Uint64
+
+// chainLSN makes lsn the table's last change sent to the slaves and
+// returns the one before it. The caller holds the table lock.
+func (t *Table) chainLSN(lsn uint64) uint64 {
+	prev := t.ReplLSN
+	t.ReplLSN = lsn
+	return prev
+}
+
+// replicaCandidates returns the slaves that satisfy b for a table whose
+// last change has LSN last, starting with the next one in turn.
+func replicaCandidates(b readBound, last uint64) []replicaRead {
+	cur := feed.LSN()
+	now := time.Now()
+	replicaMu.Lock()
+	defer replicaMu.Unlock()
+	var list []replicaRead
+	start := int(replicaTurn.Add(1))
+	for i := range slaveNodes {
+		slave := slaveNodes[(start+i)%len(slaveNodes)]
+		c := replicaRead{slave: slave, replica: strings.TrimSuffix(slaveURL(slave, ""), "/"), need: b.minLSN}
+		if b.lag && cur > b.maxLag {
+			c.need = max(c.need, cur-b.maxLag)
+		}
+		st := replicaStates[c.replica]
+		if st == nil && b.stale {
+			// Nothing was sent to it yet, so only a slave that applied
+			// everything is known to be fresh enough.
+			c.need = cur
+		}
+		if last > 0 {
+			// Later changes went to other tables.
+			c.need = min(c.need, last)
+		}
+		switch {
+		case st == nil:
+		case st.diverged:
+			continue
+		case st.applied() < c.need, b.stale && st.staleness(now) > b.maxStaleness:
+			continue
+		}
+		list = append(list, c)
+	}
+	return list
+}
+
+// readFromReplica runs a select on the first slave that satisfies b and
+// reports whether one did.
+func readFromReplica(r *http.Request, b readBound, dbName, tableName string) ([]map[string]string, string, bool) {
+	if shards.enabled() {
+		return nil, "", false
+	}
+	table, err := lookupTable(dbName, tableName)
+	if err != nil {
+		return nil, "", false
+	}
+	table.mu.Lock()
+	last := table.ReplLSN
+	table.mu.Unlock()
+	for _, c := range replicaCandidates(b, last) {
+		records, err := getFromReplica(r, c, dbName, tableName)
+		if err == nil {
+			return records, c.replica, true
+		}
+		telemetry.RequestLog(r).Debug("Replica read refused", "replica", c.replica, "min_lsn", c.need, "err", err)
+	}
+	return nil, "", false
+}
+
+// getFromReplica proxies a select to /replicate_get on a slave on behalf
+// of the caller.
+func getFromReplica(r *http.Request, c replicaRead, dbName, tableName string) ([]map[string]string, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), replicaReadTimeout)
+	defer cancel()
+	params := url.Values{"database": {dbName}, "table": {tableName}, "min_lsn": {strconv.FormatUint(c.need, 10)}}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodGet, slaveURL(c.slave, "replicate_get")+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if p := auth.RequestPrincipal(r); p != nil && nodeAuthConfigured() {
+		hreq.Header.Set(auth.CallerHeader, p.ID)
+		signNodeRequest(hreq, auth.NodeReadBody(hreq))
+	} else if auth := r.Header.Get("Authorization"); auth != "" {
+		hreq.Header.Set("Authorization", auth)
+	}
+	hreq.Header.Set(telemetry.RequestIDHeader, telemetry.RequestID(r))
+	trace := telemetry.RequestSpan(r).ClientChild("read " + c.replica)
+	trace.Set("replica", c.replica)
+	trace.Set("min_lsn", c.need)
+	if tp := trace.Traceparent(); tp != "" {
+		hreq.Header.Set(telemetry.TraceparentHeader, tp)
+	}
+	defer trace.End()
+
+	resp, err := nodeClient.Do(hreq)
+	if err != nil {
+		trace.Fail(err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		err := fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		trace.Fail(err)
+		return nil, err
+	}
+	var records []map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		trace.Fail(err)
+		return nil, err
+	}
+	return records, nil
+}
+
+// ===================== ANTI-ENTROPY =====================
+
+// Every node can hash a table as a Merkle tree with internal/merkle, so
+// two nodes find the ranges of rows where they differ by comparing a few
+// hashes.
+
+// The master checks each of its tables against every slave, in the
+// background every -anti-entropy-interval and on demand with POST
+// /consistency. Ranges that differ are confirmed while the table is
+// locked and replication to the slave has caught up with it, so changes
+// still on their way are not taken for divergence. A repair sends the
+// slave just the rows it lacks and deletes the ones only it has. GET
+// /consistency returns the report of the last check.
+
+// settleTimeout bounds the wait for replication to catch up with a table.
+const settleTimeout = 2 * time.Second
+
+type tableCheck struct {
+	Replica  string   `json:"replica"`
+	Database string   `json:"database"`
+	Table    string   `json:"table"`
+	Status   string   `json:"status"`           // consistent, diverged, repaired, missing, extra, busy or error
+	Ranges   []string `json:"ranges,omitempty"` // first byte of the row hash, in hex
+	Missing  int      `json:"missing,omitempty"`
+	Extra    int      `json:"extra,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type consistencyReport struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Repair   bool         `json:"repair"`
+	Tables   []tableCheck `json:"tables"`
+}
+
+type checker struct {
+	running sync.Mutex // one check at a time
+	mu      sync.Mutex
+	last    *consistencyReport
+}
+
+var antiEntropy checker
+
+// postReplica posts in to endpoint on a slave and decodes the answer into
+// out. It returns errTableNotFound for a 404.
+func postReplica(ctx context.Context, slave, endpoint string, in, out any) error {
+	body, _ := json.Marshal(in)
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, slaveURL(slave, endpoint), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	signNodeRequest(hreq, body)
+	resp, err := nodeClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if out != nil {
+			return json.NewDecoder(resp.Body).Decode(out)
+		}
+		return nil
+	case http.StatusNotFound:
+		return errTableNotFound
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s returned %s: %s", endpoint, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// settled waits until the slave has answered every replication request up
+// to lsn.
+func settled(ctx context.Context, replica string, lsn uint64) bool {
+	deadline := time.Now().Add(settleTimeout)
+	for {
+		replicaMu.Lock()
+		done := true
+		if st := replicaStates[replica]; st != nil {
+			for l := range st.pending {
+				if l <= lsn {
+					done = false
+				}
+			}
+		}
+		replicaMu.Unlock()
+		if done {
+			return true
+		}
+		if time.Now().After(deadline) || ctx.Err() != nil {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// checkConsistency compares every table with every slave.
+func checkConsistency(ctx context.Context, repair bool) *consistencyReport {
+	start := time.Now()
+	rep := &consistencyReport{Started: start.UTC(), Repair: repair, Tables: []tableCheck{}}
+	dbMu.Lock()
+	tables := map[string]*Table{}
+	for dbName, db := range databases {
+		for tableName, table := range db.Tables {
+			tables[dbName+"."+tableName] = table
+		}
+	}
+	dbMu.Unlock()
+
+	metrics.Reset("ddb_anti_entropy_divergent_rows")
+	for _, slave := range slaveNodes {
+		replica := strings.TrimSuffix(slaveURL(slave, ""), "/")
+		var remote []string
+		if err := postReplica(ctx, slave, "merkle/tables", struct{}{}, &remote); err != nil {
+			rep.Tables = append(rep.Tables, tableCheck{Replica: replica, Status: "error", Error: err.Error()})
+			slog.Warn("Consistency check failed", "replica", replica, "err", err)
+			continue
+		}
+		divergent, inSync := 0, true
+		for _, name := range sortedKeys(tables) {
+			dbName, tableName, _ := strings.Cut(name, ".")
+			c := checkTable(ctx, slave, dbName, tableName, tables[name], repair)
+			if c.Status != "repaired" {
+				divergent += c.Missing + c.Extra
+			}
+			inSync = inSync && (c.Status == "consistent" || c.Status == "repaired")
+			rep.Tables = append(rep.Tables, c)
+		}
+		// Replica reads may use the slave again unless a request failed
+		// since the check started.
+		replicaMu.Lock()
+		if st := replicaStates[replica]; inSync && st != nil && st.failedAt.Before(start) {
+			st.diverged = false
+		}
+		replicaMu.Unlock()
+		for _, name := range remote {
+			if tables[name] == nil {
+				dbName, tableName, _ := strings.Cut(name, ".")
+				rep.Tables = append(rep.Tables, tableCheck{Replica: replica, Database: dbName, Table: tableName, Status: "extra"})
+			}
+		}
+		metrics.Set("ddb_anti_entropy_divergent_rows", telemetry.Labels("replica", replica), float64(divergent))
+	}
+	rep.Finished = time.Now().UTC()
+	for _, c := range rep.Tables {
+		if c.Status != "consistent" {
+			slog.Warn("Replica diverges", "replica", c.Replica, "database", c.Database, "table", c.Table,
+				"status", c.Status, "ranges", len(c.Ranges), "missing", c.Missing, "extra", c.Extra, "err", c.Error)
+		}
+	}
+	antiEntropy.mu.Lock()
+	antiEntropy.last = rep
+	antiEntropy.mu.Unlock()
+	return rep
+}
+
+// checkTable compares one table with a slave and repairs it if asked.
+func checkTable(ctx context.Context, slave, dbName, tableName string, table *Table, repair bool) tableCheck {
+	c := tableCheck{Replica: strings.TrimSuffix(slaveURL(slave, ""), "/"), Database: dbName, Table: tableName, Status: "consistent"}
+	fail := func(err error) tableCheck {
+		c.Status, c.Error = "error", err.Error()
+		return c
+	}
+	req := merkle.Request{Database: dbName, Table: tableName}
+	// fetchTree returns the slave's tree, an empty one if it lacks the table.
+	fetchTree := func() (merkle.Tree, bool, error) {
+		var remote merkle.Tree
+		err := postReplica(ctx, slave, "merkle", req, &remote)
+		if err == errTableNotFound {
+			return merkle.Build(nil), false, nil
+		}
+		return remote, true, err
+	}
+
+	// A first comparison without the lock finds the candidate ranges.
+	table.mu.Lock()
+	local := merkle.Build(table.Records)
+	synced := table.ReplLSN
+	table.mu.Unlock()
+	remote, _, err := fetchTree()
+	if err != nil {
+		return fail(err)
+	}
+	if ranges, err := merkle.Diff(local, remote); err != nil || len(ranges) == 0 {
+		if err != nil {
+			return fail(err)
+		}
+		markSynced(ctx, slave, req, synced)
+		return c
+	}
+
+	// Writes to the table wait while the difference is confirmed.
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	if !settled(ctx, c.Replica, feed.LSN()) {
+		c.Status = "busy"
+		return c
+	}
+	local = merkle.Build(table.Records)
+	remote, exists, err := fetchTree()
+	if err != nil {
+		return fail(err)
+	}
+	if c.Ranges, err = merkle.Diff(local, remote); err != nil {
+		return fail(err)
+	}
+	if len(c.Ranges) == 0 {
+		markSynced(ctx, slave, req, table.ReplLSN)
+		return c
+	}
+	mine := merkle.RowsInRanges(table.Records, c.Ranges)
+	theirs := map[string][]map[string]string{}
+	if exists {
+		req.Ranges = c.Ranges
+		if err := postReplica(ctx, slave, "merkle/rows", req, &theirs); err != nil {
+			return fail(err)
+		}
+	}
+
+	type rowCount struct {
+		record        map[string]string
+		local, remote int
+	}
+	counts := map[string]*rowCount{}
+	count := func(rows map[string][]map[string]string, remote bool) {
+		for _, list := range rows {
+			for _, record := range list {
+				key, _ := json.Marshal(record)
+				rc := counts[string(key)]
+				if rc == nil {
+					rc = &rowCount{record: record}
+					counts[string(key)] = rc
+				}
+				if remote {
+					rc.remote++
+				} else {
+					rc.local++
+				}
+			}
+		}
+	}
+	count(mine, false)
+	count(theirs, true)
+	var fixes []func() error
+	for _, key := range sortedKeys(counts) {
+		rc := counts[key]
+		c.Missing += max(rc.local-rc.remote, 0)
+		c.Extra += max(rc.remote-rc.local, 0)
+		insert := RequestData{Database: dbName, Table: tableName, Columns: table.Columns, Record: rc.record}
+		inserts := rc.local - rc.remote
+		if rc.remote > rc.local {
+			// Deleting by every column removes all copies of the row.
+			conds := map[string]string{}
+			for _, col := range table.Columns {
+				conds[col] = rc.record[col]
+			}
+			maps.Copy(conds, rc.record)
+			if len(conds) == 0 {
+				continue
+			}
+			del := RequestData{Database: dbName, Table: tableName, Columns: table.Columns, Conditions: conds}
+			fixes = append(fixes, func() error { return postReplica(ctx, slave, "replicate_delete", del, nil) })
+			inserts = rc.local
+		}
+		for range inserts {
+			fixes = append(fixes, func() error { return postReplica(ctx, slave, "replicate_insert", insert, nil) })
+		}
+	}
+	c.Status = "diverged"
+	if !exists {
+		c.Status = "missing"
+	}
+	if !repair || len(fixes) == 0 {
+		return c
+	}
+	for _, fix := range fixes {
+		if err := fix(); err != nil {
+			return fail(fmt.Errorf("repair: %w", err))
+		}
+	}
+	c.Status = "repaired"
+	markSynced(ctx, slave, req, table.ReplLSN)
+	metrics.Add("ddb_anti_entropy_repaired_rows_total", telemetry.Labels("replica", c.Replica), float64(c.Missing+c.Extra))
+	slog.Info("Repaired replica", "replica", c.Replica, "database", dbName, "table", tableName, "ranges", len(c.Ranges), "missing", c.Missing, "extra", c.Extra)
+	return c
+}
+
+// markSynced tells the slave that its copy of the table matches the
+// master's after change lsn, which restarts the table's chain of changes
+// there (see REPLICA READS).
+func markSynced(ctx context.Context, slave string, req merkle.Request, lsn uint64) {
+	if lsn == 0 {
+		return
+	}
+	req.Ranges, req.LSN = nil, lsn
+	if err := postReplica(ctx, slave, "merkle/synced", req, nil); err != nil {
+		slog.Debug("Marking replica synced", "slave", slave, "database", req.Database, "table", req.Table, "err", err)
+	}
+}
+
+// handleConsistency serves GET /consistency, the last report, and POST
+// /consistency?repair=true, which checks now.
+func handleConsistency(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		antiEntropy.mu.Lock()
+		rep := antiEntropy.last
+		antiEntropy.mu.Unlock()
+		if rep == nil {
+			http.Error(w, "No consistency check has run yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+	case http.MethodPost:
+		repair := r.URL.Query().Get("repair") == "true"
+		if !antiEntropy.running.TryLock() {
+			http.Error(w, "A consistency check is already running", http.StatusConflict)
+			return
+		}
+		rep := checkConsistency(r.Context(), repair)
+		antiEntropy.running.Unlock()
+		rows := 0
+		for _, c := range rep.Tables {
+			if c.Status == "repaired" {
+				rows += c.Missing + c.Extra
+			}
+		}
+		audit.record(httpActor(r), auditEntry{Op: "consistency_check", Detail: fmt.Sprintf("repair=%t, %d tables", repair, len(rep.Tables)), Rows: rows}, nil)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rep)
+	default:
+		http.Error(w, "Only GET and POST allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// runAntiEntropy checks the slaves every interval.
+func runAntiEntropy(interval time.Duration, repair bool) {
+	for range time.Tick(interval) {
+		if len(slaveNodes) == 0 || !antiEntropy.running.TryLock() {
+			continue
+		}
+		checkConsistency(node.Stopping(), repair)
+		antiEntropy.running.Unlock()
+	}
+}
+
+// ===================== MULTI-MASTER =====================
+
+// With -peers every listed master accepts writes and replicates them to
+// the others, so each office writes locally. The first column of a table
+// is the row key and each row carries the hybrid logical clock (HLC) of
+// its last change, plus one per column and one for its last delete. Local
+// changes go to a journal that is pushed to every peer until it answers,
+// so a peer that is down catches up when it returns. Every master must
+// list all the others.
+//
+// A change that was not made on top of the version a peer has is a
+// conflict, resolved by -conflict-resolution:
+//
+//	lww     the change with the newer HLC wins the whole row
+//	merge   each column keeps its newest value; a delete hides the
+//	        columns written before it
+//	custom  -conflict-resolver gets both versions and returns the row
+//
+// Conflicts are logged to -conflict-log and served on GET /conflicts.
+// Writes are applied in HLC order per column or row, so masters that have
+// received the same changes hold the same rows whatever the order they
+// arrived in. A custom resolver keeps that guarantee when it is
+// deterministic: it gets the two versions ordered by HLC, not as local
+// and remote.
+
+var (
+	errDuplicateKey   = errors.New("A record with this key already exists")
+	errMissingKey     = errors.New("The first column is the row key and must be set")
+	errUnknownColumn  = errors.New("Unknown column")
+	errKeyUpdate      = errors.New("The row key cannot be updated")
+	errMultiMasterTxn = errors.New("Transactions are not supported with -peers")
+)
+
+const (
+	maxRowHistory      = 16  // versions kept per row to tell old changes from conflicts
+	maxConflicts       = 200 // kept for GET /conflicts
+	peerBatchSize      = 500
+	conflictResolverTO = 5 * time.Second
+)
+
+var (
+	peerJournalFile = "peers.log"
+	peerStateFile   = "peers.json"
+)
+
+// hybridClock issues HLC timestamps formatted so that they sort as
+// strings: milliseconds, a counter and the node ID.
+type hybridClock struct {
+	mu      sync.Mutex
+	wall    int64
+	logical int64
+	node    string
+}
+
+func (c *hybridClock) format() string {
+	return fmt.Sprintf("%013d.%010d.%s", c.wall, c.logical, c.node)
+}
+
+func parseHLC(ts string) (wall, logical int64, ok bool) {
+	parts := strings.SplitN(ts, ".", 3)
+	if len(parts) != 3 {
+		return 0, 0, false
+	}
+	w, err1 := strconv.ParseInt(parts[0], 10, 64)
+	l, err2 := strconv.ParseInt(parts[1], 10, 64)
+	return w, l, err1 == nil && err2 == nil
+}
+
+// now returns a timestamp newer than any issued or observed.
+func (c *hybridClock) now() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := time.Now().UnixMilli(); pt > c.wall {
+		c.wall, c.logical = pt, 0
+	} else {
+		c.logical++
+	}
+	return c.format()
+}
+
+// observe moves the clock past a timestamp from a peer.
+func (c *hybridClock) observe(ts string) {
+	w, l, ok := parseHLC(ts)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if w > c.wall || w == c.wall && l > c.logical {
+		c.wall, c.logical = w, l
+	}
+}
+
+// rowVersion is the HLC state of one row.
+type rowVersion struct {
+	HLC     string            `json:"hlc"`
+	Base    string            `json:"base,omitempty"`    // version the last change replaced
+	History []string          `json:"history,omitempty"` // earlier versions, newest last
+	Cols    map[string]string `json:"cols,omitempty"`    // last change per column
+	Deleted string            `json:"deleted,omitempty"` // last delete
+
+	CRDT map[string]*crdtState `json:"crdt,omitempty"` // state of the typed columns
+}
+
+func (v *rowVersion) advance(hlc string) {
+	if v.HLC != "" {
+		if v.History = append(v.History, v.HLC); len(v.History) > maxRowHistory {
+			v.History = v.History[len(v.History)-maxRowHistory:]
+		}
+	}
+	v.Base, v.HLC = v.HLC, hlc
+}
+
+// seen reports whether the row already went through version hlc.
+func (v *rowVersion) seen(hlc string) bool {
+	return v.HLC == hlc || slices.Contains(v.History, hlc)
+}
+
+// rowChange is one change sent to the peers.
+type rowChange struct {
+	Seq      uint64                `json:"seq"`
+	Op       string                `json:"op"` // upsert, delete, crdt, create_database, create_table, drop_table or drop_database
+	Database string                `json:"database"`
+	Table    string                `json:"table,omitempty"`
+	Columns  []string              `json:"columns,omitempty"`
+	Types    map[string]string     `json:"types,omitempty"`
+	Key      string                `json:"key,omitempty"`
+	Values   map[string]string     `json:"values,omitempty"`
+	CRDT     map[string]*crdtState `json:"crdt,omitempty"` // what ops changed in typed columns
+	HLC      string                `json:"hlc"`
+	Base     string                `json:"base,omitempty"`
+	Node     string                `json:"node"`
+}
+
+type peerBatch struct {
+	Node    string      `json:"node"`
+	Changes []rowChange `json:"changes"`
+}
+
+// conflictVersion is one side of a conflict.
+type conflictVersion struct {
+	HLC     string            `json:"hlc"`
+	Values  map[string]string `json:"values,omitempty"`
+	Deleted bool              `json:"deleted,omitempty"`
+}
+
+type conflictEntry struct {
+	Time       time.Time       `json:"time"`
+	Database   string          `json:"database"`
+	Table      string          `json:"table"`
+	Key        string          `json:"key"`
+	Local      conflictVersion `json:"local"`
+	Remote     conflictVersion `json:"remote"`
+	Resolution string          `json:"resolution"` // local, remote, merged, resolver or, when the resolver failed, local or remote with "(resolver failed)"
+	Result     conflictVersion `json:"result"`
+}
+
+type peerStatus struct {
+	Peer      string     `json:"peer"`
+	Acked     uint64     `json:"acked"`
+	Pending   int        `json:"pending"`
+	LastError string     `json:"last_error,omitempty"`
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+}
+
+type multiMaster struct {
+	mu       sync.Mutex
+	node     string
+	peers    []string
+	mode     string // lww, merge or custom
+	resolver string
+	clock    hybridClock
+
+	file    *os.File // journal of local changes
+	seq     uint64
+	journal []rowChange // not yet acknowledged by every peer
+	acked   map[string]uint64
+	dropped map[string]string // HLC of the last drop per database and database.table
+	wake    map[string]chan struct{}
+	status  map[string]*peerStatus
+
+	conflictMu   sync.Mutex
+	conflictPath string
+	conflictFile *os.File
+	conflicts    []conflictEntry
+}
+
+var leaders = &multiMaster{}
+
+func (l *multiMaster) enabled() bool {
+	return l.node != ""
+}
+
+type peerState struct {
+	Acked   map[string]uint64 `json:"acked"`
+	Dropped map[string]string `json:"dropped,omitempty"`
+}
+
+// start opens the journal and starts pushing to peers.
+func (l *multiMaster) start(node string, peers []string, mode, resolver, conflictLog string) error {
+	switch {
+	case node == "":
+		return errors.New("-peers needs -node-id")
+	case strings.ContainsAny(node, ". "):
+		return errors.New("-node-id must not contain dots or spaces")
+	case mode != "lww" && mode != "merge" && mode != "custom":
+		return errors.New("-conflict-resolution must be lww, merge or custom")
+	case mode == "custom" && resolver == "":
+		return errors.New("-conflict-resolution custom needs -conflict-resolver")
+	}
+	l.node, l.peers, l.mode, l.resolver = node, peers, mode, resolver
+	l.clock.node = node
+	l.acked, l.dropped = map[string]uint64{}, map[string]string{}
+	l.wake, l.status = map[string]chan struct{}{}, map[string]*peerStatus{}
+
+	if content, err := keyRing.ReadFile(peerStateFile); err == nil {
+		var st peerState
+		if err := json.Unmarshal(content, &st); err != nil {
+			return fmt.Errorf("%s: %v", peerStateFile, err)
+		}
+		maps.Copy(l.acked, st.Acked)
+		maps.Copy(l.dropped, st.Dropped)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := l.openJournal(); err != nil {
+		return err
+	}
+	if conflictLog != "" {
+		file, err := os.OpenFile(conflictLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		l.conflictPath, l.conflictFile = conflictLog, file
+	}
+	// Version stamps issued before a restart stay older than new ones.
+	for _, c := range l.journal {
+		l.clock.observe(c.HLC)
+	}
+	for _, peer := range peers {
+		l.wake[peer] = make(chan struct{}, 1)
+		l.status[peer] = &peerStatus{Peer: peer, Acked: l.acked[peer]}
+		go l.push(peer)
+	}
+	slog.Info("Multi-master replication", "node", node, "peers", len(peers), "conflict_resolution", mode, "unacknowledged", len(l.journal))
+	return nil
+}
+
+// openJournal loads the changes some peer has not acknowledged yet and
+// compacts the journal to them.
+func (l *multiMaster) openJournal() error {
+	minAcked := uint64(math.MaxUint64)
+	for _, peer := range l.peers {
+		minAcked = min(minAcked, l.acked[peer])
+	}
+	for _, seq := range l.acked {
+		l.seq = max(l.seq, seq)
+	}
+	file, err := os.Open(peerJournalFile)
+	if err == nil {
+		sc := bufio.NewScanner(file)
+		sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+		for sc.Scan() {
+			line, err := keyRing.OpenLine(sc.Bytes())
+			if errors.Is(err, crypto.ErrNoKey) {
+				file.Close()
+				return err
+			}
+			var c rowChange
+			if err != nil || json.Unmarshal(line, &c) != nil {
+				continue // torn line from a crash
+			}
+			l.seq = max(l.seq, c.Seq)
+			if c.Seq > minAcked {
+				l.journal = append(l.journal, c)
+			}
+		}
+		file.Close()
+		if err := sc.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return l.rewrite()
+}
+
+// rewrite replaces the journal with the unacknowledged changes and
+// re-encrypts the conflict log, both sealed with the newest key.
+func (l *multiMaster) rewrite() error {
+	l.mu.Lock()
+	err := l.rewriteLocked()
+	l.mu.Unlock()
+	if err != nil || l.conflictFile == nil {
+		return err
+	}
+	return keyRing.RewriteLog(l.conflictPath, &l.conflictMu, func(file *os.File) {
+		l.conflictFile.Close()
+		l.conflictFile = file
+	})
+}
+
+func (l *multiMaster) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Sync()
+}
+
+func (l *multiMaster) rewriteLocked() error {
+	if !l.enabled() {
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, c := range l.journal {
+		line, _ := json.Marshal(c)
+		buf.Write(keyRing.SealLine(line))
+		buf.WriteByte('\n')
+	}
+	tmp := peerJournalFile + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err := out.Write(buf.Bytes()); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	out.Close()
+	if err := os.Rename(tmp, peerJournalFile); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(peerJournalFile, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	return nil
+}
+
+// saveState writes the acknowledged positions and drops. The caller holds
+// l.mu.
+func (l *multiMaster) saveState() {
+	content, _ := json.MarshalIndent(peerState{Acked: l.acked, Dropped: l.dropped}, "", "  ")
+	if err := keyRing.WriteFile(peerStateFile, content, 0600); err != nil {
+		slog.Error("Saving peer state", "file", peerStateFile, "err", err)
+	}
+}
+
+// append journals local changes and wakes the pushers.
+func (l *multiMaster) append(changes ...rowChange) {
+	if len(changes) == 0 {
+		return
+	}
+	l.mu.Lock()
+	var buf bytes.Buffer
+	for i := range changes {
+		l.seq++
+		changes[i].Seq, changes[i].Node = l.seq, l.node
+		line, _ := json.Marshal(changes[i])
+		buf.Write(keyRing.SealLine(line))
+		buf.WriteByte('\n')
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		slog.Error("Writing peer journal", "file", peerJournalFile, "err", err)
+	}
+	l.journal = append(l.journal, changes...)
+	l.mu.Unlock()
+	for _, ch := range l.wake {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pending returns up to peerBatchSize changes the peer has not
+// acknowledged.
+func (l *multiMaster) pending(peer string) []rowChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	acked := l.acked[peer]
+	i := sort.Search(len(l.journal), func(i int) bool { return l.journal[i].Seq > acked })
+	return slices.Clone(l.journal[i:min(len(l.journal), i+peerBatchSize)])
+}
+
+// ack records that peer applied the changes up to seq and drops the ones
+// every peer has.
+func (l *multiMaster) ack(peer string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.acked[peer] = seq
+	minAcked := seq
+	for _, p := range l.peers {
+		minAcked = min(minAcked, l.acked[p])
+	}
+	i := sort.Search(len(l.journal), func(i int) bool { return l.journal[i].Seq > minAcked })
+	l.journal = slices.Delete(l.journal, 0, i)
+	l.saveState()
+	if len(l.journal) == 0 && i > 0 {
+		// Every peer is up to date, so the journal can start over.
+		if err := l.rewriteLocked(); err != nil {
+			slog.Error("Compacting peer journal", "file", peerJournalFile, "err", err)
+		}
+	}
+}
+
+// push sends the journal to one peer, retrying with backoff while it
+// cannot be reached.
+func (l *multiMaster) push(peer string) {
+	backoff := time.Second
+	for {
+		batch := l.pending(peer)
+		if len(batch) == 0 {
+			select {
+			case <-l.wake[peer]:
+			case <-time.After(5 * time.Second):
+			case <-node.Stopping().Done():
+				return
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(node.Stopping(), 30*time.Second)
+		err := postNodeContext(ctx, shardInfo{ID: peer, Master: peer}, "/peer/apply", peerBatch{Node: l.node, Changes: batch}, nil)
+		cancel()
+		l.mu.Lock()
+		st := l.status[peer]
+		if err != nil {
+			if st.LastError == "" {
+				slog.Warn("Peer unreachable, will retry", "peer", peer, "err", err)
+			}
+			st.LastError = err.Error()
+		} else {
+			if st.LastError != "" {
+				slog.Info("Peer reachable again", "peer", peer)
+			}
+			now := time.Now().UTC()
+			st.LastError, st.LastSent = "", &now
+		}
+		l.mu.Unlock()
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-node.Stopping().Done():
+				return
+			}
+			backoff = min(2*backoff, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+		l.ack(peer, batch[len(batch)-1].Seq)
+	}
+}
+
+// ----- local writes -----
+
+func keyColumn(table *Table) string {
+	if len(table.Columns) == 0 {
+		return ""
+	}
+	return table.Columns[0]
+}
+
+// rowIndex returns the position of the row with key, or -1. The caller
+// holds the table lock.
+func rowIndex(table *Table, key string) int {
+	col := keyColumn(table)
+	for i, record := range table.Records {
+		if record[col] == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// versionOf returns the HLC state of the row with key, adding it when the
+// row has none. The caller holds the table lock.
+func versionOf(table *Table, key string) *rowVersion {
+	if table.Versions == nil {
+		table.Versions = map[string]*rowVersion{}
+	}
+	v := table.Versions[key]
+	if v == nil {
+		v = &rowVersion{}
+		table.Versions[key] = v
+	}
+	if v.Cols == nil {
+		v.Cols = map[string]string{} // omitted from the data file when empty
+	}
+	return v
+}
+
+// prepareInserts checks new records against the table and fills in every
+// column, so all masters store rows of the same shape. The caller holds
+// the table lock.
+func (l *multiMaster) prepareInserts(table *Table, records []map[string]string) ([]map[string]string, error) {
+	if !l.enabled() {
+		return records, nil
+	}
+	col := keyColumn(table)
+	seen := map[string]bool{}
+	out := make([]map[string]string, len(records))
+	for i, record := range records {
+		key := record[col]
+		if col == "" || key == "" {
+			return nil, errMissingKey
+		}
+		if seen[key] || rowIndex(table, key) >= 0 {
+			return nil, errDuplicateKey
+		}
+		seen[key] = true
+		for c := range record {
+			if !slices.Contains(table.Columns, c) {
+				return nil, errUnknownColumn
+			}
+		}
+		full := map[string]string{}
+		for _, c := range table.Columns {
+			full[c] = record[c]
+		}
+		out[i] = full
+	}
+	return out, nil
+}
+
+// checkUpdate refuses updates that would change a row's key or add a
+// column.
+func (l *multiMaster) checkUpdate(table *Table, data map[string]string) error {
+	if !l.enabled() {
+		return nil
+	}
+	for k := range data {
+		switch {
+		case k == keyColumn(table):
+			return errKeyUpdate
+		case !slices.Contains(table.Columns, k):
+			return errUnknownColumn
+		}
+	}
+	return nil
+}
+
+// local stamps the rows a local write changed and journals the changes.
+// The caller holds the table lock.
+func (l *multiMaster) local(table *Table, events []changefeed.Event) {
+	if !l.enabled() || len(events) == 0 {
+		return
+	}
+	col := keyColumn(table)
+	var changes []rowChange
+	for _, e := range events {
+		row := e.After
+		if e.Op == "delete" {
+			row = e.Before
+		}
+		delta, _ := e.CRDT.(map[string]*crdtState)
+		key := row[col]
+		v := versionOf(table, key)
+		hlc := l.clock.now()
+		c := rowChange{Op: "upsert", Database: e.Database, Table: e.Table, Columns: table.Columns, Types: table.Types, Key: key, HLC: hlc, Base: v.HLC, CRDT: delta}
+		switch e.Op {
+		case "delete":
+			c.Op, v.Deleted = "delete", hlc
+		default:
+			changed := map[string]string{}
+			for k, val := range e.After {
+				if table.Types[k] != "" {
+					continue // merged from the CRDT state instead
+				}
+				if old, ok := e.Before[k]; !ok || old != val || e.Op == "insert" {
+					changed[k] = val
+				}
+			}
+			if len(changed) == 0 && len(delta) > 0 {
+				// Ops on typed columns alone merge on every master
+				// without a new row version, so they never conflict.
+				c.Op, c.Base = "crdt", ""
+				changes = append(changes, c)
+				continue
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			for k := range changed {
+				v.Cols[k] = hlc
+			}
+			c.Values = maps.Clone(e.After)
+			if l.mode == "merge" {
+				c.Values = changed
+			}
+		}
+		v.advance(hlc)
+		changes = append(changes, c)
+	}
+	l.append(changes...)
+}
+
+// schema journals a local schema change.
+func (l *multiMaster) schema(op, dbName, tableName string, columns []string, types map[string]string) {
+	if !l.enabled() {
+		return
+	}
+	hlc := l.clock.now()
+	if strings.HasPrefix(op, "drop_") {
+		l.mu.Lock()
+		l.dropped[strings.TrimSuffix(dbName+"."+tableName, ".")] = hlc
+		l.saveState()
+		l.mu.Unlock()
+	}
+	l.append(rowChange{Op: op, Database: dbName, Table: tableName, Columns: columns, Types: types, HLC: hlc})
+}
+
+// ----- changes from peers -----
+
+// droppedAfter reports whether the table was dropped after hlc.
+func (l *multiMaster) droppedAfter(dbName, tableName, hlc string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropped[dbName] >= hlc || l.dropped[dbName+"."+tableName] >= hlc
+}
+
+// applyBatch applies changes from a peer.
+func (l *multiMaster) applyBatch(b peerBatch) {
+	var reqs []RequestData
+	var endpoints []string
+	for _, c := range b.Changes {
+		l.clock.observe(c.HLC)
+		switch c.Op {
+		case "upsert", "delete", "crdt":
+			table := l.remoteTable(c)
+			if table == nil {
+				continue
+			}
+			table.mu.Lock()
+			events, conflict := l.applyRow(table, c)
+			var lsn, prev uint64
+			if len(events) > 0 {
+				lsn = feed.Publish(events)
+				prev = table.chainLSN(lsn)
+			}
+			table.mu.Unlock()
+			if conflict != nil {
+				l.logConflict(*conflict)
+			}
+			key := keyColumn(table)
+			for _, e := range events {
+				req := RequestData{Database: c.Database, Table: c.Table, Columns: c.Columns, LSN: lsn, PrevLSN: prev}
+				switch e.Op {
+				case "insert":
+					req.Record = e.After
+					endpoints = append(endpoints, "replicate_insert")
+				case "update":
+					req.Conditions, req.UpdateData = map[string]string{key: c.Key}, e.After
+					endpoints = append(endpoints, "replicate_update")
+				case "delete":
+					req.Conditions = map[string]string{key: c.Key}
+					endpoints = append(endpoints, "replicate_delete")
+				}
+				reqs = append(reqs, req)
+			}
+		default:
+			l.applySchema(c)
+		}
+	}
+	saveDataToFile()
+	for i, req := range reqs {
+		replicateToSlaves(req, endpoints[i])
+	}
+}
+
+// remoteTable returns the table a row change is for, creating it when the
+// change is newer than any drop of it.
+func (l *multiMaster) remoteTable(c rowChange) *Table {
+	if l.droppedAfter(c.Database, c.Table, c.HLC) {
+		return nil
+	}
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	db := databases[c.Database]
+	if db == nil {
+		db = &Database{Name: c.Database, Tables: map[string]*Table{}}
+		databases[c.Database] = db
+	}
+	table := db.Tables[c.Table]
+	if table == nil {
+		table = &Table{Name: c.Table, Columns: c.Columns, Types: c.Types, Records: []map[string]string{}}
+		db.Tables[c.Table] = table
+	}
+	return table
+}
+
+// applySchema applies a schema change from a peer. A drop removes the
+// rows written before it; rows written after it keep the table.
+func (l *multiMaster) applySchema(c rowChange) {
+	if c.Op == "drop_table" || c.Op == "drop_database" {
+		name := strings.TrimSuffix(c.Database+"."+c.Table, ".")
+		l.mu.Lock()
+		if c.HLC > l.dropped[name] {
+			l.dropped[name] = c.HLC
+			l.saveState()
+		}
+		l.mu.Unlock()
+	}
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	db := databases[c.Database]
+	switch c.Op {
+	case "create_database":
+		if db == nil && !l.droppedAfter(c.Database, "", c.HLC) {
+			databases[c.Database] = &Database{Name: c.Database, Tables: map[string]*Table{}}
+		}
+	case "create_table":
+		if l.droppedAfter(c.Database, c.Table, c.HLC) {
+			return
+		}
+		if db == nil {
+			db = &Database{Name: c.Database, Tables: map[string]*Table{}}
+			databases[c.Database] = db
+		}
+		if t := db.Tables[c.Table]; t == nil {
+			db.Tables[c.Table] = &Table{Name: c.Table, Columns: c.Columns, Types: c.Types, Records: []map[string]string{}}
+		} else if !slices.Equal(t.Columns, c.Columns) {
+			slog.Warn("Peer created a table with other columns, keeping ours", "database", c.Database, "table", c.Table, "peer_columns", c.Columns, "columns", t.Columns)
+		}
+	case "drop_table", "drop_database":
+		if db == nil {
+			return
+		}
+		for name, table := range db.Tables {
+			if c.Op == "drop_table" && name != c.Table {
+				continue
+			}
+			if txns.pinned(c.Database, name) {
+				continue
+			}
+			if l.dropRowsBefore(c.Database, name, table, c.HLC) {
+				delete(db.Tables, name)
+			}
+		}
+		if c.Op == "drop_database" && len(db.Tables) == 0 {
+			delete(databases, c.Database)
+		}
+	}
+}
+
+// dropRowsBefore removes the rows last written before hlc and reports
+// whether the table is empty now.
+func (l *multiMaster) dropRowsBefore(dbName, tableName string, table *Table, hlc string) bool {
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	col := keyColumn(table)
+	kept := []map[string]string{}
+	var events []changefeed.Event
+	for _, record := range table.Records {
+		if v := table.Versions[record[col]]; v != nil && v.HLC > hlc {
+			kept = append(kept, record)
+			continue
+		}
+		events = append(events, changefeed.Event{Op: "delete", Database: dbName, Table: tableName, Before: maps.Clone(record)})
+	}
+	table.Records = kept
+	for key, v := range table.Versions {
+		if v.HLC <= hlc {
+			delete(table.Versions, key)
+		}
+	}
+	if len(kept) > 0 {
+		// One LSN per request keeps the slaves' chain of the table intact.
+		for _, e := range events {
+			lsn := feed.Publish([]changefeed.Event{e})
+			req := RequestData{Database: dbName, Table: tableName, Conditions: map[string]string{col: e.Before[col]}, LSN: lsn}
+			req.PrevLSN = table.chainLSN(lsn)
+			replicateDelete(req)
+		}
+	}
+	return len(kept) == 0
+}
+
+// applyRow applies a row change from a peer and returns the resulting
+// change feed events. The caller holds the table lock.
+func (l *multiMaster) applyRow(table *Table, c rowChange) ([]changefeed.Event, *conflictEntry) {
+	v := versionOf(table, c.Key)
+	mergeColumns(v, c.CRDT)
+	if c.Op == "crdt" {
+		idx := rowIndex(table, c.Key)
+		if idx < 0 {
+			return nil, nil // kept for when the row is written again
+		}
+		old := table.Records[idx]
+		row := maps.Clone(old)
+		materialize(table, v, row)
+		if maps.Equal(old, row) {
+			return nil, nil
+		}
+		table.Records[idx] = row
+		return []changefeed.Event{{Op: "update", Database: c.Database, Table: c.Table, Before: maps.Clone(old), After: maps.Clone(row)}}, nil
+	}
+	if v.seen(c.HLC) {
+		return nil, nil // sent again, or already replaced by a later change
+	}
+	idx := rowIndex(table, c.Key)
+	var old map[string]string
+	if idx >= 0 {
+		old = table.Records[idx]
+	}
+	local := conflictVersion{HLC: v.HLC, Values: old, Deleted: old == nil}
+	remote := conflictVersion{HLC: c.HLC, Values: c.Values, Deleted: c.Op == "delete"}
+	concurrent := v.HLC != "" && c.Base != v.HLC
+
+	var next map[string]string // nil deletes the row
+	resolution := ""
+	newest := max(v.HLC, c.HLC)
+	switch l.mode {
+	case "merge":
+		if c.Op == "delete" {
+			v.Deleted = max(v.Deleted, c.HLC)
+		}
+		values := map[string]string{}
+		for k, val := range old {
+			values[k] = val
+		}
+		for k, val := range c.Values {
+			if c.HLC > v.Cols[k] {
+				values[k], v.Cols[k] = val, c.HLC
+			}
+		}
+		for _, col := range table.Columns {
+			if v.Cols[col] > v.Deleted {
+				next = values
+			}
+		}
+		if next != nil {
+			for _, col := range table.Columns {
+				if v.Cols[col] <= v.Deleted {
+					next[col] = ""
+				}
+			}
+		}
+		resolution = "merged"
+	case "custom":
+		if concurrent {
+			older, newer := local, remote
+			if remote.HLC < local.HLC {
+				older, newer = remote, local
+			}
+			res, err := l.resolve(c.Database, c.Table, c.Key, older, newer)
+			if err == nil {
+				next, resolution = res.Values, "resolver"
+				if res.Deleted {
+					next = nil
+				}
+				break
+			}
+			slog.Error("Conflict resolver failed, newest change wins", "database", c.Database, "table", c.Table, "key", c.Key, "err", err)
+			resolution = " (resolver failed)"
+		}
+		fallthrough
+	default:
+		if c.HLC > v.HLC {
+			next, resolution = c.Values, "remote"+resolution
+			if c.Op == "delete" {
+				next = nil
+			}
+		} else {
+			next, resolution = old, "local"+resolution
+		}
+	}
+
+	if c.HLC < v.HLC {
+		// An older change keeps the current version and is only recorded.
+		if v.History = append(v.History, c.HLC); len(v.History) > maxRowHistory {
+			v.History = v.History[len(v.History)-maxRowHistory:]
+		}
+	} else {
+		v.advance(newest)
+	}
+	var events []changefeed.Event
+	switch {
+	case next != nil:
+		row := map[string]string{}
+		for _, col := range table.Columns {
+			row[col] = next[col]
+		}
+		row[keyColumn(table)] = c.Key
+		materialize(table, v, row)
+		if idx >= 0 {
+			if !maps.Equal(old, row) {
+				table.Records[idx] = row
+				events = append(events, changefeed.Event{Op: "update", Database: c.Database, Table: c.Table, Before: maps.Clone(old), After: maps.Clone(row)})
+			}
+		} else {
+			table.Records = append(table.Records, row)
+			events = append(events, changefeed.Event{Op: "insert", Database: c.Database, Table: c.Table, After: maps.Clone(row)})
+		}
+		next = row
+	case idx >= 0:
+		table.Records = slices.Delete(table.Records, idx, idx+1)
+		events = append(events, changefeed.Event{Op: "delete", Database: c.Database, Table: c.Table, Before: maps.Clone(old)})
+	}
+	if !concurrent {
+		return events, nil
+	}
+	return events, &conflictEntry{
+		Time: time.Now().UTC(), Database: c.Database, Table: c.Table, Key: c.Key,
+		Local: local, Remote: remote, Resolution: resolution,
+		Result: conflictVersion{HLC: v.HLC, Values: next, Deleted: next == nil},
+	}
+}
+
+type resolverInput struct {
+	Database string          `json:"database"`
+	Table    string          `json:"table"`
+	Key      string          `json:"key"`
+	Older    conflictVersion `json:"older"`
+	Newer    conflictVersion `json:"newer"`
+}
+
+type resolverOutput struct {
+	Values  map[string]string `json:"values"`
+	Deleted bool              `json:"deleted"`
+}
+
+// resolve runs -conflict-resolver with the two versions as JSON on stdin
+// and reads the row to keep from stdout.
+func (l *multiMaster) resolve(dbName, tableName, key string, older, newer conflictVersion) (resolverOutput, error) {
+	var out resolverOutput
+	args := strings.Fields(l.resolver)
+	ctx, cancel := context.WithTimeout(context.Background(), conflictResolverTO)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	in, _ := json.Marshal(resolverInput{Database: dbName, Table: tableName, Key: key, Older: older, Newer: newer})
+	cmd.Stdin = bytes.NewReader(in)
+	stdout, err := cmd.Output()
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(stdout, &out); err != nil {
+		return out, fmt.Errorf("resolver output: %v", err)
+	}
+	if !out.Deleted && out.Values == nil {
+		return out, errors.New("resolver returned neither values nor deleted")
+	}
+	return out, nil
+}
+
+func (l *multiMaster) logConflict(e conflictEntry) {
+	metrics.Add("ddb_conflicts_total", telemetry.Labels("resolution", e.Resolution), 1)
+	slog.Info("Resolved conflict", "database", e.Database, "table", e.Table, "key", e.Key, "local", e.Local.HLC, "remote", e.Remote.HLC, "resolution", e.Resolution)
+	l.conflictMu.Lock()
+	defer l.conflictMu.Unlock()
+	if l.conflicts = append(l.conflicts, e); len(l.conflicts) > maxConflicts {
+		l.conflicts = l.conflicts[len(l.conflicts)-maxConflicts:]
+	}
+	if l.conflictFile != nil {
+		line, _ := json.Marshal(e)
+		if _, err := l.conflictFile.Write(append(keyRing.SealLine(line), '\n')); err != nil {
+			slog.Error("Writing conflict log", "err", err)
+		}
+	}
+}
+
+// ----- endpoints -----
+
+// handlePeerApply serves POST /peer/apply for other masters.
+func handlePeerApply(w http.ResponseWriter, r *http.Request) {
+	if !leaders.enabled() {
+		http.Error(w, "Multi-master replication is off", http.StatusNotFound)
+		return
+	}
+	var b peerBatch
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	leaders.applyBatch(b)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"applied": len(b.Changes)})
+}
+
+// handlePeers serves GET /peers.
+func handlePeers(w http.ResponseWriter, r *http.Request) {
+	list := []peerStatus{}
+	leaders.mu.Lock()
+	for _, peer := range leaders.peers {
+		st := *leaders.status[peer]
+		st.Acked = leaders.acked[peer]
+		for _, c := range leaders.journal {
+			if c.Seq > st.Acked {
+				st.Pending++
+			}
+		}
+		metrics.Set("ddb_peer_pending_changes", telemetry.Labels("peer", peer), float64(st.Pending))
+		list = append(list, st)
+	}
+	leaders.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"node": leaders.node, "conflict_resolution": leaders.mode, "peers": list})
+}
+
+// handleConflicts serves GET /conflicts, the most recent ones.
+func handleConflicts(w http.ResponseWriter, r *http.Request) {
+	leaders.conflictMu.Lock()
+	list := slices.Clone(leaders.conflicts)
+	leaders.conflictMu.Unlock()
+	if list == nil {
+		list = []conflictEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// ===================== CRDT COLUMNS =====================
+
+// create_table can give columns a CRDT type in "types", so that writes to
+// them from several masters merge instead of conflicting:
+//
+//	gcounter   grow-only counter: increment
+//	pncounter  counter: increment and decrement
+//	lww        last-writer-wins register: set, or update_data
+//	orset      observed-remove set of strings: add and remove
+//
+// Updates change them with "ops", e.g. {"likes": {"op": "increment"}},
+// on every matching row. An insert starts a counter from its value and a
+// set from a JSON array of strings. Rows hold the materialized value, a
+// number or a sorted JSON array, so reads and slaves see plain columns.
+// Slaves apply the ops they are sent to those values.
+//
+// With -peers each row keeps the state of its typed columns, and masters
+// send each other the part an op changed: a node's counter totals, a
+// register value with its HLC, the tag of an added element or the tags a
+// remove saw. Merging takes maxima and unions, so ops commute and a change
+// received twice does nothing more. Every master then materializes the
+// same value, whatever the row's conflict resolution decided for its other
+// columns, and ops that only touch typed columns never conflict. The state
+// outlives a delete of the row and carries on when its key is written
+// again.
+
+var (
+	errColumnType = errors.New("Unknown column type, expected gcounter, pncounter, lww or orset")
+	errCRDTColumn = errors.New("Counter and set columns change through ops")
+	errKeyType    = errors.New("The row key cannot have a column type")
+)
+
+// crdtOps lists the ops each column type takes.
+var crdtOps = map[string][]string{
+	"gcounter":  {"increment"},
+	"pncounter": {"increment", "decrement"},
+	"lww":       {"set"},
+	"orset":     {"add", "remove"},
+}
+
+// crdtState is the state of a typed column of one row, or the part of it
+// an op changed.
+type crdtState struct {
+	P       map[string]int64    `json:"p,omitempty"`       // increments per node
+	N       map[string]int64    `json:"n,omitempty"`       // decrements per node
+	Value   string              `json:"value,omitempty"`   // register
+	HLC     string              `json:"hlc,omitempty"`     // of the register value
+	Adds    map[string][]string `json:"adds,omitempty"`    // tags of each element added
+	Removed map[string]bool     `json:"removed,omitempty"` // tags removed
+}
+
+func (s *crdtState) merge(d *crdtState) {
+	for node, n := range d.P {
+		if s.P == nil {
+			s.P = map[string]int64{}
+		}
+		s.P[node] = max(s.P[node], n)
+	}
+	for node, n := range d.N {
+		if s.N == nil {
+			s.N = map[string]int64{}
+		}
+		s.N[node] = max(s.N[node], n)
+	}
+	if d.HLC > s.HLC {
+		s.Value, s.HLC = d.Value, d.HLC
+	}
+	for elem, tags := range d.Adds {
+		if s.Adds == nil {
+			s.Adds = map[string][]string{}
+		}
+		for _, tag := range tags {
+			if !slices.Contains(s.Adds[elem], tag) {
+				s.Adds[elem] = append(s.Adds[elem], tag)
+			}
+		}
+	}
+	for tag := range d.Removed {
+		if s.Removed == nil {
+			s.Removed = map[string]bool{}
+		}
+		s.Removed[tag] = true
+	}
+}
+
+// value materializes the state as a column of type typ.
+func (s *crdtState) value(typ string) string {
+	switch typ {
+	case "gcounter", "pncounter":
+		var n int64
+		for _, p := range s.P {
+			n += p
+		}
+		for _, d := range s.N {
+			n -= d
+		}
+		return strconv.FormatInt(n, 10)
+	case "orset":
+		var elems []string
+		for elem, tags := range s.Adds {
+			if slices.ContainsFunc(tags, func(tag string) bool { return !s.Removed[tag] }) {
+				elems = append(elems, elem)
+			}
+		}
+		return crdt.FormatSet(elems)
+	}
+	return s.Value
+}
+
+// checkColumnTypes checks the types of a new table.
+func checkColumnTypes(columns []string, types map[string]string) error {
+	for col, typ := range types {
+		switch {
+		case crdtOps[typ] == nil:
+			return errColumnType
+		case !slices.Contains(columns, col):
+			return errUnknownColumn
+		case leaders.enabled() && col == columns[0]:
+			return errKeyType
+		}
+	}
+	return nil
+}
+
+// insertOps returns the ops that give a new row's typed column its
+// inserted value.
+func insertOps(typ, value string) ([]crdt.Op, error) {
+	switch typ {
+	case "gcounter", "pncounter":
+		if value == "" {
+			return nil, nil
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		switch {
+		case err != nil:
+			return nil, err
+		case n < 0 && typ == "gcounter":
+			return nil, errors.New("negative")
+		case n < 0:
+			return []crdt.Op{{Op: "decrement", Value: strconv.FormatInt(-n, 10)}}, nil
+		case n > 0:
+			return []crdt.Op{{Op: "increment", Value: value}}, nil
+		}
+		return nil, nil
+	case "orset":
+		elems, err := crdt.ParseSet(value)
+		var ops []crdt.Op
+		for _, elem := range elems {
+			ops = append(ops, crdt.Op{Op: "add", Value: elem})
+		}
+		return ops, err
+	}
+	return []crdt.Op{{Op: "set", Value: value}}, nil
+}
+
+// checkInsertColumns checks the values inserted in typed columns.
+func checkInsertColumns(table *Table, records []map[string]string) error {
+	for _, record := range records {
+		if record == nil && len(table.Types) > 0 {
+			return errors.New("Missing record")
+		}
+		for col, typ := range table.Types {
+			if _, err := insertOps(typ, record[col]); err != nil {
+				return fmt.Errorf("Invalid value %q for %s column %s", record[col], typ, col)
+			}
+		}
+	}
+	return nil
+}
+
+// checkColumnWrites checks the update_data and ops of an update against
+// the column types.
+func checkColumnWrites(table *Table, data map[string]string, ops map[string]crdt.Op) error {
+	for col := range data {
+		if typ := table.Types[col]; typ != "" && typ != "lww" {
+			return errCRDTColumn
+		}
+	}
+	for col, op := range ops {
+		typ := table.Types[col]
+		if typ == "" {
+			return fmt.Errorf("Column %s has no type, ops need a gcounter, pncounter, lww or orset column", col)
+		}
+		if !slices.Contains(crdtOps[typ], op.Op) {
+			return fmt.Errorf("Column %s is a %s, which takes %s", col, typ, strings.Join(crdtOps[typ], " and "))
+		}
+		if typ == "gcounter" || typ == "pncounter" {
+			if n, err := crdt.Amount(op); err != nil || n < 0 && typ == "gcounter" {
+				return fmt.Errorf("Invalid amount %q for %s", op.Value, col)
+			}
+		}
+		if _, ok := data[col]; ok {
+			return fmt.Errorf("Column %s is both in update_data and ops", col)
+		}
+	}
+	return nil
+}
+
+// updateOps returns the ops of an update, with update_data on registers
+// turned into set ops.
+func updateOps(table *Table, data map[string]string, ops map[string]crdt.Op) map[string][]crdt.Op {
+	out := map[string][]crdt.Op{}
+	for col, op := range ops {
+		out[col] = []crdt.Op{op}
+	}
+	for col, value := range data {
+		if table.Types[col] == "lww" {
+			out[col] = []crdt.Op{{Op: "set", Value: value}}
+		}
+	}
+	return out
+}
+
+// insertColumns gives a new record's typed columns their inserted values
+// and returns what changed in their state. The caller holds the table
+// lock and has checked the record.
+func insertColumns(table *Table, record map[string]string) map[string]*crdtState {
+	if len(table.Types) == 0 {
+		return nil
+	}
+	ops := map[string][]crdt.Op{}
+	for col, typ := range table.Types {
+		ops[col], _ = insertOps(typ, record[col])
+		record[col] = (&crdtState{}).value(typ)
+	}
+	return applyColumnOps(table, record, ops)
+}
+
+// applyColumnOps applies ops to a record. With -peers they change the
+// row's state, and the part they changed is returned for the peers. The
+// caller holds the table lock.
+func applyColumnOps(table *Table, record map[string]string, ops map[string][]crdt.Op) map[string]*crdtState {
+	if len(ops) == 0 {
+		return nil
+	}
+	if !leaders.enabled() {
+		for col, list := range ops {
+			for _, op := range list {
+				record[col] = crdt.Apply(record[col], op)
+			}
+		}
+		return nil
+	}
+	v := versionOf(table, record[keyColumn(table)])
+	if v.CRDT == nil {
+		v.CRDT = map[string]*crdtState{}
+	}
+	delta := map[string]*crdtState{}
+	for col, list := range ops {
+		if v.CRDT[col] == nil {
+			v.CRDT[col] = &crdtState{}
+		}
+		d := &crdtState{}
+		for _, op := range list {
+			leaders.applyOp(v.CRDT[col], d, op)
+		}
+		delta[col] = d
+	}
+	materialize(table, v, record)
+	return delta
+}
+
+// applyOp applies op to state s and records the change in d.
+func (l *multiMaster) applyOp(s, d *crdtState, op crdt.Op) {
+	var p crdtState
+	switch op.Op {
+	case "increment", "decrement":
+		n, _ := crdt.Amount(op)
+		if op.Op == "decrement" {
+			n = -n
+		}
+		if n >= 0 {
+			p.P = map[string]int64{l.node: s.P[l.node] + n}
+		} else {
+			p.N = map[string]int64{l.node: s.N[l.node] - n}
+		}
+	case "set":
+		p.Value, p.HLC = op.Value, l.clock.now()
+	case "add":
+		p.Adds = map[string][]string{op.Value: {l.clock.now()}}
+	case "remove":
+		p.Removed = map[string]bool{}
+		for _, tag := range s.Adds[op.Value] {
+			p.Removed[tag] = true
+		}
+	}
+	s.merge(&p)
+	d.merge(&p)
+}
+
+// mergeColumns merges typed column changes from a peer into a row's state.
+func mergeColumns(v *rowVersion, changes map[string]*crdtState) {
+	for col, d := range changes {
+		if v.CRDT == nil {
+			v.CRDT = map[string]*crdtState{}
+		}
+		if v.CRDT[col] == nil {
+			v.CRDT[col] = &crdtState{}
+		}
+		v.CRDT[col].merge(d)
+	}
+}
+
+// materialize sets the typed columns of a row from their state.
+func materialize(table *Table, v *rowVersion, record map[string]string) {
+	for col, s := range v.CRDT {
+		if typ := table.Types[col]; typ != "" {
+			record[col] = s.value(typ)
+		}
+	}
+}
@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+	"github.com/omar-karam1/distributed-db-go/internal/changefeed"
+	"github.com/omar-karam1/distributed-db-go/internal/crdt"
+)
+
+func TestReplicaReadWithAPIKey(t *testing.T) {
+	oldKeys, oldEnabled, oldSecret, oldSlaves, oldDatabases := apiKeys, authEnabled, nodeSecret, slaveNodes, databases
+	oldACL := auth.CurrentACL()
+	t.Cleanup(func() {
+		apiKeys, authEnabled, nodeSecret, slaveNodes, databases = oldKeys, oldEnabled, oldSecret, oldSlaves, oldDatabases
+		auth.SetACL(oldACL)
+	})
+
+	apiKeys = &authStore{JWTSecret: "jwt-secret"}
+	key, k := apiKeys.createKey("reader", false, "readers")
+	apiKeys.Grants = []auth.Grant{{Role: "readers", Privilege: auth.PrivRead, Database: "shop"}}
+	auth.SetACL(&auth.AccessList{Keys: map[string]auth.ACLKey{k.ID: {Name: k.Name, Roles: k.Roles}}, Grants: apiKeys.Grants})
+	authEnabled, nodeSecret = true, "node-secret"
+	databases = map[string]*Database{"shop": {Name: "shop", Tables: map[string]*Table{
+		"items": {Name: "items", Columns: []string{"id"}, Records: []map[string]string{{"id": "on master"}}},
+	}}}
+
+	// The slave only knows tokens, so it must get a signed read for the
+	// key's ID rather than the key itself.
+	slave := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/replicate_get":
+			http.NotFound(w, r)
+		case r.Header.Get("Authorization") != "":
+			http.Error(w, "API key forwarded", http.StatusBadRequest)
+		case r.Header.Get(auth.CallerHeader) != k.ID:
+			http.Error(w, "wrong caller "+r.Header.Get(auth.CallerHeader), http.StatusUnauthorized)
+		case !auth.VerifyNodeSignature([]byte(nodeSecret), r, auth.NodeReadBody(r)):
+			http.Error(w, "Invalid node signature", http.StatusUnauthorized)
+		default:
+			json.NewEncoder(w).Encode([]map[string]string{{"id": "on replica"}})
+		}
+	}))
+	defer slave.Close()
+	slaveNodes = []string{slave.URL}
+
+	req := httptest.NewRequest(http.MethodGet, "/select?database=shop&table=items&max_staleness=5s", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	requireAuth(handleSelect)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get(servedByHeader); got != slave.URL {
+		t.Fatalf("served by %q, want %q", got, slave.URL)
+	}
+	if !strings.Contains(rec.Body.String(), "on replica") {
+		t.Fatalf("body %s, want the replica's rows", rec.Body)
+	}
+}
+
+func TestHybridClock(t *testing.T) {
+	c := hybridClock{node: "a"}
+	prev := c.now()
+	for range 1000 {
+		next := c.now()
+		if next <= prev {
+			t.Fatalf("%s after %s", next, prev)
+		}
+		prev = next
+	}
+
+	wall, _, _ := parseHLC(prev)
+	future := fmt.Sprintf("%013d.%010d.b", wall+60000, 7)
+	c.observe(future)
+	c.observe("not a timestamp")
+	if next := c.now(); next <= future {
+		t.Fatalf("%s after observing %s", next, future)
+	}
+}
+
+// testPeer is one master of a multi-master pair with its own copy of a
+// table. Writes go through local as in the handlers and changes travel by
+// applyRow, so the peers never touch the global databases.
+type testPeer struct {
+	*multiMaster
+	table *Table
+	sent  int // journal entries taken by send
+}
+
+func newTestPeer(t *testing.T, node, mode string) *testPeer {
+	file, err := os.Create(filepath.Join(t.TempDir(), peerJournalFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	l := &multiMaster{node: node, mode: mode, file: file}
+	l.clock.node = node
+	return &testPeer{multiMaster: l, table: &Table{Name: "items", Columns: []string{"id", "name", "qty"}, Records: []map[string]string{}}}
+}
+
+func (p *testPeer) insert(t *testing.T, row map[string]string) {
+	t.Helper()
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	rows, err := p.prepareInserts(p.table, []map[string]string{row})
+	if err != nil {
+		t.Fatalf("%s: insert %v: %v", p.node, row, err)
+	}
+	p.table.Records = append(p.table.Records, rows[0])
+	p.local(p.table, []changefeed.Event{{Op: "insert", Database: "shop", Table: "items", After: maps.Clone(rows[0])}})
+}
+
+func (p *testPeer) update(t *testing.T, key string, data map[string]string) {
+	t.Helper()
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	i := rowIndex(p.table, key)
+	if i < 0 {
+		t.Fatalf("%s: update of missing row %s", p.node, key)
+	}
+	before := maps.Clone(p.table.Records[i])
+	for k, v := range data {
+		p.table.Records[i][k] = v
+	}
+	p.local(p.table, []changefeed.Event{{Op: "update", Database: "shop", Table: "items", Before: before, After: maps.Clone(p.table.Records[i])}})
+}
+
+func (p *testPeer) remove(t *testing.T, key string) {
+	t.Helper()
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	i := rowIndex(p.table, key)
+	if i < 0 {
+		t.Fatalf("%s: delete of missing row %s", p.node, key)
+	}
+	before := p.table.Records[i]
+	p.table.Records = slices.Delete(p.table.Records, i, i+1)
+	p.local(p.table, []changefeed.Event{{Op: "delete", Database: "shop", Table: "items", Before: before}})
+}
+
+// send returns the changes journaled since the last call.
+func (p *testPeer) send() []rowChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changes := slices.Clone(p.journal[p.sent:])
+	p.sent = len(p.journal)
+	return changes
+}
+
+// receive applies changes from the other peer like applyBatch.
+func (p *testPeer) receive(changes []rowChange) []conflictEntry {
+	var conflicts []conflictEntry
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	for _, c := range changes {
+		p.clock.observe(c.HLC)
+		if _, conflict := p.applyRow(p.table, c); conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+	}
+	return conflicts
+}
+
+func (p *testPeer) rows() []string {
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	var rows []string
+	for _, r := range p.table.Records {
+		b, _ := json.Marshal(r)
+		rows = append(rows, string(b))
+	}
+	slices.Sort(rows)
+	return rows
+}
+
+func (p *testPeer) row(key string) map[string]string {
+	p.table.mu.Lock()
+	defer p.table.mu.Unlock()
+	if i := rowIndex(p.table, key); i >= 0 {
+		return maps.Clone(p.table.Records[i])
+	}
+	return nil
+}
+
+// exchange delivers each peer's new changes to the other.
+func exchange(a, b *testPeer) {
+	fromA, fromB := a.send(), b.send()
+	a.receive(fromB)
+	b.receive(fromA)
+}
+
+// tie sets both clocks to the same future instant, so their next
+// timestamps differ only in the node ID.
+func tie(a, b *testPeer) {
+	wall := time.Now().UnixMilli() + 60000
+	a.clock.wall, a.clock.logical = wall, 0
+	b.clock.wall, b.clock.logical = wall, 0
+}
+
+func TestLWWTieBreakByNodeID(t *testing.T) {
+	a, b := newTestPeer(t, "a", "lww"), newTestPeer(t, "b", "lww")
+	a.insert(t, map[string]string{"id": "1", "name": "apple", "qty": "5"})
+	exchange(a, b)
+
+	tie(a, b)
+	a.update(t, "1", map[string]string{"name": "from a"})
+	b.update(t, "1", map[string]string{"name": "from b"})
+	fromA, fromB := a.send(), b.send()
+	conflictsA, conflictsB := a.receive(fromB), b.receive(fromA)
+
+	for _, p := range []*testPeer{a, b} {
+		if got := p.row("1")["name"]; got != "from b" {
+			t.Errorf("%s: name %q, want the change of node b", p.node, got)
+		}
+	}
+	if len(conflictsA) != 1 || conflictsA[0].Resolution != "remote" {
+		t.Errorf("a: conflicts %+v, want one resolved remote", conflictsA)
+	}
+	if len(conflictsB) != 1 || conflictsB[0].Resolution != "local" {
+		t.Errorf("b: conflicts %+v, want one resolved local", conflictsB)
+	}
+}
+
+func TestTombstones(t *testing.T) {
+	a, b := newTestPeer(t, "a", "lww"), newTestPeer(t, "b", "lww")
+	a.insert(t, map[string]string{"id": "1", "name": "apple", "qty": "5"})
+	a.insert(t, map[string]string{"id": "2", "name": "pear", "qty": "1"})
+	exchange(a, b)
+
+	// A delete and re-insert that arrive in reverse order leave the row.
+	a.remove(t, "1")
+	a.insert(t, map[string]string{"id": "1", "name": "apple again", "qty": "2"})
+	changes := a.send()
+	slices.Reverse(changes)
+	b.receive(changes)
+	for _, p := range []*testPeer{a, b} {
+		if got := p.row("1"); got["name"] != "apple again" {
+			t.Errorf("%s: row 1 %v, want the re-inserted row", p.node, got)
+		}
+	}
+
+	// An older update arriving after a newer delete does not bring the
+	// row back.
+	a.update(t, "2", map[string]string{"qty": "8"})
+	b.clock.observe(fmt.Sprintf("%013d.%010d.a", time.Now().UnixMilli()+60000, 0))
+	b.remove(t, "2")
+	exchange(a, b)
+	for _, p := range []*testPeer{a, b} {
+		if got := p.row("2"); got != nil {
+			t.Errorf("%s: row 2 %v, want it deleted", p.node, got)
+		}
+		p.table.mu.Lock()
+		v := p.table.Versions["2"]
+		p.table.mu.Unlock()
+		if v == nil || v.HLC == "" {
+			t.Errorf("%s: no version kept for the deleted row", p.node)
+		}
+	}
+}
+
+func TestTwoNodeConvergence(t *testing.T) {
+	for _, mode := range []string{"lww", "merge"} {
+		t.Run(mode, func(t *testing.T) {
+			a, b := newTestPeer(t, "a", mode), newTestPeer(t, "b", mode)
+			a.insert(t, map[string]string{"id": "1", "name": "apple", "qty": "5"})
+			b.insert(t, map[string]string{"id": "2", "name": "pear", "qty": "1"})
+			exchange(a, b)
+
+			a.update(t, "1", map[string]string{"qty": "7"})
+			a.remove(t, "2")
+			a.insert(t, map[string]string{"id": "3", "name": "fig", "qty": "4"})
+			b.update(t, "1", map[string]string{"name": "green apple"})
+			b.update(t, "2", map[string]string{"qty": "9"})
+			b.insert(t, map[string]string{"id": "4", "name": "kiwi", "qty": "3"})
+			b.update(t, "1", map[string]string{"qty": "6"})
+
+			// Each side gets the other's changes in a different order.
+			fromA, fromB := a.send(), b.send()
+			slices.Reverse(fromA)
+			a.receive(fromB)
+			b.receive(fromA)
+
+			if ra, rb := a.rows(), b.rows(); !slices.Equal(ra, rb) {
+				t.Fatalf("peers differ:\na %v\nb %v", ra, rb)
+			}
+			for _, key := range []string{"1", "3", "4"} {
+				if a.row(key) == nil {
+					t.Errorf("row %s missing", key)
+				}
+			}
+			if mode == "merge" {
+				if got := a.row("1"); got["name"] != "green apple" {
+					t.Errorf("merge kept name %q, want b's change", got["name"])
+				}
+			}
+		})
+	}
+}
+
+func TestCRDTMerge(t *testing.T) {
+	node := func(id string) *multiMaster {
+		l := &multiMaster{node: id}
+		l.clock.node = id
+		return l
+	}
+	// run applies ops to one node's state and returns the change it sends.
+	run := func(l *multiMaster, s *crdtState, ops ...crdt.Op) *crdtState {
+		d := &crdtState{}
+		for _, op := range ops {
+			l.applyOp(s, d, op)
+		}
+		return d
+	}
+	// deliver merges each node's change into the other's state twice, as
+	// a change may arrive again.
+	deliver := func(sa, sb, da, db *crdtState) {
+		for range 2 {
+			sa.merge(db)
+			sb.merge(da)
+		}
+	}
+	check := func(t *testing.T, typ string, sa, sb *crdtState, want string) {
+		t.Helper()
+		if a, b := sa.value(typ), sb.value(typ); a != want || b != want {
+			t.Fatalf("a has %s, b has %s, want %s", a, b, want)
+		}
+	}
+
+	t.Run("gcounter", func(t *testing.T) {
+		a, b := node("a"), node("b")
+		sa, sb := &crdtState{}, &crdtState{}
+		da := run(a, sa, crdt.Op{Op: "increment", Value: "3"})
+		db := run(b, sb, crdt.Op{Op: "increment"}, crdt.Op{Op: "increment", Value: "2"})
+		deliver(sa, sb, da, db)
+		check(t, "gcounter", sa, sb, "6")
+	})
+
+	t.Run("pncounter", func(t *testing.T) {
+		a, b := node("a"), node("b")
+		sa, sb := &crdtState{}, &crdtState{}
+		da := run(a, sa, crdt.Op{Op: "increment", Value: "5"}, crdt.Op{Op: "decrement"})
+		db := run(b, sb, crdt.Op{Op: "decrement", Value: "2"})
+		deliver(sa, sb, da, db)
+		check(t, "pncounter", sa, sb, "2")
+	})
+
+	t.Run("lww", func(t *testing.T) {
+		a, b := node("a"), node("b")
+		sa, sb := &crdtState{}, &crdtState{}
+		// Sets at the same instant are ordered by node ID.
+		wall := time.Now().UnixMilli() + 60000
+		a.clock.wall, b.clock.wall = wall, wall
+		da := run(a, sa, crdt.Op{Op: "set", Value: "from a"})
+		db := run(b, sb, crdt.Op{Op: "set", Value: "from b"})
+		deliver(sa, sb, da, db)
+		check(t, "lww", sa, sb, "from b")
+
+		a.clock.observe(sb.HLC)
+		da = run(a, sa, crdt.Op{Op: "set", Value: "later"})
+		deliver(sa, sb, da, &crdtState{})
+		check(t, "lww", sa, sb, "later")
+	})
+
+	t.Run("orset", func(t *testing.T) {
+		a, b := node("a"), node("b")
+		sa, sb := &crdtState{}, &crdtState{}
+		da := run(a, sa, crdt.Op{Op: "add", Value: "red"}, crdt.Op{Op: "add", Value: "blue"})
+		deliver(sa, sb, da, &crdtState{})
+		check(t, "orset", sa, sb, `["blue","red"]`)
+
+		// A remove only covers the adds it saw, so a concurrent add wins.
+		da = run(a, sa, crdt.Op{Op: "remove", Value: "red"})
+		db := run(b, sb, crdt.Op{Op: "add", Value: "red"})
+		deliver(sa, sb, da, db)
+		check(t, "orset", sa, sb, `["blue","red"]`)
+
+		db = run(b, sb, crdt.Op{Op: "remove", Value: "red"})
+		deliver(sa, sb, &crdtState{}, db)
+		check(t, "orset", sa, sb, `["blue"]`)
+	})
+}
+
+func TestPostgresMalformedBind(t *testing.T) {
+	var out bytes.Buffer
+	s := &pgSession{
+		rw:      bufio.NewReadWriter(bufio.NewReader(&out), bufio.NewWriter(&out)),
+		stmts:   map[string]*pgPrepared{"": {}},
+		portals: map[string]*pgPortal{},
+	}
+	// 65535 parameters that each claim almost 2 GiB, with no bytes behind
+	// them.
+	body := []byte{0, 0, 0, 0, 0xff, 0xff}
+	for range 3 {
+		body = append(body, 0x7f, 0xff, 0xff, 0xff)
+	}
+	if err := s.handle('B', body); err == nil || !strings.Contains(err.Error(), "malformed") {
+		t.Fatalf("Bind = %v, want a malformed message", err)
+	}
+	if len(s.portals) != 0 {
+		t.Fatal("malformed Bind created a portal")
+	}
+	// A truncated message reads as zeros rather than panicking.
+	if err := s.handle('P', []byte{0, 0, 0xff}); err == nil {
+		t.Fatal("truncated Parse accepted")
+	}
+}
+
+// useTestData gives the test empty databases and a data file of its own,
+// with no slaves to replicate to.
+func useTestData(t *testing.T) {
+	t.Helper()
+	oldDatabases, oldFile, oldSlaves := databases, dataFile, slaveNodes
+	t.Cleanup(func() {
+		replicationWG.Wait()
+		databases, dataFile, slaveNodes = oldDatabases, oldFile, oldSlaves
+	})
+	databases = map[string]*Database{}
+	dataFile = filepath.Join(t.TempDir(), "data.json")
+	slaveNodes = nil
+}
+
+func TestRespCommands(t *testing.T) {
+	useTestData(t)
+	if err := createDatabase(kvDatabase); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTable(RequestData{Database: kvDatabase, Table: kvTable, Columns: []string{"key", "type", "value", "expires_at"}}); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	go serveResp(server)
+	defer client.Close()
+	rd := bufio.NewReader(client)
+	do := func(args ...string) string {
+		t.Helper()
+		cmd := fmt.Sprintf("*%d\r\n", len(args))
+		for _, a := range args {
+			cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+		}
+		if _, err := client.Write([]byte(cmd)); err != nil {
+			t.Fatal(err)
+		}
+		line, err := readRespLine(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(line, "$") && line != "$-1" {
+			if line, err = readRespLine(rd); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return line
+	}
+	stored := func() int {
+		records, _, _ := selectLocalRecords(kvDatabase, kvTable, nil, 0)
+		return len(records)
+	}
+
+	for _, c := range []struct{ args, want string }{
+		{"SET a 1", "+OK"},
+		{"GET a", "1"},
+		{"TTL a", ":-1"},
+		{"SET a 2 XX", "+OK"},
+		{"SET a 3 NX", "$-1"},
+		{"GET a", "2"},
+		{"EXPIRE a 100", ":1"},
+		{"TTL a", ":100"},
+		{"EXPIRE missing 100", ":0"},
+		{"TTL missing", ":-2"},
+		{"SET b x", "+OK"},
+		{"DEL a b missing", ":2"},
+		{"GET a", "$-1"},
+		{"SET c 1", "+OK"},
+		{"EXPIRE c 0", ":1"},
+		{"EXISTS c", ":0"},
+	} {
+		if got := do(strings.Fields(c.args)...); got != c.want {
+			t.Fatalf("%s = %q, want %q", c.args, got, c.want)
+		}
+	}
+	if n := stored(); n != 0 {
+		t.Fatalf("%d rows left after deleting every key", n)
+	}
+
+	// Reads leave an expired key's row alone; the next write replaces it.
+	do("SET", "d", "1", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	for _, c := range []struct{ args, want string }{
+		{"GET d", "$-1"},
+		{"TTL d", ":-2"},
+		{"EXISTS d", ":0"},
+		{"EXPIRE d 100", ":0"},
+	} {
+		if got := do(strings.Fields(c.args)...); got != c.want {
+			t.Fatalf("%s = %q, want %q", c.args, got, c.want)
+		}
+	}
+	if n := stored(); n != 1 {
+		t.Fatalf("%d rows after reading an expired key, want 1", n)
+	}
+	if got := do("SET", "d", "2", "NX"); got != "+OK" {
+		t.Fatalf("SET NX over an expired key = %q", got)
+	}
+	if got := do("GET", "d"); got != "2" || stored() != 1 {
+		t.Fatalf("GET d = %q with %d rows, want 2 with 1 row", got, stored())
+	}
+	do("SET", "e", "1", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	if got := do("DEL", "e"); got != ":0" || stored() != 1 {
+		t.Fatalf("DEL of an expired key = %q with %d rows, want :0 with 1 row", got, stored())
+	}
+
+	// A change made over HTTP or SQL between the read and the write is
+	// not overwritten.
+	_, row, err := kvLookup("d")
+	if err != nil || row == nil {
+		t.Fatalf("lookup d: %v", err)
+	}
+	if _, err := updateRecords(RequestData{Database: kvDatabase, Table: kvTable, Conditions: map[string]string{"key": "d"}, UpdateData: map[string]string{"value": "9"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kvPut("d", &kvEntry{Type: "string", Value: "3"}, row); err != errRespChanged {
+		t.Fatalf("put over a changed row = %v, want errRespChanged", err)
+	}
+	if got := do("GET", "d"); got != "9" {
+		t.Fatalf("GET d = %q, want the HTTP write", got)
+	}
+}
+
+func TestCDCFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lake.ndjson")
+	s := &cdcFileSink{path: path, maxBytes: 400, maxFiles: 2}
+	for i := range 12 {
+		env := cdcEnvelope{Op: "c", After: map[string]string{"id": fmt.Sprint(i)}, Source: cdcSource{LSN: uint64(i + 1)}}
+		if err := s.deliver(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.file.Close()
+
+	var lsns []uint64
+	for _, name := range []string{path + ".2", path + ".1", path} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) > 400 {
+			t.Fatalf("%s has %d bytes, over max_bytes", name, len(data))
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var env cdcEnvelope
+			if err := json.Unmarshal([]byte(line), &env); err != nil {
+				t.Fatal(err)
+			}
+			lsns = append(lsns, env.Source.LSN)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("%s.3 kept beyond max_files", path)
+	}
+	// The oldest events were rotated away; the rest are in order and end
+	// with the last one.
+	if !slices.IsSorted(lsns) || lsns[len(lsns)-1] != 12 || lsns[0] == 1 {
+		t.Fatalf("LSNs across the files %v", lsns)
+	}
+}
+
+func TestCDCWebhookRetryAndDeadLetter(t *testing.T) {
+	var times []time.Time
+	failures := 2
+	status := http.StatusServiceUnavailable
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		if len(times) <= failures {
+			w.WriteHeader(status)
+		}
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	hook := newCDCWebhookSink(cdcSinkConfig{Name: "hook", URL: srv.URL, MaxRetries: 3, BackoffMS: 20, DeadLetter: filepath.Join(dir, "dead.ndjson")})
+	dead := 0
+	hook.onDead = func(error) { dead++ }
+	env := cdcEnvelope{Op: "c", After: map[string]string{"id": "1"}, Source: cdcSource{LSN: 1}}
+
+	// Two 503s are retried, each after twice the previous wait.
+	if err := hook.deliver(env); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 3 || dead != 0 {
+		t.Fatalf("%d attempts and %d dead letters, want 3 and 0", len(times), dead)
+	}
+	if first, second := times[1].Sub(times[0]), times[2].Sub(times[1]); first < 20*time.Millisecond || second < 40*time.Millisecond {
+		t.Fatalf("retried after %v and %v, want at least 20ms and 40ms", first, second)
+	}
+
+	// A webhook that keeps failing gets max_retries retries, then the
+	// event is dead-lettered and the sink moves on.
+	times, failures = nil, 100
+	if err := hook.deliver(env); err != nil {
+		t.Fatal(err)
+	}
+	// A 4xx is not retried.
+	times, status = nil, http.StatusBadRequest
+	if err := hook.deliver(env); err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 1 || dead != 2 {
+		t.Fatalf("%d attempts for a 400 and %d dead letters, want 1 and 2", len(times), dead)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dead.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var attempts []int
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var d cdcDeadLetter
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatal(err)
+		}
+		if d.Sink != "hook" || d.Event.Source.LSN != 1 || d.Error == "" {
+			t.Fatalf("dead letter %s", line)
+		}
+		attempts = append(attempts, d.Attempts)
+	}
+	if !slices.Equal(attempts, []int{4, 1}) {
+		t.Fatalf("dead letters after %v attempts, want [4 1]", attempts)
+	}
+}
+
+// cdcRecorder is a sink that records what it is sent and stops the runner
+// after stop deliveries, failing the last one if fail is set.
+type cdcRecorder struct {
+	got    []cdcOffset
+	stop   int
+	fail   bool
+	cancel context.CancelFunc
+}
+
+func (s *cdcRecorder) deliver(env cdcEnvelope) error {
+	s.got = append(s.got, cdcOffset{LSN: env.Source.LSN, Seq: env.Source.Seq})
+	if len(s.got) < s.stop {
+		return nil
+	}
+	s.cancel()
+	if s.fail {
+		return errors.New("sink down")
+	}
+	return nil
+}
+
+func TestCDCResumeFromOffset(t *testing.T) {
+	oldFeed := feed
+	t.Cleanup(func() { feed = oldFeed })
+	dir := t.TempDir()
+	feed = changefeed.New(keyRing, metrics)
+	feed.Open(filepath.Join(dir, "changes.log"))
+	row := func(id string) changefeed.Event {
+		return changefeed.Event{Op: "insert", Database: "shop", Table: "items", After: map[string]string{"id": id}}
+	}
+	feed.Publish([]changefeed.Event{row("1"), row("2")})
+	feed.Publish([]changefeed.Event{row("3")})
+
+	sc := cdcSinkConfig{Name: "lake", Type: "file", Path: filepath.Join(dir, "lake.ndjson")}
+	runUntil := func(stop int, fail bool) *cdcRecorder {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		rec := &cdcRecorder{stop: stop, fail: fail, cancel: cancel}
+		r := newCDCRunner(dir, sc)
+		r.sink = rec
+		done := make(chan struct{})
+		go func() {
+			r.run(ctx)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("runner did not stop")
+		}
+		return rec
+	}
+
+	// The sink fails on the second event of LSN 1, so only the first is
+	// committed.
+	if got := runUntil(2, true).got; !slices.Equal(got, []cdcOffset{{1, 1}, {1, 2}}) {
+		t.Fatalf("first run delivered %v", got)
+	}
+	// A restarted runner picks up inside LSN 1 and goes on to the events
+	// published while it was down.
+	feed.Publish([]changefeed.Event{row("4")})
+	if got := runUntil(3, false).got; !slices.Equal(got, []cdcOffset{{1, 2}, {2, 1}, {3, 1}}) {
+		t.Fatalf("resumed run delivered %v", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "lake.offset"))
+	if err != nil || strings.TrimSpace(string(data)) != `{"lsn":3,"seq":1}` {
+		t.Fatalf("offset file %q, %v", data, err)
+	}
+}
+
+// useShards makes this master shard self of m for the test.
+func useShards(t *testing.T, m *shardMap, self string) {
+	t.Helper()
+	old := shards
+	t.Cleanup(func() { shards = old })
+	shards = &shardState{file: filepath.Join(t.TempDir(), "shards.json"), self: self, m: m, ring: newShardRing(m)}
+}
+
+// stubShard stands in for the master of another shard. It keeps the rows
+// of one table and records what it was sent.
+type stubShard struct {
+	mu      sync.Mutex
+	newer   *shardMap // answered once, with 409, to older calls
+	ops     []shardExec
+	rows    []map[string]string
+	staged  []shardStage
+	commit  *shardCommit
+	onStage func() // called after a stage batch is taken
+
+	prepareErr string   // answer to /txn/prepare
+	decisions  []string // /txn/commit and /txn/abort calls
+	outcome    string   // answer to /txn/status
+}
+
+func (s *stubShard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/shard/exec":
+		var x shardExec
+		json.NewDecoder(r.Body).Decode(&x)
+		if s.newer != nil && x.Version < s.newer.Version {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(shardResult{Map: s.newer})
+			s.newer = nil
+			break
+		}
+		s.ops = append(s.ops, x)
+		json.NewEncoder(w).Encode(s.exec(x))
+	case "/shard/stage":
+		var b shardStage
+		json.NewDecoder(r.Body).Decode(&b)
+		s.staged = append(s.staged, b)
+		if hook := s.onStage; hook != nil {
+			s.onStage = nil
+			s.mu.Unlock()
+			hook()
+			return
+		}
+	case "/shard/commit":
+		var c shardCommit
+		json.NewDecoder(r.Body).Decode(&c)
+		s.commit = &c
+		for _, b := range s.staged {
+			for _, st := range b.Tables {
+				s.rows = append(s.rows, st.Records...)
+			}
+			for _, e := range b.Events {
+				s.apply(e)
+			}
+		}
+		json.NewEncoder(w).Encode(len(s.rows))
+	case "/txn/prepare":
+		json.NewEncoder(w).Encode(shardResult{Error: s.prepareErr})
+	case "/txn/commit", "/txn/abort":
+		var rec txnRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		s.decisions = append(s.decisions, strings.TrimPrefix(r.URL.Path, "/txn/")+" "+rec.Txn)
+		json.NewEncoder(w).Encode([]int{})
+	case "/txn/status":
+		json.NewEncoder(w).Encode(s.outcome)
+	default:
+		http.NotFound(w, r)
+	}
+	s.mu.Unlock()
+}
+
+func (s *stubShard) exec(x shardExec) shardResult {
+	var res shardResult
+	switch x.Op {
+	case "insert":
+		s.rows = append(s.rows, x.Request.Record)
+		res.Count = 1
+	case "select":
+		for _, row := range s.rows {
+			if changefeed.MatchesConditions(row, x.Request.Conditions) {
+				res.Records = append(res.Records, row)
+			}
+		}
+	case "update", "delete":
+		for _, row := range slices.Clone(s.rows) {
+			if changefeed.MatchesConditions(row, x.Request.Conditions) {
+				after := maps.Clone(row)
+				maps.Copy(after, x.Request.UpdateData)
+				s.apply(changefeed.Event{Op: x.Op, Before: row, After: after})
+				res.Count++
+			}
+		}
+	}
+	return res
+}
+
+// apply makes a row change, matching rows by their whole contents.
+func (s *stubShard) apply(e changefeed.Event) {
+	if e.Op == "insert" {
+		s.rows = append(s.rows, e.After)
+		return
+	}
+	for i, row := range s.rows {
+		if maps.Equal(row, e.Before) {
+			if e.Op == "update" {
+				s.rows[i] = e.After
+			} else {
+				s.rows = slices.Delete(s.rows, i, i+1)
+			}
+			return
+		}
+	}
+}
+
+// ids returns the sorted ids of the rows.
+func ids(rows []map[string]string) []string {
+	var out []string
+	for _, row := range rows {
+		out = append(out, row["id"])
+	}
+	slices.Sort(out)
+	return out
+}
+
+func TestShardRouting(t *testing.T) {
+	useTestData(t)
+	stub := &stubShard{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	m := &shardMap{Version: 1, Tables: map[string]string{"shop.items": "id"}, Shards: []shardInfo{
+		{ID: "a", Master: "http://a.invalid"},
+		{ID: "b", Master: srv.URL},
+	}}
+	useShards(t, m, "a")
+	// Shard b already runs a newer map, which the first call to it brings
+	// over before the call is retried.
+	stub.newer = &shardMap{Version: 2, Tables: m.Tables, Shards: m.Shards}
+
+	if err := createDatabase("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := shards.current(); cur.Version != 2 {
+		t.Fatalf("map version %d after the conflict, want 2", cur.Version)
+	}
+	if err := createTable(RequestData{Database: "shop", Table: "items", Columns: []string{"id", "name"}}); err != nil {
+		t.Fatal(err)
+	}
+	var onA, onB []string
+	_, ring := shards.current()
+	for i := range 20 {
+		id := strconv.Itoa(i)
+		if err := insertRecord(RequestData{Database: "shop", Table: "items", Record: map[string]string{"id": id, "name": "n" + id}}); err != nil {
+			t.Fatal(err)
+		}
+		if ring.owner(id) == 0 {
+			onA = append(onA, id)
+		} else {
+			onB = append(onB, id)
+		}
+	}
+	slices.Sort(onA)
+	slices.Sort(onB)
+	if len(onA) == 0 || len(onB) == 0 {
+		t.Fatalf("keys split %v / %v, want rows on both shards", onA, onB)
+	}
+	local, _, _ := selectLocalRecords("shop", "items", nil, 0)
+	if got := ids(local); !slices.Equal(got, onA) {
+		t.Fatalf("shard a holds %v, want %v", got, onA)
+	}
+	if got := ids(stub.rows); !slices.Equal(got, onB) {
+		t.Fatalf("shard b holds %v, want %v", got, onB)
+	}
+
+	// A select on the shard key goes to the one shard that owns it.
+	sent := len(stub.ops)
+	rows, _, err := selectRecords("shop", "items", map[string]string{"id": onA[0]}, 0)
+	if err != nil || len(rows) != 1 || len(stub.ops) != sent {
+		t.Fatalf("select of %s on shard a: %v, %v, %d calls to shard b", onA[0], rows, err, len(stub.ops)-sent)
+	}
+	rows, _, err = selectRecords("shop", "items", map[string]string{"id": onB[0]}, 0)
+	if err != nil || len(rows) != 1 || rows[0]["name"] != "n"+onB[0] || len(stub.ops) != sent+1 {
+		t.Fatalf("select of %s on shard b: %v, %v", onB[0], rows, err)
+	}
+	// Without it every shard is asked and the rows are merged.
+	rows, _, err = selectRecords("shop", "items", nil, 0)
+	if err != nil || len(rows) != 20 {
+		t.Fatalf("select of every shard: %d rows, %v", len(rows), err)
+	}
+	n, err := updateRecords(RequestData{Database: "shop", Table: "items", Conditions: map[string]string{"name": "n" + onB[0]}, UpdateData: map[string]string{"name": "x"}})
+	if err != nil || n != 1 || stub.ops[len(stub.ops)-1].Op != "update" {
+		t.Fatalf("update by name: %d rows, %v", n, err)
+	}
+
+	if _, err := updateRecords(RequestData{Database: "shop", Table: "items", Conditions: map[string]string{"id": onA[0]}, UpdateData: map[string]string{"id": "99"}}); err != errShardKeyUpdate {
+		t.Fatalf("update of the shard key = %v, want errShardKeyUpdate", err)
+	}
+	if err := insertRecord(RequestData{Database: "shop", Table: "items", Record: map[string]string{"name": "no key"}}); !errors.Is(err, errShardKeyMissing) {
+		t.Fatalf("insert without the shard key = %v, want errShardKeyMissing", err)
+	}
+}
+
+func TestShardMigrationCutover(t *testing.T) {
+	useTestData(t)
+	oldFeed := feed
+	t.Cleanup(func() { feed = oldFeed })
+	feed = changefeed.New(keyRing, metrics)
+	feed.Open(filepath.Join(t.TempDir(), "changes.log"))
+	stub := &stubShard{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	cur := &shardMap{Version: 1, Tables: map[string]string{"shop.items": "id"}, Shards: []shardInfo{{ID: "a", Master: "http://a.invalid"}}}
+	useShards(t, cur, "a")
+	if err := createDatabase("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTable(RequestData{Database: "shop", Table: "items", Columns: []string{"id", "name"}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := range 20 {
+		id := strconv.Itoa(i)
+		if err := insertRecord(RequestData{Database: "shop", Table: "items", Record: map[string]string{"id": id, "name": "n" + id}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	next, _, dst, err := cur.rebalance(rebalanceRequest{Op: "split", Shard: "a", New: shardInfo{ID: "b", Master: srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextRing := newShardRing(next)
+	var stay, move []string
+	for i := range 21 {
+		id := strconv.Itoa(i)
+		if next.Shards[nextRing.owner(id)].ID == dst.ID {
+			move = append(move, id)
+		} else {
+			stay = append(stay, id)
+		}
+	}
+	slices.Sort(stay)
+	slices.Sort(move)
+
+	// Writes that land after the snapshot are sent in the catch-up.
+	stub.onStage = func() {
+		if err := insertRecord(RequestData{Database: "shop", Table: "items", Record: map[string]string{"id": "20", "name": "late"}}); err != nil {
+			t.Error(err)
+		}
+		if _, err := updateRecords(RequestData{Database: "shop", Table: "items", Conditions: map[string]string{"id": move[0]}, UpdateData: map[string]string{"name": "changed"}}); err != nil {
+			t.Error(err)
+		}
+	}
+	moved, err := migrateShard(next, dst.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != len(move) || len(stub.staged) < 2 {
+		t.Fatalf("moved %d rows in %d batches, want %d rows and a catch-up", moved, len(stub.staged), len(move))
+	}
+	if stub.commit == nil || stub.commit.Map.Version != 2 {
+		t.Fatal("migration was not committed with the next map")
+	}
+	if m, _ := shards.current(); m.Version != 2 {
+		t.Fatalf("map version %d after cutover, want 2", m.Version)
+	}
+	local, _, _ := selectLocalRecords("shop", "items", nil, 0)
+	if got := ids(local); !slices.Equal(got, stay) {
+		t.Fatalf("shard a kept %v, want %v", got, stay)
+	}
+	if got := ids(stub.rows); !slices.Equal(got, move) {
+		t.Fatalf("shard b got %v, want %v", got, move)
+	}
+	for _, row := range stub.rows {
+		if row["id"] == move[0] && row["name"] != "changed" {
+			t.Fatalf("row %s moved as %v, without the update made during the migration", move[0], row)
+		}
+	}
+
+	// Moved keys are now routed to the new shard.
+	rows, _, err := selectRecords("shop", "items", map[string]string{"id": move[0]}, 0)
+	if err != nil || len(rows) != 1 || stub.ops[len(stub.ops)-1].Version != 2 {
+		t.Fatalf("select of a moved key: %v, %v", rows, err)
+	}
+}
+
+func TestTwoPhaseCommitRecovery(t *testing.T) {
+	useTestData(t)
+	oldTxns := txns
+	t.Cleanup(func() { txns = oldTxns })
+	txns = &txnLog{live: map[string]txnRecord{}, pins: map[string]int{}}
+	if err := txns.open(filepath.Join(t.TempDir(), "txn.log"), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubShard{}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+	b := shardInfo{ID: "b", Master: srv.URL}
+	m := &shardMap{Version: 1, Tables: map[string]string{"shop.items": "id"}, Shards: []shardInfo{{ID: "a", Master: "http://a.invalid"}, b}}
+	useShards(t, m, "a")
+	if err := createDatabase("shop"); err != nil {
+		t.Fatal(err)
+	}
+	if err := createTable(RequestData{Database: "shop", Table: "items", Columns: []string{"id", "name"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, ring := shards.current()
+	var onA, onB string
+	for i := 0; onA == "" || onB == ""; i++ {
+		if id := strconv.Itoa(i); ring.owner(id) == 0 {
+			onA = id
+		} else {
+			onB = id
+		}
+	}
+	insert := func(id string) txnOp {
+		return txnOp{Op: "insert", RequestData: RequestData{Database: "shop", Table: "items", Record: map[string]string{"id": id}}}
+	}
+	rowsOnA := func() []string {
+		records, _, _ := selectLocalRecords("shop", "items", nil, 0)
+		return ids(records)
+	}
+
+	// Shard b fails to prepare, so neither part is applied and both shards
+	// are told to abort.
+	stub.prepareErr = errTableNotFound.Error()
+	id, _, pending, err := runTxn([]txnOp{insert(onA), insert(onB)}, "req", nil)
+	if !errors.Is(err, errTxnAborted) || !errors.Is(err, errTableNotFound) || len(pending) != 0 {
+		t.Fatalf("runTxn = %v with %v pending, want an abort", err, pending)
+	}
+	if got := rowsOnA(); len(got) != 0 {
+		t.Fatalf("aborted transaction left %v on shard a", got)
+	}
+	if !slices.Equal(stub.decisions, []string{"abort " + id}) || len(txns.unfinished()) != 0 {
+		t.Fatalf("shard b got %v, %d transactions unfinished", stub.decisions, len(txns.unfinished()))
+	}
+
+	// A part prepared here for b's transaction stays in doubt, keeping its
+	// table, until its deadline passes and b has decided.
+	prepare := func(txn string) {
+		t.Helper()
+		rec := txnRecord{Txn: txn, Coordinator: &b, Ops: []txnOp{insert(onA)}, Version: 1, Deadline: time.Now().Add(50 * time.Millisecond)}
+		if err := prepareTxn(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prepare("t1")
+	resolveTxns()
+	if txns.prepared() != 1 {
+		t.Fatal("part resolved before its deadline")
+	}
+	if err := dropTable(RequestData{Database: "shop", Table: "items", Routed: true}); err != errTableInTransaction {
+		t.Fatalf("drop of a table in doubt = %v, want errTableInTransaction", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	stub.outcome = "pending"
+	resolveTxns()
+	if txns.prepared() != 1 {
+		t.Fatal("part resolved while the coordinator had not decided")
+	}
+	stub.outcome = "commit"
+	resolveTxns()
+	if got := rowsOnA(); txns.prepared() != 0 || !slices.Equal(got, []string{onA}) {
+		t.Fatalf("after commit: %d parts prepared, rows %v", txns.prepared(), got)
+	}
+	// Recovering the same commit twice applies it once.
+	if rows, err := commitTxn("t1"); err != nil || rows != nil || len(rowsOnA()) != 1 {
+		t.Fatalf("second commit: %v, %v, rows %v", rows, err, rowsOnA())
+	}
+
+	prepare("t2")
+	time.Sleep(60 * time.Millisecond)
+	stub.outcome = "abort"
+	resolveTxns()
+	if got := rowsOnA(); txns.prepared() != 0 || len(got) != 1 {
+		t.Fatalf("after abort: %d parts prepared, rows %v", txns.prepared(), got)
+	}
+
+	// A coordinator that did not decide by the deadline aborts and tells
+	// the participants.
+	stub.decisions = nil
+	begin := txnRecord{Txn: "t3", Role: "coordinator", State: "begin", Participants: []shardInfo{b}, Version: 1, Deadline: time.Now().Add(-time.Second)}
+	if err := txns.record(begin); err != nil {
+		t.Fatal(err)
+	}
+	resolveTxns()
+	if !slices.Equal(stub.decisions, []string{"abort t3"}) || len(txns.unfinished()) != 0 {
+		t.Fatalf("coordinator recovery sent %v, %d transactions unfinished", stub.decisions, len(txns.unfinished()))
+	}
+}
@@ -0,0 +1,1399 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+	"github.com/omar-karam1/distributed-db-go/internal/changefeed"
+	"github.com/omar-karam1/distributed-db-go/internal/crdt"
+	"github.com/omar-karam1/distributed-db-go/internal/crypto"
+	"github.com/omar-karam1/distributed-db-go/internal/lifecycle"
+	"github.com/omar-karam1/distributed-db-go/internal/merkle"
+	"github.com/omar-karam1/distributed-db-go/internal/telemetry"
+	"github.com/omar-karam1/distributed-db-go/internal/tlsutil"
+	"github.com/omar-karam1/distributed-db-go/internal/wire"
+)
+
+// ===================== DATA STRUCTURES =====================
+
+type Table struct {
+	Name    string              `json:"name"`
+	Columns []string            `json:"columns"`
+	Records []map[string]string `json:"records"`
+	// LSN is the master's last change to the table applied along with
+	// every change before it, see chain.
+	LSN   uint64            `json:"lsn,omitempty"`
+	early map[uint64]uint64 // LSN of changes waiting for the one before, by PrevLSN
+	mu    sync.Mutex        `json:"-"`
+}
+
+type Database struct {
+	Name   string            `json:"name"`
+	Tables map[string]*Table `json:"tables"`
+}
+
+type RequestData struct {
+	Database   string            `json:"database"`
+	Table      string            `json:"table"`
+	Columns    []string          `json:"columns"`
+	Record     map[string]string `json:"record"`
+	UpdateData map[string]string `json:"update_data"`
+	Conditions map[string]string `json:"conditions"`
+	LSN        uint64            `json:"lsn,omitempty"`
+	PrevLSN    uint64            `json:"prev_lsn,omitempty"`
+	RequestID  string            `json:"-"` // sent in X-Request-Id
+
+	Ops map[string]crdt.Op `json:"ops,omitempty"` // changes to CRDT columns
+}
+
+var (
+	databases   = make(map[string]*Database)
+	dbMu        sync.Mutex
+	dataFile    = "data.json"
+	slaveFile   = "slave_data.json"
+	changesFile = "slave_changes.log"
+	aclFile     = "slave_acl.json"
+	slavePort   = "8001" // Default port
+	grpcAddr    = ""     // gRPC address, disabled when empty
+	jwtSecret   = ""     // verifies client tokens
+	nodeSecret  = ""     // verifies replication requests
+	serverTLS   *tls.Config
+	nodePeers   = map[string]bool{} // certificate names allowed to replicate, empty when mTLS is off
+
+	insecureReplication = false // accept unsigned replication requests
+	masterURL           = ""    // where client writes belong, see handleReadOnly
+	forwardWrites       = false
+	masterClient        = &http.Client{Timeout: 30 * time.Second}
+)
+
+// ===================== INIT =====================
+
+func initSlaveDatabase() {
+	// Load slave data if available
+	if _, err := os.Stat(slaveFile); err == nil {
+		content, err := keyRing.ReadFile(slaveFile)
+		if err != nil {
+			telemetry.Fatal("Loading data file", "file", slaveFile, "err", err)
+		}
+		json.Unmarshal(content, &databases)
+		slog.Info("Loaded data", "file", slaveFile)
+		return
+	}
+	slog.Info("No existing data file found", "file", slaveFile)
+	databases = make(map[string]*Database)
+}
+
+// saveSlaveDataToFile saves the data file. It takes dbMu, so the caller
+// must hold neither dbMu nor a table lock.
+func saveSlaveDataToFile() {
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	dataHealth.Report(err)
+	if err != nil {
+		slog.Error("Saving data file", "file", slaveFile, "err", err)
+	}
+}
+
+// saveData writes the data file. The caller holds dbMu.
+func saveData() error {
+	defer metrics.Since("ddb_snapshot_write_duration_seconds", "", time.Now())
+	content, _ := json.MarshalIndent(databases, "", "  ")
+	return keyRing.WriteFile(slaveFile, content, 0644)
+}
+
+func initDatabaseStorage() {
+	// Load master data if available
+	if _, err := os.Stat(dataFile); err == nil {
+		content, err := ioutil.ReadFile(dataFile)
+		if err == nil {
+			json.Unmarshal(content, &databases)
+			slog.Info("Loaded data", "file", dataFile)
+			return
+		}
+	}
+	slog.Info("No existing data file found", "file", dataFile)
+	databases = make(map[string]*Database)
+}
+
+func saveDataToFile() {
+	content, _ := json.MarshalIndent(databases, "", "  ")
+	ioutil.WriteFile(dataFile, content, 0644)
+}
+
+// ===================== MAIN =====================
+
+func main() {
+	flag.StringVar(&grpcAddr, "grpc-addr", grpcAddr, "serve the read-only gRPC API on this address, e.g. :9001")
+	flag.StringVar(&jwtSecret, "jwt-secret", "", "require tokens signed with this secret (the master's jwt_secret) for reads, or set $DDB_JWT_SECRET")
+	flag.StringVar(&nodeSecret, "node-secret", "", "only accept replication requests signed with this secret, or set $DDB_NODE_SECRET")
+	tlsCert := flag.String("tls-cert", "", "serve HTTP and gRPC over TLS with this certificate")
+	tlsKey := flag.String("tls-key", "", "private key for -tls-cert")
+	nodeCA := flag.String("node-ca", "", "require replication requests to present a client certificate signed by this CA")
+	flag.StringVar(&slavePort, "port", slavePort, "serve HTTP on this port")
+	peers := flag.String("node-peers", "master", "comma separated certificate names (CN or DNS SAN) allowed to replicate with -node-ca")
+	flag.BoolVar(&insecureReplication, "insecure-replication", false, "accept replication requests without -node-secret or -node-ca, for local testing only")
+	flag.StringVar(&masterURL, "master", "", "master URL that client writes are pointed or forwarded to, e.g. http://localhost:8000")
+	flag.BoolVar(&forwardWrites, "forward-writes", false, "forward client writes to -master instead of refusing them")
+	keyFile := flag.String("encryption-key-file", "", "encrypt data and change log files with the keys in this `file`, or set $DDB_ENCRYPTION_KEY")
+	logFormat := flag.String("log-format", "text", "log as logfmt text or json")
+	logLevel := flag.String("log-level", "info", "minimum log `level`: debug, info, warn or error")
+	logOutput := flag.String("log-output", "stderr", "comma separated log destinations: stderr, stdout or file paths")
+	traceOutput := flag.String("trace-output", "", "export trace spans to this file, or to an OTLP/HTTP collector URL such as http://localhost:4318/v1/traces")
+	traceSample := flag.Float64("trace-sample", 1, "fraction of new traces to record")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGTERM, how long to wait for requests in progress")
+	flag.Parse()
+	if err := telemetry.SetupLogging(*logFormat, *logLevel, *logOutput); err != nil {
+		telemetry.Fatal("Configuring logging", "err", err)
+	}
+	if err := telemetry.StartTracing(*traceOutput, "ddb-slave", *traceSample); err != nil {
+		telemetry.Fatal("Starting tracing", "err", err)
+	}
+	if jwtSecret == "" {
+		jwtSecret = os.Getenv("DDB_JWT_SECRET")
+	}
+	if nodeSecret == "" {
+		nodeSecret = os.Getenv("DDB_NODE_SECRET")
+	}
+
+	if *nodeCA != "" && *tlsCert == "" {
+		telemetry.Fatal("-node-ca needs -tls-cert")
+	}
+	if *tlsCert != "" {
+		cfg, err := tlsutil.NewServerConfig(*tlsCert, *tlsKey, *nodeCA)
+		if err != nil {
+			telemetry.Fatal("Loading TLS certificate", "err", err)
+		}
+		serverTLS = cfg
+	}
+	if *nodeCA != "" {
+		for _, name := range strings.Split(*peers, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				nodePeers[name] = true
+			}
+		}
+		// The master's certificate comes from the same CA.
+		cfg, err := tlsutil.NewClientConfig(*nodeCA, "", "")
+		if err != nil {
+			telemetry.Fatal("Loading node CA", "err", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cfg
+		masterClient.Transport = transport
+	}
+	masterURL = strings.TrimRight(masterURL, "/")
+	if forwardWrites && masterURL == "" {
+		telemetry.Fatal("-forward-writes needs -master")
+	}
+	switch {
+	case nodeSecret == "" && len(nodePeers) == 0 && insecureReplication:
+		slog.Warn("Accepting unauthenticated replication requests")
+	case nodeSecret == "" && len(nodePeers) == 0:
+		slog.Warn("Refusing replication until -node-secret or -node-ca is set")
+	}
+
+	slog.Info("Slave node starting", "addr", ":"+slavePort)
+	if err := keyRing.Load(*keyFile); err != nil {
+		telemetry.Fatal("Loading encryption keys", "err", err)
+	}
+	keyRing.Watch(reencrypt)
+	initSlaveDatabase()
+	feed.Open(changesFile)
+	if keyRing.Stale() {
+		go keyRing.Reencrypt(reencrypt)
+	}
+	loadACL()
+	if grpcAddr != "" {
+		go startGRPCListener(grpcAddr)
+	}
+fs := http.FileServer(http.Dir("slave"))
+	http.Handle("/", fs)
+	http.HandleFunc("/replicate_insert", requireNode(handleReplicateInsert))
+	http.HandleFunc("/replicate_update", requireNode(handleReplicateUpdate))
+	http.HandleFunc("/replicate_delete", requireNode(handleReplicateDelete))
+	http.HandleFunc("/replicate_acl", requireNode(handleReplicateACL))
+	http.HandleFunc("/merkle", requireNode(handleMerkle))
+	http.HandleFunc("/merkle/rows", requireNode(handleMerkleRows))
+	http.HandleFunc("/merkle/synced", requireNode(handleMerkleSynced))
+	http.HandleFunc("/merkle/tables", requireNode(handleMerkleTables))
+	http.HandleFunc("/replicate_get", requireToken(handleGetData))
+	http.HandleFunc("/changes", requireToken(feed.HandleChanges))
+	http.HandleFunc("/metrics", requireToken(handleMetrics))
+	http.HandleFunc("/healthz", node.HandleHealthz)
+	http.HandleFunc("/readyz", node.HandleReadyz)
+	for _, endpoint := range writeEndpoints {
+		http.HandleFunc(endpoint, handleReadOnly)
+	}
+
+	srv := &http.Server{Addr: ":" + slavePort, Handler: telemetry.TraceRequests(telemetry.LogRequests(metrics.Instrument(http.DefaultServeMux))), TLSConfig: serverTLS}
+	go node.Serve(srv)
+	node.Ready()
+
+	// Wait a moment for server to start
+	time.Sleep(500 * time.Millisecond)
+
+	// Open browser automatically
+	if serverTLS != nil {
+		openBrowser("https://localhost:" + slavePort)
+	} else {
+		openBrowser("http://localhost:" + slavePort)
+	}
+	
+	// Run until SIGTERM or SIGINT
+	waitForShutdown(*shutdownTimeout)
+
+}
+
+// ===================== BROWSER UTILS =====================
+
+func openBrowser(url string) {
+	var cmd string
+	var args []string
+
+	switch runtime.GOOS {
+	case "windows":
+		cmd = "cmd"
+		args = []string{"/c", "start", url}
+	case "darwin":
+		cmd = "open"
+		args = []string{url}
+	default: // linux, freebsd, etc.
+		cmd = "xdg-open"
+		args = []string{url}
+	}
+
+	if err := exec.Command(cmd, args...).Start(); err != nil {
+		slog.Warn("Failed to open browser", "err", err)
+	}
+}
+
+// ===================== REPLICATION =====================
+
+func replicateInsert(req RequestData) {
+	db, ok := databases[req.Database]
+	if !ok {
+		slog.Warn("Database not found", "request_id", req.RequestID, "database", req.Database)
+		return
+	}
+	table, ok := db.Tables[req.Table]
+	if !ok {
+		slog.Warn("Table not found", "request_id", req.RequestID, "database", req.Database, "table", req.Table)
+		return
+	}
+
+	// Lock table while inserting
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	table.Records = append(table.Records, req.Record)
+	saveSlaveDataToFile()
+	slog.Info("Data inserted in slave", "request_id", req.RequestID, "database", req.Database, "table", req.Table)
+}
+
+func replicateUpdate(req RequestData) {
+	db, ok := databases[req.Database]
+	if !ok {
+		slog.Warn("Database not found", "request_id", req.RequestID, "database", req.Database)
+		return
+	}
+	table, ok := db.Tables[req.Table]
+	if !ok {
+		slog.Warn("Table not found", "request_id", req.RequestID, "database", req.Database, "table", req.Table)
+		return
+	}
+
+	// Lock table while updating
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	updated := 0
+	for _, record := range table.Records {
+		match := true
+		for k, v := range req.Conditions {
+			if record[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			for k, v := range req.UpdateData {
+				record[k] = v
+			}
+			updated++
+		}
+	}
+	saveSlaveDataToFile()
+	slog.Info("Updated records in slave", "request_id", req.RequestID, "database", req.Database, "table", req.Table, "rows", updated)
+}
+
+func replicateDelete(req RequestData) {
+	db, ok := databases[req.Database]
+	if !ok {
+		slog.Warn("Database not found", "request_id", req.RequestID, "database", req.Database)
+		return
+	}
+	table, ok := db.Tables[req.Table]
+	if !ok {
+		slog.Warn("Table not found", "request_id", req.RequestID, "database", req.Database, "table", req.Table)
+		return
+	}
+
+	// Lock table while deleting
+	table.mu.Lock()
+	defer table.mu.Unlock()
+
+	filtered := []map[string]string{}
+	deleted := 0
+	for _, record := range table.Records {
+		match := true
+		for k, v := range req.Conditions {
+			if record[k] != v {
+				match = false
+				break
+			}
+		}
+		if !match {
+			filtered = append(filtered, record)
+		} else {
+			deleted++
+		}
+	}
+	table.Records = filtered
+	saveSlaveDataToFile()
+	slog.Info("Deleted records in slave", "request_id", req.RequestID, "database", req.Database, "table", req.Table, "rows", deleted)
+}
+
+
+
+// Function to replicate data from master to slave (Insert)
+func replicateToSlaveInsert(req RequestData) {
+    slaveURL := "http://localhost:8001/replicate_insert"  // عنوان السلاف
+    jsonData, err := json.Marshal(req)
+    if err != nil {
+        slog.Error("Error marshalling data", "err", err)
+        return
+    }
+
+    // إرسال البيانات إلى السلاف
+    resp, err := http.Post(slaveURL, "application/json", bytes.NewBuffer(jsonData))
+    if err != nil {
+        slog.Error("Error sending data to slave", "err", err)
+        return
+    }
+    defer resp.Body.Close()
+    
+    if resp.StatusCode == http.StatusOK {
+        slog.Info("Data successfully replicated to slave")
+    } else {
+        slog.Warn("Failed to replicate data to slave", "status", resp.Status)
+    }
+}
+
+// Function to replicate data from master to slave (Update)
+func replicateToSlaveUpdate(req RequestData) {
+    slaveURL := "http://localhost:8001/replicate_update"  // عنوان السلاف
+    jsonData, err := json.Marshal(req)
+    if err != nil {
+        slog.Error("Error marshalling data", "err", err)
+        return
+    }
+
+    // إرسال البيانات إلى السلاف
+    resp, err := http.Post(slaveURL, "application/json", bytes.NewBuffer(jsonData))
+    if err != nil {
+        slog.Error("Error sending data to slave", "err", err)
+        return
+    }
+    defer resp.Body.Close()
+    
+    if resp.StatusCode == http.StatusOK {
+        slog.Info("Data successfully replicated to slave")
+    } else {
+        slog.Warn("Failed to replicate data to slave", "status", resp.Status)
+    }
+}
+
+// Function to replicate data from master to slave (Delete)
+func replicateToSlaveDelete(req RequestData) {
+    slaveURL := "http://localhost:8001/replicate_delete"  // عنوان السلاف
+    jsonData, err := json.Marshal(req)
+    if err != nil {
+        slog.Error("Error marshalling data", "err", err)
+        return
+    }
+
+    // إرسال البيانات إلى السلاف
+    resp, err := http.Post(slaveURL, "application/json", bytes.NewBuffer(jsonData))
+    if err != nil {
+        slog.Error("Error sending data to slave", "err", err)
+        return
+    }
+    defer resp.Body.Close()
+    
+    if resp.StatusCode == http.StatusOK {
+        slog.Info("Data successfully replicated to slave")
+    } else {
+        slog.Warn("Failed to replicate data to slave", "status", resp.Status)
+    }
+}
+
+// ===================== HANDLERS =====================
+
+// Handle incoming insert requests
+// appliedTable returns the table a change from the master applies to,
+// creating it and its database when this slave has not seen them yet.
+func appliedTable(req RequestData) *Table {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	db, ok := databases[req.Database]
+	if !ok {
+		db = &Database{
+			Name:   req.Database,
+			Tables: make(map[string]*Table),
+		}
+		databases[req.Database] = db
+	}
+	table, ok := db.Tables[req.Table]
+	if !ok {
+		table = &Table{
+			Name:    req.Table,
+			Columns: req.Columns,
+			Records: []map[string]string{},
+		}
+		db.Tables[req.Table] = table
+	}
+	return table
+}
+
+func handleReplicateInsert(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    trace := telemetry.RequestSpan(r)
+    decode := trace.Child("decode")
+    var req RequestData
+    json.NewDecoder(r.Body).Decode(&req)
+    decode.End()
+    req.RequestID = telemetry.RequestID(r)
+
+    // إضافة السجل إلى قاعدة بيانات السلاف
+    table := appliedTable(req)
+
+    // إضافة السجل
+    wait := trace.Child("lock_wait")
+    table.mu.Lock()
+    wait.End()
+    apply := trace.Child("apply")
+    table.Records = append(table.Records, req.Record)
+    table.chain(req.PrevLSN, req.LSN)
+    recordApplied(req.LSN, []changefeed.Event{{Op: "insert", Database: req.Database, Table: req.Table, After: maps.Clone(req.Record)}})
+    apply.Set("lsn", req.LSN)
+    apply.End()
+    table.mu.Unlock()
+
+    // حفظ البيانات في السلاف
+    persist := trace.Child("persist")
+    saveSlaveDataToFile()
+    persist.End()
+    slog.Debug("Applied insert", "request_id", req.RequestID, "database", req.Database, "table", req.Table, "lsn", req.LSN)
+
+    w.Write([]byte("Record inserted successfully on slave"))
+}
+
+// Handle incoming update requests
+func handleReplicateUpdate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    trace := telemetry.RequestSpan(r)
+    decode := trace.Child("decode")
+    var req RequestData
+    json.NewDecoder(r.Body).Decode(&req)
+    decode.End()
+    req.RequestID = telemetry.RequestID(r)
+
+    // تحديث السجل في السلاف بناءً على الشروط
+    table := appliedTable(req)
+
+    wait := trace.Child("lock_wait")
+    table.mu.Lock()
+    wait.End()
+    apply := trace.Child("apply")
+    updated := 0
+    var events []changefeed.Event
+    for _, record := range table.Records {
+        match := true
+        for k, v := range req.Conditions {
+            if record[k] != v {
+                match = false
+                break
+            }
+        }
+        if match {
+            before := maps.Clone(record)
+            for k, v := range req.UpdateData {
+                record[k] = v
+            }
+            for k, op := range req.Ops {
+                record[k] = crdt.Apply(record[k], op)
+            }
+            events = append(events, changefeed.Event{Op: "update", Database: req.Database, Table: req.Table, Before: before, After: maps.Clone(record)})
+            updated++
+        }
+    }
+    table.chain(req.PrevLSN, req.LSN)
+    recordApplied(req.LSN, events)
+    apply.Set("lsn", req.LSN)
+    apply.Set("rows", len(events))
+    apply.End()
+    table.mu.Unlock()
+
+    persist := trace.Child("persist")
+    saveSlaveDataToFile()
+    persist.End()
+    slog.Debug("Applied update", "request_id", req.RequestID, "database", req.Database, "table", req.Table, "lsn", req.LSN, "rows", updated)
+
+    w.Write([]byte(fmt.Sprintf("Updated %d records in slave.", updated)))
+}
+
+// Handle incoming delete requests
+func handleReplicateDelete(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    trace := telemetry.RequestSpan(r)
+    decode := trace.Child("decode")
+    var req RequestData
+    json.NewDecoder(r.Body).Decode(&req)
+    decode.End()
+    req.RequestID = telemetry.RequestID(r)
+
+    // حذف السجل في السلاف بناءً على الشروط
+    table := appliedTable(req)
+
+    wait := trace.Child("lock_wait")
+    table.mu.Lock()
+    wait.End()
+    apply := trace.Child("apply")
+    filtered := []map[string]string{}
+    deleted := 0
+    var events []changefeed.Event
+    for _, record := range table.Records {
+        match := true
+        for k, v := range req.Conditions {
+            if record[k] != v {
+                match = false
+                break
+            }
+        }
+        if !match {
+            filtered = append(filtered, record)
+        } else {
+            events = append(events, changefeed.Event{Op: "delete", Database: req.Database, Table: req.Table, Before: maps.Clone(record)})
+            deleted++
+        }
+    }
+    table.Records = filtered
+    table.chain(req.PrevLSN, req.LSN)
+    recordApplied(req.LSN, events)
+    apply.Set("lsn", req.LSN)
+    apply.Set("rows", len(events))
+    apply.End()
+    table.mu.Unlock()
+
+    persist := trace.Child("persist")
+    saveSlaveDataToFile()
+    persist.End()
+    slog.Debug("Applied delete", "request_id", req.RequestID, "database", req.Database, "table", req.Table, "lsn", req.LSN, "rows", deleted)
+
+    w.Write([]byte(fmt.Sprintf("Deleted %d records in slave.", deleted)))
+}
+
+// lsnHeader carries the LSN this slave has applied with the records.
+const lsnHeader = "X-Ddb-Lsn"
+
+// maxEarlyChanges bounds the changes a table holds back while one before
+// them is missing. Dropping more only delays the applied LSN.
+const maxEarlyChanges = 1024
+
+// chain advances the table's applied LSN past a change from the master.
+// Requests for one table may arrive in any order, so a change whose
+// predecessor prev has not been applied yet waits until it is. A zero
+// prev starts the chain, as for a new table or after anti-entropy found
+// the table in sync. The caller holds the table lock.
+func (t *Table) chain(prev, lsn uint64) {
+	if lsn == 0 {
+		return
+	}
+	if prev > t.LSN {
+		if t.early == nil {
+			t.early = map[uint64]uint64{}
+		}
+		if len(t.early) < maxEarlyChanges {
+			t.early[prev] = lsn
+		}
+		return
+	}
+	t.LSN = max(t.LSN, lsn)
+	for more := true; more; {
+		more = false
+		for p, next := range t.early {
+			if p <= t.LSN {
+				delete(t.early, p)
+				t.LSN = max(t.LSN, next)
+				more = true
+			}
+		}
+	}
+}
+
+// Handle displaying data in slave
+func handleGetData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dbName := r.URL.Query().Get("database")
+	tableName := r.URL.Query().Get("table")
+	if !checkAccess(w, r, auth.PrivRead, dbName, tableName) {
+		return
+	}
+	// min_lsn is a read-your-writes token or the master's bound on lag.
+	var minLSN uint64
+	if v := r.URL.Query().Get("min_lsn"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid min_lsn", http.StatusBadRequest)
+			return
+		}
+		minLSN = n
+	}
+
+	dbMu.Lock()
+	db, ok := databases[dbName]
+	var table *Table
+	if ok {
+		table = db.Tables[tableName]
+	}
+	dbMu.Unlock()
+	if !ok {
+		http.Error(w, "Database not found", http.StatusNotFound)
+		return
+	}
+	if table == nil {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+
+	// Lock the table while reading the data
+	table.mu.Lock()
+	defer table.mu.Unlock()
+	// Later LSNs may belong to other tables, so only the table's own
+	// chain tells whether it is fresh enough.
+	if table.LSN < minLSN {
+		http.Error(w, fmt.Sprintf("Replica has applied LSN %d of the table, behind %d", table.LSN, minLSN), http.StatusPreconditionFailed)
+		return
+	}
+	w.Header().Set(lsnHeader, strconv.FormatUint(table.LSN, 10))
+	json.NewEncoder(w).Encode(table.Records)
+}
+
+// ===================== GRPC =====================
+
+// The slave serves the read RPCs of proto/ddb.proto over cleartext HTTP/2.
+// Writes reach a slave through replication only, so write RPCs return
+// UNIMPLEMENTED.
+
+type grpcRequest struct {
+	RequestData
+	Limit int
+}
+
+func startGRPCListener(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(wire.Service, handleGRPC)
+	srv := &http.Server{Addr: addr, Handler: telemetry.TraceRequests(telemetry.LogRequests(metrics.Instrument(mux))), Protocols: new(http.Protocols), TLSConfig: serverTLS}
+	slog.Info("gRPC listening", "addr", addr)
+	if serverTLS != nil {
+		srv.Protocols.SetHTTP2(true)
+	} else {
+		srv.Protocols.SetUnencryptedHTTP2(true)
+	}
+	node.Serve(srv)
+}
+
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	method := strings.TrimPrefix(r.URL.Path, wire.Service)
+
+	send := wire.Respond(w)
+
+	code, msg := wire.OK, ""
+	var err error
+	var user *auth.Principal
+	if jwtSecret != "" {
+		var aerr error
+		if user, aerr = authenticateToken(auth.BearerCredential(r)); aerr != nil {
+			err = wire.NewError(wire.Unauthenticated, aerr.Error())
+		}
+	}
+	var req *grpcRequest
+	if err == nil {
+		req, err = readGRPCRequest(r.Body)
+	}
+	if err == nil {
+		err = dispatchGRPC(user, method, req, send)
+	}
+	if err != nil {
+		code, msg = wire.InvalidArgument, err.Error()
+		if ge, ok := err.(*wire.Error); ok {
+			code = ge.Code
+		}
+	}
+	wire.WriteStatus(w, code, msg)
+}
+
+func readGRPCRequest(body io.Reader) (*grpcRequest, error) {
+	data, err := wire.ReadMessage(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := pbDecodeRequest(data)
+	if err != nil {
+		return nil, wire.NewError(wire.InvalidArgument, err.Error())
+	}
+	return req, nil
+}
+
+func dispatchGRPC(p *auth.Principal, method string, req *grpcRequest, send func([]byte)) error {
+	notFound := func(what string) error { return wire.NewError(wire.NotFound, what+" not found") }
+	if method == "DescribeTable" || method == "Select" || method == "StreamSelect" {
+		if err := auth.Authorize(p, auth.PrivRead, req.Database, req.Table); err != nil {
+			return wire.NewError(wire.PermissionDenied, err.Error())
+		}
+	}
+
+	switch method {
+	case "ListDatabases":
+		dbMu.Lock()
+		names := []string{}
+		for name := range databases {
+			if auth.CanSee(p, name, "") {
+				names = append(names, name)
+			}
+		}
+		dbMu.Unlock()
+		sort.Strings(names)
+		send(wire.EncodeNames(names))
+	case "ListTables":
+		dbMu.Lock()
+		db, ok := databases[req.Database]
+		names := []string{}
+		if ok {
+			for name := range db.Tables {
+				if auth.CanSee(p, req.Database, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		dbMu.Unlock()
+		if !ok {
+			return notFound("Database")
+		}
+		sort.Strings(names)
+		send(wire.EncodeNames(names))
+	case "DescribeTable", "Select", "StreamSelect":
+		dbMu.Lock()
+		db, ok := databases[req.Database]
+		var table *Table
+		if ok {
+			table = db.Tables[req.Table]
+		}
+		dbMu.Unlock()
+		if !ok {
+			return notFound("Database")
+		}
+		if table == nil {
+			return notFound("Table")
+		}
+		if method == "DescribeTable" {
+			send(wire.EncodeNames(table.Columns))
+			return nil
+		}
+
+		table.mu.Lock()
+		var records [][]byte
+		for _, record := range table.Records {
+			match := true
+			for k, v := range req.Conditions {
+				if record[k] != v {
+					match = false
+					break
+				}
+			}
+			if !match {
+				continue
+			}
+			records = append(records, wire.EncodeRecord(record))
+			if req.Limit > 0 && len(records) == req.Limit {
+				break
+			}
+		}
+		table.mu.Unlock()
+
+		if method == "StreamSelect" {
+			for _, rec := range records {
+				send(rec)
+			}
+			return nil
+		}
+		var b []byte
+		for _, rec := range records {
+			b = wire.AppendBytes(b, 1, rec)
+		}
+		send(b)
+	case "CreateDatabase", "DropDatabase", "CreateTable", "DropTable", "Insert", "InsertBatch", "Update", "Delete":
+		return wire.NewError(wire.Unimplemented, "slaves are read-only, send writes to the master")
+	default:
+		return wire.NewError(wire.Unimplemented, "unknown method "+method)
+	}
+	return nil
+}
+
+// ===================== PROTOBUF =====================
+
+// pbDecodeRequest reads the fields of Request a slave needs for reads.
+func pbDecodeRequest(data []byte) (*grpcRequest, error) {
+	req := &grpcRequest{}
+	err := wire.Fields(data, func(field int, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			req.Database = string(b)
+		case 2:
+			req.Table = string(b)
+		case 6:
+			if req.Conditions == nil {
+				req.Conditions = map[string]string{}
+			}
+			return wire.DecodeMapEntry(b, req.Conditions)
+		case 7:
+			req.Limit = int(int32(v))
+		}
+		return nil
+	})
+	return req, err
+}
+
+// ===================== CHANGE FEED =====================
+
+// Changes are logged and streamed by internal/changefeed.
+
+var feed = changefeed.New(keyRing, metrics)
+
+// recordApplied stores events applied from the master under the master's
+// LSN and notes when it happened.
+func recordApplied(lsn uint64, events []changefeed.Event) {
+	feed.Record(lsn, events)
+	now := time.Now()
+	lastApplied.Store(now.UnixNano())
+	metrics.Set("ddb_replication_last_applied_timestamp_seconds", "", float64(now.Unix()))
+}
+
+// ===================== AUTH =====================
+
+// With -jwt-secret set, reads need "Authorization: Bearer <token>" (or
+// ?access_token=) carrying a token issued by the master's /auth/token and
+// signed with the same secret. API keys only exist on the master.
+//
+// With -node-secret set, the replicate_* endpoints only accept requests
+// signed by the master: X-Ddb-Node-Signature: t=<unix>,sig=<hex
+// HMAC-SHA256 of "<t>\n<path>\n<body>">.
+
+// authenticateToken verifies a bearer token against -jwt-secret.
+func authenticateToken(cred string) (*auth.Principal, error) {
+	if cred == "" {
+		return nil, auth.ErrUnauthenticated
+	}
+	claims, err := auth.VerifyToken([]byte(jwtSecret), cred)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Principal{ID: claims.Subject, Name: claims.Name, Admin: claims.Admin}, nil
+}
+
+// requireToken protects read endpoints when -jwt-secret is set. Reads
+// the master forwards for a caller pass with the node credentials instead.
+func requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if jwtSecret == "" {
+			h(w, r)
+			return
+		}
+		var p *auth.Principal
+		var err error
+		if r.Header.Get(auth.CallerHeader) != "" {
+			p, err = nodeCaller(r)
+		} else {
+			p, err = authenticateToken(auth.BearerCredential(r))
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="ddb"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, auth.WithPrincipal(r, p))
+	}
+}
+
+// requireNode only lets requests from the master through: with -node-ca
+// they must carry a verified client certificate for one of -node-peers,
+// and with -node-secret they must be signed. With neither, only
+// -insecure-replication lets them through.
+func requireNode(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(nodePeers) > 0 && !trustedPeer(r) {
+			http.Error(w, "Client certificate is not a trusted node", http.StatusForbidden)
+			return
+		}
+		if nodeSecret == "" {
+			if len(nodePeers) == 0 && !insecureReplication {
+				http.Error(w, "Replica is read-only: replication needs -node-secret or -node-ca", http.StatusForbidden)
+				return
+			}
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if !auth.VerifyNodeSignature([]byte(nodeSecret), r, body) {
+			http.Error(w, "Invalid node signature", http.StatusUnauthorized)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h(w, r)
+	}
+}
+
+// nodeCaller returns the caller of a read the master forwards. The read
+// must pass requireNode's checks, with the signature covering the query
+// and the caller, and the caller's key must still be on the access list.
+func nodeCaller(r *http.Request) (*auth.Principal, error) {
+	if nodeSecret == "" && len(nodePeers) == 0 {
+		return nil, auth.ErrBadCredentials
+	}
+	if len(nodePeers) > 0 && !trustedPeer(r) {
+		return nil, auth.ErrBadCredentials
+	}
+	if nodeSecret != "" && !auth.VerifyNodeSignature([]byte(nodeSecret), r, auth.NodeReadBody(r)) {
+		return nil, auth.ErrBadCredentials
+	}
+	id := r.Header.Get(auth.CallerHeader)
+	k, ok := auth.CurrentACL().Keys[id]
+	if !ok {
+		return nil, auth.ErrBadCredentials
+	}
+	return &auth.Principal{ID: id, Name: k.Name, Admin: k.Admin}, nil
+}
+
+// trustedPeer reports whether r came with a client certificate verified
+// against -node-ca whose common name or a DNS name is in nodePeers.
+func trustedPeer(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	if nodePeers[leaf.Subject.CommonName] {
+		return true
+	}
+	for _, name := range leaf.DNSNames {
+		if nodePeers[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// ===================== ACCESS CONTROL =====================
+
+// Grants and the access list they form live in internal/auth.
+
+// checkAccess writes 403 and returns false when the caller of r lacks priv.
+func checkAccess(w http.ResponseWriter, r *http.Request, priv, db, table string) bool {
+	if err := auth.Authorize(auth.RequestPrincipal(r), priv, db, table); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// loadACL restores the access list last replicated from the master.
+func loadACL() {
+	content, err := os.ReadFile(aclFile)
+	if err != nil {
+		return
+	}
+	var a auth.AccessList
+	if err := json.Unmarshal(content, &a); err != nil {
+		slog.Error("Reading access list", "file", aclFile, "err", err)
+		return
+	}
+	auth.SetACL(&a)
+}
+
+// handleReplicateACL replaces the access list with the master's copy.
+func handleReplicateACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	content, err := io.ReadAll(r.Body)
+	var a auth.AccessList
+	if err != nil || json.Unmarshal(content, &a) != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	auth.SetACL(&a)
+	if err := os.WriteFile(aclFile, content, 0600); err != nil {
+		slog.Error("Writing access list", "file", aclFile, "err", err)
+	}
+	w.Write([]byte("Access list updated on slave."))
+}
+
+// ===================== ENCRYPTION =====================
+
+// Data files and the change log are encrypted with AES-256-GCM when a key
+// is configured; internal/crypto holds the keys and seals the files.
+
+var keyRing = &crypto.Keyring{}
+
+// reencrypt writes the data file and the change log again under the
+// newest key.
+func reencrypt() error {
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	if err == nil {
+		err = feed.Rewrite()
+	}
+	return err
+}
+
+// ===================== METRICS =====================
+
+// /metrics serves the Prometheus text format. Counters and histograms are
+// updated as requests run; gauges such as table sizes are collected when
+// the endpoint is scraped.
+
+// metricInfo is the TYPE and HELP line of each metric family.
+var metricInfo = map[string][2]string{
+	"ddb_table_records":                              {"gauge", "Records per table."},
+	"ddb_snapshot_write_duration_seconds":            {"histogram", "Time to write the data file."},
+	"ddb_changelog_write_duration_seconds":           {"histogram", "Time to append a batch to the change log."},
+	"ddb_changelog_lsn":                              {"gauge", "Last LSN written to the change log."},
+	"ddb_replication_queue_depth":                    {"gauge", "Replication requests in flight per replica."},
+	"ddb_replication_requests_total":                 {"counter", "Replication requests per replica by result."},
+	"ddb_replication_duration_seconds":               {"histogram", "Replication request latency per replica."},
+	"ddb_replication_lag_lsn":                        {"gauge", "Changes written on the master but not yet acknowledged by the replica."},
+	"ddb_replication_last_ack_timestamp_seconds":     {"gauge", "Unix time of the replica's last successful replication request."},
+	"ddb_replication_applied_lsn":                    {"gauge", "Last LSN applied from the master."},
+	"ddb_replication_last_applied_timestamp_seconds": {"gauge", "Unix time a change from the master was last applied."},
+}
+
+var metrics = telemetry.NewRegistry(metricInfo)
+
+// handleMetrics serves GET /metrics.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	collectTableMetrics()
+	collectReplicationMetrics()
+	metrics.Serve(w)
+}
+
+// collectTableMetrics sets the table size and change log gauges.
+func collectTableMetrics() {
+	metrics.Reset("ddb_table_records")
+	dbMu.Lock()
+	for dbName, db := range databases {
+		for tableName, table := range db.Tables {
+			table.mu.Lock()
+			n := len(table.Records)
+			table.mu.Unlock()
+			metrics.Set("ddb_table_records", telemetry.Labels("database", dbName, "table", tableName), float64(n))
+		}
+	}
+	dbMu.Unlock()
+	metrics.Set("ddb_changelog_lsn", "", float64(feed.LSN()))
+}
+
+// collectReplicationMetrics reports how far this slave has applied the
+// master's change log.
+func collectReplicationMetrics() {
+	metrics.Set("ddb_replication_applied_lsn", "", float64(feed.LSN()))
+}
+
+// ===================== LIFECYCLE =====================
+
+// /healthz and /readyz are served by internal/lifecycle from nodeChecks
+// and replicationHealth.
+//
+// On SIGTERM or SIGINT the node stops accepting connections, lets requests
+// in progress finish, saves its data file and syncs its logs to disk
+// before it exits. A second signal exits immediately.
+
+var node = lifecycle.NewNode(nodeChecks, replicationHealth)
+
+var dataHealth lifecycle.Check
+
+// storageChecks reports the data file and change log.
+func storageChecks() map[string]string {
+	return map[string]string{"data_file": dataHealth.Status(), "change_log": feed.Status()}
+}
+
+// waitForShutdown blocks until SIGTERM or SIGINT and then shuts the node
+// down, giving requests in progress up to timeout to finish.
+func waitForShutdown(timeout time.Duration) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	s := <-sig
+	signal.Stop(sig)
+	slog.Info("Shutting down", "signal", s.String(), "timeout", timeout)
+	node.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	shutdown(ctx)
+
+	dbMu.Lock()
+	err := saveData()
+	dbMu.Unlock()
+	dataHealth.Report(err)
+	if err != nil {
+		slog.Error("Saving data file", "err", err)
+	}
+	if err := feed.Sync(); err != nil {
+		slog.Error("Syncing change log", "err", err)
+	}
+	slog.Info("Shutdown complete")
+	telemetry.FlushTraces()
+}
+
+// lastApplied is when a change from the master was last applied, in Unix
+// nanoseconds.
+var lastApplied atomic.Int64
+
+func nodeChecks() map[string]string {
+	return storageChecks()
+}
+
+type appliedHealth struct {
+	AppliedLSN  uint64     `json:"applied_lsn"`
+	LastApplied *time.Time `json:"last_applied,omitempty"`
+}
+
+// replicationHealth reports the last change applied from the master.
+func replicationHealth() any {
+	h := appliedHealth{AppliedLSN: feed.LSN()}
+	if ns := lastApplied.Load(); ns != 0 {
+		t := time.Unix(0, ns).UTC()
+		h.LastApplied = &t
+	}
+	return h
+}
+
+// shutdown drains the HTTP servers.
+func shutdown(ctx context.Context) {
+	node.ShutdownServers(ctx)
+}
+
+// ===================== READ-ONLY =====================
+
+// A slave only changes through the replication stream. Client writes sent
+// to it are refused with 421 and X-Ddb-Master pointing at -master, which
+// the Go client follows, or with -forward-writes passed on to the master
+// with the caller's credentials and the master's response returned as is.
+
+const (
+	masterHeader    = "X-Ddb-Master"
+	forwardedHeader = "X-Ddb-Forwarded"
+)
+
+// writeEndpoints are the master's client write endpoints.
+var writeEndpoints = []string{
+	"/create_database", "/create_table", "/insert", "/update", "/delete",
+	"/drop_table", "/drop_database", "/transaction",
+}
+
+// handleReadOnly serves the write endpoints.
+func handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if masterURL != "" {
+		w.Header().Set(masterHeader, masterURL)
+	}
+	if !forwardWrites {
+		http.Error(w, "Replica is read-only, send writes to the master", http.StatusMisdirectedRequest)
+		return
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		// -master points at a slave, maybe this one.
+		http.Error(w, "Write already forwarded by a replica", http.StatusLoopDetected)
+		return
+	}
+	forwardToMaster(w, r)
+}
+
+func forwardToMaster(w http.ResponseWriter, r *http.Request) {
+	freq, err := http.NewRequestWithContext(r.Context(), r.Method, masterURL+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, h := range []string{"Authorization", "Content-Type"} {
+		if v := r.Header.Get(h); v != "" {
+			freq.Header.Set(h, v)
+		}
+	}
+	freq.Header.Set(telemetry.RequestIDHeader, telemetry.RequestID(r))
+	freq.Header.Set(forwardedHeader, "1")
+	trace := telemetry.RequestSpan(r).ClientChild("forward " + r.URL.Path)
+	trace.Set("master", masterURL)
+	if tp := trace.Traceparent(); tp != "" {
+		freq.Header.Set(telemetry.TraceparentHeader, tp)
+	}
+	defer trace.End()
+
+	resp, err := masterClient.Do(freq)
+	if err != nil {
+		trace.Fail(err)
+		telemetry.RequestLog(r).Warn("Forwarding write to master", "master", masterURL, "path", r.URL.Path, "err", err)
+		http.Error(w, "Master unreachable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for k, vs := range resp.Header {
+		if k != telemetry.RequestIDHeader {
+			w.Header()[k] = vs
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	telemetry.RequestLog(r).Debug("Forwarded write to master", "master", masterURL, "path", r.URL.Path, "status", resp.StatusCode)
+}
+
+// ===================== ANTI-ENTROPY =====================
+
+// Every node can hash a table as a Merkle tree with internal/merkle, so
+// two nodes find the ranges of rows where they differ by comparing a few
+// hashes.
+
+// The master runs the checks: POST /merkle returns the tree of a table,
+// /merkle/rows the rows of some ranges and /merkle/tables every table
+// this slave holds.
+
+func replicaTable(dbName, tableName string) *Table {
+	dbMu.Lock()
+	defer dbMu.Unlock()
+	if db, ok := databases[dbName]; ok {
+		return db.Tables[tableName]
+	}
+	return nil
+}
+
+// handleMerkle serves POST /merkle.
+func handleMerkle(w http.ResponseWriter, r *http.Request) {
+	var req merkle.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	table := replicaTable(req.Database, req.Table)
+	if table == nil {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	table.mu.Lock()
+	t := merkle.Build(table.Records)
+	table.mu.Unlock()
+	t.LSN = feed.LSN()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// handleMerkleSynced serves POST /merkle/synced, sent by the master once
+// anti-entropy found the table equal to its own after change req.LSN.
+func handleMerkleSynced(w http.ResponseWriter, r *http.Request) {
+	var req merkle.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	table := replicaTable(req.Database, req.Table)
+	if table == nil {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	table.mu.Lock()
+	table.chain(0, req.LSN)
+	table.mu.Unlock()
+	saveSlaveDataToFile()
+}
+
+// handleMerkleRows serves POST /merkle/rows.
+func handleMerkleRows(w http.ResponseWriter, r *http.Request) {
+	var req merkle.Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	table := replicaTable(req.Database, req.Table)
+	if table == nil {
+		http.Error(w, "Table not found", http.StatusNotFound)
+		return
+	}
+	table.mu.Lock()
+	rows := merkle.RowsInRanges(table.Records, req.Ranges)
+	table.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// handleMerkleTables serves POST /merkle/tables.
+func handleMerkleTables(w http.ResponseWriter, r *http.Request) {
+	dbMu.Lock()
+	names := []string{}
+	for dbName, db := range databases {
+		for tableName := range db.Tables {
+			names = append(names, dbName+"."+tableName)
+		}
+	}
+	dbMu.Unlock()
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+)
+
+func TestTableChain(t *testing.T) {
+	var table Table
+	table.chain(0, 3)
+	if table.LSN != 3 {
+		t.Fatalf("first change: LSN = %d, want 3", table.LSN)
+	}
+
+	// 7 follows 5, which has not arrived yet.
+	table.chain(5, 7)
+	if table.LSN != 3 {
+		t.Fatalf("change after a gap: LSN = %d, want 3", table.LSN)
+	}
+	table.chain(3, 5)
+	if table.LSN != 7 {
+		t.Fatalf("gap filled: LSN = %d, want 7", table.LSN)
+	}
+
+	// Resync requests carry no LSN.
+	table.chain(0, 0)
+	if table.LSN != 7 {
+		t.Fatalf("request without LSN: LSN = %d, want 7", table.LSN)
+	}
+
+	// 12 follows the lost 10 until anti-entropy marks the table synced
+	// after 10.
+	table.chain(10, 12)
+	table.chain(0, 10)
+	if table.LSN != 12 || len(table.early) != 0 {
+		t.Fatalf("after sync: LSN = %d with %d waiting, want 12 with none", table.LSN, len(table.early))
+	}
+
+	// A late duplicate never moves the LSN back.
+	table.chain(3, 5)
+	if table.LSN != 12 {
+		t.Fatalf("duplicate: LSN = %d, want 12", table.LSN)
+	}
+}
+
+func TestRequireTokenForwardedRead(t *testing.T) {
+	oldJWT, oldNode, oldACL := jwtSecret, nodeSecret, auth.CurrentACL()
+	t.Cleanup(func() {
+		jwtSecret, nodeSecret = oldJWT, oldNode
+		auth.SetACL(oldACL)
+	})
+	jwtSecret, nodeSecret = "jwt-secret", "node-secret"
+	auth.SetACL(&auth.AccessList{Keys: map[string]auth.ACLKey{"k1": {Name: "reader"}}})
+
+	var caller *auth.Principal
+	h := requireToken(func(w http.ResponseWriter, r *http.Request) { caller = auth.RequestPrincipal(r) })
+	read := func(query, id, signedQuery string) int {
+		r := httptest.NewRequest(http.MethodGet, "/replicate_get?"+query, nil)
+		r.Header.Set(auth.CallerHeader, id)
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		sig := auth.NodeSignature([]byte(nodeSecret), ts, r.URL.Path, []byte(signedQuery+"\n"+id))
+		r.Header.Set(auth.NodeSignatureHeader, "t="+ts+",sig="+sig)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w.Code
+	}
+
+	const q = "database=shop&table=items"
+	if code := read(q, "k1", q); code != http.StatusOK || caller == nil || caller.ID != "k1" || caller.Name != "reader" {
+		t.Fatalf("signed read: status %d, caller %+v", code, caller)
+	}
+	if code := read("database=shop&table=secrets", "k1", q); code != http.StatusUnauthorized {
+		t.Fatalf("read of another table with the same signature: status %d, want 401", code)
+	}
+	if code := read(q, "k2", q); code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: status %d, want 401", code)
+	}
+	nodeSecret = ""
+	if code := read(q, "k1", q); code != http.StatusUnauthorized {
+		t.Fatalf("without node credentials: status %d, want 401", code)
+	}
+}
+
+func TestForwardWrites(t *testing.T) {
+	oldMaster, oldForward := masterURL, forwardWrites
+	t.Cleanup(func() { masterURL, forwardWrites = oldMaster, oldForward })
+
+	var got *http.Request
+	var body string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.Header().Set("X-Ddb-Lsn", "7")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("Record inserted successfully."))
+	}))
+	defer master.Close()
+	masterURL = master.URL
+
+	write := func(forwarded bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/insert?x=1", strings.NewReader(`{"database":"shop"}`))
+		r.Header.Set("Authorization", "Bearer key")
+		r.Header.Set("Content-Type", "application/json")
+		if forwarded {
+			r.Header.Set(forwardedHeader, "1")
+		}
+		w := httptest.NewRecorder()
+		handleReadOnly(w, r)
+		return w
+	}
+
+	// Without -forward-writes the client is sent to the master.
+	forwardWrites = false
+	if w := write(false); w.Code != http.StatusMisdirectedRequest || w.Header().Get(masterHeader) != master.URL || got != nil {
+		t.Fatalf("refused write: status %d, master %q", w.Code, w.Header().Get(masterHeader))
+	}
+
+	forwardWrites = true
+	w := write(false)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Ddb-Lsn") != "7" || w.Body.String() != "Record inserted successfully." {
+		t.Fatalf("forwarded write: status %d, body %q", w.Code, w.Body)
+	}
+	if got == nil || got.URL.RequestURI() != "/insert?x=1" || body != `{"database":"shop"}` {
+		t.Fatalf("master got %v with body %q", got, body)
+	}
+	if got.Header.Get("Authorization") != "Bearer key" || got.Header.Get(forwardedHeader) == "" {
+		t.Fatalf("master got headers %v", got.Header)
+	}
+
+	// A write that a replica already forwarded is not passed on again, so
+	// a -master pointing at a replica cannot loop.
+	got = nil
+	if w := write(true); w.Code != http.StatusLoopDetected || got != nil {
+		t.Fatalf("write forwarded twice: status %d, reached master %v", w.Code, got != nil)
+	}
+
+	master.Close()
+	if w := write(false); w.Code != http.StatusBadGateway {
+		t.Fatalf("write with the master down: status %d, want 502", w.Code)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/omar-karam1/distributed-db-go
+
+go 1.24
@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+)
+
+// Privileges are ordered: each one includes the ones before it. A grant
+// gives a privilege to a role on the whole cluster (no database), one
+// database (no table) or one table; API keys hold roles. Keys flagged
+// admin, and callers when authentication is off, may do anything.
+
+const (
+	PrivRead  = "read"
+	PrivWrite = "write"
+	PrivDDL   = "ddl"
+	PrivAdmin = "admin"
+)
+
+var privLevel = map[string]int{PrivRead: 1, PrivWrite: 2, PrivDDL: 3, PrivAdmin: 4}
+
+var ErrForbidden = errors.New("Permission denied")
+
+// ValidPrivilege reports whether priv names a privilege.
+func ValidPrivilege(priv string) bool {
+	return privLevel[priv] != 0
+}
+
+type Grant struct {
+	Role      string `json:"role"`
+	Privilege string `json:"privilege"`
+	Database  string `json:"database,omitempty"`
+	Table     string `json:"table,omitempty"`
+}
+
+// covers reports whether the grant's scope includes db.table; an empty
+// table means the database itself.
+func (g Grant) covers(db, table string) bool {
+	return g.Database == "" || g.Database == db && (g.Table == "" || g.Table == table)
+}
+
+type ACLKey struct {
+	Name  string   `json:"name"`
+	Admin bool     `json:"admin"`
+	Roles []string `json:"roles"`
+}
+
+// AccessList is the part of the credential store every node needs. The
+// master replicates it to the slaves whenever it changes.
+type AccessList struct {
+	Keys   map[string]ACLKey `json:"keys"`
+	Grants []Grant           `json:"grants"`
+}
+
+var (
+	aclMu sync.RWMutex
+	acl   = &AccessList{Keys: map[string]ACLKey{}}
+)
+
+// CurrentACL returns the access list in force.
+func CurrentACL() *AccessList {
+	aclMu.RLock()
+	defer aclMu.RUnlock()
+	return acl
+}
+
+// SetACL replaces the access list. a must not change afterwards.
+func SetACL(a *AccessList) {
+	if a.Keys == nil {
+		a.Keys = map[string]ACLKey{}
+	}
+	aclMu.Lock()
+	acl = a
+	aclMu.Unlock()
+}
+
+// GrantsFor returns the grants reaching key id through its roles.
+func (a *AccessList) GrantsFor(id string) []Grant {
+	k, ok := a.Keys[id]
+	if !ok {
+		return nil
+	}
+	var out []Grant
+	for _, g := range a.Grants {
+		for _, role := range k.Roles {
+			if g.Role == role {
+				out = append(out, g)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (a *AccessList) allowed(id, priv, db, table string) bool {
+	if k, ok := a.Keys[id]; ok && k.Admin {
+		return true
+	}
+	for _, g := range a.GrantsFor(id) {
+		if privLevel[g.Privilege] >= privLevel[priv] && g.covers(db, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether id holds any privilege on db.table or, for an
+// empty table, on db or anything in it. Listings only show visible names.
+func (a *AccessList) visible(id, db, table string) bool {
+	if k, ok := a.Keys[id]; ok && k.Admin {
+		return true
+	}
+	for _, g := range a.GrantsFor(id) {
+		if g.Database == "" || g.Database == db && (table == "" || g.Table == "" || g.Table == table) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks priv on db.table for p; a nil principal means
+// authentication is disabled.
+func Authorize(p *Principal, priv, db, table string) error {
+	if p == nil || CurrentACL().allowed(p.ID, priv, db, table) {
+		return nil
+	}
+	return ErrForbidden
+}
+
+// CanSee reports whether p may see db.table, or db for an empty table, in
+// listings.
+func CanSee(p *Principal, db, table string) bool {
+	return p == nil || CurrentACL().visible(p.ID, db, table)
+}
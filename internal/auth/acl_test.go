@@ -0,0 +1,48 @@
+package auth
+
+import "testing"
+
+func TestAuthorize(t *testing.T) {
+	old := CurrentACL()
+	t.Cleanup(func() { SetACL(old) })
+	SetACL(&AccessList{
+		Keys: map[string]ACLKey{
+			"root":   {Name: "root", Admin: true},
+			"reader": {Name: "reader", Roles: []string{"readers"}},
+			"owner":  {Name: "owner", Roles: []string{"owners"}},
+		},
+		Grants: []Grant{
+			{Role: "readers", Privilege: PrivRead, Database: "shop", Table: "items"},
+			{Role: "owners", Privilege: PrivDDL, Database: "shop"},
+		},
+	})
+
+	for _, tc := range []struct {
+		id, priv, db, table string
+		ok                  bool
+	}{
+		{"root", PrivAdmin, "", "", true},
+		{"reader", PrivRead, "shop", "items", true},
+		{"reader", PrivWrite, "shop", "items", false},
+		{"reader", PrivRead, "shop", "orders", false},
+		{"reader", PrivRead, "shop", "", false},
+		{"owner", PrivWrite, "shop", "orders", true},
+		{"owner", PrivDDL, "shop", "", true},
+		{"owner", PrivAdmin, "shop", "", false},
+		{"owner", PrivRead, "blog", "posts", false},
+		{"unknown", PrivRead, "shop", "items", false},
+	} {
+		err := Authorize(&Principal{ID: tc.id}, tc.priv, tc.db, tc.table)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s %s on %s.%s: err %v", tc.id, tc.priv, tc.db, tc.table, err)
+		}
+	}
+	if Authorize(nil, PrivAdmin, "", "") != nil {
+		t.Error("nil principal refused with authentication off")
+	}
+
+	reader := &Principal{ID: "reader"}
+	if !CanSee(reader, "shop", "") || !CanSee(reader, "shop", "items") || CanSee(reader, "shop", "orders") || CanSee(reader, "blog", "") {
+		t.Error("reader sees the wrong names")
+	}
+}
@@ -0,0 +1,174 @@
+// Package auth authenticates the callers of the master and the slaves.
+//
+// Clients authenticate with "Authorization: Bearer <credential>", where the
+// credential is an API key (ddb_<id>.<secret>) or an HS256 JWT issued by
+// the master's /auth/token. Browsers that cannot set headers on
+// EventSource or WebSocket requests may pass ?access_token= instead.
+//
+// Requests between nodes are signed with the shared node secret instead:
+// X-Ddb-Node-Signature: t=<unix>,sig=<hex HMAC-SHA256 of
+// "<t>\n<path>\n<body>">.
+//
+// What an authenticated caller may do is decided by the access list,
+// which the master replicates to every slave.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	NodeSignatureHeader = "X-Ddb-Node-Signature"
+	nodeSignatureMaxAge = 5 * time.Minute
+
+	// CallerHeader names the API key the master forwards a read for.
+	CallerHeader = "X-Ddb-Caller"
+)
+
+var (
+	ErrUnauthenticated = errors.New("Authentication required")
+	ErrBadCredentials  = errors.New("Invalid credentials")
+	ErrTokenExpired    = errors.New("Token expired")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	ID    string
+	Name  string
+	Admin bool
+}
+
+// TokenClaims are the claims of the JWTs the master issues.
+type TokenClaims struct {
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	Admin     bool   `json:"admin,omitempty"`
+	Issuer    string `json:"iss"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns r carrying its authenticated caller.
+func WithPrincipal(r *http.Request, p *Principal) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, p))
+}
+
+// RequestPrincipal returns the caller stored by WithPrincipal.
+func RequestPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
+
+// BearerCredential extracts the credential from the Authorization header
+// or the access_token query parameter.
+func BearerCredential(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); h != "" {
+		if scheme, cred, ok := strings.Cut(h, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(cred)
+		}
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// SignToken returns an HS256 JWT carrying claims.
+func SignToken(secret []byte, claims TokenClaims) string {
+	enc := base64.RawURLEncoding
+	header := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	signing := header + "." + enc.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signing))
+	return signing + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyToken checks the signature and expiry of an HS256 JWT.
+func VerifyToken(secret []byte, token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(secret) == 0 || len(parts) != 3 {
+		return nil, ErrBadCredentials
+	}
+	enc := base64.RawURLEncoding
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	raw, err := enc.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil || header.Alg != "HS256" {
+		return nil, ErrBadCredentials
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBadCredentials
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrBadCredentials
+	}
+	var claims TokenClaims
+	raw, err = enc.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(raw, &claims) != nil {
+		return nil, ErrBadCredentials
+	}
+	if claims.ExpiresAt != 0 && time.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrTokenExpired
+	}
+	return &claims, nil
+}
+
+// NodeSignature returns the signature of a request to path sent at ts.
+func NodeSignature(secret []byte, ts, path string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n", ts, path)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignNodeRequest adds the node signature of body to req.
+func SignNodeRequest(req *http.Request, secret []byte, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(NodeSignatureHeader, "t="+ts+",sig="+NodeSignature(secret, ts, req.URL.Path, body))
+}
+
+// VerifyNodeSignature checks the node signature of r, whose body has
+// already been read into body.
+func VerifyNodeSignature(secret []byte, r *http.Request, body []byte) bool {
+	var ts, sig string
+	for _, part := range strings.Split(r.Header.Get(NodeSignatureHeader), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch k {
+		case "t":
+			ts = v
+		case "sig":
+			sig = v
+		}
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > nodeSignatureMaxAge || age < -nodeSignatureMaxAge {
+		return false
+	}
+	want := NodeSignature(secret, ts, r.URL.Path, body)
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+// NodeReadBody returns what the node signature of a forwarded read
+// covers: the query and the caller instead of a body.
+func NodeReadBody(r *http.Request) []byte {
+	return []byte(r.URL.RawQuery + "\n" + r.Header.Get(CallerHeader))
+}
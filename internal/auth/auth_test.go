@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	secret := []byte("jwt-secret")
+	now := time.Now()
+	token := SignToken(secret, TokenClaims{Subject: "k1", Name: "reader", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()})
+	claims, err := VerifyToken(secret, token)
+	if err != nil || claims.Subject != "k1" || claims.Name != "reader" {
+		t.Fatalf("VerifyToken = %+v, %v", claims, err)
+	}
+
+	expired := SignToken(secret, TokenClaims{Subject: "k1", ExpiresAt: now.Add(-time.Second).Unix()})
+	for _, tc := range []struct {
+		name, token string
+		secret      []byte
+		err         error
+	}{
+		{"other secret", token, []byte("other"), ErrBadCredentials},
+		{"no secret", token, nil, ErrBadCredentials},
+		{"tampered", token[:len(token)-2] + "AA", secret, ErrBadCredentials},
+		{"not a JWT", "ddb_key.secret", secret, ErrBadCredentials},
+		{"expired", expired, secret, ErrTokenExpired},
+	} {
+		if _, err := VerifyToken(tc.secret, tc.token); err != tc.err {
+			t.Errorf("%s: err %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestNodeSignature(t *testing.T) {
+	secret := []byte("node-secret")
+	body := []byte(`{"database":"shop"}`)
+	r := httptest.NewRequest("POST", "/replicate_insert", bytes.NewReader(body))
+	SignNodeRequest(r, secret, body)
+	if !VerifyNodeSignature(secret, r, body) {
+		t.Fatal("signed request rejected")
+	}
+	if VerifyNodeSignature(secret, r, []byte(`{"database":"other"}`)) {
+		t.Error("signature accepted for another body")
+	}
+	if VerifyNodeSignature([]byte("other"), r, body) {
+		t.Error("signature accepted with another secret")
+	}
+
+	old := strconv.FormatInt(time.Now().Add(-nodeSignatureMaxAge-time.Minute).Unix(), 10)
+	r.Header.Set(NodeSignatureHeader, "t="+old+",sig="+NodeSignature(secret, old, r.URL.Path, body))
+	if VerifyNodeSignature(secret, r, body) {
+		t.Error("stale signature accepted")
+	}
+}
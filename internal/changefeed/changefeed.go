@@ -0,0 +1,308 @@
+// Package changefeed keeps the change log of the master and the slaves and
+// streams it to subscribers.
+//
+// Every insert, update and delete is appended to the change log with a
+// log sequence number (LSN). One operation gets one LSN shared by all rows
+// it touched, and that LSN travels with the replication request so master
+// and slaves describe the same change the same way. Subscribers stream
+// events from the log with /changes, as Server-Sent Events or over a
+// WebSocket, and can resume after a given LSN.
+package changefeed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+	"github.com/omar-karam1/distributed-db-go/internal/crypto"
+	"github.com/omar-karam1/distributed-db-go/internal/lifecycle"
+	"github.com/omar-karam1/distributed-db-go/internal/telemetry"
+)
+
+type Event struct {
+	LSN      uint64            `json:"lsn"`
+	Op       string            `json:"op"`
+	Database string            `json:"database"`
+	Table    string            `json:"table"`
+	Before   map[string]string `json:"before,omitempty"`
+	After    map[string]string `json:"after,omitempty"`
+	Time     time.Time         `json:"ts"`
+
+	// CRDT is what the node that made the change needs to pass it on to
+	// its peers. It is neither logged nor streamed.
+	CRDT any `json:"-"`
+}
+
+type Filter struct {
+	Database   string
+	Table      string
+	Conditions map[string]string
+	User       *auth.Principal // only events the user may read
+}
+
+// matches reports whether e belongs to the filter. Conditions match when
+// either the before or the after image satisfies all of them.
+func (f Filter) matches(e Event) bool {
+	if f.Database != "" && e.Database != f.Database || f.Table != "" && e.Table != f.Table {
+		return false
+	}
+	if auth.Authorize(f.User, auth.PrivRead, e.Database, e.Table) != nil {
+		return false
+	}
+	if len(f.Conditions) == 0 {
+		return true
+	}
+	return e.Before != nil && MatchesConditions(e.Before, f.Conditions) ||
+		e.After != nil && MatchesConditions(e.After, f.Conditions)
+}
+
+// MatchesConditions reports whether record has every column value in
+// conditions.
+func MatchesConditions(record map[string]string, conditions map[string]string) bool {
+	for k, v := range conditions {
+		if record[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type sub struct {
+	ch chan []Event
+}
+
+// A Feed is the change log of one node and its live subscribers.
+type Feed struct {
+	keyring *crypto.Keyring
+	metrics *telemetry.Registry
+	health  lifecycle.Check
+
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	lastLSN uint64
+	subs    map[*sub]bool
+}
+
+// New returns a Feed that seals its log with keyring and reports write
+// latency to metrics. Open must be called before it is used.
+func New(keyring *crypto.Keyring, metrics *telemetry.Registry) *Feed {
+	return &Feed{keyring: keyring, metrics: metrics, subs: map[*sub]bool{}}
+}
+
+// Open opens the log at path for appending and recovers the last LSN.
+func (f *Feed) Open(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.path = path
+	if err := f.ReadLog(0, func(e Event) bool {
+		if e.LSN > f.lastLSN {
+			f.lastLSN = e.LSN
+		}
+		return true
+	}); errors.Is(err, crypto.ErrNoKey) {
+		telemetry.Fatal("Reading change log", "file", path, "err", err)
+	} else if err != nil && !os.IsNotExist(err) {
+		slog.Error("Reading change log", "file", path, "err", err)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Opening change log", "file", path, "err", err)
+		return
+	}
+	f.file = file
+}
+
+// Publish assigns the next LSN to events and records them. It is called
+// with the table lock held so LSN order matches apply order per table.
+func (f *Feed) Publish(events []Event) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	lsn := f.lastLSN + 1
+	f.publishAt(lsn, events)
+	return lsn
+}
+
+// Record stores events applied from the master under the master's LSN.
+// Requests without an LSN (for example from ddb resync) reuse the last one.
+func (f *Feed) Record(lsn uint64, events []Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if lsn == 0 {
+		lsn = f.lastLSN
+	}
+	f.publishAt(lsn, events)
+}
+
+// publishAt records events under lsn, appends them to the log and hands
+// them to subscribers. Subscribers that fall behind are dropped and have
+// to resume from their last LSN.
+func (f *Feed) publishAt(lsn uint64, events []Event) {
+	if lsn > f.lastLSN {
+		f.lastLSN = lsn
+	}
+	if len(events) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	var buf bytes.Buffer
+	for i := range events {
+		events[i].LSN = lsn
+		events[i].Time = now
+		line, _ := json.Marshal(events[i])
+		buf.Write(f.keyring.SealLine(line))
+		buf.WriteByte('\n')
+	}
+	if f.file != nil {
+		start := time.Now()
+		_, err := f.file.Write(buf.Bytes())
+		f.health.Report(err)
+		if err != nil {
+			slog.Error("Writing change log", "err", err)
+		}
+		f.metrics.Since("ddb_changelog_write_duration_seconds", "", start)
+	}
+	for s := range f.subs {
+		select {
+		case s.ch <- events:
+		default:
+			delete(f.subs, s)
+			close(s.ch)
+		}
+	}
+}
+
+func (f *Feed) subscribe() *sub {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := &sub{ch: make(chan []Event, 1024)}
+	f.subs[s] = true
+	return s
+}
+
+func (f *Feed) unsubscribe(s *sub) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs[s] {
+		delete(f.subs, s)
+		close(s.ch)
+	}
+}
+
+// LSN returns the last LSN recorded. Every event up to it is on disk.
+func (f *Feed) LSN() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastLSN
+}
+
+// Status returns "ok", the last write's error or "not open".
+func (f *Feed) Status() string {
+	f.mu.Lock()
+	open := f.file != nil
+	f.mu.Unlock()
+	if !open {
+		return "not open"
+	}
+	return f.health.Status()
+}
+
+// Sync flushes the log to disk.
+func (f *Feed) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Sync()
+}
+
+// Rewrite re-encrypts the log under the newest key.
+func (f *Feed) Rewrite() error {
+	return f.keyring.RewriteLog(f.path, &f.mu, func(file *os.File) {
+		if f.file != nil {
+			f.file.Close()
+		}
+		f.file = file
+	})
+}
+
+// ReadLog calls fn for every event after fromLSN until fn returns false.
+// A torn last line from a crash is ignored.
+func (f *Feed) ReadLog(fromLSN uint64, fn func(Event) bool) error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		line, err := f.keyring.OpenLine(sc.Bytes())
+		if errors.Is(err, crypto.ErrNoKey) {
+			return err
+		}
+		var e Event
+		if err != nil || json.Unmarshal(line, &e) != nil || e.LSN <= fromLSN {
+			continue
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+	return sc.Err()
+}
+
+var ErrLagged = errors.New("subscriber fell behind, resume from the last LSN")
+
+// Stream replays the log after fromLSN and then follows live events until
+// ctx is done or emit fails.
+func (f *Feed) Stream(ctx context.Context, filter Filter, fromLSN uint64, emit func(Event) error) error {
+	s := f.subscribe()
+	defer f.unsubscribe(s)
+
+	last := fromLSN
+	var emitErr error
+	err := f.ReadLog(fromLSN, func(e Event) bool {
+		last = e.LSN
+		if filter.matches(e) {
+			emitErr = emit(e)
+		}
+		return emitErr == nil
+	})
+	if emitErr != nil {
+		return emitErr
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case events, ok := <-s.ch:
+			if !ok {
+				return ErrLagged
+			}
+			if events[0].LSN <= last {
+				continue
+			}
+			last = events[0].LSN
+			for _, e := range events {
+				if filter.matches(e) {
+					if err := emit(e); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package changefeed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/crypto"
+	"github.com/omar-karam1/distributed-db-go/internal/telemetry"
+)
+
+func newFeed(t *testing.T) (*Feed, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "changes.log")
+	f := New(&crypto.Keyring{}, telemetry.NewRegistry(nil))
+	f.Open(path)
+	return f, path
+}
+
+func TestPublishAndReopen(t *testing.T) {
+	f, path := newFeed(t)
+	if lsn := f.Publish([]Event{{Op: "insert", Database: "shop", Table: "items", After: map[string]string{"id": "1"}}}); lsn != 1 {
+		t.Fatalf("first LSN %d", lsn)
+	}
+	f.Record(0, []Event{{Op: "delete", Database: "shop", Table: "items", Before: map[string]string{"id": "1"}}})
+	f.Record(5, nil)
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if f.Status() != "ok" {
+		t.Fatalf("status %q", f.Status())
+	}
+
+	// A torn line from a crash is skipped.
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	file.WriteString(`{"lsn":9,"op":"ins`)
+	file.Close()
+
+	g := New(&crypto.Keyring{}, telemetry.NewRegistry(nil))
+	g.Open(path)
+	if g.LSN() != 1 {
+		t.Fatalf("recovered LSN %d, want 1", g.LSN())
+	}
+	var ops []string
+	g.ReadLog(0, func(e Event) bool {
+		ops = append(ops, e.Op)
+		return true
+	})
+	if len(ops) != 2 || ops[0] != "insert" || ops[1] != "delete" {
+		t.Fatalf("log holds %v", ops)
+	}
+	if New(&crypto.Keyring{}, nil).Status() != "not open" {
+		t.Fatal("unopened feed reported ok")
+	}
+}
+
+func TestStream(t *testing.T) {
+	f, _ := newFeed(t)
+	f.Publish([]Event{{Op: "insert", Database: "shop", Table: "items", After: map[string]string{"id": "1"}}})
+	f.Publish([]Event{{Op: "insert", Database: "crm", Table: "users", After: map[string]string{"id": "2"}}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan Event, 10)
+	done := make(chan error, 1)
+	filter := Filter{Database: "shop", Conditions: map[string]string{"id": "3"}}
+	go func() {
+		done <- f.Stream(ctx, filter, 0, func(e Event) error {
+			got <- e
+			return nil
+		})
+	}()
+	f.Publish([]Event{{Op: "update", Database: "shop", Table: "items", Before: map[string]string{"id": "1"}, After: map[string]string{"id": "3"}}})
+	f.Publish([]Event{{Op: "insert", Database: "shop", Table: "items", After: map[string]string{"id": "4"}}})
+
+	select {
+	case e := <-got:
+		if e.LSN != 3 || e.Op != "update" {
+			t.Fatalf("streamed %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event streamed")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("streamed %+v outside the filter", <-got)
+	}
+}
+
+func TestReadWebSocketFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 300)
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | 126, byte(len(payload) >> 8), byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	opcode, got, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(frame)))
+	if err != nil || opcode != 0x1 || !bytes.Equal(got, payload) {
+		t.Fatalf("opcode %d, %d bytes, %v", opcode, len(got), err)
+	}
+
+	huge := []byte{0x82, 127, 0, 0, 0, 0, 0, 0x20, 0, 0}
+	if _, _, err := readWebSocketFrame(bufio.NewReader(bytes.NewReader(huge))); err == nil {
+		t.Fatal("accepted a 2 MiB frame")
+	}
+}
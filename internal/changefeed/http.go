@@ -0,0 +1,201 @@
+package changefeed
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/omar-karam1/distributed-db-go/internal/auth"
+)
+
+// HandleChanges serves GET /changes?database=&table=&filter=col=value&from_lsn=
+// as Server-Sent Events, or as a WebSocket when the request asks for an
+// upgrade. SSE clients resume with the Last-Event-ID header.
+func (f *Feed) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	filter := Filter{Database: q.Get("database"), Table: q.Get("table"), User: auth.RequestPrincipal(r)}
+	for _, cond := range q["filter"] {
+		k, v, ok := strings.Cut(cond, "=")
+		if !ok {
+			http.Error(w, "filter must be column=value", http.StatusBadRequest)
+			return
+		}
+		if filter.Conditions == nil {
+			filter.Conditions = map[string]string{}
+		}
+		filter.Conditions[k] = v
+	}
+	from := q.Get("from_lsn")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		from = id
+	}
+	var fromLSN uint64
+	if from != "" {
+		var err error
+		if fromLSN, err = strconv.ParseUint(from, 10, 64); err != nil {
+			http.Error(w, "from_lsn must be a number", http.StatusBadRequest)
+			return
+		}
+	} else {
+		fromLSN = f.LSN()
+	}
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		f.serveWebSocket(w, r, filter, fromLSN)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := f.Stream(r.Context(), filter, fromLSN, func(e Event) error {
+		data, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.LSN, e.Op, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err == ErrLagged {
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket performs the RFC 6455 handshake and sends each
+// event as a text message. Client messages other than ping and close are
+// ignored.
+func (f *Feed) serveWebSocket(w http.ResponseWriter, r *http.Request, filter Filter, fromLSN uint64) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if rw.Flush() != nil {
+		return
+	}
+
+	var writeMu sync.Mutex
+	writeFrame := func(opcode byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		header := []byte{0x80 | opcode}
+		switch n := len(payload); {
+		case n < 126:
+			header = append(header, byte(n))
+		case n <= 0xffff:
+			header = append(header, 126, byte(n>>8), byte(n))
+		default:
+			header = append(header, 127)
+			header = binary.BigEndian.AppendUint64(header, uint64(n))
+		}
+		rw.Write(header)
+		rw.Write(payload)
+		return rw.Flush()
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case 0x8: // close
+				writeFrame(0x8, payload)
+				return
+			case 0x9: // ping
+				writeFrame(0xA, payload)
+			}
+		}
+	}()
+
+	err = f.Stream(ctx, filter, fromLSN, func(e Event) error {
+		data, _ := json.Marshal(e)
+		return writeFrame(0x1, data)
+	})
+	msg := []byte{0x03, 0xe8} // 1000 normal closure
+	if err == ErrLagged {
+		msg = append([]byte{0x03, 0xf3}, err.Error()...) // 1011
+	}
+	writeFrame(0x8, msg)
+}
+
+func readWebSocketFrame(rd *bufio.Reader) (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(rd, h[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode, masked, n := h[0]&0x0f, h[1]&0x80 != 0, uint64(h[1]&0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(rd, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(rd, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("websocket frame too large")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(rd, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(rd, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,66 @@
+// Package crdt applies ops to the materialized values of CRDT columns:
+// counters hold a number and sets a sorted JSON array of strings. The
+// master also merges the state behind those values between masters; the
+// slaves only replay the ops they are sent.
+package crdt
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+)
+
+// Op is an op on a typed column.
+type Op struct {
+	Op    string `json:"op"`
+	Value string `json:"value,omitempty"` // the amount for counters, 1 when empty
+}
+
+// ParseSet reads the elements of a set value.
+func ParseSet(value string) ([]string, error) {
+	var elems []string
+	if value == "" {
+		return nil, nil
+	}
+	err := json.Unmarshal([]byte(value), &elems)
+	return elems, err
+}
+
+// FormatSet returns the value of a set: its elements sorted, without
+// duplicates.
+func FormatSet(elems []string) string {
+	if len(elems) == 0 {
+		return "[]"
+	}
+	elems = slices.Compact(slices.Sorted(slices.Values(elems)))
+	out, _ := json.Marshal(elems)
+	return string(out)
+}
+
+// Amount parses the amount of a counter op.
+func Amount(op Op) (int64, error) {
+	if op.Value == "" {
+		return 1, nil
+	}
+	return strconv.ParseInt(op.Value, 10, 64)
+}
+
+// Apply applies an op to a materialized value.
+func Apply(value string, op Op) string {
+	switch op.Op {
+	case "increment", "decrement":
+		n, _ := strconv.ParseInt(value, 10, 64)
+		d, _ := Amount(op)
+		if op.Op == "decrement" {
+			d = -d
+		}
+		return strconv.FormatInt(n+d, 10)
+	case "add", "remove":
+		elems, _ := ParseSet(value)
+		if elems = slices.DeleteFunc(elems, func(e string) bool { return e == op.Value }); op.Op == "add" {
+			elems = append(elems, op.Value)
+		}
+		return FormatSet(elems)
+	}
+	return op.Value
+}
@@ -0,0 +1,31 @@
+package crdt
+
+import "testing"
+
+func TestApply(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		op    Op
+		want  string
+	}{
+		{"", Op{Op: "increment"}, "1"},
+		{"5", Op{Op: "increment", Value: "3"}, "8"},
+		{"5", Op{Op: "decrement", Value: "7"}, "-2"},
+		{"", Op{Op: "add", Value: "red"}, `["red"]`},
+		{`["red"]`, Op{Op: "add", Value: "blue"}, `["blue","red"]`},
+		{`["blue","red"]`, Op{Op: "add", Value: "red"}, `["blue","red"]`},
+		{`["blue","red"]`, Op{Op: "remove", Value: "red"}, `["blue"]`},
+		{`["blue"]`, Op{Op: "remove", Value: "blue"}, `[]`},
+		{"old", Op{Op: "set", Value: "new"}, "new"},
+	} {
+		if got := Apply(tc.value, tc.op); got != tc.want {
+			t.Errorf("Apply(%q, %+v) = %q, want %q", tc.value, tc.op, got, tc.want)
+		}
+	}
+	if _, err := Amount(Op{Op: "increment", Value: "x"}); err == nil {
+		t.Error("Amount accepted a non-number")
+	}
+	if _, err := ParseSet(`{"red":true}`); err == nil {
+		t.Error("ParseSet accepted an object")
+	}
+}
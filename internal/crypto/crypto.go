@@ -0,0 +1,414 @@
+// Package crypto encrypts the nodes' data files and logs at rest with
+// AES-256-GCM when a key is configured. The key file holds one hex or
+// base64 encoded 32-byte key per line, newest first. New data is always
+// written with the newest key; older keys only have to stay in the file
+// until the background re-encryption after a rotation has finished.
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	FileHeader = "DDBENC1 " // followed by the key id and a newline
+	linePrefix = "enc:"     // enc:<key id>:<base64 nonce+ciphertext>
+)
+
+// ErrNoKey reports data sealed with a key the keyring does not hold.
+var ErrNoKey = errors.New("encryption key not available")
+
+// A Keyring holds the keys. Its zero value has encryption off.
+type Keyring struct {
+	file string
+
+	mu      sync.RWMutex
+	primary string // id of the newest key, empty when encryption is off
+	aeads   map[string]cipher.AEAD
+	ids     []string
+
+	stale      atomic.Bool // plain text or old-key data was read
+	rotating   atomic.Bool
+	rotatedAt  time.Time
+	rotateErr  string
+	rotationMu sync.Mutex
+}
+
+// Load configures encryption from file, or from $DDB_ENCRYPTION_KEY when
+// file is empty. Encryption stays off when neither is set.
+func (k *Keyring) Load(file string) error {
+	k.file = file
+	_, err := k.reload()
+	return err
+}
+
+// reload reads the keys again and reports whether the newest key changed.
+func (k *Keyring) reload() (bool, error) {
+	text := os.Getenv("DDB_ENCRYPTION_KEY")
+	if k.file != "" {
+		data, err := os.ReadFile(k.file)
+		if err != nil {
+			return false, err
+		}
+		text = string(data)
+	}
+	aeads := map[string]cipher.AEAD{}
+	var ids []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := decodeKey(line)
+		if err != nil {
+			return false, err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return false, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return false, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if aeads[id] == nil {
+			ids = append(ids, id)
+		}
+		aeads[id] = aead
+	}
+	if k.file != "" && len(ids) == 0 {
+		return false, fmt.Errorf("%s: no keys found", k.file)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	old := k.primary
+	k.aeads, k.ids, k.primary = aeads, ids, ""
+	if len(ids) > 0 {
+		k.primary = ids[0]
+	}
+	return k.primary != old, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, errors.New("encryption keys must be 32 bytes, hex or base64 encoded")
+}
+
+// Enabled reports whether new data is encrypted.
+func (k *Keyring) Enabled() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary != ""
+}
+
+// Configured reports whether keys are expected, from a key file or the
+// environment, even when none could be loaded.
+func (k *Keyring) Configured() bool {
+	return k.Enabled() || k.file != "" || os.Getenv("DDB_ENCRYPTION_KEY") != ""
+}
+
+// Stale reports whether plain text or data sealed with an older key has
+// been read since the last re-encryption.
+func (k *Keyring) Stale() bool {
+	return k.stale.Load()
+}
+
+// seal encrypts plain with the newest key, binding the key id as
+// additional data.
+func (k *Keyring) seal(plain []byte) (string, []byte) {
+	k.mu.RLock()
+	id, aead := k.primary, k.aeads[k.primary]
+	k.mu.RUnlock()
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	return id, aead.Seal(nonce, nonce, plain, []byte(id))
+}
+
+func (k *Keyring) open(id string, sealed []byte) ([]byte, error) {
+	k.mu.RLock()
+	aead, primary := k.aeads[id], k.primary
+	k.mu.RUnlock()
+	if aead == nil {
+		return nil, fmt.Errorf("%w: data is encrypted with key %s, set -encryption-key-file or $DDB_ENCRYPTION_KEY", ErrNoKey, id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is truncated")
+	}
+	if id != primary {
+		k.stale.Store(true)
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], []byte(id))
+}
+
+// SealData returns data as it is stored on disk, unchanged when
+// encryption is off.
+func (k *Keyring) SealData(data []byte) []byte {
+	if !k.Enabled() {
+		return data
+	}
+	id, sealed := k.seal(data)
+	return append([]byte(FileHeader+id+"\n"), sealed...)
+}
+
+// OpenData reverses SealData. Plain text is returned as is, so existing
+// files are encrypted the next time they are written.
+func (k *Keyring) OpenData(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(FileHeader)) {
+		if k.Enabled() {
+			k.stale.Store(true)
+		}
+		return data, nil
+	}
+	id, sealed, ok := bytes.Cut(data[len(FileHeader):], []byte("\n"))
+	if !ok {
+		return nil, errors.New("invalid encrypted file header")
+	}
+	return k.open(string(id), sealed)
+}
+
+// SealLine encrypts one log line on its own so the log stays appendable.
+func (k *Keyring) SealLine(line []byte) []byte {
+	if !k.Enabled() {
+		return line
+	}
+	id, sealed := k.seal(line)
+	return []byte(linePrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed))
+}
+
+// OpenLine reverses SealLine.
+func (k *Keyring) OpenLine(line []byte) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(linePrefix)) {
+		if k.Enabled() && len(line) > 0 {
+			k.stale.Store(true)
+		}
+		return line, nil
+	}
+	id, enc, ok := bytes.Cut(line[len(linePrefix):], []byte(":"))
+	if !ok {
+		return nil, errors.New("invalid encrypted log line")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(enc))
+	if err != nil {
+		return nil, err
+	}
+	return k.open(string(id), sealed)
+}
+
+// ReadFile reads a file written by WriteFile.
+func (k *Keyring) ReadFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return k.OpenData(data)
+}
+
+// WriteFile encrypts data when a key is configured and replaces path
+// atomically, after syncing the new file, so a crash never leaves a half
+// written file.
+func (k *Keyring) WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(k.SealData(data)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RewriteLog re-encrypts an append-only log of sealed lines under the
+// newest key. Most of the log is copied without blocking writers; only the
+// tail written meanwhile is copied under mu, the writers' lock, before the
+// files are swapped and swap is handed the reopened log.
+func (k *Keyring) RewriteLog(path string, mu *sync.Mutex, swap func(*os.File)) error {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	r := bufio.NewReaderSize(in, 64*1024)
+	w := bufio.NewWriterSize(out, 64*1024)
+	var partial []byte
+	copyLines := func() error {
+		for {
+			chunk, err := r.ReadBytes('\n')
+			partial = append(partial, chunk...)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			line, err := k.OpenLine(bytes.TrimSuffix(partial, []byte("\n")))
+			partial = partial[:0]
+			if errors.Is(err, ErrNoKey) {
+				return err
+			}
+			if err != nil {
+				continue // torn line from a crash
+			}
+			w.Write(k.SealLine(line))
+			w.WriteByte('\n')
+		}
+	}
+	if err := copyLines(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := copyLines(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	swap(file)
+	return nil
+}
+
+// Rotate reloads the key file and, when the newest key changed, calls
+// Reencrypt in the background.
+func (k *Keyring) Rotate(rewrite func() error) error {
+	changed, err := k.reload()
+	if err != nil {
+		return err
+	}
+	if changed {
+		slog.Info("Encryption key changed, re-encrypting data")
+		go k.Reencrypt(rewrite)
+	}
+	return nil
+}
+
+// Reencrypt calls rewrite, which writes every file again under the newest
+// key, and records the outcome for Status. A rotation that arrives while
+// it is busy runs again afterwards.
+func (k *Keyring) Reencrypt(rewrite func() error) {
+	k.rotationMu.Lock()
+	defer k.rotationMu.Unlock()
+	k.rotating.Store(true)
+	defer k.rotating.Store(false)
+
+	err := rewrite()
+	k.mu.Lock()
+	k.rotatedAt, k.rotateErr = time.Now().UTC(), ""
+	if err != nil {
+		k.rotateErr = err.Error()
+	}
+	k.mu.Unlock()
+	if err != nil {
+		slog.Error("Re-encrypting data", "err", err)
+		return
+	}
+	k.stale.Store(false)
+	slog.Info("Re-encrypted data", "key_id", k.Status().KeyID)
+}
+
+// Watch rotates keys on SIGHUP.
+func (k *Keyring) Watch(rewrite func() error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := k.Rotate(rewrite); err != nil {
+				slog.Error("Reloading encryption keys", "err", err)
+			}
+		}
+	}()
+}
+
+// Status is the key and re-encryption state nodes report.
+type Status struct {
+	Enabled     bool       `json:"enabled"`
+	KeyID       string     `json:"key_id,omitempty"`
+	Keys        []string   `json:"keys,omitempty"`
+	Rotating    bool       `json:"rotating"`
+	Stale       bool       `json:"stale"`
+	LastRotated *time.Time `json:"last_rotated,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// Status returns the key and re-encryption state.
+func (k *Keyring) Status() Status {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	st := Status{
+		Enabled:  k.primary != "",
+		KeyID:    k.primary,
+		Keys:     k.ids,
+		Rotating: k.rotating.Load(),
+		Stale:    k.stale.Load(),
+		Error:    k.rotateErr,
+	}
+	if !k.rotatedAt.IsZero() {
+		t := k.rotatedAt
+		st.LastRotated = &t
+	}
+	return st
+}
@@ -0,0 +1,127 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func writeKeys(t *testing.T, file string, keys ...byte) {
+	t.Helper()
+	var lines []string
+	for _, k := range keys {
+		lines = append(lines, hex.EncodeToString(bytes.Repeat([]byte{k}, 32)))
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	t.Setenv("DDB_ENCRYPTION_KEY", "")
+	var off Keyring
+	if off.Enabled() || off.Configured() || string(off.SealData([]byte("x"))) != "x" {
+		t.Fatal("zero Keyring encrypts")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	writeKeys(t, keyFile, 1)
+	var k Keyring
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	data := k.SealData([]byte(`{"a":1}`))
+	if !bytes.HasPrefix(data, []byte(FileHeader)) {
+		t.Fatalf("sealed data %q", data)
+	}
+	line := k.SealLine([]byte("event"))
+	if got, err := k.OpenData(data); err != nil || string(got) != `{"a":1}` {
+		t.Fatalf("OpenData = %q, %v", got, err)
+	}
+	if k.Stale() {
+		t.Fatal("stale after reading data sealed with the newest key")
+	}
+
+	// A new key goes first; data sealed with the old one still opens but
+	// marks the keyring stale.
+	writeKeys(t, keyFile, 2, 1)
+	rewrites := make(chan struct{}, 1)
+	if err := k.Rotate(func() error { rewrites <- struct{}{}; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	<-rewrites
+	if got, err := k.OpenLine(line); err != nil || string(got) != "event" {
+		t.Fatalf("OpenLine = %q, %v", got, err)
+	}
+	if !k.Stale() {
+		t.Fatal("not stale after reading data sealed with the old key")
+	}
+
+	writeKeys(t, keyFile, 2)
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.OpenData(data); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("err %v, want ErrNoKey", err)
+	}
+}
+
+func TestRewriteLog(t *testing.T) {
+	t.Setenv("DDB_ENCRYPTION_KEY", "")
+	dir := t.TempDir()
+	keyFile, logFile := filepath.Join(dir, "keys"), filepath.Join(dir, "log")
+	writeKeys(t, keyFile, 1)
+	var k Keyring
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	var log []byte
+	for _, l := range []string{"one", "two"} {
+		log = append(append(log, k.SealLine([]byte(l))...), '\n')
+	}
+	log = append(log, "enc:torn"...)
+	if err := os.WriteFile(logFile, log, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeKeys(t, keyFile, 2)
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.RewriteLog(logFile, new(sync.Mutex), func(f *os.File) { f.Close() }); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("rewrite without the old key: %v", err)
+	}
+
+	writeKeys(t, keyFile, 2, 1)
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var reopened *os.File
+	if err := k.RewriteLog(logFile, &mu, func(f *os.File) { reopened = f }); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+
+	writeKeys(t, keyFile, 2)
+	if err := k.Load(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(logFile)
+	var got []string
+	for _, l := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		plain, err := k.OpenLine([]byte(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(plain))
+	}
+	if strings.Join(got, ",") != "one,two" {
+		t.Fatalf("rewritten log holds %q, want the two complete lines", got)
+	}
+}
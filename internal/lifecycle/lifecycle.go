@@ -0,0 +1,170 @@
+// Package lifecycle reports the health of the master and the slaves and
+// shuts their HTTP servers down.
+//
+// GET /healthz reports whether the node's storage works. GET /readyz also
+// fails while the node starts or shuts down, so load balancers stop
+// sending it requests. Both are open without credentials so probes can
+// reach them.
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/omar-karam1/distributed-db-go/internal/telemetry"
+)
+
+// Check remembers the outcome of the last write to a file.
+type Check struct {
+	mu  sync.Mutex
+	err error
+}
+
+// Report records the outcome of a write.
+func (c *Check) Report(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// Status returns "ok" or the last write's error.
+func (c *Check) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err.Error()
+	}
+	return "ok"
+}
+
+// A Node is the lifecycle of one master or slave process.
+type Node struct {
+	checks      func() map[string]string
+	replication func() any
+
+	ready    atomic.Bool
+	draining atomic.Bool
+	stopping context.Context
+	stop     context.CancelFunc
+
+	mu      sync.Mutex
+	servers []*http.Server
+}
+
+// NewNode returns a Node that reports checks, "ok" or the problem by
+// name, and replication, which is shown but never fails a check.
+func NewNode(checks func() map[string]string, replication func() any) *Node {
+	n := &Node{checks: checks, replication: replication}
+	n.stopping, n.stop = context.WithCancel(context.Background())
+	return n
+}
+
+// Ready marks the node ready once it serves requests.
+func (n *Node) Ready() {
+	n.ready.Store(true)
+}
+
+// Drain fails readiness from now on and cancels Stopping.
+func (n *Node) Drain() {
+	n.draining.Store(true)
+	n.stop()
+}
+
+// Stopping is cancelled when shutdown starts. It ends change feed
+// streams, which would otherwise keep the servers from draining.
+func (n *Node) Stopping() context.Context {
+	return n.stopping
+}
+
+type healthStatus struct {
+	Status      string            `json:"status"`
+	Checks      map[string]string `json:"checks"`
+	Replication any               `json:"replication,omitempty"`
+}
+
+// HandleHealthz serves GET /healthz.
+func (n *Node) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	n.writeHealth(w, n.checks())
+}
+
+// HandleReadyz serves GET /readyz.
+func (n *Node) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := n.checks()
+	switch {
+	case n.draining.Load():
+		checks["lifecycle"] = "shutting down"
+	case !n.ready.Load():
+		checks["lifecycle"] = "starting"
+	default:
+		checks["lifecycle"] = "ok"
+	}
+	n.writeHealth(w, checks)
+}
+
+func (n *Node) writeHealth(w http.ResponseWriter, checks map[string]string) {
+	st := healthStatus{Status: "ok", Checks: checks, Replication: n.replication()}
+	code := http.StatusOK
+	for _, v := range checks {
+		if v != "ok" {
+			st.Status, code = "fail", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
+
+// Serve runs srv until shutdown.
+func (n *Node) Serve(srv *http.Server) {
+	srv.BaseContext = func(net.Listener) context.Context { return n.stopping }
+	n.mu.Lock()
+	n.servers = append(n.servers, srv)
+	n.mu.Unlock()
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		telemetry.Fatal("HTTP server stopped", "addr", srv.Addr, "err", err)
+	}
+}
+
+// ShutdownServers stops the HTTP servers and waits for their requests.
+func (n *Node) ShutdownServers(ctx context.Context) {
+	n.mu.Lock()
+	list := n.servers
+	n.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range list {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				slog.Warn("HTTP requests still running at shutdown", "addr", srv.Addr, "err", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Wait waits for wg until ctx is done.
+func Wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
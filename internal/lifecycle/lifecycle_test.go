@@ -0,0 +1,67 @@
+package lifecycle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	var data Check
+	n := NewNode(func() map[string]string {
+		return map[string]string{"data_file": data.Status()}
+	}, func() any { return []string{} })
+
+	get := func(h http.HandlerFunc) (int, healthStatus) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		var st healthStatus
+		if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, st
+	}
+	for _, step := range []struct {
+		name      string
+		do        func()
+		healthz   int
+		readyz    int
+		lifecycle string
+	}{
+		{"starting", func() {}, 200, 503, "starting"},
+		{"ready", n.Ready, 200, 200, "ok"},
+		{"write failed", func() { data.Report(errors.New("disk full")) }, 503, 503, "ok"},
+		{"draining", func() { data.Report(nil); n.Drain() }, 200, 503, "shutting down"},
+	} {
+		step.do()
+		if code, _ := get(n.HandleHealthz); code != step.healthz {
+			t.Errorf("%s: /healthz %d, want %d", step.name, code, step.healthz)
+		}
+		code, st := get(n.HandleReadyz)
+		if code != step.readyz || st.Checks["lifecycle"] != step.lifecycle {
+			t.Errorf("%s: /readyz %d %v, want %d with lifecycle %q", step.name, code, st.Checks, step.readyz, step.lifecycle)
+		}
+	}
+	if n.Stopping().Err() == nil {
+		t.Error("Stopping not cancelled by Drain")
+	}
+}
+
+func TestWait(t *testing.T) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Wait(ctx, &wg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait = %v, want the deadline", err)
+	}
+	wg.Done()
+	if err := Wait(context.Background(), &wg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+// Package merkle hashes tables as Merkle trees for anti-entropy.
+//
+// Each row is hashed (the SHA-256 of its JSON, whose keys are sorted) and
+// falls into one of Ranges ranges by the first byte of that hash. A
+// range's hash covers the sorted hashes of its rows and the tree pairs
+// ranges up to a single root, so two nodes find the ranges where they
+// differ by comparing a few hashes.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sort"
+)
+
+const Ranges = 256
+
+// Tree is the hash tree of a table as of LSN.
+type Tree struct {
+	LSN    uint64     `json:"lsn"`
+	Rows   int        `json:"rows"`
+	Levels [][]string `json:"levels"` // root first, the ranges last
+}
+
+// Request names a table in the /merkle requests the master sends slaves.
+type Request struct {
+	Database string   `json:"database"`
+	Table    string   `json:"table"`
+	Ranges   []string `json:"ranges,omitempty"` // for /merkle/rows
+	LSN      uint64   `json:"lsn,omitempty"`    // for /merkle/synced
+}
+
+func rowHash(record map[string]string) [32]byte {
+	b, _ := json.Marshal(record)
+	return sha256.Sum256(b)
+}
+
+// rowRange returns the range of a row as two hex digits.
+func rowRange(record map[string]string) string {
+	h := rowHash(record)
+	return hex.EncodeToString(h[:1])
+}
+
+// Build hashes records. The caller holds the table lock.
+func Build(records []map[string]string) Tree {
+	ranges := make([][][32]byte, Ranges)
+	for _, record := range records {
+		h := rowHash(record)
+		ranges[h[0]] = append(ranges[h[0]], h)
+	}
+	level := make([][32]byte, Ranges)
+	for i, hashes := range ranges {
+		sort.Slice(hashes, func(a, b int) bool { return bytes.Compare(hashes[a][:], hashes[b][:]) < 0 })
+		sum := sha256.New()
+		for _, h := range hashes {
+			sum.Write(h[:])
+		}
+		copy(level[i][:], sum.Sum(nil))
+	}
+	t := Tree{Rows: len(records)}
+	for {
+		hexes := make([]string, len(level))
+		for i, h := range level {
+			hexes[i] = hex.EncodeToString(h[:])
+		}
+		t.Levels = append([][]string{hexes}, t.Levels...)
+		if len(level) == 1 {
+			return t
+		}
+		up := make([][32]byte, len(level)/2)
+		for i := range up {
+			up[i] = sha256.Sum256(append(level[2*i][:], level[2*i+1][:]...))
+		}
+		level = up
+	}
+}
+
+// Diff returns the ranges where a and b differ, descending only
+// into subtrees whose hashes differ.
+func Diff(a, b Tree) ([]string, error) {
+	if len(a.Levels) != len(b.Levels) {
+		return nil, errors.New("Merkle trees of different shapes")
+	}
+	nodes := []int{0}
+	for lvl := range a.Levels {
+		if len(a.Levels[lvl]) != 1<<lvl || len(b.Levels[lvl]) != 1<<lvl {
+			return nil, errors.New("Merkle trees of different shapes")
+		}
+		var next []int
+		for _, i := range nodes {
+			if a.Levels[lvl][i] == b.Levels[lvl][i] {
+				continue
+			}
+			if lvl == len(a.Levels)-1 {
+				next = append(next, i)
+			} else {
+				next = append(next, 2*i, 2*i+1)
+			}
+		}
+		nodes = next
+	}
+	ranges := make([]string, len(nodes))
+	for i, n := range nodes {
+		ranges[i] = hex.EncodeToString([]byte{byte(n)})
+	}
+	return ranges, nil
+}
+
+// RowsInRanges returns the records in the given ranges, by range. The
+// caller holds the table lock.
+func RowsInRanges(records []map[string]string, ranges []string) map[string][]map[string]string {
+	want := map[string]bool{}
+	for _, r := range ranges {
+		want[r] = true
+	}
+	out := map[string][]map[string]string{}
+	for _, record := range records {
+		if r := rowRange(record); want[r] {
+			out[r] = append(out[r], maps.Clone(record))
+		}
+	}
+	return out
+}
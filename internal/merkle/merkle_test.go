@@ -0,0 +1,46 @@
+package merkle
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	var a []map[string]string
+	for i := range 1000 {
+		a = append(a, map[string]string{"id": fmt.Sprint(i), "name": fmt.Sprint("row ", i)})
+	}
+	// Row order does not matter; a changed row and an extra one do.
+	b := slices.Clone(a)
+	slices.Reverse(b)
+	changed := map[string]string{"id": "7", "name": "changed"}
+	extra := map[string]string{"id": "1000"}
+	b[0] = changed
+	b = append(b, extra)
+
+	ta := Build(a)
+	if len(ta.Levels) != 9 || len(ta.Levels[0]) != 1 || len(ta.Levels[8]) != Ranges || ta.Rows != 1000 {
+		t.Fatalf("tree of %d rows with %d levels", ta.Rows, len(ta.Levels))
+	}
+	if ranges, err := Diff(ta, Build(b[1:len(b)-1])); err != nil || len(ranges) != 1 || ranges[0] != rowRange(a[999]) {
+		t.Fatalf("Diff without one row = %v, %v", ranges, err)
+	}
+	ranges, err := Diff(ta, Build(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []map[string]string{a[999], changed, extra} {
+		if !slices.Contains(ranges, rowRange(row)) {
+			t.Fatalf("range of %v missing from %v", row, ranges)
+		}
+	}
+	rows := RowsInRanges(b, []string{rowRange(changed)})
+	if !slices.ContainsFunc(rows[rowRange(changed)], func(r map[string]string) bool { return r["name"] == "changed" }) {
+		t.Fatalf("RowsInRanges = %v", rows)
+	}
+
+	if _, err := Diff(ta, Tree{Levels: ta.Levels[:3]}); err == nil {
+		t.Fatal("Diff accepted trees of different shapes")
+	}
+}
@@ -0,0 +1,513 @@
+// Package sqlparse parses the small SQL dialect shared by the PostgreSQL
+// front-end and the database/sql driver. It maps one to one onto the HTTP
+// API:
+//
+//	SELECT * | col, ... FROM t [WHERE col = v [AND col = v]...] [LIMIT n]
+//	INSERT INTO t (col, ...) VALUES (v, ...)
+//	UPDATE t SET col = v, ... [WHERE ...]
+//	DELETE FROM t [WHERE ...]
+//	CREATE TABLE t (col [type], ...) / DROP TABLE t
+//	CREATE DATABASE d / DROP DATABASE d
+//
+// Names are bare, "quoted" or `quoted`. Values are quoted strings, numbers,
+// TRUE, FALSE, NULL or placeholders written as ? or $n. A trailing
+// semicolon and -- comments are ignored.
+package sqlparse
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Kind is the statement type.
+type Kind int
+
+const (
+	Select Kind = iota
+	Insert
+	Update
+	Delete
+	CreateTable
+	DropTable
+	CreateDatabase
+	DropDatabase
+)
+
+var kindNames = [...]string{"SELECT", "INSERT", "UPDATE", "DELETE", "CREATE TABLE", "DROP TABLE", "CREATE DATABASE", "DROP DATABASE"}
+
+// String returns the statement's verb, e.g. "CREATE TABLE".
+func (k Kind) String() string { return kindNames[k] }
+
+// Value is a literal or a reference to a bound argument.
+type Value struct {
+	Lit   string
+	Null  bool
+	Param int // 1-based argument index, 0 for literals
+}
+
+// Assignment is a "col = v" in SET or WHERE.
+type Assignment struct {
+	Column string
+	Value  Value
+}
+
+// Statement is a parsed statement.
+type Statement struct {
+	Kind    Kind
+	Target  string   // table, or database for CREATE/DROP DATABASE
+	Columns []string // SELECT list (nil for *), INSERT and CREATE columns
+	Values  []Value  // INSERT values
+	Set     []Assignment
+	Where   []Assignment
+	Limit   int
+	Params  int // highest placeholder number
+}
+
+type token struct {
+	kind byte // 'i' identifier/keyword, 's' string, 'n' number, 'p' placeholder, or the punctuation itself
+	text string
+}
+
+func tokenize(query string) ([]token, error) {
+	var toks []token
+	rs := []rune(query)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '-' && i+1 < len(rs) && rs[i+1] == '-':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case r == '\'':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(rs) {
+					return nil, errors.New("unterminated string literal")
+				}
+				if rs[i] == '\'' {
+					if i+1 < len(rs) && rs[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(rs[i])
+				i++
+			}
+			toks = append(toks, token{'s', sb.String()})
+		case r == '"' || r == '`':
+			end := i + 1
+			for end < len(rs) && rs[end] != r {
+				end++
+			}
+			if end >= len(rs) {
+				return nil, errors.New("unterminated quoted identifier")
+			}
+			toks = append(toks, token{'i', string(rs[i+1 : end])})
+			i = end + 1
+		case r == '?':
+			toks = append(toks, token{'p', ""})
+			i++
+		case r == '$':
+			end := i + 1
+			for end < len(rs) && unicode.IsDigit(rs[end]) {
+				end++
+			}
+			if end == i+1 {
+				return nil, fmt.Errorf("bad placeholder at offset %d", i)
+			}
+			toks = append(toks, token{'p', string(rs[i+1 : end])})
+			i = end
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			end := i + 1
+			for end < len(rs) && (unicode.IsDigit(rs[end]) || rs[end] == '.') {
+				end++
+			}
+			toks = append(toks, token{'n', string(rs[i:end])})
+			i = end
+		case unicode.IsLetter(r) || r == '_':
+			end := i + 1
+			for end < len(rs) && (unicode.IsLetter(rs[end]) || unicode.IsDigit(rs[end]) || rs[end] == '_') {
+				end++
+			}
+			toks = append(toks, token{'i', string(rs[i:end])})
+			i = end
+		case strings.ContainsRune("(),=*;", r):
+			toks = append(toks, token{byte(r), string(r)})
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", r)
+		}
+	}
+	return toks, nil
+}
+
+type parser struct {
+	toks   []token
+	pos    int
+	nextQ  int // next index for ? placeholders
+	params int
+}
+
+// Parse parses a single statement.
+func Parse(query string) (*Statement, error) {
+	toks, err := tokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	for len(toks) > 0 && toks[len(toks)-1].kind == ';' {
+		toks = toks[:len(toks)-1]
+	}
+	p := &parser{toks: toks}
+
+	var st *Statement
+	switch {
+	case p.keyword("SELECT"):
+		st, err = p.parseSelect()
+	case p.keyword("INSERT"):
+		st, err = p.parseInsert()
+	case p.keyword("UPDATE"):
+		st, err = p.parseUpdate()
+	case p.keyword("DELETE"):
+		st, err = p.parseDelete()
+	case p.keyword("CREATE"):
+		st, err = p.parseCreate()
+	case p.keyword("DROP"):
+		st, err = p.parseDrop()
+	default:
+		return nil, fmt.Errorf("unsupported statement: %s", strings.TrimSpace(query))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.toks) {
+		return nil, fmt.Errorf("syntax error at or near %q", p.toks[p.pos].text)
+	}
+	st.Params = p.params
+	return st, nil
+}
+
+// Split splits a multi-statement query string on semicolons outside quotes
+// and comments.
+func Split(query string) []string {
+	var out []string
+	var quote rune
+	comment := false
+	start := 0
+	prev := rune(0)
+	for i, r := range query {
+		switch {
+		case comment:
+			comment = r != '\n'
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '-' && prev == '-':
+			comment = true
+		case r == ';':
+			out = append(out, query[start:i])
+			start = i + 1
+		}
+		prev = r
+	}
+	return append(out, query[start:])
+}
+
+func (p *parser) peek() token {
+	if p.pos >= len(p.toks) {
+		return token{}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *parser) keyword(kw string) bool {
+	t := p.peek()
+	if t.kind == 'i' && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return fmt.Errorf("syntax error: expected %s near %q", kw, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) punct(c byte) bool {
+	if p.peek().kind == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectPunct(c byte) error {
+	if !p.punct(c) {
+		return fmt.Errorf("syntax error: expected %q near %q", c, p.peek().text)
+	}
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.peek()
+	if t.kind != 'i' {
+		return "", fmt.Errorf("syntax error: expected name near %q", t.text)
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *parser) value() (Value, error) {
+	t := p.peek()
+	switch t.kind {
+	case 's', 'n':
+		p.pos++
+		return Value{Lit: t.text}, nil
+	case 'p':
+		p.pos++
+		n := p.nextQ + 1
+		if t.text != "" {
+			n, _ = strconv.Atoi(t.text)
+			if n < 1 {
+				return Value{}, fmt.Errorf("bad placeholder $%s", t.text)
+			}
+		} else {
+			p.nextQ++
+		}
+		if n > p.params {
+			p.params = n
+		}
+		return Value{Param: n}, nil
+	case 'i':
+		if strings.EqualFold(t.text, "NULL") {
+			p.pos++
+			return Value{Null: true}, nil
+		}
+		if strings.EqualFold(t.text, "TRUE") || strings.EqualFold(t.text, "FALSE") {
+			p.pos++
+			return Value{Lit: strings.ToLower(t.text)}, nil
+		}
+	}
+	return Value{}, fmt.Errorf("syntax error: expected value near %q", t.text)
+}
+
+func (p *parser) identList() ([]string, error) {
+	var cols []string
+	for {
+		c, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, c)
+		if !p.punct(',') {
+			return cols, nil
+		}
+	}
+}
+
+func (p *parser) assignments(sep string) ([]Assignment, error) {
+	var out []Assignment
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectPunct('='); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Assignment{col, v})
+		if sep == "," && !p.punct(',') || sep != "," && !p.keyword(sep) {
+			return out, nil
+		}
+	}
+}
+
+func (p *parser) optionalWhere() ([]Assignment, error) {
+	if !p.keyword("WHERE") {
+		return nil, nil
+	}
+	return p.assignments("AND")
+}
+
+func (p *parser) parseSelect() (*Statement, error) {
+	st := &Statement{Kind: Select}
+	if !p.punct('*') {
+		cols, err := p.identList()
+		if err != nil {
+			return nil, err
+		}
+		st.Columns = cols
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if st.Target, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if st.Where, err = p.optionalWhere(); err != nil {
+		return nil, err
+	}
+	if p.keyword("LIMIT") {
+		t := p.peek()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != 'n' || err != nil || n < 0 {
+			return nil, fmt.Errorf("syntax error: bad LIMIT %q", t.text)
+		}
+		p.pos++
+		st.Limit = n
+	}
+	return st, nil
+}
+
+func (p *parser) parseInsert() (*Statement, error) {
+	st := &Statement{Kind: Insert}
+	if err := p.expectKeyword("INTO"); err != nil {
+		return nil, err
+	}
+	var err error
+	if st.Target, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct('('); err != nil {
+		return nil, err
+	}
+	if st.Columns, err = p.identList(); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct(')'); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct('('); err != nil {
+		return nil, err
+	}
+	for {
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		st.Values = append(st.Values, v)
+		if !p.punct(',') {
+			break
+		}
+	}
+	if err := p.expectPunct(')'); err != nil {
+		return nil, err
+	}
+	if len(st.Values) != len(st.Columns) {
+		return nil, fmt.Errorf("INSERT has %d columns but %d values", len(st.Columns), len(st.Values))
+	}
+	return st, nil
+}
+
+func (p *parser) parseUpdate() (*Statement, error) {
+	st := &Statement{Kind: Update}
+	var err error
+	if st.Target, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	if st.Set, err = p.assignments(","); err != nil {
+		return nil, err
+	}
+	if st.Where, err = p.optionalWhere(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (p *parser) parseDelete() (*Statement, error) {
+	st := &Statement{Kind: Delete}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	var err error
+	if st.Target, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if st.Where, err = p.optionalWhere(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (p *parser) parseCreate() (*Statement, error) {
+	var err error
+	if p.keyword("DATABASE") {
+		st := &Statement{Kind: CreateDatabase}
+		st.Target, err = p.ident()
+		return st, err
+	}
+	st := &Statement{Kind: CreateTable}
+	if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	if st.Target, err = p.ident(); err != nil {
+		return nil, err
+	}
+	if err := p.expectPunct('('); err != nil {
+		return nil, err
+	}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		st.Columns = append(st.Columns, col)
+		// Column types are accepted for compatibility and ignored; the
+		// server stores every value as a string.
+		for p.peek().kind == 'i' {
+			p.pos++
+		}
+		if p.punct('(') {
+			for p.peek().kind != ')' && p.peek().kind != 0 {
+				p.pos++
+			}
+			if err := p.expectPunct(')'); err != nil {
+				return nil, err
+			}
+		}
+		if !p.punct(',') {
+			break
+		}
+	}
+	if err := p.expectPunct(')'); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (p *parser) parseDrop() (*Statement, error) {
+	st := &Statement{Kind: DropTable}
+	if p.keyword("DATABASE") {
+		st.Kind = DropDatabase
+	} else if err := p.expectKeyword("TABLE"); err != nil {
+		return nil, err
+	}
+	var err error
+	st.Target, err = p.ident()
+	return st, err
+}
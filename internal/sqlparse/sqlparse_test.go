@@ -0,0 +1,65 @@
+package sqlparse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		query string
+		want  *Statement
+	}{
+		{"SELECT * FROM stu WHERE id = ? AND name = 'o''k' LIMIT 5;", &Statement{
+			Kind: Select, Target: "stu", Limit: 5, Params: 1,
+			Where: []Assignment{{"id", Value{Param: 1}}, {"name", Value{Lit: "o'k"}}},
+		}},
+		{"INSERT INTO `stu` (\"id\", name) VALUES ($2, NULL) -- note", &Statement{
+			Kind: Insert, Target: "stu", Columns: []string{"id", "name"}, Params: 2,
+			Values: []Value{{Param: 2}, {Null: true}},
+		}},
+		{"UPDATE stu SET name = TRUE, age = -3.5 WHERE id = ?", &Statement{
+			Kind: Update, Target: "stu", Params: 1,
+			Set:   []Assignment{{"name", Value{Lit: "true"}}, {"age", Value{Lit: "-3.5"}}},
+			Where: []Assignment{{"id", Value{Param: 1}}},
+		}},
+		{"create table stu (id int, name varchar(20))", &Statement{
+			Kind: CreateTable, Target: "stu", Columns: []string{"id", "name"},
+		}},
+		{"DROP DATABASE school", &Statement{Kind: DropDatabase, Target: "school"}},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) = %+v, want %+v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, q := range []string{
+		"SELECT * FROM stu WHERE id = $",
+		"SELECT * FROM stu WHERE id = $0",
+		"SELECT * FROM stu LIMIT -1",
+		"INSERT INTO stu (id, name) VALUES (1)",
+		"SELECT * FROM 'stu'",
+		"SELECT * FROM stu extra",
+		"GRANT ALL ON stu",
+	} {
+		if _, err := Parse(q); err == nil {
+			t.Errorf("Parse(%q) succeeded", q)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	got := Split("INSERT INTO t (a) VALUES ('x;y'); -- a;b\nSELECT * FROM `t;`")
+	want := []string{"INSERT INTO t (a) VALUES ('x;y')", " -- a;b\nSELECT * FROM `t;`"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Split = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,122 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Logs are structured with log/slog, as logfmt text or JSON. Every HTTP
+// request gets an ID, returned in X-Request-Id and logged with the
+// request. The master passes it on to the slaves with each replicated
+// write so one change can be followed across nodes.
+
+// RequestIDHeader carries the request ID.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// SetupLogging installs the default logger. output is a comma separated
+// list of destinations: stderr, stdout or file paths, which are appended
+// to.
+func SetupLogging(format, level, output string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("-log-level: %v", err)
+	}
+	var writers []io.Writer
+	for _, dest := range strings.Split(output, ",") {
+		switch dest = strings.TrimSpace(dest); dest {
+		case "", "stderr":
+			writers = append(writers, os.Stderr)
+		case "stdout":
+			writers = append(writers, os.Stdout)
+		default:
+			file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("-log-output: %v", err)
+			}
+			writers = append(writers, file)
+		}
+	}
+	w := io.MultiWriter(writers...)
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(w, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, opts)))
+	default:
+		return fmt.Errorf("-log-format must be text or json")
+	}
+	return nil
+}
+
+// Fatal logs msg at error level and exits, like log.Fatal.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestID returns the ID LogRequests gave r.
+func RequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestLog returns a logger that tags entries with r's request ID.
+func RequestLog(r *http.Request) *slog.Logger {
+	return slog.With("request_id", RequestID(r))
+}
+
+// LogRequests assigns each request an ID, keeping one sent by the caller
+// in X-Request-Id, and logs the request when it completes.
+func LogRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = NewRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		trace := RequestSpan(r)
+		trace.Set("request_id", id)
+
+		start := time.Now()
+		rec := &StatusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.Status >= 500 {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.Status),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if trace != nil {
+			attrs = append(attrs, slog.String("trace_id", trace.TraceID()))
+		}
+		slog.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
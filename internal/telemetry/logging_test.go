@@ -0,0 +1,37 @@
+package telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogRequests(t *testing.T) {
+	var seen string
+	h := LogRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r)
+	}))
+	for _, tc := range []struct {
+		name, sent string
+		keep       bool
+	}{
+		{"caller's ID", "abc123", true},
+		{"no ID", "", false},
+		{"ID too long", strings.Repeat("x", 65), false},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tc.sent != "" {
+			r.Header.Set(RequestIDHeader, tc.sent)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		got := w.Header().Get(RequestIDHeader)
+		if got != seen {
+			t.Errorf("%s: responded with %q, handler saw %q", tc.name, got, seen)
+		}
+		if (got == tc.sent) != tc.keep || got == "" {
+			t.Errorf("%s: request ID %q", tc.name, got)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Package telemetry holds what the master and the slaves report about
+// themselves: Prometheus metrics, structured logs and OpenTelemetry traces.
+package telemetry
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/internal/wire"
+)
+
+// runtimeInfo is the TYPE and HELP line of the families every node has.
+var runtimeInfo = map[string][2]string{
+	"ddb_http_requests_total":           {"counter", "HTTP and gRPC requests by endpoint, method and status code."},
+	"ddb_http_request_duration_seconds": {"histogram", "HTTP and gRPC request latency by endpoint."},
+	"go_goroutines":                     {"gauge", "Number of goroutines."},
+	"go_memstats_alloc_bytes":           {"gauge", "Bytes of allocated heap objects."},
+	"go_memstats_heap_inuse_bytes":      {"gauge", "Bytes in in-use heap spans."},
+	"go_memstats_sys_bytes":             {"gauge", "Bytes of memory obtained from the OS."},
+	"go_memstats_heap_objects":          {"gauge", "Number of allocated heap objects."},
+	"go_gc_cycles_total":                {"counter", "Completed GC cycles."},
+	"go_gc_pause_seconds_total":         {"counter", "Total GC stop-the-world pause time."},
+	"process_start_time_seconds":        {"gauge", "Start time of the process since unix epoch in seconds."},
+}
+
+var buckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var processStart = time.Now()
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// A Registry holds counters, gauges and histograms by name and label set
+// and writes them in the Prometheus text format.
+type Registry struct {
+	info map[string][2]string
+
+	mu         sync.Mutex
+	values     map[string]map[string]float64 // counters and gauges by name, then labels
+	histograms map[string]map[string]*histogram
+}
+
+// NewRegistry returns a Registry for the families in info, the TYPE and
+// HELP line of each, on top of the request and Go runtime families.
+func NewRegistry(info map[string][2]string) *Registry {
+	all := maps.Clone(runtimeInfo)
+	maps.Copy(all, info)
+	return &Registry{info: all, values: map[string]map[string]float64{}, histograms: map[string]map[string]*histogram{}}
+}
+
+// Labels formats name/value pairs as a Prometheus label set.
+func Labels(kv ...string) string {
+	var b strings.Builder
+	for i := 0; i+1 < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		fmt.Fprintf(&b, `%s="%s"`, kv[i], v)
+	}
+	return b.String()
+}
+
+// Add adds v to a counter.
+func (m *Registry) Add(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][labels] += v
+}
+
+// Set sets a gauge.
+func (m *Registry) Set(name, labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = map[string]float64{}
+	}
+	m.values[name][labels] = v
+}
+
+// Reset drops every series of a gauge so that removed tables or
+// replicas disappear from the next scrape.
+func (m *Registry) Reset(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, name)
+}
+
+// Observe records a duration in a histogram.
+func (m *Registry) Observe(name, labels string, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = map[string]*histogram{}
+	}
+	h := m.histograms[name][labels]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(buckets))}
+		m.histograms[name][labels] = h
+	}
+	for i, le := range buckets {
+		if seconds <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Since observes the time elapsed from start.
+func (m *Registry) Since(name, labels string, start time.Time) {
+	m.Observe(name, labels, time.Since(start).Seconds())
+}
+
+// Serve sets the Go runtime gauges and writes every metric to w.
+func (m *Registry) Serve(w http.ResponseWriter) {
+	m.collectRuntime()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.writeTo(w)
+}
+
+func (m *Registry) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.values)+len(m.histograms))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	series := func(name, labels, extra string) string {
+		switch {
+		case labels == "" && extra == "":
+			return name
+		case labels == "":
+			return name + "{" + extra + "}"
+		case extra == "":
+			return name + "{" + labels + "}"
+		}
+		return name + "{" + labels + "," + extra + "}"
+	}
+	for _, name := range names {
+		info := m.info[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, info[1], name, info[0])
+		if hs, ok := m.histograms[name]; ok {
+			for _, labels := range slices.Sorted(maps.Keys(hs)) {
+				h := hs[labels]
+				var cum uint64
+				for i, le := range buckets {
+					cum += h.counts[i]
+					fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, fmt.Sprintf(`le="%g"`, le)), cum)
+				}
+				fmt.Fprintf(w, "%s %d\n", series(name+"_bucket", labels, `le="+Inf"`), h.count)
+				fmt.Fprintf(w, "%s %g\n", series(name+"_sum", labels, ""), h.sum)
+				fmt.Fprintf(w, "%s %d\n", series(name+"_count", labels, ""), h.count)
+			}
+			continue
+		}
+		for _, labels := range slices.Sorted(maps.Keys(m.values[name])) {
+			fmt.Fprintf(w, "%s %g\n", series(name, labels, ""), m.values[name][labels])
+		}
+	}
+}
+
+// collectRuntime sets the Go runtime gauges.
+func (m *Registry) collectRuntime() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.Set("go_goroutines", "", float64(runtime.NumGoroutine()))
+	m.Set("go_memstats_alloc_bytes", "", float64(ms.Alloc))
+	m.Set("go_memstats_heap_inuse_bytes", "", float64(ms.HeapInuse))
+	m.Set("go_memstats_sys_bytes", "", float64(ms.Sys))
+	m.Set("go_memstats_heap_objects", "", float64(ms.HeapObjects))
+	m.Set("go_gc_cycles_total", "", float64(ms.NumGC))
+	m.Set("go_gc_pause_seconds_total", "", float64(ms.PauseTotalNs)/1e9)
+	m.Set("process_start_time_seconds", "", float64(processStart.Unix()))
+}
+
+// StatusRecorder captures the status code of a response. It passes
+// Flush and Hijack through for the change feed and gRPC streams.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (r *StatusRecorder) WriteHeader(code int) {
+	if r.Status == 0 {
+		r.Status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	if r.Status == 0 {
+		r.Status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *StatusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	r.Status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+func (r *StatusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Instrument counts requests and their latency by the mux pattern that
+// served them, which keeps the number of series bounded.
+func (m *Registry) Instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &StatusRecorder{ResponseWriter: w}
+		mux.ServeHTTP(rec, r)
+		_, endpoint := mux.Handler(r)
+		switch endpoint {
+		case "":
+			endpoint = "other"
+		case wire.Service:
+			if wire.Methods[strings.TrimPrefix(r.URL.Path, wire.Service)] {
+				endpoint = r.URL.Path // one series per RPC
+			}
+		}
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		m.Add("ddb_http_requests_total", Labels("endpoint", endpoint, "method", r.Method, "code", strconv.Itoa(rec.Status)), 1)
+		m.Since("ddb_http_request_duration_seconds", Labels("endpoint", endpoint), start)
+	})
+}
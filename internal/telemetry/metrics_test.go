@@ -0,0 +1,60 @@
+package telemetry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	m := NewRegistry(map[string][2]string{"ddb_table_records": {"gauge", "Records per table."}})
+	m.Set("ddb_table_records", Labels("table", `a"b`), 3)
+	m.Observe("ddb_http_request_duration_seconds", Labels("endpoint", "/x"), 0.003)
+
+	w := httptest.NewRecorder()
+	m.Serve(w)
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE ddb_table_records gauge\n",
+		`ddb_table_records{table="a\"b"} 3` + "\n",
+		`ddb_http_request_duration_seconds_bucket{endpoint="/x",le="0.0025"} 0` + "\n",
+		`ddb_http_request_duration_seconds_bucket{endpoint="/x",le="0.005"} 1` + "\n",
+		`ddb_http_request_duration_seconds_count{endpoint="/x"} 1` + "\n",
+		"# TYPE go_goroutines gauge\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in\n%s", want, body)
+		}
+	}
+
+	m.Reset("ddb_table_records")
+	w = httptest.NewRecorder()
+	m.Serve(w)
+	if strings.Contains(w.Body.String(), "ddb_table_records") {
+		t.Error("reset gauge still served")
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	m := NewRegistry(nil)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tables/{name}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "gone", http.StatusNotFound)
+	})
+	h := m.Instrument(mux)
+	for _, path := range []string{"/tables/a", "/tables/b", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	w := httptest.NewRecorder()
+	m.Serve(w)
+	for _, want := range []string{
+		`ddb_http_requests_total{endpoint="/tables/{name}",method="GET",code="404"} 2`,
+		`ddb_http_requests_total{endpoint="other",method="GET",code="404"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("missing %q", want)
+		}
+	}
+}
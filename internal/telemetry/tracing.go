@@ -0,0 +1,393 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Each HTTP or gRPC call is traced as a server span with child spans for
+// its steps, such as decoding, waiting for the table lock, applying,
+// persisting and replicating to each slave. The W3C traceparent header
+// carries the trace from the master to the slaves. Spans are exported as
+// OTLP/JSON, to a file (one export request per line, like the
+// OpenTelemetry collector's file exporter) or to an OTLP/HTTP collector.
+
+// TraceparentHeader carries the trace of a request to another node.
+const TraceparentHeader = "traceparent"
+
+// OTLP span kinds.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+type otlpValue map[string]any
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpExport struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttr `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+func toOTLPValue(v any) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{"stringValue": v}
+	case int:
+		return otlpValue{"intValue": strconv.Itoa(v)}
+	case uint64:
+		return otlpValue{"intValue": strconv.FormatUint(v, 10)}
+	case bool:
+		return otlpValue{"boolValue": v}
+	}
+	return otlpValue{"stringValue": fmt.Sprint(v)}
+}
+
+type tracer struct {
+	service string
+	sample  float64
+	output  string // file path or collector URL
+	file    *os.File
+	client  *http.Client
+	queue   chan otlpSpan
+	flushes chan chan struct{}
+	dropped atomic.Int64
+}
+
+var tracing tracer
+
+// StartTracing exports spans to output, a file or an http(s) collector
+// URL. Tracing stays off when output is empty. sample is the fraction of
+// new traces recorded; traces started by another node keep its decision.
+func StartTracing(output, service string, sample float64) error {
+	if output == "" {
+		return nil
+	}
+	if sample < 0 || sample > 1 {
+		return errors.New("-trace-sample must be between 0 and 1")
+	}
+	t := &tracing
+	t.service, t.sample, t.output = service, sample, output
+	if strings.HasPrefix(output, "http://") || strings.HasPrefix(output, "https://") {
+		t.client = &http.Client{Timeout: 10 * time.Second}
+	} else {
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		t.file = file
+	}
+	t.queue = make(chan otlpSpan, 4096)
+	t.flushes = make(chan chan struct{})
+	go t.run()
+	return nil
+}
+
+// FlushTraces exports the queued spans, giving up after five seconds.
+func FlushTraces() {
+	tracing.flush()
+}
+
+func (t *tracer) enabled() bool {
+	return t.queue != nil
+}
+
+// run exports spans in batches, at least once a second.
+func (t *tracer) run() {
+	ticker := time.NewTicker(time.Second)
+	var batch []otlpSpan
+	for {
+		var flushed chan struct{}
+		select {
+		case s := <-t.queue:
+			if batch = append(batch, s); len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+		case flushed = <-t.flushes:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+		}
+		if len(batch) > 0 {
+			if err := t.export(batch); err != nil {
+				slog.Warn("Exporting spans", "output", t.output, "spans", len(batch), "err", err)
+			}
+			batch = nil
+		}
+		if n := t.dropped.Swap(0); n > 0 {
+			slog.Warn("Dropped spans, export queue full", "spans", n)
+		}
+		if flushed != nil {
+			close(flushed)
+		}
+	}
+}
+
+func (t *tracer) flush() {
+	if !t.enabled() {
+		return
+	}
+	timeout := time.After(5 * time.Second)
+	done := make(chan struct{})
+	select {
+	case t.flushes <- done:
+	case <-timeout:
+		return
+	}
+	select {
+	case <-done:
+	case <-timeout:
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) error {
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{{Spans: spans}}}
+	rs.Resource.Attributes = []otlpAttr{{Key: "service.name", Value: toOTLPValue(t.service)}}
+	rs.ScopeSpans[0].Scope.Name = "ddb"
+	body, _ := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{rs}})
+	if t.file != nil {
+		_, err := t.file.Write(append(body, '\n'))
+		return err
+	}
+	resp, err := t.client.Post(t.output, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// A Span is one timed step of a trace. All methods accept a nil Span,
+// which is what callers get when tracing is off, and do nothing.
+type Span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+
+	mu     sync.Mutex
+	attrs  []otlpAttr
+	status otlpStatus
+}
+
+func newSpan(name string, traceID [16]byte, parent [8]byte, sampled bool) *Span {
+	s := &Span{traceID: traceID, parent: parent, sampled: sampled, name: name, kind: spanInternal, start: time.Now()}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// startTrace starts a span that continues the trace in a traceparent
+// header, or a new trace when the header is empty or invalid.
+func startTrace(name, traceparent string) *Span {
+	if !tracing.enabled() {
+		return nil
+	}
+	if traceID, parent, sampled, ok := parseTraceparent(traceparent); ok {
+		return newSpan(name, traceID, parent, sampled)
+	}
+	var traceID [16]byte
+	rand.Read(traceID[:])
+	// Like OpenTelemetry's ratio sampler, decide from the trace ID itself.
+	sampled := float64(binary.BigEndian.Uint64(traceID[8:])>>11)/(1<<53) < tracing.sample
+	return newSpan(name, traceID, [8]byte{}, sampled)
+}
+
+// parseTraceparent reads a W3C traceparent header:
+// version-traceid-parentid-flags.
+func parseTraceparent(h string) (traceID [16]byte, parent [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return
+	}
+	if _, err := hex.Decode(parent[:], []byte(parts[2])); err != nil {
+		return
+	}
+	if traceID == ([16]byte{}) || parent == ([8]byte{}) {
+		return
+	}
+	return traceID, parent, flags[0]&1 == 1, true
+}
+
+// Child starts a span under s.
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	return newSpan(name, s.traceID, s.spanID, s.sampled)
+}
+
+// ClientChild starts a span under s for a request to another node.
+func (s *Span) ClientChild(name string) *Span {
+	c := s.Child(name)
+	if c != nil {
+		c.kind = spanClient
+	}
+	return c
+}
+
+// Set adds an attribute.
+func (s *Span) Set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, otlpAttr{Key: key, Value: toOTLPValue(value)})
+}
+
+// Fail marks the span as failed when err is not nil.
+func (s *Span) Fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = otlpStatus{Code: 2, Message: err.Error()}
+}
+
+// End queues the span for export. A full queue drops it rather than
+// slowing the request down.
+func (s *Span) End() {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	o := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        s.attrs,
+		Status:            s.status,
+	}
+	s.mu.Unlock()
+	if s.parent != ([8]byte{}) {
+		o.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	select {
+	case tracing.queue <- o:
+	default:
+		tracing.dropped.Add(1)
+	}
+}
+
+// Traceparent returns the header that makes s the parent of the spans of
+// an outgoing request.
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// TraceID returns the hex trace ID, for logs.
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+type spanKey struct{}
+
+// RequestSpan returns the server span TraceRequests started for r.
+func RequestSpan(r *http.Request) *Span {
+	s, _ := r.Context().Value(spanKey{}).(*Span)
+	return s
+}
+
+// TraceRequests starts a server span for each request, continuing the
+// caller's trace when it sends traceparent.
+func TraceRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := startTrace(r.Method+" "+r.URL.Path, r.Header.Get(TraceparentHeader))
+		if s == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.kind = spanServer
+		rec := &StatusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), spanKey{}, s)))
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		s.Set("http.request.method", r.Method)
+		s.Set("url.path", r.URL.Path)
+		s.Set("http.response.status_code", rec.Status)
+		if rec.Status >= 500 {
+			s.Fail(errors.New(http.StatusText(rec.Status)))
+		}
+		s.End()
+	})
+}
@@ -0,0 +1,74 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const h = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceID, parent, sampled, ok := parseTraceparent(h)
+	if !ok || !sampled || parent[0] != 0x00 || parent[7] != 0xb7 || traceID[0] != 0x4b {
+		t.Fatalf("parseTraceparent(%q) = %x, %x, %v, %v", h, traceID, parent, sampled, ok)
+	}
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := parseTraceparent(bad); ok {
+			t.Errorf("parseTraceparent(%q) accepted", bad)
+		}
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "spans.json")
+	if err := StartTracing(out, "test", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var traceparent string
+	h := TraceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		step := RequestSpan(r).ClientChild("replicate")
+		traceparent = step.Traceparent()
+		step.End()
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	r := httptest.NewRequest("POST", "/insert", nil)
+	r.Header.Set(TraceparentHeader, parent)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	FlushTraces()
+
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceparent, "-01") {
+		t.Fatalf("child traceparent %q does not continue the trace", traceparent)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export otlpExport
+	if err := json.Unmarshal(b, &export); err != nil {
+		t.Fatal(err)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	client, server := spans[0], spans[1]
+	if server.Name != "POST /insert" || server.Kind != spanServer || server.ParentSpanID != "00f067aa0ba902b7" || server.Status.Code != 2 {
+		t.Errorf("server span %+v", server)
+	}
+	if client.Kind != spanClient || client.ParentSpanID != server.SpanID {
+		t.Errorf("client span %+v, want a child of %s", client, server.SpanID)
+	}
+}
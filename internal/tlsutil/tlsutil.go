@@ -0,0 +1,159 @@
+// Package tlsutil builds the TLS configs of the master and the slaves:
+// listeners for clients and replication, and clients that authenticate
+// to other nodes with mutual TLS. Certificates are reloaded from disk when
+// they are renewed.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate and key from disk. Renewed files are
+// picked up without a restart: they are checked during handshakes at most
+// every few seconds, and SIGHUP reloads them immediately.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := r.reload(); err != nil {
+				slog.Error("Reloading certificate", "file", r.certFile, "err", err)
+			} else {
+				slog.Info("Reloaded certificate", "file", r.certFile)
+			}
+		}
+	}()
+	return r, nil
+}
+
+// filesModTime returns the newer modification time of the pair.
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.cert, r.modTime = &cert, modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) current() *tls.Certificate {
+	r.mu.Lock()
+	check := time.Since(r.checked) > 5*time.Second
+	if check {
+		r.checked = time.Now()
+	}
+	loaded := r.modTime
+	r.mu.Unlock()
+	if check {
+		if modTime, err := r.filesModTime(); err == nil && modTime.After(loaded) {
+			if err := r.reload(); err != nil {
+				slog.Error("Reloading certificate", "file", r.certFile, "err", err)
+			} else {
+				slog.Info("Reloaded certificate", "file", r.certFile)
+			}
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// LoadCertPool reads the PEM certificates in file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", file)
+	}
+	return pool, nil
+}
+
+// NewServerConfig returns the listener config for certFile/keyFile.
+// With clientCAFile, clients may present a certificate signed by that CA;
+// handlers decide whether one is required.
+func NewServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: r.getCertificate}
+	if clientCAFile != "" {
+		if cfg.ClientCAs, err = LoadCertPool(clientCAFile); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// NewClientConfig returns the config of a client that only trusts
+// servers signed by caFile. With certFile it presents that certificate as
+// its own identity.
+func NewClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pool, err := LoadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: pool}
+	if certFile != "" {
+		r, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.GetClientCertificate = r.getClientCertificate
+	}
+	return cfg, nil
+}
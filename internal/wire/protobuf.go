@@ -0,0 +1,175 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// AppendVarint appends v as a varint.
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendBytes appends a length-delimited field.
+func AppendBytes(b []byte, field int, data []byte) []byte {
+	b = AppendVarint(b, uint64(field)<<3|2)
+	b = AppendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// AppendString appends a string field unless it is empty.
+func AppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return AppendBytes(b, field, []byte(s))
+}
+
+// AppendInt appends a varint field unless it is zero.
+func AppendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = AppendVarint(b, uint64(field)<<3)
+	return AppendVarint(b, uint64(v))
+}
+
+// AppendMap encodes a map<string, string> with sorted keys so output is
+// deterministic.
+func AppendMap(b []byte, field int, m map[string]string) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := AppendString(nil, 1, k)
+		entry = AppendString(entry, 2, m[k])
+		b = AppendBytes(b, field, entry)
+	}
+	return b
+}
+
+// EncodeAck encodes an Ack message.
+func EncodeAck(message string, count int64) []byte {
+	return AppendInt(AppendString(nil, 1, message), 2, count)
+}
+
+// EncodeNames encodes a Names message.
+func EncodeNames(names []string) []byte {
+	var b []byte
+	for _, n := range names {
+		b = AppendBytes(b, 1, []byte(n))
+	}
+	return b
+}
+
+// EncodeRecord encodes a Record message.
+func EncodeRecord(rec map[string]string) []byte {
+	return AppendMap(nil, 1, rec)
+}
+
+// EncodeRecords encodes a Records message.
+func EncodeRecords(records []map[string]string) []byte {
+	var b []byte
+	for _, rec := range records {
+		b = AppendBytes(b, 1, EncodeRecord(rec))
+	}
+	return b
+}
+
+// ReadVarint reads a varint from the start of data and returns it with
+// its length.
+func ReadVarint(data []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		v |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("malformed varint")
+}
+
+// Fields calls fn for every field in data. For length-delimited fields
+// raw holds the payload; for varints it holds nil and v the value. Fixed
+// width fields are skipped.
+func Fields(data []byte, fn func(field int, v uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		tag, n, err := ReadVarint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		field, wire := int(tag>>3), tag&7
+		switch wire {
+		case 0:
+			v, n, err := ReadVarint(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+			if err := fn(field, v, nil); err != nil {
+				return err
+			}
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return errors.New("truncated message")
+			}
+			data = data[size:]
+		case 2:
+			l, n, err := ReadVarint(data)
+			if err != nil {
+				return err
+			}
+			data = data[n:]
+			if uint64(len(data)) < l {
+				return errors.New("truncated message")
+			}
+			if err := fn(field, 0, data[:l]); err != nil {
+				return err
+			}
+			data = data[l:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+	}
+	return nil
+}
+
+// DecodeMapEntry decodes one entry of a map<string, string> into m.
+func DecodeMapEntry(raw []byte, m map[string]string) error {
+	var k, v string
+	err := Fields(raw, func(field int, _ uint64, b []byte) error {
+		switch field {
+		case 1:
+			k = string(b)
+		case 2:
+			v = string(b)
+		}
+		return nil
+	})
+	m[k] = v
+	return err
+}
+
+// DecodeRecord decodes a Record message.
+func DecodeRecord(raw []byte) (map[string]string, error) {
+	rec := map[string]string{}
+	err := Fields(raw, func(field int, _ uint64, b []byte) error {
+		if field == 1 && b != nil {
+			return DecodeMapEntry(b, rec)
+		}
+		return nil
+	})
+	return rec, err
+}
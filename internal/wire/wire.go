@@ -0,0 +1,113 @@
+// Package wire speaks the gRPC API of proto/ddb.proto for the master and
+// the slaves. It frames messages and trailers as gRPC over HTTP/2 does and
+// encodes messages by hand; they only use strings, int32/int64, repeated
+// fields and map<string, string>.
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Service is the path prefix of every RPC.
+const Service = "/ddb.v1.Database/"
+
+// Methods are the RPCs of proto/ddb.proto.
+var Methods = map[string]bool{
+	"CreateDatabase": true, "DropDatabase": true, "ListDatabases": true,
+	"CreateTable": true, "DropTable": true, "ListTables": true, "DescribeTable": true,
+	"Insert": true, "InsertBatch": true, "Update": true, "Delete": true,
+	"Select": true, "StreamSelect": true,
+}
+
+// Status codes.
+const (
+	OK               = 0
+	InvalidArgument  = 3
+	NotFound         = 5
+	AlreadyExists    = 6
+	PermissionDenied = 7
+	Unimplemented    = 12
+	Internal         = 13
+	Unauthenticated  = 16
+)
+
+// maxMessage bounds a request message.
+const maxMessage = 64 << 20
+
+// Error is an RPC failure with its status code.
+type Error struct {
+	Code int
+	Msg  string
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+// NewError returns an Error with code and msg.
+func NewError(code int, msg string) *Error {
+	return &Error{Code: code, Msg: msg}
+}
+
+// ReadMessage reads the length-prefixed request message from body.
+func ReadMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, NewError(InvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, NewError(Unimplemented, "compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(prefix[1:])
+	if n > maxMessage {
+		return nil, NewError(InvalidArgument, "request message too large")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, NewError(InvalidArgument, "truncated request message")
+	}
+	return data, nil
+}
+
+// Respond starts a response on w and returns a function that sends one
+// message of it. End the response with WriteStatus.
+func Respond(w http.ResponseWriter) func(msg []byte) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	return func(msg []byte) {
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// WriteStatus ends a response with the grpc-status and grpc-message
+// trailers.
+func WriteStatus(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", EncodeMessage(msg))
+	}
+}
+
+// EncodeMessage percent-encodes a status message as the gRPC spec
+// requires for the grpc-message trailer.
+func EncodeMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
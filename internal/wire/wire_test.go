@@ -0,0 +1,78 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"maps"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	rec := map[string]string{"id": "1", "name": "café", "note": "", "": "x"}
+	got, err := DecodeRecord(EncodeRecord(rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(got, rec) {
+		t.Fatalf("decoded %q, want %q", got, rec)
+	}
+
+	var n int
+	if err := Fields(EncodeRecords([]map[string]string{rec, {"id": "2"}}), func(field int, _ uint64, raw []byte) error {
+		if field == 1 {
+			n++
+		}
+		return nil
+	}); err != nil || n != 2 {
+		t.Fatalf("Records message: %d records, err %v", n, err)
+	}
+
+	if err := Fields([]byte{0x0a, 0x05, 'a'}, func(int, uint64, []byte) error { return nil }); err == nil {
+		t.Fatal("truncated message decoded")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	frame := func(flags byte, n uint32, body string) *bytes.Reader {
+		b := []byte{flags, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], n)
+		return bytes.NewReader(append(b, body...))
+	}
+	if msg, err := ReadMessage(frame(0, 3, "abc")); err != nil || string(msg) != "abc" {
+		t.Fatalf("got %q, %v", msg, err)
+	}
+	for _, tc := range []struct {
+		name string
+		r    *bytes.Reader
+		code int
+	}{
+		{"compressed", frame(1, 3, "abc"), Unimplemented},
+		{"too large", frame(0, maxMessage+1, ""), InvalidArgument},
+		{"truncated", frame(0, 4, "abc"), InvalidArgument},
+		{"empty", bytes.NewReader(nil), InvalidArgument},
+	} {
+		var e *Error
+		if _, err := ReadMessage(tc.r); !errors.As(err, &e) || e.Code != tc.code {
+			t.Errorf("%s: err %v, want code %d", tc.name, err, tc.code)
+		}
+	}
+}
+
+func TestRespond(t *testing.T) {
+	w := httptest.NewRecorder()
+	send := Respond(w)
+	send([]byte("hi"))
+	WriteStatus(w, NotFound, "Table 100% gone\n")
+	if got := w.Body.Bytes(); !bytes.Equal(got, []byte{0, 0, 0, 0, 2, 'h', 'i'}) {
+		t.Fatalf("body %v", got)
+	}
+	res := w.Result()
+	if res.Header.Get("Content-Type") != "application/grpc" {
+		t.Fatalf("Content-Type %q", res.Header.Get("Content-Type"))
+	}
+	if res.Trailer.Get("Grpc-Status") != "5" || res.Trailer.Get("Grpc-Message") != "Table 100%25 gone%0A" {
+		t.Fatalf("trailers %v", res.Trailer)
+	}
+}
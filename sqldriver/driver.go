@@ -0,0 +1,553 @@
+// Package sqldriver registers a database/sql driver named "ddb".
+//
+// The data source name is the master URL with the database as its path:
+//
+//	db, err := sql.Open("ddb", "http://localhost:8000/school?replica=http://localhost:8001")
+//
+// Supported query parameters:
+//
+//	master   extra master candidates for failover (repeatable)
+//	replica  slave URLs used for reads (repeatable)
+//	read     "replica" to send SELECTs to replicas, default "master"
+//	timeout  per request timeout, e.g. "5s"
+//	retries  retries on transient errors
+//	token    API key or token sent as a bearer credential
+//	ca       PEM file with the CA to trust for https nodes
+//
+// The accepted SQL is the dialect of the PostgreSQL front-end, with ? or
+// $n placeholders.
+//
+// Transactions buffer their INSERT, UPDATE and DELETE statements and send
+// them to the master's /transaction endpoint on Commit, so they apply
+// atomically or not at all. Until then nothing reaches the server: reads
+// inside a transaction don't see its own writes, and Result.RowsAffected
+// is only known for inserts.
+package sqldriver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omar-karam1/distributed-db-go/client"
+	"github.com/omar-karam1/distributed-db-go/internal/sqlparse"
+)
+
+func init() {
+	sql.Register("ddb", &Driver{})
+}
+
+var (
+	errTxSchema    = errors.New("ddb: CREATE and DROP can't run in a transaction")
+	errTxReadOnly  = errors.New("ddb: write in a read-only transaction")
+	errTxIsolation = errors.New("ddb: only the default isolation level is supported")
+	errTxPending   = errors.New("ddb: rows affected is only known after Commit")
+)
+
+// Driver implements driver.Driver and driver.DriverContext.
+type Driver struct{}
+
+// Open opens a connection for dsn.
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	c, err := d.OpenConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return c.Connect(context.Background())
+}
+
+// OpenConnector parses dsn once for a pool of connections.
+func (d *Driver) OpenConnector(dsn string) (driver.Connector, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("ddb: bad dsn: %w", err)
+	}
+	database := strings.Trim(u.Path, "/")
+	if database == "" {
+		return nil, errors.New("ddb: dsn must name a database, e.g. http://localhost:8000/school")
+	}
+	q := u.Query()
+
+	cfg := client.Config{
+		Masters:  append([]string{u.Scheme + "://" + u.Host}, q["master"]...),
+		Replicas: q["replica"],
+		Token:    q.Get("token"),
+	}
+	if v := q.Get("timeout"); v != "" {
+		if cfg.Timeout, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("ddb: bad timeout: %w", err)
+		}
+	}
+	if v := q.Get("retries"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("ddb: bad retries: %w", err)
+		}
+		if n == 0 {
+			n = -1
+		}
+		cfg.MaxRetries = n
+	}
+	if v := q.Get("ca"); v != "" {
+		pem, err := os.ReadFile(v)
+		if err != nil {
+			return nil, fmt.Errorf("ddb: bad ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ddb: bad ca: no certificates in %s", v)
+		}
+		cfg.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	readReplica := false
+	switch q.Get("read") {
+	case "", "master":
+	case "replica":
+		if len(cfg.Replicas) == 0 {
+			return nil, errors.New("ddb: read=replica requires at least one replica")
+		}
+		readReplica = true
+	default:
+		return nil, fmt.Errorf("ddb: bad read mode %q", q.Get("read"))
+	}
+
+	cl, err := client.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &connector{driver: d, client: cl, database: database, readReplica: readReplica}, nil
+}
+
+type connector struct {
+	driver      *Driver
+	client      *client.Client
+	database    string
+	readReplica bool
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{connector: c}, nil
+}
+
+func (c *connector) Driver() driver.Driver { return c.driver }
+
+// conn is stateless outside a transaction; every statement is a standalone
+// HTTP request.
+type conn struct {
+	*connector
+	tx *tx
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *conn) PrepareContext(_ context.Context, query string) (driver.Stmt, error) {
+	st, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{conn: c, st: st}, nil
+}
+
+func (c *conn) Close() error { return nil }
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if sql.IsolationLevel(opts.Isolation) != sql.LevelDefault {
+		return nil, errTxIsolation
+	}
+	c.tx = &tx{conn: c, ctx: ctx, readOnly: opts.ReadOnly}
+	return c.tx, nil
+}
+
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	st, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmt{conn: c, st: st}).ExecContext(ctx, args)
+}
+
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	st, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return (&stmt{conn: c, st: st}).QueryContext(ctx, args)
+}
+
+func parse(query string) (*sqlparse.Statement, error) {
+	st, err := sqlparse.Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("ddb: %w", err)
+	}
+	return st, nil
+}
+
+type stmt struct {
+	conn *conn
+	st   *sqlparse.Statement
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return s.st.Params }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), named(args))
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), named(args))
+}
+
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	st, c := s.st, s.conn
+	var err error
+	switch st.Kind {
+	case sqlparse.Insert, sqlparse.Update, sqlparse.Delete:
+		op, err := s.bindOp(args)
+		if err != nil {
+			return nil, err
+		}
+		if c.tx != nil {
+			return c.tx.add(op)
+		}
+		return c.exec(ctx, op)
+	case sqlparse.Select:
+		return nil, errors.New("ddb: SELECT must be run with Query")
+	}
+	if c.tx != nil {
+		return nil, errTxSchema
+	}
+	switch st.Kind {
+	case sqlparse.CreateTable:
+		err = c.client.CreateTable(ctx, c.database, st.Target, st.Columns)
+	case sqlparse.DropTable:
+		err = c.client.DropTable(ctx, c.database, st.Target)
+	case sqlparse.CreateDatabase:
+		err = c.client.CreateDatabase(ctx, st.Target)
+	case sqlparse.DropDatabase:
+		err = c.client.DropDatabase(ctx, st.Target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// bindOp turns an INSERT, UPDATE or DELETE into the write it stands for.
+func (s *stmt) bindOp(args []driver.NamedValue) (client.Op, error) {
+	st := s.st
+	op := client.Op{Database: s.conn.database, Table: st.Target}
+	var err error
+	switch st.Kind {
+	case sqlparse.Insert:
+		op.Op, op.Record = "insert", client.Record{}
+		for i, col := range st.Columns {
+			v, null, err := bind(st.Values[i], args)
+			if err != nil {
+				return op, err
+			}
+			if !null {
+				op.Record[col] = v
+			}
+		}
+		return op, nil
+	case sqlparse.Update:
+		op.Op = "update"
+		if op.Data, err = bindAll(st.Set, args); err != nil {
+			return op, err
+		}
+	case sqlparse.Delete:
+		op.Op = "delete"
+	}
+	op.Where, err = bindAll(st.Where, args)
+	return op, err
+}
+
+// exec applies a single write outside a transaction.
+func (c *conn) exec(ctx context.Context, op client.Op) (driver.Result, error) {
+	var n int
+	var err error
+	switch op.Op {
+	case "insert":
+		n, err = 1, c.client.Insert(ctx, op.Database, op.Table, op.Record)
+	case "update":
+		n, err = c.client.Update(ctx, op.Database, op.Table, op.Where, op.Data)
+	case "delete":
+		n, err = c.client.Delete(ctx, op.Database, op.Table, op.Where)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+// tx collects the writes of a transaction until Commit.
+type tx struct {
+	conn     *conn
+	ctx      context.Context
+	readOnly bool
+	ops      []client.Op
+}
+
+func (t *tx) add(op client.Op) (driver.Result, error) {
+	if t.readOnly {
+		return nil, errTxReadOnly
+	}
+	t.ops = append(t.ops, op)
+	if op.Op == "insert" {
+		return driver.RowsAffected(1), nil
+	}
+	return pendingResult{}, nil
+}
+
+// Commit sends the buffered writes as one atomic transaction.
+func (t *tx) Commit() error {
+	t.conn.tx = nil
+	if len(t.ops) == 0 {
+		return nil
+	}
+	_, err := t.conn.client.Transaction(t.ctx, t.ops)
+	return err
+}
+
+// Rollback drops the buffered writes; none of them reached the server.
+func (t *tx) Rollback() error {
+	t.conn.tx = nil
+	return nil
+}
+
+// pendingResult is returned for updates and deletes buffered in a
+// transaction, whose row counts the server only reports on Commit.
+type pendingResult struct{}
+
+func (pendingResult) LastInsertId() (int64, error) { return driver.RowsAffected(0).LastInsertId() }
+func (pendingResult) RowsAffected() (int64, error) { return 0, errTxPending }
+
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	st, c := s.st, s.conn
+	if st.Kind != sqlparse.Select {
+		return nil, errors.New("ddb: only SELECT can be run with Query")
+	}
+	where, err := bindAll(st.Where, args)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.client.Query(ctx, client.Query{
+		Database:        c.database,
+		Table:           st.Target,
+		Where:           client.Conditions(where),
+		Limit:           st.Limit,
+		ReadFromReplica: c.readReplica,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	columns := st.Columns
+	if columns == nil {
+		columns, err = c.client.DescribeTable(ctx, c.database, st.Target)
+		if err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			columns = recordColumns(records)
+		}
+	}
+	return newRows(columns, records), nil
+}
+
+// recordColumns is the sorted union of record keys, used for tables created
+// without a column list.
+func recordColumns(records []client.Record) []string {
+	seen := map[string]bool{}
+	var cols []string
+	for _, r := range records {
+		for k := range r {
+			if !seen[k] {
+				seen[k] = true
+				cols = append(cols, k)
+			}
+		}
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+func named(args []driver.Value) []driver.NamedValue {
+	out := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		out[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return out
+}
+
+// bind resolves v against args and renders it the way the server stores
+// values.
+func bind(v sqlparse.Value, args []driver.NamedValue) (string, bool, error) {
+	if v.Param == 0 {
+		return v.Lit, v.Null, nil
+	}
+	if v.Param > len(args) {
+		return "", false, fmt.Errorf("ddb: missing argument $%d", v.Param)
+	}
+	switch a := args[v.Param-1].Value.(type) {
+	case nil:
+		return "", true, nil
+	case string:
+		return a, false, nil
+	case []byte:
+		return string(a), false, nil
+	case int64:
+		return strconv.FormatInt(a, 10), false, nil
+	case float64:
+		return strconv.FormatFloat(a, 'g', -1, 64), false, nil
+	case bool:
+		return strconv.FormatBool(a), false, nil
+	case time.Time:
+		return a.Format(time.RFC3339Nano), false, nil
+	default:
+		return "", false, fmt.Errorf("ddb: unsupported argument type %T", a)
+	}
+}
+
+func bindAll(as []sqlparse.Assignment, args []driver.NamedValue) (map[string]string, error) {
+	if len(as) == 0 {
+		return nil, nil
+	}
+	out := make(map[string]string, len(as))
+	for _, a := range as {
+		v, null, err := bind(a.Value, args)
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			// A missing key reads as "" on the server, so NULL compares
+			// and stores as the empty string.
+			v = ""
+		}
+		out[a.Column] = v
+	}
+	return out, nil
+}
+
+// ===================== ROWS =====================
+
+// Column types are inferred from the returned values because the server
+// stores everything as strings.
+const (
+	typeInteger = "INTEGER"
+	typeReal    = "REAL"
+	typeBoolean = "BOOLEAN"
+	typeText    = "TEXT"
+)
+
+type rows struct {
+	columns []string
+	types   []string
+	nulls   []bool
+	records []client.Record
+	pos     int
+}
+
+func newRows(columns []string, records []client.Record) *rows {
+	r := &rows{columns: columns, records: records, types: make([]string, len(columns)), nulls: make([]bool, len(columns))}
+	for i, col := range columns {
+		r.types[i], r.nulls[i] = inferType(col, records)
+	}
+	return r
+}
+
+func inferType(col string, records []client.Record) (string, bool) {
+	isInt, isReal, isBool, seen, nullable := true, true, true, false, false
+	for _, rec := range records {
+		v, ok := rec[col]
+		if !ok {
+			nullable = true
+			continue
+		}
+		seen = true
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			isReal = false
+		}
+		if v != "true" && v != "false" {
+			isBool = false
+		}
+	}
+	switch {
+	case !seen:
+		return typeText, nullable
+	case isInt:
+		return typeInteger, nullable
+	case isReal:
+		return typeReal, nullable
+	case isBool:
+		return typeBoolean, nullable
+	}
+	return typeText, nullable
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.records) {
+		return io.EOF
+	}
+	rec := r.records[r.pos]
+	r.pos++
+	for i, col := range r.columns {
+		v, ok := rec[col]
+		if !ok {
+			dest[i] = nil
+			continue
+		}
+		switch r.types[i] {
+		case typeInteger:
+			dest[i], _ = strconv.ParseInt(v, 10, 64)
+		case typeReal:
+			dest[i], _ = strconv.ParseFloat(v, 64)
+		case typeBoolean:
+			dest[i] = v == "true"
+		default:
+			dest[i] = v
+		}
+	}
+	return nil
+}
+
+func (r *rows) ColumnTypeDatabaseTypeName(i int) string { return r.types[i] }
+
+func (r *rows) ColumnTypeNullable(i int) (bool, bool) { return r.nulls[i], true }
+
+func (r *rows) ColumnTypeScanType(i int) reflect.Type {
+	switch r.types[i] {
+	case typeInteger:
+		return reflect.TypeOf(int64(0))
+	case typeReal:
+		return reflect.TypeOf(float64(0))
+	case typeBoolean:
+		return reflect.TypeOf(false)
+	}
+	return reflect.TypeOf("")
+}
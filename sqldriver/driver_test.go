@@ -0,0 +1,247 @@
+package sqldriver
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// fakeMaster stores the rows of one table and records the paths it was
+// sent.
+type fakeMaster struct {
+	mu    sync.Mutex
+	rows  []map[string]string
+	paths []string
+}
+
+type fakeRequest struct {
+	Op         string            `json:"op"`
+	Record     map[string]string `json:"record"`
+	UpdateData map[string]string `json:"update_data"`
+	Conditions map[string]string `json:"conditions"`
+}
+
+// apply runs one write and returns the number of rows it touched.
+func (m *fakeMaster) apply(req fakeRequest) int {
+	n := 0
+	kept := m.rows[:0]
+	for _, row := range m.rows {
+		match := true
+		for k, v := range req.Conditions {
+			match = match && row[k] == v
+		}
+		switch {
+		case !match:
+		case req.Op == "update":
+			maps.Copy(row, req.UpdateData)
+			n++
+		case req.Op == "delete":
+			n++
+			continue
+		}
+		kept = append(kept, row)
+	}
+	m.rows = kept
+	if req.Op == "insert" {
+		m.rows = append(m.rows, req.Record)
+		n = 1
+	}
+	return n
+}
+
+func (m *fakeMaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.paths = append(m.paths, r.URL.Path)
+	body, _ := io.ReadAll(r.Body)
+	var req fakeRequest
+	json.Unmarshal(body, &req)
+	switch r.URL.Path {
+	case "/insert":
+		req.Op = "insert"
+		m.apply(req)
+		w.Write([]byte("Record inserted successfully."))
+	case "/update":
+		req.Op = "update"
+		fmt.Fprintf(w, "Updated %d records.", m.apply(req))
+	case "/delete":
+		req.Op = "delete"
+		fmt.Fprintf(w, "Deleted %d records.", m.apply(req))
+	case "/transaction":
+		var txn struct {
+			Operations []fakeRequest `json:"operations"`
+		}
+		json.Unmarshal(body, &txn)
+		var rows []int
+		for _, op := range txn.Operations {
+			rows = append(rows, m.apply(op))
+		}
+		json.NewEncoder(w).Encode(map[string][]int{"rows": rows})
+	case "/select":
+		json.NewEncoder(w).Encode(m.rows)
+	case "/describe_table":
+		json.NewEncoder(w).Encode(map[string][]string{"columns": {"id", "name", "price", "active", "note"}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (m *fakeMaster) sent() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.paths...)
+}
+
+func openTestDB(t *testing.T) (*sql.DB, *fakeMaster) {
+	t.Helper()
+	m := &fakeMaster{}
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	db, err := sql.Open("ddb", srv.URL+"/shop?retries=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, m
+}
+
+func TestBindAndScan(t *testing.T) {
+	db, m := openTestDB(t)
+	_, err := db.Exec("INSERT INTO items (id, name, price, active, note) VALUES (?, ?, ?, ?, ?)",
+		1, "O'Brien'); DROP TABLE items; --", 2.5, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO items (id, name, price, active) VALUES ($2, 'it''s', $1, FALSE)", 0.25, 2); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]string{
+		{"id": "1", "name": "O'Brien'); DROP TABLE items; --", "price": "2.5", "active": "true"},
+		{"id": "2", "name": "it's", "price": "0.25", "active": "false"},
+	}
+	if len(m.rows) != 2 || !maps.Equal(m.rows[0], want[0]) || !maps.Equal(m.rows[1], want[1]) {
+		t.Fatalf("stored %v, want %v", m.rows, want)
+	}
+
+	row := db.QueryRow("SELECT * FROM items WHERE name = ?", "O'Brien'); DROP TABLE items; --")
+	var (
+		id     int64
+		name   string
+		price  float64
+		active bool
+		note   sql.NullString
+	)
+	if err := row.Scan(&id, &name, &price, &active, &note); err != nil {
+		t.Fatal(err)
+	}
+	if id != 1 || price != 2.5 || !active || note.Valid {
+		t.Fatalf("scanned %d %q %v %v %v", id, name, price, active, note)
+	}
+
+	rows, err := db.Query("SELECT * FROM items")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, ct := range types {
+		names = append(names, ct.DatabaseTypeName())
+	}
+	if fmt.Sprint(names) != "[INTEGER TEXT REAL BOOLEAN TEXT]" {
+		t.Fatalf("column types %v", names)
+	}
+	if nullable, ok := types[4].Nullable(); !ok || !nullable {
+		t.Fatal("note is not reported nullable")
+	}
+}
+
+func TestRowsAffected(t *testing.T) {
+	db, m := openTestDB(t)
+	m.rows = []map[string]string{{"id": "1", "name": "a"}, {"id": "2", "name": "a"}, {"id": "3", "name": "b"}}
+	for _, c := range []struct {
+		query string
+		args  []any
+		want  int64
+	}{
+		{"UPDATE items SET name = ? WHERE name = ?", []any{"c", "a"}, 2},
+		{"UPDATE items SET name = 'd' WHERE id = 9", nil, 0},
+		{"DELETE FROM items WHERE name = $1", []any{"b"}, 1},
+		{"INSERT INTO items (id) VALUES (4)", nil, 1},
+	} {
+		res, err := db.Exec(c.query, c.args...)
+		if err != nil {
+			t.Fatalf("%s: %v", c.query, err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n != c.want {
+			t.Fatalf("%s affected %d rows (%v), want %d", c.query, n, err, c.want)
+		}
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	db, m := openTestDB(t)
+	m.rows = []map[string]string{{"id": "1", "name": "a"}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("INSERT INTO items (id, name) VALUES (?, ?)", 2, "b"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := tx.Exec("UPDATE items SET name = ? WHERE id = ?", "z", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := res.RowsAffected(); !errors.Is(err, errTxPending) {
+		t.Fatalf("RowsAffected in a transaction = %v, want errTxPending", err)
+	}
+	if _, err := tx.Exec("DROP TABLE items"); !errors.Is(err, errTxSchema) {
+		t.Fatalf("DROP in a transaction = %v, want errTxSchema", err)
+	}
+	if sent := m.sent(); len(sent) != 0 {
+		t.Fatalf("sent %v before Commit", sent)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := m.sent(); fmt.Sprint(sent) != "[/transaction]" {
+		t.Fatalf("Commit sent %v, want one /transaction", sent)
+	}
+	if len(m.rows) != 2 || m.rows[0]["name"] != "z" || m.rows[1]["name"] != "b" {
+		t.Fatalf("rows after Commit %v", m.rows)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("DELETE FROM items"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if sent := m.sent(); len(sent) != 1 || len(m.rows) != 2 {
+		t.Fatalf("Rollback sent %v and left %d rows", sent[1:], len(m.rows))
+	}
+
+	// The connection is back to sending each write on its own.
+	if _, err := db.Exec("DELETE FROM items WHERE id = ?", 2); err != nil {
+		t.Fatal(err)
+	}
+	if sent := m.sent(); sent[len(sent)-1] != "/delete" || len(m.rows) != 1 {
+		t.Fatalf("sent %v after the transaction, %d rows left", sent, len(m.rows))
+	}
+}